@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/generic"
+	"github.com/xtaci/smux"
+)
+
+// size of the writes and reads of a benchmark
+const benchBuffer = 32768
+
+// bench measures the goodput of a fresh session to remote, uploading for d and then
+// downloading for d through streams which KCP Server in dynamic mode discards and
+// fills. The goodput of each direction is printed with the segments kcp retransmitted
+// or fec recovered meanwhile, and the share of a cpu the process used. It reports
+// whether both directions ran.
+func bench(createConn func(string) (*generic.Session, error), remote string, d time.Duration) bool {
+	session, err := createConn(remote)
+	if err != nil {
+		fmt.Printf("%v: %v\n", remote, err)
+		return false
+	}
+	defer session.Mux.Close()
+
+	for _, direction := range []string{"up", "down"} {
+		snmp, cpu := kcp.DefaultSnmp.Copy(), generic.CPUTime()
+		start := time.Now()
+		var n uint64
+		var elapsed time.Duration
+		if direction == "up" {
+			n, elapsed, err = benchUp(session.Mux, d)
+		} else {
+			n, elapsed, err = benchDown(session.Mux, d)
+		}
+		if err != nil {
+			fmt.Printf("%v: %v: %v\n", remote, direction, err)
+			return false
+		}
+		cpuShare := 100 * float64(generic.CPUTime()-cpu) / float64(time.Since(start))
+		cur := kcp.DefaultSnmp.Copy()
+
+		var segs string
+		if direction == "up" {
+			out, retrans := cur.OutSegs-snmp.OutSegs, cur.RetransSegs-snmp.RetransSegs
+			segs = fmt.Sprintf("retransmitted %.2f%% of %v segments", percent(retrans, out), out)
+		} else {
+			in, recovered := cur.InSegs-snmp.InSegs, cur.FECRecovered-snmp.FECRecovered
+			segs = fmt.Sprintf("fec recovered %.2f%% of %v segments", percent(recovered, in), in)
+		}
+		rate := float64(n) / elapsed.Seconds()
+		fmt.Printf("%v: %-4v %.2f MB/s (%.1f Mbps), %v, cpu %.0f%%\n", remote, direction, rate/1e6, rate*8/1e6, segs, cpuShare)
+	}
+	return true
+}
+
+// benchUp writes to a stream for d, and returns the bytes the server reported last
+// before d and when
+func benchUp(mux generic.Mux, d time.Duration) (uint64, time.Duration, error) {
+	stream, err := openStream(mux, &generic.StreamHeader{Network: generic.NetBench, Addr: "up"}, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stream.Close()
+
+	var mu sync.Mutex
+	var received uint64
+	var at time.Duration
+	start := time.Now()
+	go func() {
+		var report [8]byte
+		for {
+			if _, err := io.ReadFull(stream, report[:]); err != nil {
+				return
+			}
+			elapsed := time.Since(start)
+			if elapsed > d {
+				return
+			}
+			mu.Lock()
+			received, at = binary.BigEndian.Uint64(report[:]), elapsed
+			mu.Unlock()
+		}
+	}()
+
+	buf := make([]byte, benchBuffer)
+	rand.Read(buf)
+	stream.SetWriteDeadline(start.Add(d))
+	for {
+		if _, err := stream.Write(buf); err != nil {
+			if err != smux.ErrTimeout {
+				return 0, 0, err
+			}
+			break
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if at == 0 {
+		return 0, 0, errors.Errorf("no report from the server in %v", d)
+	}
+	return received, at, nil
+}
+
+// benchDown reads from a stream for d, and returns the bytes read
+func benchDown(mux generic.Mux, d time.Duration) (uint64, time.Duration, error) {
+	stream, err := openStream(mux, &generic.StreamHeader{Network: generic.NetBench, Addr: "down"}, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stream.Close()
+
+	var n uint64
+	buf := make([]byte, benchBuffer)
+	start := time.Now()
+	stream.SetReadDeadline(start.Add(d))
+	for {
+		m, err := stream.Read(buf)
+		n += uint64(m)
+		if err != nil {
+			if err != smux.ErrTimeout {
+				return 0, 0, err
+			}
+			break
+		}
+	}
+	return n, time.Since(start), nil
+}
+
+// percent returns part of whole in percent, 0 of nothing
+func percent(part, whole uint64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(whole)
+}
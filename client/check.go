@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/generic"
+)
+
+const (
+	// probes sent to each server by a check
+	checkProbes = 5
+	// size of the payload echoed through a server in dynamic mode
+	checkPayload = 64
+)
+
+// check probes every server and prints the rtt and loss to it, then echoes a payload
+// through the current one if it runs in dynamic mode. It reports whether every server
+// answered and the echo came back intact.
+func (t *tuner) check(echo bool) bool {
+	ok := true
+	for _, remote := range t.servers().addrs {
+		var rtts []time.Duration
+		for i := 0; i < checkProbes; i++ {
+			rtt, err := t.probe(remote)
+			if err != nil {
+				log.Println("check:", remote, err)
+				continue
+			}
+			rtts = append(rtts, rtt)
+		}
+		loss := 100 * (checkProbes - len(rtts)) / checkProbes
+		if len(rtts) == 0 {
+			fmt.Printf("%v: unreachable, loss %v%%\n", remote, loss)
+			ok = false
+			continue
+		}
+		fastest, slowest, sum := rtts[0], rtts[0], time.Duration(0)
+		for _, rtt := range rtts {
+			if rtt < fastest {
+				fastest = rtt
+			}
+			if rtt > slowest {
+				slowest = rtt
+			}
+			sum += rtt
+		}
+		avg := sum / time.Duration(len(rtts))
+		fmt.Printf("%v: rtt min/avg/max %v/%v/%v, loss %v%%\n", remote,
+			fastest.Round(time.Microsecond), avg.Round(time.Microsecond), slowest.Round(time.Microsecond), loss)
+	}
+
+	if echo && ok {
+		remote := t.servers().current()
+		rtt, err := t.echo(remote)
+		if err != nil {
+			fmt.Printf("%v: echo failed: %v\n", remote, err)
+			return false
+		}
+		fmt.Printf("%v: echo %v bytes in %v\n", remote, checkPayload, rtt.Round(time.Microsecond))
+	}
+	return ok
+}
+
+// dialMux dials a kcp session of its own to remote with cfg and starts smux on it, for
+// checks outside of the tunnel's sessions
+func (t *tuner) dialMux(remote string, cfg *Config, block kcp.BlockCrypt) (*ownedSession, generic.Mux, error) {
+	kcpconn, err := dial(remote, cfg, block, t.psk())
+	if err != nil {
+		return nil, nil, err
+	}
+	kcpconn.SetStreamMode(true)
+	kcpconn.SetWriteDelay(false)
+	kcpconn.SetACKNoDelay(true)
+	p := t.Params()
+	p.ApplyTo(kcpconn.UDPSession)
+	if err := connKey(kcpconn.UDPSession, cfg, t.psk(), true); err != nil {
+		kcpconn.Close()
+		return nil, nil, err
+	}
+
+	var wire net.Conn = kcpconn
+	if t.certs != nil {
+		if wire, err = generic.CertAuth(wire, t.certs, true); err != nil {
+			kcpconn.Close()
+			return nil, nil, err
+		}
+	}
+	if cfg.KeyExchange {
+		exchange := generic.KeyExchange
+		if cfg.PQKeyExchange {
+			exchange = generic.HybridKeyExchange
+		}
+		if wire, err = exchange(wire, t.psk(), true); err != nil {
+			kcpconn.Close()
+			return nil, nil, err
+		}
+	}
+	codec, _ := generic.ParseComp(cfg.Comp)
+	conn, err := generic.DialComp(wire, codec, cfg.CompLevel, cfg.CompThreshold, cfg.CompAdaptive, cfg.Mux)
+	if err != nil {
+		kcpconn.Close()
+		return nil, nil, err
+	}
+	session, err := generic.NewMux(conn, cfg.Mux, newSmuxConfig(cfg), true)
+	if err != nil {
+		kcpconn.Close()
+		return nil, nil, errors.WithStack(err)
+	}
+	return kcpconn, session, nil
+}
+
+// echo opens a session and a stream which the server in dynamic mode sends back, and
+// measures the round trip of a payload through it
+func (t *tuner) echo(remote string) (time.Duration, error) {
+	cfg, block := t.transport()
+	kcpconn, session, err := t.dialMux(remote, &cfg, block)
+	if err != nil {
+		return 0, err
+	}
+	defer kcpconn.Close()
+	defer session.Close()
+
+	start := time.Now()
+	stream, err := openStream(session, &generic.StreamHeader{Network: generic.NetEcho}, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(start.Add(probeTimeout))
+
+	payload := make([]byte, checkPayload)
+	io.ReadFull(rand.Reader, payload)
+	if _, err := stream.Write(payload); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	reply := make([]byte, len(payload))
+	if _, err := io.ReadFull(stream, reply); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if !bytes.Equal(reply, payload) {
+		return 0, errors.New("echo mismatch")
+	}
+	return time.Since(start), nil
+}
@@ -1,51 +1,120 @@
 package main
 
-import (
-	"encoding/json"
-	"os"
-)
-
 // Config for client
 type Config struct {
-	LocalAddr    string `json:"localaddr"`
-	RemoteAddr   string `json:"remoteaddr"`
-	Key          string `json:"key"`
-	Crypt        string `json:"crypt"`
-	Mode         string `json:"mode"`
-	Conn         int    `json:"conn"`
-	AutoExpire   int    `json:"autoexpire"`
-	ScavengeTTL  int    `json:"scavengettl"`
-	MTU          int    `json:"mtu"`
-	SndWnd       int    `json:"sndwnd"`
-	RcvWnd       int    `json:"rcvwnd"`
-	DataShard    int    `json:"datashard"`
-	ParityShard  int    `json:"parityshard"`
-	DSCP         int    `json:"dscp"`
-	NoComp       bool   `json:"nocomp"`
-	AckNodelay   bool   `json:"acknodelay"`
-	NoDelay      int    `json:"nodelay"`
-	Interval     int    `json:"interval"`
-	Resend       int    `json:"resend"`
-	NoCongestion int    `json:"nc"`
-	SockBuf      int    `json:"sockbuf"`
-	SmuxVer      int    `json:"smuxver"`
-	SmuxBuf      int    `json:"smuxbuf"`
-	StreamBuf    int    `json:"streambuf"`
-	KeepAlive    int    `json:"keepalive"`
-	Log          string `json:"log"`
-	Fifo         string `json:"fifo"`
-	SnmpLog      string `json:"snmplog"`
-	SnmpPeriod   int    `json:"snmpperiod"`
-	Quiet        bool   `json:"quiet"`
-	TCP          bool   `json:"tcp"`
-}
-
-func parseJSONConfig(config *Config, path string) error {
-	file, err := os.Open(path) // For read access.
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+	LocalAddr         string `json:"localaddr"`
+	RemoteAddr        string `json:"remoteaddr"`
+	HopInterval       int    `json:"hopinterval"`
+	Family            string `json:"family"`
+	BindAddr          string `json:"bindaddr"`
+	BindIface         string `json:"bindiface"`
+	Key               string `json:"key"`
+	KeyFile           string `json:"keyfile"`
+	Crypt             string `json:"crypt"`
+	Rekey             int    `json:"rekey"`
+	AntiReplay        int    `json:"antireplay"`
+	Token             int    `json:"token"`
+	Migrate           bool   `json:"migrate"`
+	STUN              string `json:"stun"`
+	KeyExchange       bool   `json:"keyexchange"`
+	PQKeyExchange     bool   `json:"pqkeyexchange"`
+	ConnKey           bool   `json:"connkey"`
+	Cert              string `json:"cert"`
+	CertKey           string `json:"certkey"`
+	CA                string `json:"ca"`
+	KDF               string `json:"kdf"`
+	Salt              string `json:"salt"`
+	KDFIter           int    `json:"kdfiter"`
+	KDFMem            int    `json:"kdfmem"`
+	Mode              string `json:"mode"`
+	Conn              int    `json:"conn"`
+	Sched             string `json:"sched"`
+	ConnWeights       string `json:"connweights"`
+	Spread            bool   `json:"spread"`
+	Backoff           int    `json:"backoff"`
+	MaxRetries        int    `json:"maxretries"`
+	Standby           bool   `json:"standby"`
+	MaxStreams        int    `json:"maxstreams"`
+	Probe             int    `json:"probe"`
+	Monitor           int    `json:"monitor"`
+	Resolve           int    `json:"resolve"`
+	AutoExpire        int    `json:"autoexpire"`
+	ScavengeTTL       int    `json:"scavengettl"`
+	ScavengeIdle      bool   `json:"scavengeidle"`
+	MTU               int    `json:"mtu"`
+	SndWnd            int    `json:"sndwnd"`
+	RcvWnd            int    `json:"rcvwnd"`
+	Wnd               string `json:"wnd"`
+	MaxWnd            int    `json:"maxwnd"`
+	DataShard         int    `json:"datashard"`
+	ParityShard       int    `json:"parityshard"`
+	AutoFEC           bool   `json:"autofec"`
+	MinParity         int    `json:"minparity"`
+	MaxParity         int    `json:"maxparity"`
+	DSCP              int    `json:"dscp"`
+	FwMark            int    `json:"fwmark"`
+	NoComp            bool   `json:"nocomp"`
+	Comp              string `json:"comp"`
+	CompLevel         int    `json:"complevel"`
+	CompThreshold     int    `json:"compthreshold"`
+	CompAdaptive      bool   `json:"compadaptive"`
+	AckNodelay        bool   `json:"acknodelay"`
+	NoDelay           int    `json:"nodelay"`
+	Interval          int    `json:"interval"`
+	Resend            int    `json:"resend"`
+	NoCongestion      int    `json:"nc"`
+	SockBuf           int    `json:"sockbuf"`
+	NoOffload         bool   `json:"nooffload"`
+	SmuxVer           int    `json:"smuxver"`
+	Mux               string `json:"mux"`
+	SmuxBuf           int    `json:"smuxbuf"`
+	StreamBuf         int    `json:"streambuf"`
+	CopyBuf           int    `json:"copybuf"`
+	GOMAXPROCS        int    `json:"gomaxprocs"`
+	CPUs              string `json:"cpus"`
+	KeepAlive         int    `json:"keepalive"`
+	KeepAliveTimeout  int    `json:"keepalivetimeout"`
+	AutoKeepAlive     int    `json:"autokeepalive"`
+	OnConnect         string `json:"onconnect"`
+	OnDisconnect      string `json:"ondisconnect"`
+	OnDegraded        string `json:"ondegraded"`
+	Webhook           string `json:"webhook"`
+	WebhookRTT        int    `json:"webhookrtt"`
+	WebhookLoss       int    `json:"webhookloss"`
+	WebhookReconnects int    `json:"webhookreconnects"`
+	Log               string `json:"log"`
+	LogFormat         string `json:"logformat"`
+	Fifo              string `json:"fifo"`
+	ControlAddr       string `json:"controladdr"`
+	ControlToken      string `json:"controltoken"`
+	ControlSock       string `json:"controlsock"`
+	MetricsAddr       string `json:"metricsaddr"`
+	OTLP              string `json:"otlp"`
+	SnmpLog           string `json:"snmplog"`
+	SnmpPeriod        int    `json:"snmpperiod"`
+	SnmpFormat        string `json:"snmpformat"`
+	SnmpReset         bool   `json:"snmpreset"`
+	Quiet             bool   `json:"quiet"`
+	TCP               bool   `json:"tcp"`
+	ICMP              bool   `json:"icmp"`
+	Padding           bool   `json:"padding"`
+	Proxy             string `json:"proxy"`
+	WS                string `json:"ws"`
+	WSFallback        bool   `json:"wsfallback"`
+	Transport         string `json:"transport"`
+	Socks5            bool   `json:"socks5"`
+	HTTPProxy         bool   `json:"httpproxy"`
+	TProxy            bool   `json:"tproxy"`
+	ProxyProtocol     bool   `json:"proxyprotocol"`
+	Reverse           bool   `json:"reverse"`
+	P2P               bool   `json:"p2p"`
+	UDP               bool   `json:"udp"`
+	UDPTimeout        int    `json:"udptimeout"`
+	TUN               string `json:"tun"`
+	TUNAddr           string `json:"tunaddr"`
+	UpLimit           string `json:"uplimit"`
+	DownLimit         string `json:"downlimit"`
+	StreamLimit       string `json:"streamlimit"`
 
-	return json.NewDecoder(file).Decode(config)
+	Mappings []Mapping `json:"mappings"`
 }
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"runtime"
+	"strings"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// checkConfig collects the problems of config, and if listen is set whether its local
+// addresses can be listened on
+func checkConfig(config *Config, listen bool) generic.ConfigCheck {
+	var c generic.ConfigCheck
+	if config.PQKeyExchange && !config.KeyExchange {
+		c.Fail("pqkeyexchange", "pqkeyexchange needs keyexchange")
+	}
+	if config.ConnKey && config.Crypt == "null" {
+		c.Fail("connkey", "connkey needs a crypt other than null")
+	}
+	if config.SmuxVer < 1 || config.SmuxVer > maxSmuxVer {
+		c.Fail("smuxver", "unsupported smux version:", config.SmuxVer)
+	} else {
+		c.Smux(config.SmuxVer, config.SmuxBuf, config.StreamBuf, config.KeepAlive, config.KeepAliveTimeout)
+	}
+	if config.Mux != generic.MuxSmux && config.Mux != generic.MuxYamux && config.Mux != generic.MuxNone {
+		c.Fail("mux", "unknown mux:", config.Mux)
+	}
+	if config.Mux == generic.MuxNone && (config.Socks5 || config.HTTPProxy || config.TProxy || len(config.Mappings) > 0 || config.UDP || config.TUN != "" || config.Reverse) {
+		c.Fail("mux", "mux none can't be used with socks5, httpproxy, tproxy, mappings, udp, tun or reverse")
+	}
+	if config.Mux == generic.MuxNone && (config.Probe > 0 || config.Monitor > 0) {
+		c.Fail("mux", "mux none can't be used with probe or monitor, which open streams of their own")
+	}
+	if config.SnmpFormat != generic.SnmpCSV && config.SnmpFormat != generic.SnmpJSON {
+		c.Fail("snmpformat", "unsupported snmpformat:", config.SnmpFormat)
+	}
+	if config.Sched != schedRR && config.Sched != schedLeastLoaded {
+		c.Fail("sched", "unsupported sched:", config.Sched)
+	}
+	if _, err := parseWeights(config.ConnWeights, config.Conn); err != nil {
+		c.Fail("connweights", err)
+	}
+	if config.Spread && (config.Reverse || config.P2P) {
+		c.Fail("spread", "spread can't be used with reverse or p2p")
+	}
+	if config.Standby && (config.Reverse || config.Mux == generic.MuxNone || config.Spread) {
+		c.Fail("standby", "standby can't be used with reverse, mux none or spread")
+	}
+	if config.Backoff < 1 {
+		c.Fail("backoff", "backoff must be at least 1")
+	}
+	if config.MaxRetries < 0 {
+		c.Fail("maxretries", "maxretries can't be negative")
+	}
+	if config.MaxStreams < 0 {
+		c.Fail("maxstreams", "maxstreams can't be negative")
+	}
+	if config.MaxStreams > 0 && config.Reverse {
+		c.Fail("maxstreams", "maxstreams can't be used with reverse, whose sessions are dialed by the server")
+	}
+	if config.Monitor < 0 {
+		c.Fail("monitor", "monitor can't be negative")
+	}
+	if config.Webhook != "" {
+		if u, err := url.Parse(config.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			c.Fail("webhook", "webhook must be an http or https url:", config.Webhook)
+		}
+		if config.WebhookRTT == 0 && config.WebhookLoss == 0 && config.WebhookReconnects == 0 {
+			c.Fail("webhook", "webhook needs webhookrtt, webhookloss or webhookreconnects")
+		}
+	}
+	if config.WebhookRTT < 0 || config.WebhookLoss < 0 || config.WebhookReconnects < 0 {
+		c.Fail("webhook", "webhookrtt, webhookloss and webhookreconnects can't be negative")
+	}
+	if config.AutoFEC && (config.DataShard <= 0 || config.ParityShard <= 0) {
+		c.Fail("autofec", "autofec requires datashard and parityshard above 0")
+	}
+	if config.AutoFEC && (config.MinParity < 1 || config.MinParity > config.MaxParity) {
+		c.Fail("minparity", "invalid autofec bounds: minparity", config.MinParity, "maxparity", config.MaxParity)
+	}
+	if config.Wnd != "" && config.Wnd != "auto" {
+		c.Fail("wnd", "unsupported wnd:", config.Wnd)
+	}
+	if config.Wnd == "auto" && (config.MaxWnd < config.SndWnd || config.MaxWnd < config.RcvWnd) {
+		c.Fail("maxwnd", "maxwnd can't be below sndwnd or rcvwnd")
+	}
+	for field, rate := range map[string]string{"uplimit": config.UpLimit, "downlimit": config.DownLimit, "streamlimit": config.StreamLimit} {
+		if _, err := generic.ParseRate(rate); err != nil {
+			c.Fail(field, err)
+		}
+	}
+	if config.KeepAliveTimeout < config.KeepAlive {
+		c.Fail("keepalivetimeout", "keepalivetimeout can't be below keepalive")
+	}
+	if config.AutoKeepAlive < 0 {
+		c.Fail("autokeepalive", "autokeepalive can't be negative")
+	}
+	if config.AutoKeepAlive > 0 && config.AutoKeepAlive < config.KeepAlive {
+		c.Fail("autokeepalive", "autokeepalive can't be below keepalive")
+	}
+	if config.AutoKeepAlive > 0 && (config.Reverse || config.Transport == "tcp") {
+		c.Fail("autokeepalive", "autokeepalive can't be used with reverse or transport tcp")
+	}
+	if config.CopyBuf <= 0 {
+		c.Fail("copybuf", "copybuf must be positive")
+	}
+	if config.GOMAXPROCS < 0 {
+		c.Fail("gomaxprocs", "gomaxprocs can't be negative")
+	}
+	if config.ControlAddr != "" && config.ControlToken == "" && !generic.IsLoopbackAddr(config.ControlAddr) {
+		c.Fail("controladdr", "controladdr on a non-loopback address needs a controltoken")
+	}
+	if config.CPUs != "" {
+		if _, err := generic.ParseCPUList(config.CPUs); err != nil {
+			c.Fail("cpus", err)
+		}
+	}
+	if _, err := generic.ParseComp(config.Comp); err != nil {
+		c.Fail("comp", err)
+	}
+	if config.CompLevel < 0 || config.CompLevel > 9 {
+		c.Fail("complevel", "unsupported complevel:", config.CompLevel)
+	}
+	if config.TCP && runtime.GOOS != "linux" {
+		c.Fail("tcp", "tcp is only supported on linux, see icmp, transport and ws")
+	}
+	if config.BindAddr != "" && net.ParseIP(config.BindAddr) == nil {
+		c.Fail("bindaddr", "invalid bindaddr:", config.BindAddr)
+	}
+	if (config.BindAddr != "" || config.BindIface != "") && (config.TCP || config.ICMP || config.Proxy != "" || config.WS != "" || config.Reverse) {
+		c.Fail("bindaddr", "bindaddr and bindiface can't be used with tcp, icmp, proxy, ws or reverse")
+	}
+	if config.FwMark != 0 && (config.TCP || config.Proxy != "" || config.WS != "" || config.Reverse) {
+		c.Fail("fwmark", "fwmark can't be used with tcp, proxy, ws or reverse")
+	}
+	if config.FwMark < 0 || (config.FwMark != 0 && runtime.GOOS != "linux") {
+		c.Fail("fwmark", "fwmark must be positive and is only supported on linux")
+	}
+	if config.BindIface != "" && runtime.GOOS != "linux" {
+		c.Fail("bindiface", "bindiface is only supported on linux")
+	}
+	if config.TUNAddr != "" {
+		if ip, _, err := net.ParseCIDR(config.TUNAddr); err != nil || ip.To4() == nil || config.TUN == "" {
+			c.Fail("tunaddr", "tunaddr must be an IPv4 address and prefix of a tun device:", config.TUNAddr)
+		}
+	}
+	if config.TUN != "" && (config.UDP || config.Socks5 || config.HTTPProxy || config.TProxy || len(config.Mappings) > 0 || runtime.GOOS != "linux") {
+		c.Fail("tun", "tun can't be used with udp, socks5, httpproxy, tproxy or mappings, and only on linux")
+	}
+	if config.ProxyProtocol && (config.UDP || config.TUN != "" || config.TProxy) {
+		c.Fail("proxyprotocol", "proxyprotocol can't be used with udp, tun or tproxy")
+	}
+	if config.Proxy != "" && (config.TCP || config.Reverse) {
+		c.Fail("proxy", "proxy can't be used with tcp or reverse")
+	}
+	if config.Migrate && (config.TCP || config.Proxy != "" || config.WS != "" || config.Reverse) {
+		c.Fail("migrate", "migrate can't be used with tcp, proxy, ws or reverse")
+	}
+	if config.P2P && (config.TCP || config.Proxy != "" || config.WS != "" || config.Reverse || config.Migrate || config.Transport != "kcp" || generic.IsPortRange(config.RemoteAddr)) {
+		c.Fail("p2p", "p2p can't be used with tcp, proxy, ws, reverse, migrate, transport or a port range")
+	}
+	if config.ICMP && (config.TCP || config.Proxy != "" || config.WS != "" || config.Reverse || config.Migrate || config.P2P || config.Transport != "kcp" || generic.IsPortRange(config.RemoteAddr)) {
+		c.Fail("icmp", "icmp can't be used with tcp, proxy, ws, reverse, migrate, p2p, transport or a port range")
+	}
+	if config.WS != "" && config.Reverse {
+		c.Fail("ws", "ws can't be used with reverse")
+	}
+	switch config.Transport {
+	case "kcp":
+	case "tcp", "auto":
+		if config.TCP || config.Proxy != "" || config.WS != "" || config.Reverse {
+			c.Fail("transport", "transport tcp and auto can't be used with tcp, proxy, ws or reverse")
+		}
+	default:
+		c.Fail("transport", "unsupported transport:", config.Transport)
+	}
+	if config.Family != "" && config.Family != "4" && config.Family != "6" && config.Family != "dual" {
+		c.Fail("family", "unsupported family:", config.Family)
+	}
+	if config.KeyFile != "" {
+		if _, err := generic.ReadKeyFile(config.KeyFile); err != nil {
+			c.Fail("keyfile", err)
+		}
+	}
+	if config.Cert != "" || config.CertKey != "" || config.CA != "" {
+		if config.Cert == "" || config.CertKey == "" || config.CA == "" {
+			c.Fail("cert", "cert, certkey and ca must be set together")
+		} else if _, err := generic.LoadCertAuth(config.Cert, config.CertKey, config.CA); err != nil {
+			c.Fail("cert", err)
+		}
+	}
+	if config.Token < 0 {
+		c.Fail("token", "token can't be negative")
+	}
+	if config.Token > 0 && config.Proxy != "" {
+		c.Fail("token", "token can't be used with proxy, the server sees the address of the proxy")
+	}
+	if config.AntiReplay > 0 && (config.Crypt == "null" || generic.IsAEAD(config.Crypt)) {
+		c.Fail("antireplay", "antireplay requires a cipher other than null, aes-gcm, aes-gcm-siv and chacha20-poly1305")
+	}
+	if config.Crypt == "aes-gcm-siv" && config.Rekey <= 0 {
+		c.Fail("rekey", "aes-gcm-siv requires rekey, its 4 bytes nonces don't last a long-lived key")
+	}
+	c.Transport(config.Crypt, config.Mode, config.MTU, config.SndWnd, config.RcvWnd, config.DataShard, config.ParityShard)
+
+	// the local addresses, unix domain sockets are replaced when listened on
+	if listen {
+		network := "tcp"
+		if config.UDP {
+			network = "udp"
+		}
+		if !strings.HasPrefix(config.LocalAddr, unixPrefix) && config.TUN == "" {
+			c.Listen("localaddr", network, config.LocalAddr)
+		}
+		for _, m := range config.Mappings {
+			if !strings.HasPrefix(m.LocalAddr, unixPrefix) {
+				c.Listen("mappings", "tcp", m.LocalAddr)
+			}
+		}
+		// the server dials in on remoteaddr in reverse mode
+		if config.Reverse {
+			c.Listen("remoteaddr", "udp", config.RemoteAddr)
+		}
+	}
+	return c
+}
@@ -1,18 +1,396 @@
 package main
 
 import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/pkg/errors"
 	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/generic"
 	"github.com/xtaci/tcpraw"
 )
 
-func dial(config *Config, block kcp.BlockCrypt) (*kcp.UDPSession, error) {
+// ownedSession is a kcp session on a packet conn created for it alone, which kcp-go
+// leaves open when the session is closed
+type ownedSession struct {
+	*kcp.UDPSession
+	conn net.PacketConn
+}
+
+func (s *ownedSession) Close() error {
+	err := s.UDPSession.Close()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return err
+}
+
+// dial connects to a kcp server at remote, pass is the key tokens are under. With
+// connkey the session gets a block of its own on block.
+func dial(remote string, config *Config, block kcp.BlockCrypt, pass []byte) (*ownedSession, error) {
+	if config.ConnKey && block != nil {
+		block = generic.NewConnKeyBlockCrypt(block)
+	}
+	if config.WS != "" {
+		return dialWebSocket(config, block, pass)
+	}
+	if config.P2P {
+		return dialP2P(remote, config, block, pass)
+	}
+	if !config.TCP && !config.ICMP && !config.Padding && config.Token == 0 && !config.Migrate && config.Proxy == "" && config.BindAddr == "" && config.BindIface == "" && config.FwMark == 0 && !generic.IsPortRange(remote) && config.NoOffload {
+		sess, err := kcp.DialWithOptions(remote, block, config.DataShard, config.ParityShard)
+		if err != nil {
+			return nil, err
+		}
+		return &ownedSession{UDPSession: sess}, nil
+	}
+
+	host, lo, hi, err := generic.ParsePortRange(remote)
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(lo)))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var conn net.PacketConn
 	if config.TCP {
-		conn, err := tcpraw.Dial("tcp", config.RemoteAddr)
+		tcpconn, err := tcpraw.Dial("tcp", raddr.String())
 		if err != nil {
 			return nil, errors.Wrap(err, "tcpraw.Dial()")
 		}
-		return kcp.NewConn(config.RemoteAddr, block, config.DataShard, config.ParityShard, conn)
+		conn = tcpconn
+	} else if config.ICMP {
+		if conn, err = generic.DialICMP(); err != nil {
+			return nil, errors.Wrap(err, "DialICMP()")
+		}
+		if config.FwMark != 0 {
+			if err := generic.SetMark(conn, config.FwMark); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+	} else if config.Proxy != "" {
+		if conn, err = dialProxy(config.Proxy, raddr); err != nil {
+			return nil, errors.Wrap(err, "dialProxy()")
+		}
+	} else {
+		network := "udp4"
+		if raddr.IP.To4() == nil {
+			network = "udp"
+		}
+		udpconn, err := listenUDP(network, config)
+		if err != nil {
+			return nil, err
+		}
+		conn = udpconn
+		if hi > lo {
+			conn = generic.NewHopConn(conn, raddr.IP, lo, hi, time.Duration(config.HopInterval)*time.Second)
+		} else if !config.NoOffload {
+			conn = generic.NewOffloadConn(conn)
+		}
+		if config.Migrate {
+			conn = generic.NewMigrateDialConn(conn)
+		}
+	}
+
+	if config.Token > 0 {
+		conn = generic.NewTokenConn(conn, [][]byte{pass}, time.Duration(config.Token)*time.Second, tokenSource(raddr))
+	}
+	if config.Padding {
+		conn = generic.NewPaddingConn(conn)
+	}
+	// icmp has no ports
+	var dst net.Addr = raddr
+	if config.ICMP {
+		dst = &net.IPAddr{IP: raddr.IP}
+	}
+	sess, err := kcp.NewConn2(dst, block, config.DataShard, config.ParityShard, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ownedSession{sess, conn}, nil
+}
+
+// tokenSource returns the ip the server sees the sessions to raddr come from, which
+// their tokens are bound to: the public ip the stun servers saw, or the local address
+// of the route to raddr without a nat
+func tokenSource(raddr net.Addr) func() net.IP {
+	return func() net.IP {
+		if ip, ok := publicIP.Load().(net.IP); ok {
+			return ip
+		}
+		ip := generic.RouteIP(raddr)
+		if ip != nil && ip.IsPrivate() {
+			privateTokenIP.Do(func() {
+				log.Println("token: bound to the private ip", ip, "behind a nat the server sees another one, set stun to learn it")
+			})
+		}
+		return ip
+	}
+}
+
+// privateTokenIP warns once of tokens bound to a private ip
+var privateTokenIP sync.Once
+
+// listenUDP opens the udp socket of a session, bound to bindaddr and bindiface and
+// marked with fwmark if set
+func listenUDP(network string, config *Config) (net.PacketConn, error) {
+	var laddr string
+	if config.BindAddr != "" {
+		laddr = net.JoinHostPort(config.BindAddr, "0")
+	}
+	lc := net.ListenConfig{Control: generic.SocketControl(config.BindIface, config.FwMark)}
+	conn, err := lc.ListenPacket(context.Background(), network, laddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return conn, nil
+}
+
+// dialWebSocket carries the kcp packets on a websocket to a server started with -ws
+func dialWebSocket(config *Config, block kcp.BlockCrypt, pass []byte) (*ownedSession, error) {
+	ws, err := generic.DialWebSocket(config.WS, proxyTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "DialWebSocket()")
+	}
+	conn := generic.NewStreamPacketConn(ws, nil)
+	if config.Token > 0 {
+		conn = generic.NewTokenConn(conn, [][]byte{pass}, time.Duration(config.Token)*time.Second, nil)
+	}
+	sess, err := kcp.NewConn2(ws.RemoteAddr(), block, config.DataShard, config.ParityShard, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ownedSession{sess, conn}, nil
+}
+
+// dialP2P asks the rendezvous at remote for the address of the server registered under
+// the key, and dials it once punched through
+func dialP2P(remote string, config *Config, block kcp.BlockCrypt, pass []byte) (*ownedSession, error) {
+	rendezvous, err := net.ResolveUDPAddr("udp", remote)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	network := "udp4"
+	if rendezvous.IP.To4() == nil {
+		network = "udp"
+	}
+	udpconn, err := listenUDP(network, config)
+	if err != nil {
+		return nil, err
+	}
+	id := generic.P2PID(pass)
+	raddr, err := generic.P2PLookup(udpconn, rendezvous, id, proxyTimeout)
+	if err != nil {
+		udpconn.Close()
+		return nil, err
+	}
+	log.Println("p2p: server at", raddr)
+
+	conn := generic.NewP2PConn(udpconn, nil, id)
+	if config.Token > 0 {
+		conn = generic.NewTokenConn(conn, [][]byte{pass}, time.Duration(config.Token)*time.Second, tokenSource(raddr))
+	}
+	if config.Padding {
+		conn = generic.NewPaddingConn(conn)
+	}
+	sess, err := kcp.NewConn2(raddr, block, config.DataShard, config.ParityShard, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ownedSession{sess, conn}, nil
+}
+
+// listenReverse listens on addr for a kcp server started with -reverse to dial in
+func listenReverse(addr string, config *Config, block kcp.BlockCrypt, pass []byte) (*kcp.Listener, error) {
+	var conn net.PacketConn
+	if config.TCP {
+		tcpconn, err := tcpraw.Listen("tcp", addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "tcpraw.Listen()")
+		}
+		conn = tcpconn
+	} else if config.Padding || config.Token > 0 {
+		udpconn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		conn = udpconn
+	} else {
+		lis, err := kcp.ListenWithOptions(addr, block, config.DataShard, config.ParityShard)
+		return connKeyListener(lis, config, block), err
+	}
+
+	if config.Token > 0 {
+		conn = generic.NewTokenConn(conn, [][]byte{pass}, time.Duration(config.Token)*time.Second, nil)
+	}
+	if config.Padding {
+		conn = generic.NewPaddingConn(conn)
+	}
+	lis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, conn)
+	return connKeyListener(lis, config, block), err
+}
+
+// connKeyListener gives the sessions lis accepts a block of their own on block with
+// connkey
+func connKeyListener(lis *kcp.Listener, config *Config, block kcp.BlockCrypt) *kcp.Listener {
+	if lis != nil && config.ConnKey && block != nil {
+		lis.SetSessionBlockCrypt(func() kcp.BlockCrypt { return generic.NewConnKeyBlockCrypt(block) })
+	}
+	return lis
+}
+
+// remotes is the list of kcp servers to fail over between
+type remotes struct {
+	mu    sync.Mutex
+	addrs []string
+	cur   int
+	own   []int // the servers of the conn sessions spread over them
+	stats map[string]*probeStats
+}
+
+// newRemotes parses a comma separated list of server addresses, the first spread
+// sessions of conn dialed to a server each in turn
+func newRemotes(list string, spread int) *remotes {
+	r := new(remotes)
+	r.stats = make(map[string]*probeStats)
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			r.addrs = append(r.addrs, addr)
+		}
+	}
+	if len(r.addrs) > 1 {
+		for idx := 0; idx < spread; idx++ {
+			r.own = append(r.own, idx%len(r.addrs))
+		}
+	}
+	return r
+}
+
+// spreadConns is the number of conn sessions -spread dials to servers of their own
+func spreadConns(config *Config) int {
+	if config.Spread {
+		return config.Conn
+	}
+	return 0
+}
+
+// current returns the server new sessions should be dialed to
+func (r *remotes) current() string {
+	return r.currentAt(-1)
+}
+
+// currentAt returns the server the session at idx of conn should be dialed to, its
+// own one if spread, and the current one otherwise or for -1
+func (r *remotes) currentAt(idx int) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.addrs) == 0 {
+		return ""
+	}
+	if idx >= 0 && idx < len(r.own) {
+		return r.addrs[r.own[idx]]
+	}
+	return r.addrs[r.cur]
+}
+
+// failover switches to the next server if addr is still the current one
+func (r *remotes) failover(addr string) {
+	r.failoverAt(-1, addr)
+}
+
+// failoverAt switches the session at idx of conn to the next server if addr is still
+// its own one, or like failover if it's not spread
+func (r *remotes) failoverAt(idx int, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.addrs) < 2 {
+		return
+	}
+	if idx >= 0 && idx < len(r.own) {
+		if r.addrs[r.own[idx]] == addr {
+			r.own[idx] = (r.own[idx] + 1) % len(r.addrs)
+			log.Println("failover: session", idx, addr, "->", r.addrs[r.own[idx]])
+		}
+		return
+	}
+	if r.addrs[r.cur] != addr {
+		return
+	}
+	r.cur = (r.cur + 1) % len(r.addrs)
+	log.Println("failover:", addr, "->", r.addrs[r.cur])
+}
+
+// report records a probe result of a server
+func (r *remotes) report(addr string, ok bool, rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ps, exists := r.stats[addr]
+	if !exists {
+		ps = new(probeStats)
+		r.stats[addr] = ps
+	}
+	ps.add(ok, rtt)
+}
+
+// selectBest switches to the server with the best probe results for new sessions
+func (r *remotes) selectBest() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	best := r.cur
+	for k, addr := range r.addrs {
+		if ps, ok := r.stats[addr]; ok {
+			if cur, ok := r.stats[r.addrs[best]]; !ok || ps.score() < cur.score() {
+				best = k
+			}
+		}
+	}
+	for _, addr := range r.addrs {
+		if ps, ok := r.stats[addr]; ok {
+			log.Println("probe:", addr, "rtt:", ps.rtt, "loss:", ps.loss())
+		}
+	}
+	if best != r.cur {
+		log.Println("probe: switching to", r.addrs[best], "from", r.addrs[r.cur])
+		r.cur = best
+	}
+}
+
+// dialStream connects to the plain tcp transport of the server at the first port of
+// remote, encrypted with pass unless it is nil
+func dialStream(remote string, config *Config, pass []byte) (net.Conn, error) {
+	host, lo, _, err := generic.ParsePortRange(remote)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{Timeout: proxyTimeout, Control: generic.SocketControl(config.BindIface, config.FwMark)}
+	if config.BindAddr != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(config.BindAddr)}
+	}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(lo)))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	tcpconn := conn.(*net.TCPConn)
+	tcpconn.SetNoDelay(true)
+	if err := tcpconn.SetReadBuffer(config.SockBuf); err != nil {
+		log.Println("SetReadBuffer:", err)
+	}
+	if err := tcpconn.SetWriteBuffer(config.SockBuf); err != nil {
+		log.Println("SetWriteBuffer:", err)
+	}
+	if pass == nil {
+		return conn, nil
 	}
-	return kcp.DialWithOptions(config.RemoteAddr, block, config.DataShard, config.ParityShard)
+	return generic.NewCryptConn(conn, pass), nil
 }
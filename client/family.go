@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how long the ipv6 path is given a head start in dual stack mode
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// pickAddr resolves the host of remote to an address of the family configured with
+// -4 or -6. In dual stack mode both families are probed, ipv6 first, and the one
+// whose server answers first is dialed.
+func (t *tuner) pickAddr(remote string) (string, error) {
+	cfg, _ := t.transport()
+	if cfg.Family == "" {
+		return remote, nil
+	}
+
+	host, ports, err := net.SplitHostPort(remote)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	var v4, v6 []string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, net.JoinHostPort(ip.String(), ports))
+		} else {
+			v6 = append(v6, net.JoinHostPort(ip.String(), ports))
+		}
+	}
+
+	switch {
+	case cfg.Family == "4" || (cfg.Family == "dual" && len(v6) == 0):
+		if len(v4) == 0 {
+			return "", errors.Errorf("no ipv4 address for %v", host)
+		}
+		return v4[0], nil
+	case cfg.Family == "6" || (cfg.Family == "dual" && len(v4) == 0):
+		if len(v6) == 0 {
+			return "", errors.Errorf("no ipv6 address for %v", host)
+		}
+		return v6[0], nil
+	}
+	return t.race(v6[0], v4[0])
+}
+
+// race probes the ipv6 and the ipv4 address of a server and returns the first one to
+// answer, ipv4 is tried after a delay or as soon as ipv6 failed
+func (t *tuner) race(v6, v4 string) (string, error) {
+	type result struct {
+		addr string
+		err  error
+	}
+	results := make(chan result, 2)
+	probe := func(addr string) {
+		_, err := t.probe(addr)
+		results <- result{addr, err}
+	}
+
+	go probe(v6)
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	started, pending := false, 1
+
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				log.Println("dual stack:", r.addr, "answered first")
+				return r.addr, nil
+			}
+			err = r.err
+		}
+		if !started {
+			go probe(v4)
+			started, pending = true, pending+1
+		}
+	}
+	return "", errors.Wrap(err, "dual stack")
+}
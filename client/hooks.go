@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// states of the tunnel the hooks are run on changes of
+const (
+	tunnelDown     = "down"
+	tunnelUp       = "up"
+	tunnelDegraded = "degraded"
+)
+
+const (
+	// the time a hook script has to finish before it's killed
+	hookTimeout = 30 * time.Second
+	// hook runs waiting behind a slow script before new ones are dropped
+	hookQueue = 16
+)
+
+// hookRun is a script to run with the environment describing an event
+type hookRun struct {
+	script string
+	env    []string
+}
+
+// hooks tracks the state of the tunnel and runs the script of onconnect, ondisconnect
+// or ondegraded when it changes. The tunnel is up once a session is dialed, degraded
+// while the open sessions hear nothing from the server, not even its keepalives, for
+// half of keepalivetimeout, and down once they are closed for it, or when dialing
+// fails with no session open.
+type hooks struct {
+	tun  *tuner
+	runs chan hookRun
+
+	mu    sync.Mutex
+	state string
+
+	lastIn     uint64
+	lastChange time.Time
+}
+
+func newHooks(tun *tuner) *hooks {
+	h := &hooks{tun: tun, runs: make(chan hookRun, hookQueue), state: tunnelDown, lastChange: time.Now()}
+	go h.run()
+	return h
+}
+
+// connected records a session dialed to remote, once it's tracked by the tuner
+func (h *hooks) connected(remote string) {
+	h.set(tunnelUp, remote)
+}
+
+// failed records a failure to dial remote, the tunnel is down without open sessions
+func (h *hooks) failed(remote string, err error) {
+	if len(h.tun.Sessions()) == 0 {
+		h.set(tunnelDown, remote, "KCPTUN_ERROR="+err.Error())
+	}
+}
+
+// monitor looks every second for the sessions going silent, hearing from the server
+// again, or being closed while silent
+func (h *hooks) monitor() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		config, _ := h.tun.transport()
+		sessions := h.tun.Sessions()
+		var in uint64
+		for _, s := range sessions {
+			in += s.Meter.BytesIn()
+		}
+		h.mu.Lock()
+		heard := in > h.lastIn // closed sessions only lower it
+		if heard {
+			h.lastChange = time.Now()
+		}
+		h.lastIn = in
+		silent := time.Since(h.lastChange)
+		state := h.state
+		h.mu.Unlock()
+
+		switch {
+		case state == tunnelUp && len(sessions) > 0 && silent >= time.Duration(config.KeepAliveTimeout)*time.Second/2:
+			h.set(tunnelDegraded, "", fmt.Sprintf("KCPTUN_SILENT=%d", int(silent/time.Second)))
+		case state == tunnelDegraded && len(sessions) == 0:
+			h.set(tunnelDown, "", fmt.Sprintf("KCPTUN_SILENT=%d", int(silent/time.Second)))
+		case state == tunnelDegraded && heard:
+			h.set(tunnelUp, "")
+		}
+	}
+}
+
+// set changes the state of the tunnel, and queues the hook of the new one with the
+// environment of the event and extra variables
+func (h *hooks) set(state, remote string, extra ...string) {
+	h.mu.Lock()
+	previous := h.state
+	h.state = state
+	if state == tunnelUp {
+		h.lastChange = time.Now()
+	}
+	h.mu.Unlock()
+	if state == previous {
+		return
+	}
+
+	config, _ := h.tun.transport()
+	var event, script string
+	switch state {
+	case tunnelUp:
+		event, script = "connect", config.OnConnect
+	case tunnelDown:
+		event, script = "disconnect", config.OnDisconnect
+	case tunnelDegraded:
+		event, script = "degraded", config.OnDegraded
+	}
+	if remote == "" {
+		remote = h.tun.servers().current()
+	}
+	generic.LogEvent("tunnel "+state, "previous", previous, "remote", remote)
+	if script == "" {
+		return
+	}
+
+	env := append([]string{
+		"KCPTUN_EVENT=" + event,
+		"KCPTUN_STATE=" + state,
+		"KCPTUN_PREVIOUS=" + previous,
+		"KCPTUN_REMOTE=" + remote,
+		"KCPTUN_LOCAL=" + config.LocalAddr,
+		fmt.Sprintf("KCPTUN_SESSIONS=%d", len(h.tun.Sessions())),
+		fmt.Sprintf("KCPTUN_TIME=%d", time.Now().Unix()),
+	}, extra...)
+	select {
+	case h.runs <- hookRun{script: script, env: env}:
+	default:
+		log.Println("hook dropped, too many running:", event, script)
+	}
+}
+
+// run executes the hooks one after the other, in the order of the events
+func (h *hooks) run() {
+	for r := range h.runs {
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		cmd := exec.CommandContext(ctx, r.script)
+		cmd.Env = append(os.Environ(), r.env...)
+		out, err := cmd.CombinedOutput()
+		cancel()
+		if err != nil {
+			log.Printf("hook %v: %v: %s", r.script, err, strings.TrimSpace(string(out)))
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// bufferedConn reads through the buffer which may hold data past the request headers
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// handleHTTPProxy serves a local http proxy client, supporting CONNECT and absolute-URI
+// requests, the destination is dialed by the server
+func handleHTTPProxy(session generic.Mux, p1 net.Conn, quiet bool) {
+	span := generic.StartSpan("stream", nil, "peer", p1.RemoteAddr())
+	defer span.End()
+
+	p1.SetDeadline(time.Now().Add(handshakeTimeout))
+	conn := &bufferedConn{p1, bufio.NewReader(p1)}
+	req, err := http.ReadRequest(conn.r)
+	if err != nil {
+		log.Println("http proxy:", err)
+		p1.Close()
+		return
+	}
+
+	addr := req.Host
+	if req.Method != http.MethodConnect {
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			httpProxyError(p1, http.StatusBadRequest)
+			return
+		}
+		addr = req.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "80")
+	}
+
+	p2, err := openStream(session, &generic.StreamHeader{Network: generic.NetTCP, Addr: addr, Source: sourceOf(p1)}, span)
+	if err != nil {
+		log.Println("http proxy:", addr, err)
+		httpProxyError(p1, http.StatusBadGateway)
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		_, err = fmt.Fprintf(p1, "HTTP/1.1 200 Connection established\r\n\r\n")
+	} else {
+		// forward in origin-form, one request per connection
+		req.RequestURI = ""
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+		req.Close = true
+		err = req.Write(p2)
+	}
+	if err != nil {
+		p1.Close()
+		p2.Close()
+		return
+	}
+	p1.SetDeadline(time.Time{})
+	relay(conn, p2, span, quiet)
+}
+
+func httpProxyError(p1 net.Conn, code int) {
+	fmt.Fprintf(p1, "HTTP/1.1 %d %s\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+	p1.Close()
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+const (
+	// mtu of generated configs
+	initMTU = 1350
+	// the smallest and largest windows of generated configs, in packets
+	initMinWnd = 128
+	initMaxWnd = 8192
+	// the smallest and largest socket and smux buffers of generated configs
+	initMinBuf = 4 << 20
+	initMaxBuf = 64 << 20
+)
+
+// initCommon holds the settings both configs of a generated pair share
+type initCommon struct {
+	Key         string `json:"key"`
+	Crypt       string `json:"crypt"`
+	Mode        string `json:"mode"`
+	MTU         int    `json:"mtu"`
+	DataShard   int    `json:"datashard"`
+	ParityShard int    `json:"parityshard"`
+	SockBuf     int    `json:"sockbuf"`
+	SmuxVer     int    `json:"smuxver"`
+	SmuxBuf     int    `json:"smuxbuf"`
+	StreamBuf   int    `json:"streambuf"`
+}
+
+// initClient is the generated config of KCP Client
+type initClient struct {
+	LocalAddr  string `json:"localaddr"`
+	RemoteAddr string `json:"remoteaddr"`
+	initCommon
+	SndWnd int `json:"sndwnd"`
+	RcvWnd int `json:"rcvwnd"`
+}
+
+// initServer is the generated config of KCP Server
+type initServer struct {
+	Listen string `json:"listen"`
+	Target string `json:"target"`
+	initCommon
+	SndWnd int `json:"sndwnd"`
+	RcvWnd int `json:"rcvwnd"`
+}
+
+// link describes the path between client and server configs are generated for
+type link struct {
+	bandwidth float64 // Mbps
+	rtt       float64 // ms
+	loss      float64 // percent
+}
+
+// initCommand writes a matching pair of client and server configs with a random key,
+// sized to the bandwidth, rtt and loss of the link given as flags, or asked for on the
+// terminal if no flag is given
+func initCommand() cli.Command {
+	return cli.Command{
+		Name:  "init",
+		Usage: "write a matching pair of client and server json configs with a random key, sized to the link",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "localaddr", Value: ":12948", Usage: "local listen address of the client"},
+			cli.StringFlag{Name: "remoteaddr", Value: "vps:29900", Usage: "address of the server the client dials"},
+			cli.StringFlag{Name: "listen", Value: ":29900", Usage: "listen address of the server"},
+			cli.StringFlag{Name: "target", Value: "127.0.0.1:12948", Usage: "target address of the server"},
+			cli.Float64Flag{Name: "bandwidth", Value: 100, Usage: "bandwidth of the link in Mbps"},
+			cli.Float64Flag{Name: "rtt", Value: 100, Usage: "round trip time of the link in ms"},
+			cli.Float64Flag{Name: "loss", Value: 1, Usage: "packet loss of the link in percent"},
+			cli.StringFlag{Name: "dir", Value: ".", Usage: "directory to write client.json and server.json to"},
+			cli.BoolFlag{Name: "force", Usage: "overwrite existing configs"},
+		},
+		Action: func(c *cli.Context) error {
+			checkError(runInit(c))
+			return nil
+		},
+	}
+}
+
+// runInit writes the configs for initCommand
+func runInit(c *cli.Context) error {
+	values := map[string]string{}
+	for _, name := range []string{"localaddr", "remoteaddr", "listen", "target", "bandwidth", "rtt", "loss", "dir"} {
+		values[name] = c.String(name)
+		if name == "bandwidth" || name == "rtt" || name == "loss" {
+			values[name] = strconv.FormatFloat(c.Float64(name), 'f', -1, 64)
+		}
+	}
+	if c.NumFlags() == 0 {
+		in := bufio.NewReader(os.Stdin)
+		for _, q := range []struct{ name, question string }{
+			{"remoteaddr", "server address the client dials"},
+			{"localaddr", "client listen address"},
+			{"listen", "server listen address"},
+			{"target", "server target address"},
+			{"bandwidth", "bandwidth of the link in Mbps"},
+			{"rtt", "round trip time of the link in ms"},
+			{"loss", "packet loss of the link in percent"},
+			{"dir", "directory to write the configs to"},
+		} {
+			answer, err := ask(in, q.question, values[q.name])
+			if err != nil {
+				return err
+			}
+			values[q.name] = answer
+		}
+	}
+
+	var l link
+	for name, v := range map[string]*float64{"bandwidth": &l.bandwidth, "rtt": &l.rtt, "loss": &l.loss} {
+		f, err := strconv.ParseFloat(values[name], 64)
+		if err != nil || f < 0 || (name != "loss" && f == 0) || (name == "loss" && f >= 100) {
+			return errors.Errorf("invalid %v: %v", name, values[name])
+		}
+		*v = f
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return errors.WithStack(err)
+	}
+
+	common, wnd := l.common(base64.StdEncoding.EncodeToString(key))
+	// downloads are sized to the link, uploads to half of it
+	client := initClient{values["localaddr"], values["remoteaddr"], common, halfWnd(wnd), wnd}
+	server := initServer{values["listen"], values["target"], common, wnd, halfWnd(wnd)}
+	for _, out := range []struct {
+		name   string
+		config interface{}
+	}{{"client.json", client}, {"server.json", server}} {
+		path := filepath.Join(values["dir"], out.name)
+		if err := writeConfig(path, out.config, c.Bool("force")); err != nil {
+			return err
+		}
+		fmt.Println("written:", path)
+	}
+	fmt.Printf("mode: %v datashard: %v parityshard: %v wnd: %v sockbuf: %v\n",
+		common.Mode, common.DataShard, common.ParityShard, wnd, common.SockBuf)
+	return nil
+}
+
+// common returns the shared settings for the link and the window its bandwidth-delay
+// product needs, twice over for the retransmissions
+func (l link) common(key string) (initCommon, int) {
+	bdp := l.bandwidth * 1e6 / 8 * l.rtt / 1000
+	wnd := nextPow2(int(math.Ceil(2 * bdp / float64(initMTU-kcp.IKCP_OVERHEAD))))
+	if wnd < initMinWnd {
+		wnd = initMinWnd
+	}
+	if wnd > initMaxWnd {
+		wnd = initMaxWnd
+	}
+	buf := nextPow2(int(2 * bdp))
+	if buf < initMinBuf {
+		buf = initMinBuf
+	}
+	if buf > initMaxBuf {
+		buf = initMaxBuf
+	}
+
+	// more aggressive retransmissions on lossier links
+	mode := "fast"
+	switch {
+	case l.loss >= 2:
+		mode = "fast3"
+	case l.loss >= 0.5:
+		mode = "fast2"
+	}
+	// parity shards against twice the loss, and one more
+	const dataShard = 10
+	parityShard := int(math.Ceil(2*l.loss/100*dataShard)) + 1
+	if parityShard > dataShard {
+		parityShard = dataShard
+	}
+
+	return initCommon{
+		Key:         key,
+		Crypt:       "aes",
+		Mode:        mode,
+		MTU:         initMTU,
+		DataShard:   dataShard,
+		ParityShard: parityShard,
+		SockBuf:     buf,
+		SmuxVer:     2,
+		SmuxBuf:     buf,
+		StreamBuf:   buf / 2,
+	}, wnd
+}
+
+// halfWnd returns half of wnd, not below the smallest window
+func halfWnd(wnd int) int {
+	if wnd/2 < initMinWnd {
+		return initMinWnd
+	}
+	return wnd / 2
+}
+
+// nextPow2 returns the smallest power of 2 not below n
+func nextPow2(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// ask prints question with the default answer def, and returns the line typed, or def
+// if it's empty or the input has ended
+func ask(in *bufio.Reader, question, def string) (string, error) {
+	fmt.Printf("%v [%v]: ", question, def)
+	line, err := in.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", errors.WithStack(err)
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line, nil
+	}
+	return def, nil
+}
+
+// writeConfig writes config as indented json to path, readable by the owner only as
+// it holds the key, an existing file is only replaced if force is set
+func writeConfig(path string, config interface{}, force bool) error {
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Close())
+}
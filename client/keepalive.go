@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// the search stops once the interval is known this close, or to a tenth
+	autoKeepAliveStep = 5
+	// how often the interval found is checked to still hold
+	autoKeepAliveRecheck = time.Hour
+	// pause after a probe failed to dial
+	autoKeepAliveRetry = 10 * time.Second
+)
+
+// natProbe reports whether a session of its own to remote survives with the client
+// silent for interval seconds between keepalives. If the nat drops the mapping in the
+// silence, the server's keepalives are lost on the way and the client's next one comes
+// from a new mapping, so the session hears nothing more and smux closes it.
+func (t *tuner) natProbe(remote string, interval int) (bool, error) {
+	cfg, block := t.transport()
+	cfg.WS = "" // the nat of the udp path is probed
+	cfg.KeepAliveTimeout += interval - cfg.KeepAlive
+	cfg.KeepAlive = interval
+	kcpconn, session, err := t.dialMux(remote, &cfg, block)
+	if err != nil {
+		return false, err
+	}
+	defer kcpconn.Close()
+	defer session.Close()
+
+	// smux closes the session at the second check of its timeout without a frame heard
+	time.Sleep(2*time.Duration(cfg.KeepAliveTimeout)*time.Second + probeTimeout)
+	return !session.IsClosed(), nil
+}
+
+// autoKeepAlive searches between the configured keepalive lo and hi seconds for the
+// longest silence a session survives, and has new sessions keep alive at 4/5 of it.
+// The search starts over from lo when that stops holding.
+func (t *tuner) autoKeepAlive(lo, hi int) {
+	for {
+		good, bad := lo, hi+1
+		for bad-good > autoKeepAliveStep && bad-good > good/10 {
+			interval := (good + bad) / 2
+			ok, err := t.natProbe(t.servers().current(), interval)
+			if err != nil {
+				log.Println("autokeepalive:", err)
+				time.Sleep(autoKeepAliveRetry)
+				continue
+			}
+			log.Println("autokeepalive: silence of", interval, "seconds survived:", ok)
+			if ok {
+				good = interval
+			} else {
+				bad = interval
+			}
+		}
+
+		keepalive := good * 4 / 5
+		if keepalive < lo {
+			keepalive = lo
+		}
+		t.setKeepAlive(keepalive)
+		log.Println("autokeepalive: keepalive of new sessions:", keepalive)
+
+		for {
+			time.Sleep(autoKeepAliveRecheck)
+			if ok, err := t.natProbe(t.servers().current(), good); err == nil && !ok {
+				break
+			}
+		}
+		log.Println("autokeepalive: silence of", good, "seconds no longer survived, searching again")
+		t.setKeepAlive(lo)
+	}
+}
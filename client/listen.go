@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// unixPrefix marks a local address as a unix domain socket path, like unix:/run/kcptun.sock
+const unixPrefix = "unix:"
+
+// listen listens on a tcp address, or on a unix domain socket prefixed by unix:, or
+// takes over a socket passed by systemd prefixed by systemd:
+func listen(addr string) (net.Listener, error) {
+	if generic.IsSystemd(addr) {
+		return generic.SystemdListener(addr)
+	}
+	if strings.HasPrefix(addr, unixPrefix) {
+		path := strings.TrimPrefix(addr, unixPrefix)
+		// remove the socket left by a previous run
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		return l, errors.WithStack(err)
+	}
+
+	tcpaddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	l, err := net.ListenTCP("tcp", tcpaddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return l, nil
+}
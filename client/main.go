@@ -1,22 +1,14 @@
 package main
 
 import (
-	"crypto/sha1"
-	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net"
 	"os"
-    "bufio"
-    "strings"
-    "strconv"
-    "syscall"
     "sync"
 	"time"
 
-	"golang.org/x/crypto/pbkdf2"
-
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	kcp "github.com/xtaci/kcp-go/v5"
@@ -25,51 +17,166 @@ import (
 )
 
 const (
-	// SALT is use for pbkdf2 key expansion
+	// SALT is the default salt for key derivation
 	SALT = "kcp-go"
 	// maximum supported smux version
 	maxSmuxVer = 2
-	// stream copy buffer size
-	bufSize = 4096
+	// share of autoexpire a session's lifetime varies by either way
+	autoExpireJitter = 0.1
+	// how long a spare session of maxstreams lingers without streams
+	spareIdle = 30 * time.Second
+	// share of the reconnect delay it varies by either way
+	backoffJitter = 0.2
+	// exit code when maxretries dials in a row failed
+	exitUnreachable = 3
 )
 
 // VERSION is injected by buildflags
 //var VERSION = "SELFBUILD"
 var VERSION = "KOOLCABUILD"
 
+// bandwidth limits the streams relayed
+var bandwidth = generic.NewBandwidth()
+
+// familyFlags are the flags setting family
+var familyFlags = map[string]string{"4": "family", "6": "family", "dualstack": "family"}
+
 // handleClient aggregates connection p1 on mux with 'writeLock'
-func handleClient(session *smux.Session, p1 net.Conn, quiet bool) {
-	logln := func(v ...interface{}) {
+func handleClient(session generic.Mux, p1 net.Conn, quiet bool) {
+	span := generic.StartSpan("stream", nil, "peer", p1.RemoteAddr())
+	defer span.End()
+
+	open := generic.StartSpan("stream open", span)
+	p2, err := session.OpenStream()
+	open.SetError(err)
+	open.End()
+	if err != nil {
+		span.SetError(err)
 		if !quiet {
-			log.Println(v...)
+			log.Println(err)
 		}
+		p1.Close()
+		return
 	}
-	defer p1.Close()
-	p2, err := session.OpenStream()
+	relay(p1, p2, span, quiet)
+}
+
+// openStream opens a stream announcing its destination to a server running in dynamic mode,
+// and waits for the server to dial it, traced as a child of span
+func openStream(session generic.Mux, hdr *generic.StreamHeader, span *generic.Span) (p2 generic.Stream, err error) {
+	open := generic.StartSpan("stream open", span, "target", hdr.Addr)
+	defer func() {
+		open.SetError(err)
+		open.End()
+		span.SetError(err)
+	}()
+
+	p2, err = session.OpenStream()
 	if err != nil {
-		logln(err)
-		return
+		return nil, err
+	}
+	if err := generic.WriteHeader(p2, hdr); err != nil {
+		p2.Close()
+		return nil, err
+	}
+	if err := generic.ReadStatus(p2); err != nil {
+		p2.Close()
+		return nil, err
 	}
+	return p2, nil
+}
+
+// sourceOf is the address p1 was accepted from as announced to the server, none for
+// unix domain sockets
+func sourceOf(p1 net.Conn) string {
+	if addr, ok := p1.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.String()
+	}
+	return ""
+}
 
+// relay copies between connection p1 and stream p2 until either side closes, traced
+// as a child of span
+func relay(p1 net.Conn, p2 generic.Stream, span *generic.Span, quiet bool) {
+	logEvent := func(msg string, fields ...interface{}) {
+		if !quiet {
+			generic.LogEvent(msg, append([]interface{}{"in", p1.RemoteAddr(), "out", p2.RemoteAddr(), "stream", p2.ID()}, fields...)...)
+		}
+	}
+	defer p1.Close()
 	defer p2.Close()
 
-	logln("stream opened", "in:", p1.RemoteAddr(), "out:", fmt.Sprint(p2.RemoteAddr(), "(", p2.ID(), ")"))
-	defer logln("stream closed", "in:", p1.RemoteAddr(), "out:", fmt.Sprint(p2.RemoteAddr(), "(", p2.ID(), ")"))
+	logEvent("stream opened")
+	start := time.Now()
+	copying := generic.StartSpan("copy", span, "stream", p2.ID())
 
 	// start tunnel & wait for tunnel termination
-	streamCopy := func(dst io.Writer, src io.ReadCloser) {
-		if _, err := generic.Copy(dst, src); err != nil {
+	streamCopy := func(dst io.Writer, src io.ReadCloser) int64 {
+		n, err := generic.Copy(dst, src)
+		if err != nil {
 			// report protocol error
 			if err == smux.ErrInvalidProtocol {
-				log.Println("smux", err, "in:", p1.RemoteAddr(), "out:", fmt.Sprint(p2.RemoteAddr(), "(", p2.ID(), ")"))
+				generic.LogEvent("smux error", "error", err, "in", p1.RemoteAddr(), "out", p2.RemoteAddr(), "stream", p2.ID())
 			}
 		}
 		p1.Close()
 		p2.Close()
+		return n
+	}
+
+	upWriter, downWriter := bandwidth.Limit(p2, p1)
+	chDown := make(chan int64, 1)
+	go func() { chDown <- streamCopy(downWriter, p2) }()
+	up := streamCopy(upWriter, p1)
+	down := <-chDown
+
+	duration := time.Since(start)
+	generic.RecordStream(up, down, duration)
+	copying.SetAttr("up", up, "down", down)
+	copying.End()
+	logEvent("stream closed", "up", up, "down", down, "duration", duration.Round(time.Millisecond))
+}
+
+// deriveKey expands the pre-shared secret to the key for block ciphers
+func deriveKey(config *Config) ([]byte, error) {
+	return generic.DeriveKey(config.KDF, config.Key, config.Salt, config.KDFIter, config.KDFMem)
+}
+
+// newBlockCrypt creates the packet cipher of config, rekeyed periodically and
+// guarded against replays if enabled
+func newBlockCrypt(config *Config, pass []byte) kcp.BlockCrypt {
+	block, crypt := generic.NewBlockCrypt(config.Crypt, pass)
+	config.Crypt = crypt
+	if block != nil && config.Rekey > 0 {
+		block = generic.NewRekeyBlockCrypt(crypt, pass, time.Duration(config.Rekey)*time.Second)
+	}
+	if block != nil && config.AntiReplay > 0 && !generic.IsAEAD(crypt) {
+		block = generic.NewReplayBlockCrypt(block, time.Duration(config.AntiReplay)*time.Second)
+	}
+	return block
+}
+
+// connKey moves the kcp session conn to a key of its own with connkey, the side which
+// dialed it initiates
+func connKey(conn *kcp.UDPSession, config *Config, psk []byte, initiator bool) error {
+	if !config.ConnKey {
+		return nil
 	}
+	cfg := *config
+	return generic.ConnKeyExchange(conn, psk, func(key []byte) kcp.BlockCrypt {
+		return newBlockCrypt(&cfg, key)
+	}, initiator)
+}
 
-	go streamCopy(p1, p2)
-	streamCopy(p2, p1)
+// newSmuxConfig creates the smux config for new sessions
+func newSmuxConfig(config *Config) *smux.Config {
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = config.SmuxVer
+	smuxConfig.MaxReceiveBuffer = config.SmuxBuf
+	smuxConfig.MaxStreamBuffer = config.StreamBuf
+	smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
+	smuxConfig.KeepAliveTimeout = time.Duration(config.KeepAliveTimeout) * time.Second
+	return smuxConfig
 }
 
 func checkError(err error) {
@@ -80,8 +187,11 @@ func checkError(err error) {
 }
 
 type timedSession struct {
-	session    *smux.Session
+	session    generic.Mux
+	conn       *kcp.UDPSession // for the rtt of leastloaded, nil over tcp
 	expiryDate time.Time
+	remote     string
+	dialing    chan struct{} // closed once the session being dialed for the slot is in
 }
 
 func main() {
@@ -97,14 +207,49 @@ func main() {
 	myApp.Version = VERSION
 	myApp.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "localaddr,l",
-			Value: ":12948",
-			Usage: "local listen address",
+			Name:   "localaddr,l",
+			Value:  ":12948",
+			Usage:  "local listen address, or unix:path/to/unix_socket, or systemd:[name] for a socket passed by systemd",
+			EnvVar: "KCPTUN_LOCALADDR",
+		},
+		cli.StringFlag{
+			Name:   "remoteaddr, r",
+			Value:  "vps:29900",
+			Usage:  "kcp server address, or a comma separated list of addresses to fail over between, a port range like vps:4000-5000 hops between its ports",
+			EnvVar: "KCPTUN_REMOTEADDR",
+		},
+		cli.BoolFlag{
+			Name:   "4",
+			Usage:  "dial the ipv4 address of the server only",
+			EnvVar: "KCPTUN_4",
+		},
+		cli.BoolFlag{
+			Name:   "6",
+			Usage:  "dial the ipv6 address of the server only",
+			EnvVar: "KCPTUN_6",
+		},
+		cli.BoolFlag{
+			Name:   "dualstack",
+			Usage:  "probe the ipv6 and ipv4 address of the server and dial the one answering first",
+			EnvVar: "KCPTUN_DUALSTACK",
 		},
 		cli.StringFlag{
-			Name:  "remoteaddr, r",
-			Value: "vps:29900",
-			Usage: "kcp server address",
+			Name:   "bindaddr",
+			Value:  "",
+			Usage:  "local ip to send to the server from, to pick the uplink of a multihomed host",
+			EnvVar: "KCPTUN_BINDADDR",
+		},
+		cli.StringFlag{
+			Name:   "bindiface",
+			Value:  "",
+			Usage:  "interface to send to the server through whatever the routes say, with SO_BINDTODEVICE (linux), needs root or CAP_NET_RAW",
+			EnvVar: "KCPTUN_BINDIFACE",
+		},
+		cli.IntFlag{
+			Name:   "hopinterval",
+			Value:  60,
+			Usage:  "seconds between switching to another port of the remoteaddr port range",
+			EnvVar: "KCPTUN_HOPINTERVAL",
 		},
 		cli.StringFlag{
 			Name:   "key",
@@ -113,410 +258,1427 @@ func main() {
 			EnvVar: "KCPTUN_KEY",
 		},
 		cli.StringFlag{
-			Name:  "crypt",
-			Value: "aes",
-			Usage: "aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none, null",
+			Name:   "keyfile",
+			Value:  "",
+			Usage:  "read the pre-shared secret from this file instead of key, - for stdin, fd:N for file descriptor N",
+			EnvVar: "KCPTUN_KEYFILE",
+		},
+		cli.StringFlag{
+			Name:   "crypt",
+			Value:  "aes",
+			Usage:  "aes, aes-128, aes-192, aes-gcm, aes-gcm-siv, chacha20-poly1305, xchacha20, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none, null",
+			EnvVar: "KCPTUN_CRYPT",
+		},
+		cli.StringFlag{
+			Name:   "kdf",
+			Value:  "pbkdf2",
+			Usage:  "key derivation function: pbkdf2, argon2id",
+			EnvVar: "KCPTUN_KDF",
+		},
+		cli.StringFlag{
+			Name:   "salt",
+			Value:  SALT,
+			Usage:  "salt for key derivation",
+			EnvVar: "KCPTUN_SALT",
+		},
+		cli.IntFlag{
+			Name:   "kdfiter",
+			Value:  0,
+			Usage:  "iterations of pbkdf2 or passes of argon2id, 0 for the defaults 4096 and 3",
+			EnvVar: "KCPTUN_KDFITER",
+		},
+		cli.IntFlag{
+			Name:   "kdfmem",
+			Value:  65536,
+			Usage:  "memory cost of argon2id in KiB",
+			EnvVar: "KCPTUN_KDFMEM",
+		},
+		cli.IntFlag{
+			Name:   "rekey",
+			Value:  0,
+			Usage:  "derive a fresh sub-key from the key every N seconds, needs clocks in sync, 0 to disable",
+			EnvVar: "KCPTUN_REKEY",
+		},
+		cli.IntFlag{
+			Name:   "antireplay",
+			Value:  0,
+			Usage:  "drop packets older than N seconds or seen before, needs clocks in sync and a non-aead cipher, remembers about a million packets per 2N seconds, 0 to disable",
+			EnvVar: "KCPTUN_ANTIREPLAY",
+		},
+		cli.IntFlag{
+			Name:   "token",
+			Value:  0,
+			Usage:  "prefix the first packets to a peer with a token of the key and the client ip valid for N seconds, and drop the packets of peers without one before decrypting them, needs clocks in sync, 0 to disable",
+			EnvVar: "KCPTUN_TOKEN",
+		},
+		cli.BoolFlag{
+			Name:   "migrate",
+			Usage:  "prefix packets with an id of the session so that it survives a change of the local address, the server needs migrate too",
+			EnvVar: "KCPTUN_MIGRATE",
+		},
+		cli.BoolFlag{
+			Name:   "keyexchange",
+			Usage:  "encrypt each session with a key of its own from an ecdh exchange authenticated by the key, for forward secrecy",
+			EnvVar: "KCPTUN_KEYEXCHANGE",
+		},
+		cli.BoolFlag{
+			Name:   "pqkeyexchange",
+			Usage:  "with keyexchange, exchange the keys on x25519 and ml-kem-768 together, against quantum computers decrypting recorded traffic later",
+			EnvVar: "KCPTUN_PQKEYEXCHANGE",
+		},
+		cli.BoolFlag{
+			Name:   "connkey",
+			Usage:  "encrypt the packets of each kcp connection with a key of its own, derived from nonces exchanged by both sides",
+			EnvVar: "KCPTUN_CONNKEY",
+		},
+		cli.StringFlag{
+			Name:   "cert",
+			Value:  "",
+			Usage:  "certificate file presented to the peer in a tls handshake on each session, requires certkey and ca",
+			EnvVar: "KCPTUN_CERT",
+		},
+		cli.StringFlag{
+			Name:   "certkey",
+			Value:  "",
+			Usage:  "private key file of cert",
+			EnvVar: "KCPTUN_CERTKEY",
+		},
+		cli.StringFlag{
+			Name:   "ca",
+			Value:  "",
+			Usage:  "ca file the certificate of the peer must be signed by, sessions without one are rejected",
+			EnvVar: "KCPTUN_CA",
+		},
+		cli.StringFlag{
+			Name:   "mode",
+			Value:  "fast",
+			Usage:  "profiles: fast3, fast2, fast, normal, manual, or auto to switch between the first four by the loss and rtt",
+			EnvVar: "KCPTUN_MODE",
+		},
+		cli.IntFlag{
+			Name:   "conn",
+			Value:  1,
+			Usage:  "set num of UDP connections to server",
+			EnvVar: "KCPTUN_CONN",
+		},
+		cli.StringFlag{
+			Name:   "sched",
+			Value:  schedRR,
+			Usage:  "how new streams are spread over the conn sessions, rr for round robin or leastloaded for the fewest streams and lowest rtt, sessions failing to open streams last",
+			EnvVar: "KCPTUN_SCHED",
+		},
+		cli.StringFlag{
+			Name:   "connweights",
+			Value:  "",
+			Usage:  "weights of the conn sessions for sched like 3,1,1, a session not listed weighs 1",
+			EnvVar: "KCPTUN_CONNWEIGHTS",
+		},
+		cli.BoolFlag{
+			Name:   "spread",
+			Usage:  "dial the conn sessions to the servers of remoteaddr in turn, each failing over on its own, instead of all to the same one",
+			EnvVar: "KCPTUN_SPREAD",
+		},
+		cli.IntFlag{
+			Name:   "backoff",
+			Value:  30,
+			Usage:  "the longest wait in seconds between re-dials of an unreachable server, doubling from 1 with some jitter, 1 for re-dialing every second",
+			EnvVar: "KCPTUN_BACKOFF",
+		},
+		cli.IntFlag{
+			Name:   "maxretries",
+			Value:  0,
+			Usage:  "exit with code 3 once that many dials of a session failed in a row, for a supervisor to take over, 0 to wait indefinitely",
+			EnvVar: "KCPTUN_MAXRETRIES",
+		},
+		cli.BoolFlag{
+			Name:   "standby",
+			Usage:  "keep a spare session dialed and alive by its keepalives, taking over at once from a session that dies or expires",
+			EnvVar: "KCPTUN_STANDBY",
+		},
+		cli.IntFlag{
+			Name:   "maxstreams",
+			Value:  0,
+			Usage:  "open a spare connection once all of them carry this many streams, closed when they have room again, 0 is unlimited",
+			EnvVar: "KCPTUN_MAXSTREAMS",
+		},
+		cli.IntFlag{
+			Name:   "probe",
+			Value:  0,
+			Usage:  "probe rtt and loss of every remote server every N seconds and prefer the best one for new sessions, 0 to disable",
+			EnvVar: "KCPTUN_PROBE",
+		},
+		cli.IntFlag{
+			Name:   "monitor",
+			Value:  0,
+			Usage:  "probe the current server every N seconds with or without traffic, and log the rtt, jitter, loss and retransmissions, 0 to disable",
+			EnvVar: "KCPTUN_MONITOR",
+		},
+		cli.StringFlag{
+			Name:   "stun",
+			Value:  "",
+			Usage:  "stun servers to learn the nat type and public address from at start and with check, comma separated, two or more to tell a symmetric nat",
+			EnvVar: "KCPTUN_STUN",
+		},
+		cli.IntFlag{
+			Name:   "resolve",
+			Value:  0,
+			Usage:  "re-resolve the remote hostnames every N seconds and re-dial the sessions when their address changed, 0 to disable",
+			EnvVar: "KCPTUN_RESOLVE",
+		},
+		cli.IntFlag{
+			Name:   "autoexpire",
+			Value:  0,
+			Usage:  "set auto expiration time(in seconds) for a single UDP connection, 0 to disable",
+			EnvVar: "KCPTUN_AUTOEXPIRE",
+		},
+		cli.IntFlag{
+			Name:   "scavengettl",
+			Value:  600,
+			Usage:  "set how long an expired connection can live (in seconds)",
+			EnvVar: "KCPTUN_SCAVENGETTL",
+		},
+		cli.BoolFlag{
+			Name:   "scavengeidle",
+			Usage:  "close an expired connection once its streams are done, scavengettl still being the longest it lives",
+			EnvVar: "KCPTUN_SCAVENGEIDLE",
+		},
+		cli.IntFlag{
+			Name:   "mtu",
+			Value:  1350,
+			Usage:  "set maximum transmission unit for UDP packets",
+			EnvVar: "KCPTUN_MTU",
+		},
+		cli.IntFlag{
+			Name:   "sndwnd",
+			Value:  128,
+			Usage:  "set send window size(num of packets)",
+			EnvVar: "KCPTUN_SNDWND",
+		},
+		cli.IntFlag{
+			Name:   "rcvwnd",
+			Value:  512,
+			Usage:  "set receive window size(num of packets)",
+			EnvVar: "KCPTUN_RCVWND",
 		},
 		cli.StringFlag{
-			Name:  "mode",
-			Value: "fast",
-			Usage: "profiles: fast3, fast2, fast, normal, manual",
+			Name:   "wnd",
+			Value:  "",
+			Usage:  "auto to size the windows of each session to its bandwidth-delay product, with sndwnd and rcvwnd the least",
+			EnvVar: "KCPTUN_WND",
 		},
 		cli.IntFlag{
-			Name:  "conn",
-			Value: 1,
-			Usage: "set num of UDP connections to server",
+			Name:   "maxwnd",
+			Value:  8192,
+			Usage:  "the largest window(num of packets) of -wnd auto",
+			EnvVar: "KCPTUN_MAXWND",
 		},
 		cli.IntFlag{
-			Name:  "autoexpire",
-			Value: 0,
-			Usage: "set auto expiration time(in seconds) for a single UDP connection, 0 to disable",
+			Name:   "datashard,ds",
+			Value:  10,
+			Usage:  "set reed-solomon erasure coding - datashard",
+			EnvVar: "KCPTUN_DATASHARD",
 		},
 		cli.IntFlag{
-			Name:  "scavengettl",
-			Value: 600,
-			Usage: "set how long an expired connection can live (in seconds)",
+			Name:   "parityshard,ps",
+			Value:  3,
+			Usage:  "set reed-solomon erasure coding - parityshard",
+			EnvVar: "KCPTUN_PARITYSHARD",
+		},
+		cli.BoolFlag{
+			Name:   "autofec",
+			Usage:  "adjust parityshard to the packet loss observed, between minparity and maxparity",
+			EnvVar: "KCPTUN_AUTOFEC",
 		},
 		cli.IntFlag{
-			Name:  "mtu",
-			Value: 1350,
-			Usage: "set maximum transmission unit for UDP packets",
+			Name:   "minparity",
+			Value:  1,
+			Usage:  "the fewest parity shards autofec lowers to",
+			EnvVar: "KCPTUN_MINPARITY",
 		},
 		cli.IntFlag{
-			Name:  "sndwnd",
-			Value: 128,
-			Usage: "set send window size(num of packets)",
+			Name:   "maxparity",
+			Value:  10,
+			Usage:  "the most parity shards autofec raises to",
+			EnvVar: "KCPTUN_MAXPARITY",
 		},
 		cli.IntFlag{
-			Name:  "rcvwnd",
-			Value: 512,
-			Usage: "set receive window size(num of packets)",
+			Name:   "dscp",
+			Value:  0,
+			Usage:  "set DSCP(6bit)",
+			EnvVar: "KCPTUN_DSCP",
 		},
 		cli.IntFlag{
-			Name:  "datashard,ds",
-			Value: 10,
-			Usage: "set reed-solomon erasure coding - datashard",
+			Name:   "fwmark",
+			Value:  0,
+			Usage:  "set SO_MARK on the udp sockets for policy routing and firewall rules (linux), needs root or CAP_NET_ADMIN, 0 to disable",
+			EnvVar: "KCPTUN_FWMARK",
+		},
+		cli.StringFlag{
+			Name:   "comp",
+			Value:  "snappy",
+			Usage:  "compression of the sessions dialed: snappy, deflate, lz4, zstd or none",
+			EnvVar: "KCPTUN_COMP",
 		},
 		cli.IntFlag{
-			Name:  "parityshard,ps",
-			Value: 3,
-			Usage: "set reed-solomon erasure coding - parityshard",
+			Name:   "complevel",
+			Value:  0,
+			Usage:  "deflate or zstd compression level 1-9, 0 for the default",
+			EnvVar: "KCPTUN_COMPLEVEL",
 		},
 		cli.IntFlag{
-			Name:  "dscp",
-			Value: 0,
-			Usage: "set DSCP(6bit)",
+			Name:   "compthreshold",
+			Value:  0,
+			Usage:  "send writes shorter than this many bytes uncompressed, sparing small interactive packets the compression latency",
+			EnvVar: "KCPTUN_COMPTHRESHOLD",
+		},
+		cli.BoolFlag{
+			Name:   "compadaptive",
+			Usage:  "send streams uncompressed whose first 64KB didn't compress, like https or video",
+			EnvVar: "KCPTUN_COMPADAPTIVE",
 		},
 		cli.BoolFlag{
-			Name:  "nocomp",
-			Usage: "disable compression",
+			Name:   "nocomp",
+			Usage:  "disable compression, same as -comp none",
+			EnvVar: "KCPTUN_NOCOMP",
 		},
 		cli.BoolFlag{
 			Name:   "acknodelay",
 			Usage:  "flush ack immediately when a packet is received",
 			Hidden: true,
+			EnvVar: "KCPTUN_ACKNODELAY",
 		},
 		cli.IntFlag{
 			Name:   "nodelay",
 			Value:  0,
 			Hidden: true,
+			EnvVar: "KCPTUN_NODELAY",
 		},
 		cli.IntFlag{
 			Name:   "interval",
 			Value:  50,
 			Hidden: true,
+			EnvVar: "KCPTUN_INTERVAL",
 		},
 		cli.IntFlag{
 			Name:   "resend",
 			Value:  0,
 			Hidden: true,
+			EnvVar: "KCPTUN_RESEND",
 		},
 		cli.IntFlag{
 			Name:   "nc",
 			Value:  0,
 			Hidden: true,
+			EnvVar: "KCPTUN_NC",
 		},
 		cli.IntFlag{
-			Name:  "sockbuf",
-			Value: 4194304, // socket buffer size in bytes
-			Usage: "per-socket buffer in bytes",
+			Name:   "sockbuf",
+			Value:  4194304, // socket buffer size in bytes
+			Usage:  "per-socket buffer in bytes",
+			EnvVar: "KCPTUN_SOCKBUF",
+		},
+		cli.BoolFlag{
+			Name:   "nooffload",
+			Usage:  "disable udp segmentation and receive offload(linux)",
+			EnvVar: "KCPTUN_NOOFFLOAD",
 		},
 		cli.IntFlag{
-			Name:  "smuxver",
-			Value: 1,
-			Usage: "specify smux version, available 1,2",
+			Name:   "gomaxprocs",
+			Value:  0,
+			Usage:  "run goroutines on this many threads at once, 0 for the number of cpus",
+			EnvVar: "KCPTUN_GOMAXPROCS",
+		},
+		cli.StringFlag{
+			Name:   "cpus",
+			Value:  "",
+			Usage:  "pin the process to a list of cpus like 0-3,6(linux)",
+			EnvVar: "KCPTUN_CPUS",
 		},
 		cli.IntFlag{
-			Name:  "smuxbuf",
-			Value: 4194304,
-			Usage: "the overall de-mux buffer in bytes",
+			Name:   "smuxver",
+			Value:  1,
+			Usage:  "specify smux version, available 1,2",
+			EnvVar: "KCPTUN_SMUXVER",
+		},
+		cli.StringFlag{
+			Name:   "mux",
+			Value:  generic.MuxSmux,
+			Usage:  "stream multiplexer, smux, yamux or none for a kcp connection per tcp connection, yamux takes the keepalive and streambuf settings too",
+			EnvVar: "KCPTUN_MUX",
+		},
+		cli.IntFlag{
+			Name:   "smuxbuf",
+			Value:  4194304,
+			Usage:  "the overall de-mux buffer in bytes",
+			EnvVar: "KCPTUN_SMUXBUF",
+		},
+		cli.IntFlag{
+			Name:   "streambuf",
+			Value:  2097152,
+			Usage:  "per stream receive buffer in bytes, smux v2+",
+			EnvVar: "KCPTUN_STREAMBUF",
+		},
+		cli.IntFlag{
+			Name:   "copybuf",
+			Value:  generic.DefaultCopyBuffer,
+			Usage:  "buffer in bytes of each copy between a connection and a stream, pooled among streams",
+			EnvVar: "KCPTUN_COPYBUF",
+		},
+		cli.IntFlag{
+			Name:   "keepalive",
+			Value:  10, // nat keepalive interval in seconds
+			Usage:  "seconds between heartbeats",
+			EnvVar: "KCPTUN_KEEPALIVE",
+		},
+		cli.IntFlag{
+			Name:   "keepalivetimeout",
+			Value:  30,
+			Usage:  "seconds without hearing from the peer before a session is closed as dead",
+			EnvVar: "KCPTUN_KEEPALIVETIMEOUT",
 		},
 		cli.IntFlag{
-			Name:  "streambuf",
-			Value: 2097152,
-			Usage: "per stream receive buffer in bytes, smux v2+",
+			Name:   "autokeepalive",
+			Value:  0,
+			Usage:  "probe for the longest silence up to N seconds the nat keeps a session through, and stretch keepalive of new sessions to 4/5 of it, 0 to disable",
+			EnvVar: "KCPTUN_AUTOKEEPALIVE",
+		},
+		cli.StringFlag{
+			Name:   "onconnect",
+			Value:  "",
+			Usage:  "script run when the tunnel comes up or recovers, with the event in KCPTUN_ environment variables",
+			EnvVar: "KCPTUN_ONCONNECT",
+		},
+		cli.StringFlag{
+			Name:   "ondisconnect",
+			Value:  "",
+			Usage:  "script run when the tunnel goes down, its silent sessions closed or dialing failing with none open",
+			EnvVar: "KCPTUN_ONDISCONNECT",
+		},
+		cli.StringFlag{
+			Name:   "ondegraded",
+			Value:  "",
+			Usage:  "script run when the sessions hear nothing from the server for half of keepalivetimeout",
+			EnvVar: "KCPTUN_ONDEGRADED",
+		},
+		cli.StringFlag{
+			Name:   "webhook",
+			Value:  "",
+			Usage:  "post a json event to this url when the rtt, loss or reconnects of a minute cross their thresholds, and once they are back below",
+			EnvVar: "KCPTUN_WEBHOOK",
+		},
+		cli.IntFlag{
+			Name:   "webhookrtt",
+			Value:  0,
+			Usage:  "rtt in ms of the sessions at which the webhook is posted, 0 to disable",
+			EnvVar: "KCPTUN_WEBHOOKRTT",
 		},
 		cli.IntFlag{
-			Name:  "keepalive",
-			Value: 10, // nat keepalive interval in seconds
-			Usage: "seconds between heartbeats",
+			Name:   "webhookloss",
+			Value:  0,
+			Usage:  "loss in percent at which the webhook is posted, 0 to disable",
+			EnvVar: "KCPTUN_WEBHOOKLOSS",
+		},
+		cli.IntFlag{
+			Name:   "webhookreconnects",
+			Value:  0,
+			Usage:  "reconnects in a minute at which the webhook is posted, 0 to disable",
+			EnvVar: "KCPTUN_WEBHOOKRECONNECTS",
+		},
+		cli.StringFlag{
+			Name:   "snmplog",
+			Value:  "",
+			Usage:  "collect snmp to file, aware of timeformat in golang, like: ./snmp-20060102.log",
+			EnvVar: "KCPTUN_SNMPLOG",
+		},
+		cli.IntFlag{
+			Name:   "snmpperiod",
+			Value:  60,
+			Usage:  "snmp collect period, in seconds",
+			EnvVar: "KCPTUN_SNMPPERIOD",
+		},
+		cli.StringFlag{
+			Name:   "snmpformat",
+			Value:  "csv",
+			Usage:  "snmp log format, csv with a header row or json lines",
+			EnvVar: "KCPTUN_SNMPFORMAT",
+		},
+		cli.BoolFlag{
+			Name:   "snmpreset",
+			Usage:  "reset the snmp counters after each period, to log deltas instead of totals",
+			EnvVar: "KCPTUN_SNMPRESET",
+		},
+		cli.StringFlag{
+			Name:   "log",
+			Value:  "",
+			Usage:  "specify a log file to output, default goes to stderr",
+			EnvVar: "KCPTUN_LOG",
+		},
+		cli.StringFlag{
+			Name:   "logformat",
+			Value:  "text",
+			Usage:  "text, or json for one object per line with fields of stream, reconnect and scavenger events",
+			EnvVar: "KCPTUN_LOGFORMAT",
+		},
+		cli.StringFlag{
+			Name:   "fifo",
+			Value:  "",
+			Usage:  "specify a fifo file",
+			EnvVar: "KCPTUN_FIFO",
+		},
+		cli.StringFlag{
+			Name:   "controlsock",
+			Value:  "",
+			Usage:  "serve newline delimited json control requests on this unix socket, like: /var/run/kcptun-client.sock",
+			EnvVar: "KCPTUN_CONTROLSOCK",
+		},
+		cli.StringFlag{
+			Name:   "metricsaddr",
+			Value:  "",
+			Usage:  "serve prometheus metrics at /metrics on this address, like: 127.0.0.1:12950",
+			EnvVar: "KCPTUN_METRICSADDR",
+		},
+		cli.StringFlag{
+			Name:   "otlp",
+			Value:  "",
+			Usage:  "export traces of streams and connects to this OTLP/HTTP collector, like: http://127.0.0.1:4318",
+			EnvVar: "KCPTUN_OTLP",
+		},
+		cli.StringFlag{
+			Name:   "controladdr",
+			Value:  "",
+			Usage:  "serve the http control api for runtime tuning on this address, like: 127.0.0.1:12949",
+			EnvVar: "KCPTUN_CONTROLADDR",
+		},
+		cli.StringFlag{
+			Name:   "controltoken",
+			Value:  "",
+			Usage:  "require this bearer token on requests to the http control api, needed to serve it on a non-loopback address",
+			EnvVar: "KCPTUN_CONTROLTOKEN",
+		},
+		cli.BoolFlag{
+			Name:   "quiet",
+			Usage:  "to suppress the 'stream open/close' messages",
+			EnvVar: "KCPTUN_QUIET",
+		},
+		cli.BoolFlag{
+			Name:   "tcp",
+			Usage:  "to emulate a TCP connection(linux)",
+			EnvVar: "KCPTUN_TCP",
+		},
+		cli.BoolFlag{
+			Name:   "icmp",
+			Usage:  "carry the packets in icmp echo requests, experimental, needs root and a server with -icmp",
+			EnvVar: "KCPTUN_ICMP",
+		},
+		cli.StringFlag{
+			Name:   "proxy",
+			Value:  "",
+			Usage:  "reach the server through an upstream proxy, socks5://[user:pass@]host:port with UDP ASSOCIATE or http://[user:pass@]host:port with CONNECT to a server started with -stream",
+			EnvVar: "KCPTUN_PROXY",
+		},
+		cli.StringFlag{
+			Name:   "ws",
+			Value:  "",
+			Usage:  "carry the kcp packets on a websocket to ws://host[:port]/path or wss://..., for networks blocking udp, the server must run with -ws",
+			EnvVar: "KCPTUN_WS",
+		},
+		cli.BoolFlag{
+			Name:   "wsfallback",
+			Usage:  "only use the websocket when the server doesn't answer over udp",
+			EnvVar: "KCPTUN_WSFALLBACK",
 		},
 		cli.StringFlag{
-			Name:  "snmplog",
-			Value: "",
-			Usage: "collect snmp to file, aware of timeformat in golang, like: ./snmp-20060102.log",
+			Name:   "transport",
+			Value:  "kcp",
+			Usage:  "kcp, tcp to run smux over an encrypted tcp connection to a server started with -transport tcp or both, auto to fall back to tcp when the server doesn't answer over udp",
+			EnvVar: "KCPTUN_TRANSPORT",
+		},
+		cli.BoolFlag{
+			Name:   "padding",
+			Usage:  "pad packets to random bucket sizes and inject dummy packets to blur their length signature",
+			EnvVar: "KCPTUN_PADDING",
+		},
+		cli.BoolFlag{
+			Name:   "socks5",
+			Usage:  "serve socks5 on localaddr, destinations are dialed by the server which must run with -dynamic",
+			EnvVar: "KCPTUN_SOCKS5",
+		},
+		cli.BoolFlag{
+			Name:   "httpproxy",
+			Usage:  "serve http proxy(CONNECT and absolute-URI requests) on localaddr, destinations are dialed by the server which must run with -dynamic",
+			EnvVar: "KCPTUN_HTTPPROXY",
+		},
+		cli.BoolFlag{
+			Name:   "reverse",
+			Usage:  "listen on remoteaddr for the server started with -reverse to dial in, instead of dialing it",
+			EnvVar: "KCPTUN_REVERSE",
+		},
+		cli.BoolFlag{
+			Name:   "p2p",
+			Usage:  "ask the rendezvous at remoteaddr for the address of the server started with -p2p and punch through to it, for servers behind NAT",
+			EnvVar: "KCPTUN_P2P",
+		},
+		cli.BoolFlag{
+			Name:   "tproxy",
+			Usage:  "accept connections diverted by iptables TPROXY or REDIRECT on localaddr and forward them to their original destination(linux), the server must run with -dynamic",
+			EnvVar: "KCPTUN_TPROXY",
+		},
+		cli.BoolFlag{
+			Name:   "proxyprotocol",
+			Usage:  "expect a PROXY protocol v1 or v2 header on the connections accepted, from a load balancer in front, and announce the source it tells of to the server",
+			EnvVar: "KCPTUN_PROXYPROTOCOL",
+		},
+		cli.BoolFlag{
+			Name:   "udp",
+			Usage:  "forward udp datagrams received on localaddr instead of tcp connections, the server must run with -udp too",
+			EnvVar: "KCPTUN_UDP",
 		},
 		cli.IntFlag{
-			Name:  "snmpperiod",
-			Value: 60,
-			Usage: "snmp collect period, in seconds",
+			Name:   "udptimeout",
+			Value:  60,
+			Usage:  "seconds before an idle udp peer is forgotten",
+			EnvVar: "KCPTUN_UDPTIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "tun",
+			Value:  "",
+			Usage:  "create this tun device and carry its IP packets to the one of a server with -tun and -dynamic instead of listening on localaddr (linux), needs root or CAP_NET_ADMIN",
+			EnvVar: "KCPTUN_TUN",
+		},
+		cli.StringFlag{
+			Name:   "tunaddr",
+			Value:  "",
+			Usage:  "IPv4 address and prefix to give the tun device, like 10.9.0.1/24, empty to leave it to ip addr",
+			EnvVar: "KCPTUN_TUNADDR",
+		},
+		cli.StringFlag{
+			Name:   "uplimit",
+			Value:  "",
+			Usage:  "limit the bandwidth of all streams from local peers to the server, like: 10mbit, 512kbit or 2mbps",
+			EnvVar: "KCPTUN_UPLIMIT",
 		},
 		cli.StringFlag{
-			Name:  "log",
-			Value: "",
-			Usage: "specify a log file to output, default goes to stderr",
+			Name:   "downlimit",
+			Value:  "",
+			Usage:  "limit the bandwidth of all streams in the other direction",
+			EnvVar: "KCPTUN_DOWNLIMIT",
+		},
+		cli.StringFlag{
+			Name:   "streamlimit",
+			Value:  "",
+			Usage:  "limit the bandwidth of each stream in either direction",
+			EnvVar: "KCPTUN_STREAMLIMIT",
+		},
+		cli.IntFlag{
+			Name:   "bench",
+			Value:  0,
+			Usage:  "upload and then download for this many seconds each through a server started with -dynamic, print the goodput, retransmissions and cpu usage and exit",
+			EnvVar: "KCPTUN_BENCH",
 		},
-        cli.StringFlag{
-            Name:  "fifo",
-            Value: "",
-            Usage: "specify a fifo file",
-        },
 		cli.BoolFlag{
-			Name:  "quiet",
-			Usage: "to suppress the 'stream open/close' messages",
+			Name:   "check",
+			Usage:  "probe the servers, echo a payload through a server started with -dynamic if socks5, httpproxy, tproxy or mappings are set, print the rtt and loss and exit, non-zero on failure",
+			EnvVar: "KCPTUN_CHECK",
 		},
 		cli.BoolFlag{
-			Name:  "tcp",
-			Usage: "to emulate a TCP connection(linux)",
+			Name:   "checkconfig",
+			Usage:  "check the flags and config without starting, print the problems found as json and exit, non-zero if any",
+			EnvVar: "KCPTUN_CHECKCONFIG",
+		},
+		cli.StringFlag{
+			Name:   "c",
+			Value:  "", // when the value is not empty, the config path must exists
+			Usage:  "config from json file, which will override the command from shell unless precedence is flags",
+			EnvVar: "KCPTUN_C",
+		},
+		cli.StringFlag{
+			Name:   "precedence",
+			Value:  "config",
+			Usage:  "config: the json config overrides the flags and environment variables, flags: they override the json config",
+			EnvVar: "KCPTUN_PRECEDENCE",
 		},
 		cli.StringFlag{
-			Name:  "c",
-			Value: "", // when the value is not empty, the config path must exists
-			Usage: "config from json file, which will override the command from shell",
+			Name:   "service",
+			Value:  "",
+			Usage:  "install: run as a windows service with the other flags, uninstall: remove the service, run: used by the service control manager",
+			EnvVar: "KCPTUN_SERVICE",
+		},
+		cli.StringFlag{
+			Name:   "servicename",
+			Value:  "kcptun",
+			Usage:  "name of the windows service",
+			EnvVar: "KCPTUN_SERVICENAME",
 		},
 	}
+	myApp.Commands = []cli.Command{initCommand(), generic.BenchCryptoCommand()}
 	myApp.Action = func(c *cli.Context) error {
+		switch c.String("service") {
+		case "", "run":
+		case "install":
+			checkError(installService(c.String("servicename"), os.Args[1:]))
+			log.Println("service", c.String("servicename"), "installed")
+			return nil
+		case "uninstall":
+			checkError(uninstallService(c.String("servicename")))
+			log.Println("service", c.String("servicename"), "uninstalled")
+			return nil
+		default:
+			log.Fatal("unknown service:", c.String("service"))
+		}
+
 		config := Config{}
 		config.LocalAddr = c.String("localaddr")
 		config.RemoteAddr = c.String("remoteaddr")
+		config.HopInterval = c.Int("hopinterval")
+		switch {
+		case c.Bool("4"):
+			config.Family = "4"
+		case c.Bool("6"):
+			config.Family = "6"
+		case c.Bool("dualstack"):
+			config.Family = "dual"
+		}
+		config.BindAddr = c.String("bindaddr")
+		config.BindIface = c.String("bindiface")
 		config.Key = c.String("key")
+		config.KeyFile = c.String("keyfile")
 		config.Crypt = c.String("crypt")
+		config.KDF = c.String("kdf")
+		config.Salt = c.String("salt")
+		config.KDFIter = c.Int("kdfiter")
+		config.KDFMem = c.Int("kdfmem")
+		config.Rekey = c.Int("rekey")
+		config.AntiReplay = c.Int("antireplay")
+		config.Token = c.Int("token")
+		config.Migrate = c.Bool("migrate")
+		config.KeyExchange = c.Bool("keyexchange")
+		config.PQKeyExchange = c.Bool("pqkeyexchange")
+		config.ConnKey = c.Bool("connkey")
+		config.Cert = c.String("cert")
+		config.CertKey = c.String("certkey")
+		config.CA = c.String("ca")
 		config.Mode = c.String("mode")
 		config.Conn = c.Int("conn")
+		config.Sched = c.String("sched")
+		config.ConnWeights = c.String("connweights")
+		config.Spread = c.Bool("spread")
+		config.Backoff = c.Int("backoff")
+		config.MaxRetries = c.Int("maxretries")
+		config.Standby = c.Bool("standby")
+		config.MaxStreams = c.Int("maxstreams")
+		config.Probe = c.Int("probe")
+		config.Monitor = c.Int("monitor")
+		config.STUN = c.String("stun")
+		config.Resolve = c.Int("resolve")
 		config.AutoExpire = c.Int("autoexpire")
 		config.ScavengeTTL = c.Int("scavengettl")
+		config.ScavengeIdle = c.Bool("scavengeidle")
 		config.MTU = c.Int("mtu")
 		config.SndWnd = c.Int("sndwnd")
+		config.Wnd = c.String("wnd")
+		config.MaxWnd = c.Int("maxwnd")
 		config.RcvWnd = c.Int("rcvwnd")
 		config.DataShard = c.Int("datashard")
 		config.ParityShard = c.Int("parityshard")
+		config.AutoFEC = c.Bool("autofec")
+		config.MinParity = c.Int("minparity")
+		config.MaxParity = c.Int("maxparity")
 		config.DSCP = c.Int("dscp")
+		config.FwMark = c.Int("fwmark")
 		config.NoComp = c.Bool("nocomp")
+		config.Comp = c.String("comp")
+		config.CompLevel = c.Int("complevel")
+		config.CompThreshold = c.Int("compthreshold")
+		config.CompAdaptive = c.Bool("compadaptive")
 		config.AckNodelay = c.Bool("acknodelay")
 		config.NoDelay = c.Int("nodelay")
 		config.Interval = c.Int("interval")
 		config.Resend = c.Int("resend")
 		config.NoCongestion = c.Int("nc")
 		config.SockBuf = c.Int("sockbuf")
+		config.NoOffload = c.Bool("nooffload")
 		config.SmuxBuf = c.Int("smuxbuf")
 		config.StreamBuf = c.Int("streambuf")
+		config.CopyBuf = c.Int("copybuf")
+		config.GOMAXPROCS = c.Int("gomaxprocs")
+		config.CPUs = c.String("cpus")
 		config.SmuxVer = c.Int("smuxver")
+		config.Mux = c.String("mux")
 		config.KeepAlive = c.Int("keepalive")
+		config.KeepAliveTimeout = c.Int("keepalivetimeout")
+		config.AutoKeepAlive = c.Int("autokeepalive")
+		config.OnConnect = c.String("onconnect")
+		config.OnDisconnect = c.String("ondisconnect")
+		config.OnDegraded = c.String("ondegraded")
+		config.Webhook = c.String("webhook")
+		config.WebhookRTT = c.Int("webhookrtt")
+		config.WebhookLoss = c.Int("webhookloss")
+		config.WebhookReconnects = c.Int("webhookreconnects")
 		config.Log = c.String("log")
+		config.LogFormat = c.String("logformat")
         config.Fifo = c.String("fifo")
+		config.ControlAddr = c.String("controladdr")
+		config.ControlToken = c.String("controltoken")
+		config.ControlSock = c.String("controlsock")
+		config.MetricsAddr = c.String("metricsaddr")
+		config.OTLP = c.String("otlp")
 		config.SnmpLog = c.String("snmplog")
 		config.SnmpPeriod = c.Int("snmpperiod")
+		config.SnmpFormat = c.String("snmpformat")
+		config.SnmpReset = c.Bool("snmpreset")
 		config.Quiet = c.Bool("quiet")
 		config.TCP = c.Bool("tcp")
+		config.ICMP = c.Bool("icmp")
+		config.Padding = c.Bool("padding")
+		config.Proxy = c.String("proxy")
+		config.WS = c.String("ws")
+		config.WSFallback = c.Bool("wsfallback")
+		config.Transport = c.String("transport")
+		config.Socks5 = c.Bool("socks5")
+		config.HTTPProxy = c.Bool("httpproxy")
+		config.TProxy = c.Bool("tproxy")
+		config.ProxyProtocol = c.Bool("proxyprotocol")
+		config.Reverse = c.Bool("reverse")
+		config.P2P = c.Bool("p2p")
+		config.UDP = c.Bool("udp")
+		config.UDPTimeout = c.Int("udptimeout")
+		config.TUN = c.String("tun")
+		config.TUNAddr = c.String("tunaddr")
+		config.UpLimit = c.String("uplimit")
+		config.DownLimit = c.String("downlimit")
+		config.StreamLimit = c.String("streamlimit")
 
-		if c.String("c") != "" {
-			err := parseJSONConfig(&config, c.String("c"))
-			checkError(err)
+		base := config
+		precedence := c.String("precedence")
+		if precedence != generic.PrecedenceConfig && precedence != generic.PrecedenceFlags {
+			log.Fatal("unsupported precedence:", precedence)
 		}
+		shell := generic.ShellSources(c, familyFlags)
+		sources, err := generic.LoadConfig(&config, c.String("c"), precedence, shell)
+		checkError(err)
 
-		// log redirect
-		if config.Log != "" {
-			f, err := os.OpenFile(config.Log, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			checkError(err)
-			defer f.Close()
-			log.SetOutput(f)
+		if c.String("service") == "run" {
+			checkError(runService(c.String("servicename"), &config))
+		}
+
+		if nodelay, interval, resend, nc, ok := generic.ModeProfile(config.Mode); ok {
+			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = nodelay, interval, resend, nc
+		}
+		if config.NoComp {
+			config.Comp = "none"
 		}
 
-		switch config.Mode {
-		case "normal":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 40, 2, 1
-		case "fast":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 30, 2, 1
-		case "fast2":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 20, 2, 1
-		case "fast3":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 10, 2, 1
+		// report every problem of the config at once, without starting
+		if c.Bool("checkconfig") {
+			if !checkConfig(&config, true).Report(os.Stdout) {
+				os.Exit(1)
+			}
+			return nil
 		}
 
+		// log redirect
+		checkError(generic.SetLogFormat(config.LogFormat))
+		checkError(generic.SetLogOutput(config.Log))
+		checkError(generic.SetTraceExporter(config.OTLP, "kcptun-client"))
+
 		log.Println("version:", VERSION)
-		addr, err := net.ResolveTCPAddr("tcp", config.LocalAddr)
-		checkError(err)
-		listener, err := net.ListenTCP("tcp", addr)
-		checkError(err)
+		log.Println("precedence:", precedence, "sources:", sources)
+		// parameters check, before anything is listened on
+		problems := checkConfig(&config, false)
+		for _, w := range problems.Warnings() {
+			log.Println("warning:", w.Error)
+		}
+		if err := problems.Err(); err != nil {
+			log.Fatal(err)
+		}
+		check, benchSeconds := c.Bool("check"), c.Int("bench")
+		serve := !check && benchSeconds == 0
+		var listener net.Listener
+		var udpconn *net.UDPConn
+		var tunDev io.ReadWriteCloser
+		mappings := make([]net.Listener, len(config.Mappings))
+		// nothing is served while checking or benchmarking the servers
+		if serve {
+			if config.TUN != "" {
+				var err error
+				tunDev, err = generic.OpenTUN(config.TUN, config.TUNAddr)
+				checkError(err)
+			} else if config.UDP && generic.IsSystemd(config.LocalAddr) {
+				conn, err := generic.SystemdPacketConn(config.LocalAddr)
+				checkError(err)
+				var ok bool
+				if udpconn, ok = conn.(*net.UDPConn); !ok {
+					log.Fatal("not a udp socket:", config.LocalAddr)
+				}
+			} else if config.UDP {
+				addr, err := net.ResolveUDPAddr("udp", config.LocalAddr)
+				checkError(err)
+				udpconn, err = net.ListenUDP("udp", addr)
+				checkError(err)
+			} else if config.TProxy && !generic.IsSystemd(config.LocalAddr) {
+				l, err := listenTransparent(config.LocalAddr)
+				checkError(err)
+				listener = l
+			} else {
+				var err error
+				listener, err = listen(config.LocalAddr)
+				checkError(err)
+				if config.ProxyProtocol {
+					listener = generic.NewProxyListener(listener)
+				}
+			}
+
+			// additional mappings from the json config
+			for i, m := range config.Mappings {
+				var err error
+				mappings[i], err = listen(m.LocalAddr)
+				checkError(err)
+				if config.ProxyProtocol {
+					mappings[i] = generic.NewProxyListener(mappings[i])
+				}
+			}
+		}
 
 		log.Println("smux version:", config.SmuxVer)
-		log.Println("listening on:", listener.Addr())
+		log.Println("mux:", config.Mux)
+		if serve {
+			if config.TUN != "" {
+				log.Println("tun device:", config.TUN)
+			} else if config.UDP {
+				log.Println("listening on:", udpconn.LocalAddr(), "(udp)")
+			} else {
+				log.Println("listening on:", listener.Addr())
+			}
+			for i, m := range config.Mappings {
+				log.Println("listening on:", mappings[i].Addr(), "target:", m.Target)
+			}
+		}
 		log.Println("encryption:", config.Crypt)
+		log.Println("kdf:", config.KDF, "kdfiter:", config.KDFIter, "kdfmem:", config.KDFMem)
+		log.Println("rekey:", config.Rekey)
+		log.Println("antireplay:", config.AntiReplay)
+		log.Println("token:", config.Token)
+		log.Println("migrate:", config.Migrate)
+		log.Println("keyexchange:", config.KeyExchange, "pqkeyexchange:", config.PQKeyExchange, "connkey:", config.ConnKey)
+		log.Println("cert:", config.Cert, "ca:", config.CA)
 		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
 		log.Println("remote address:", config.RemoteAddr)
-		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
-		log.Println("compression:", !config.NoComp)
+		log.Println("hopinterval:", config.HopInterval)
+		log.Println("family:", config.Family)
+		log.Println("bindaddr:", config.BindAddr, "bindiface:", config.BindIface)
+		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd, "wnd:", config.Wnd, "maxwnd:", config.MaxWnd)
+		log.Println("compression:", config.Comp, "complevel:", config.CompLevel, "compthreshold:", config.CompThreshold, "compadaptive:", config.CompAdaptive)
 		log.Println("mtu:", config.MTU)
 		log.Println("datashard:", config.DataShard, "parityshard:", config.ParityShard)
+		log.Println("autofec:", config.AutoFEC, "minparity:", config.MinParity, "maxparity:", config.MaxParity)
 		log.Println("acknodelay:", config.AckNodelay)
-		log.Println("dscp:", config.DSCP)
-		log.Println("sockbuf:", config.SockBuf)
+		log.Println("dscp:", config.DSCP, "fwmark:", config.FwMark)
+		log.Println("sockbuf:", config.SockBuf, "nooffload:", config.NoOffload)
 		log.Println("smuxbuf:", config.SmuxBuf)
-		log.Println("streambuf:", config.StreamBuf)
-		log.Println("keepalive:", config.KeepAlive)
+		log.Println("streambuf:", config.StreamBuf, "copybuf:", config.CopyBuf)
+		log.Println("gomaxprocs:", config.GOMAXPROCS, "cpus:", config.CPUs)
+		log.Println("keepalive:", config.KeepAlive, "keepalivetimeout:", config.KeepAliveTimeout, "autokeepalive:", config.AutoKeepAlive)
+		log.Println("onconnect:", config.OnConnect, "ondisconnect:", config.OnDisconnect, "ondegraded:", config.OnDegraded)
+		log.Println("webhook:", config.Webhook, "webhookrtt:", config.WebhookRTT, "webhookloss:", config.WebhookLoss, "webhookreconnects:", config.WebhookReconnects)
 		log.Println("conn:", config.Conn)
+		log.Println("sched:", config.Sched, "connweights:", config.ConnWeights)
+		log.Println("spread:", config.Spread)
+		log.Println("backoff:", config.Backoff, "maxretries:", config.MaxRetries)
+		log.Println("standby:", config.Standby)
+		log.Println("probe:", config.Probe)
+		log.Println("monitor:", config.Monitor)
+		log.Println("stun:", config.STUN)
+		log.Println("resolve:", config.Resolve)
 		log.Println("autoexpire:", config.AutoExpire)
-		log.Println("scavengettl:", config.ScavengeTTL)
+		log.Println("maxstreams:", config.MaxStreams)
+		log.Println("scavengettl:", config.ScavengeTTL, "scavengeidle:", config.ScavengeIdle)
 		log.Println("snmplog:", config.SnmpLog)
-		log.Println("snmpperiod:", config.SnmpPeriod)
+		log.Println("snmpperiod:", config.SnmpPeriod, "snmpformat:", config.SnmpFormat, "snmpreset:", config.SnmpReset)
 		log.Println("quiet:", config.Quiet)
 		log.Println("tcp:", config.TCP)
+		log.Println("icmp:", config.ICMP)
+		log.Println("padding:", config.Padding)
+		log.Println("proxy:", config.Proxy)
+		log.Println("ws:", config.WS, "wsfallback:", config.WSFallback)
+		log.Println("transport:", config.Transport)
+		log.Println("udp:", config.UDP, "udptimeout:", config.UDPTimeout)
+		log.Println("tun:", config.TUN, "tunaddr:", config.TUNAddr)
+		log.Println("uplimit:", config.UpLimit, "downlimit:", config.DownLimit, "streamlimit:", config.StreamLimit)
+		log.Println("socks5:", config.Socks5)
+		log.Println("httpproxy:", config.HTTPProxy)
+		log.Println("tproxy:", config.TProxy)
+		log.Println("proxyprotocol:", config.ProxyProtocol)
+		log.Println("reverse:", config.Reverse)
+		log.Println("p2p:", config.P2P)
+		log.Println("controladdr:", config.ControlAddr)
+		log.Println("controlsock:", config.ControlSock)
+		log.Println("metricsaddr:", config.MetricsAddr)
+		log.Println("otlp:", config.OTLP)
 
 		// parameters check
-		if config.SmuxVer > maxSmuxVer {
-			log.Fatal("unsupported smux version:", config.SmuxVer)
+		if err := bandwidth.Set(config.UpLimit, config.DownLimit, config.StreamLimit); err != nil {
+			log.Fatal(err)
+		}
+		generic.SetCopyBuffer(config.CopyBuf)
+		if err := generic.SetCPUs(config.CPUs, config.GOMAXPROCS); err != nil {
+			log.Fatal(err)
+		}
+		if benchSeconds < 0 {
+			log.Fatal("bench can't be negative")
+		}
+		if !serve && config.Reverse {
+			log.Fatal("check and bench can't be used with reverse")
+		}
+		if !serve && config.Mux == generic.MuxNone {
+			log.Fatal("check and bench can't be used with mux none")
+		}
+
+		if config.KeyFile != "" {
+			key, err := generic.ReadKeyFile(config.KeyFile)
+			checkError(err)
+			config.Key = key
 		}
 
 		log.Println("initiating key derivation")
-		pass := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
+		pass, err := deriveKey(&config)
+		checkError(err)
 		log.Println("key derivation done")
-		var block kcp.BlockCrypt
-		switch config.Crypt {
-		case "null":
-			block = nil
-		case "sm4":
-			block, _ = kcp.NewSM4BlockCrypt(pass[:16])
-		case "tea":
-			block, _ = kcp.NewTEABlockCrypt(pass[:16])
-		case "xor":
-			block, _ = kcp.NewSimpleXORBlockCrypt(pass)
-		case "none":
-			block, _ = kcp.NewNoneBlockCrypt(pass)
-		case "aes-128":
-			block, _ = kcp.NewAESBlockCrypt(pass[:16])
-		case "aes-192":
-			block, _ = kcp.NewAESBlockCrypt(pass[:24])
-		case "blowfish":
-			block, _ = kcp.NewBlowfishBlockCrypt(pass)
-		case "twofish":
-			block, _ = kcp.NewTwofishBlockCrypt(pass)
-		case "cast5":
-			block, _ = kcp.NewCast5BlockCrypt(pass[:16])
-		case "3des":
-			block, _ = kcp.NewTripleDESBlockCrypt(pass[:24])
-		case "xtea":
-			block, _ = kcp.NewXTEABlockCrypt(pass[:16])
-		case "salsa20":
-			block, _ = kcp.NewSalsa20BlockCrypt(pass)
-		default:
-			config.Crypt = "aes"
-			block, _ = kcp.NewAESBlockCrypt(pass)
-		}
+		block := newBlockCrypt(&config, pass)
 
-		createConn := func() (*smux.Session, *kcp.UDPSession, error) {
-			kcpconn, err := dial(&config, block)
-			if err != nil {
-				return nil, nil, errors.Wrap(err, "dial()")
+		tun := newTuner(&config, block, pass)
+		if config.Cert != "" || config.CertKey != "" || config.CA != "" {
+			tun.certs, err = generic.LoadCertAuth(config.Cert, config.CertKey, config.CA)
+			checkError(err)
+		}
+		if check {
+			if config.STUN != "" && !checkNAT(config.STUN) {
+				os.Exit(1)
+			}
+			// servers expecting stream headers echo a stream back
+			if !tun.check(config.Socks5 || config.HTTPProxy || config.TProxy || len(config.Mappings) > 0) {
+				os.Exit(1)
 			}
-			kcpconn.SetStreamMode(true)
-			kcpconn.SetWriteDelay(false)
-			kcpconn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-			kcpconn.SetWindowSize(config.SndWnd, config.RcvWnd)
-			kcpconn.SetMtu(config.MTU)
-			kcpconn.SetACKNoDelay(config.AckNodelay)
-
-			if err := kcpconn.SetDSCP(config.DSCP); err != nil {
+			return nil
+		}
+		if config.AutoFEC {
+			go generic.AutoFEC(tun, config.MinParity, config.MaxParity)
+		}
+		go generic.AutoMode(tun)
+		if config.Wnd == "auto" {
+			go generic.AutoWindow(tun, config.MaxWnd)
+		}
+		if config.STUN != "" {
+			if config.Token > 0 {
+				// the tokens are bound to the public ip, learned before the first dial
+				logNAT(config.STUN)
+			} else {
+				go logNAT(config.STUN)
+			}
+		}
+
+		// in reverse mode the sessions are dialed in by the server
+		var reverse *kcp.Listener
+		if config.Reverse {
+			var err error
+			reverse, err = listenReverse(config.RemoteAddr, &config, block, pass)
+			checkError(err)
+			if err := reverse.SetDSCP(config.DSCP); err != nil {
 				log.Println("SetDSCP:", err)
 			}
-			if err := kcpconn.SetReadBuffer(config.SockBuf); err != nil {
+			if err := reverse.SetReadBuffer(config.SockBuf); err != nil {
 				log.Println("SetReadBuffer:", err)
 			}
-			if err := kcpconn.SetWriteBuffer(config.SockBuf); err != nil {
+			if err := reverse.SetWriteBuffer(config.SockBuf); err != nil {
 				log.Println("SetWriteBuffer:", err)
 			}
-			log.Println("smux version:", config.SmuxVer, "on connection:", kcpconn.LocalAddr(), "->", kcpconn.RemoteAddr())
-			smuxConfig := smux.DefaultConfig()
-			smuxConfig.Version = config.SmuxVer
-			smuxConfig.MaxReceiveBuffer = config.SmuxBuf
-			smuxConfig.MaxStreamBuffer = config.StreamBuf
-			smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
+			log.Println("waiting for server on:", reverse.Addr())
+		}
+
+		createConn := func(remote string) (*generic.Session, error) {
+			params := tun.Params()
+			cfg, block := tun.transport()
+			var kcpconn *kcp.UDPSession
+			var conn net.Conn // closes the packet conn of dialed sessions too
+			if reverse != nil {
+				var err error
+				if kcpconn, err = reverse.AcceptKCP(); err != nil {
+					return nil, errors.Wrap(err, "AcceptKCP()")
+				}
+				conn = kcpconn
+			} else {
+				addr, err := tun.pickAddr(remote)
+				if err != nil {
+					return nil, err
+				}
+				if cfg.WS != "" && cfg.WSFallback {
+					if _, err := tun.probe(addr); err == nil {
+						cfg.WS = ""
+					} else {
+						log.Println("falling back to websocket:", err)
+					}
+				}
+				if cfg.Transport == "auto" {
+					if _, err := tun.probe(addr); err == nil {
+						cfg.Transport = "kcp"
+					} else {
+						log.Println("falling back to tcp transport:", err)
+						cfg.Transport = "tcp"
+					}
+				}
+				if cfg.Transport == "tcp" {
+					if conn, err = dialStream(addr, &cfg, tun.streamKey()); err != nil {
+						return nil, errors.Wrap(err, "dialStream()")
+					}
+				} else {
+					owned, err := dial(addr, &cfg, block, tun.psk())
+					if err != nil {
+						return nil, errors.Wrap(err, "dial()")
+					}
+					kcpconn, conn = owned.UDPSession, owned
+					if err := kcpconn.SetDSCP(cfg.DSCP); err != nil {
+						log.Println("SetDSCP:", err)
+					}
+					if err := kcpconn.SetReadBuffer(cfg.SockBuf); err != nil {
+						log.Println("SetReadBuffer:", err)
+					}
+					if err := kcpconn.SetWriteBuffer(cfg.SockBuf); err != nil {
+						log.Println("SetWriteBuffer:", err)
+					}
+				}
+			}
+			if kcpconn != nil {
+				kcpconn.SetStreamMode(true)
+				kcpconn.SetWriteDelay(false)
+				params.ApplyTo(kcpconn)
+				kcpconn.SetACKNoDelay(cfg.AckNodelay)
+				if err := connKey(kcpconn, &cfg, tun.psk(), reverse == nil); err != nil {
+					conn.Close()
+					return nil, errors.Wrap(err, "createConn()")
+				}
+			}
+
+			log.Println("smux version:", cfg.SmuxVer, "mux:", cfg.Mux, "on connection:", conn.LocalAddr(), "->", conn.RemoteAddr())
+			smuxConfig := newSmuxConfig(&cfg)
 
 			if err := smux.VerifyConfig(smuxConfig); err != nil {
 				log.Fatalf("%+v", err)
 			}
 
-			// stream multiplex
-			var session *smux.Session
-			if config.NoComp {
-				session, err = smux.Client(kcpconn, smuxConfig)
+			// stream multiplex, in tls with cert and on a key of the session's own with keyexchange
+			meter := generic.NewMeter(conn)
+			var wire net.Conn = meter
+			if tun.certs != nil {
+				var err error
+				if wire, err = generic.CertAuth(wire, tun.certs, reverse == nil); err != nil {
+					conn.Close()
+					return nil, errors.Wrap(err, "createConn()")
+				}
+			}
+			if cfg.KeyExchange {
+				exchange := generic.KeyExchange
+				if cfg.PQKeyExchange {
+					exchange = generic.HybridKeyExchange
+				}
+				var err error
+				if wire, err = exchange(wire, tun.psk(), reverse == nil); err != nil {
+					conn.Close()
+					return nil, errors.Wrap(err, "createConn()")
+				}
+			}
+			var stream net.Conn
+			var err error
+			if reverse != nil {
+				stream, err = generic.AcceptComp(wire, cfg.CompLevel, cfg.CompThreshold, cfg.CompAdaptive, cfg.Mux)
 			} else {
-				session, err = smux.Client(generic.NewCompStream(kcpconn), smuxConfig)
+				codec, _ := generic.ParseComp(cfg.Comp)
+				stream, err = generic.DialComp(wire, codec, cfg.CompLevel, cfg.CompThreshold, cfg.CompAdaptive, cfg.Mux)
+			}
+			if err != nil {
+				conn.Close()
+				return nil, errors.Wrap(err, "createConn()")
 			}
+			session, err := generic.NewMux(stream, cfg.Mux, smuxConfig, true)
 			if err != nil {
-				return nil, nil, errors.Wrap(err, "createConn()")
+				conn.Close()
+				return nil, errors.Wrap(err, "createConn()")
 			}
-			return session, kcpconn, nil
+			return &generic.Session{KCP: kcpconn, Mux: session, Meter: meter}, nil
 		}
 
-		// wait until a connection is ready
-		waitConn := func() (*smux.Session, *kcp.UDPSession) {
-			for {
-				if session, conn, err := createConn(); err == nil {
-					return session, conn
+		if benchSeconds > 0 {
+			if !bench(createConn, tun.servers().current(), time.Duration(benchSeconds)*time.Second) {
+				os.Exit(1)
+			}
+			return nil
+		}
+
+		// wait until a connection is ready, the systemd watchdog starves while it fails
+		wd := newWatchdog(tun, config.KeepAlive)
+		hook := newHooks(tun)
+		alarm := newWebhook(tun)
+		// wait until the session at idx of conn is dialed, -1 for the others
+		waitConn := func(idx int) (*generic.Session, string) {
+			span := generic.StartSpan("connect", nil)
+			defer span.End()
+			for attempt := 1; ; attempt++ {
+				remote := tun.servers().currentAt(idx)
+				dial := generic.StartSpan("dial", span, "remote", remote, "attempt", attempt)
+				session, err := createConn(remote)
+				dial.SetError(err)
+				dial.End()
+				if err == nil {
+					wd.failing(false)
+					span.SetAttr("remote", remote, "attempts", attempt)
+					return session, remote
 				} else {
-					log.Println("re-connecting:", err)
-					time.Sleep(time.Second)
+					wd.failing(true)
+					hook.failed(remote, err)
+					if config.MaxRetries > 0 && attempt >= config.MaxRetries {
+						generic.LogEvent("giving up", "remote", remote, "attempts", attempt, "error", err)
+						os.Exit(exitUnreachable)
+					}
+					delay := backoffDelay(attempt, config.Backoff)
+					generic.LogEvent("re-connecting", "remote", remote, "error", err, "delay", delay)
+					tun.servers().failoverAt(idx, remote)
+					time.Sleep(delay)
 				}
 			}
 		}
 
+		// reload json config on SIGHUP
+		if c.String("c") != "" {
+			go func() {
+				for range reloadSignal {
+					tun.reload(base, c.String("c"), precedence, shell)
+				}
+			}()
+		}
+
+		// start server probing and re-resolution
+		go tun.prober(config.Probe)
+		go tun.monitor(config.Monitor)
+		if config.AutoKeepAlive > 0 {
+			go tun.autoKeepAlive(config.KeepAlive, config.AutoKeepAlive)
+		}
+		go tun.resolver(config.Resolve)
+		go hook.monitor()
+		go alarm.watch()
+
 		// start snmp logger
-		go generic.SnmpLogger(config.SnmpLog, config.SnmpPeriod)
+		go generic.SnmpLogger(config.SnmpLog, config.SnmpPeriod, config.SnmpFormat, config.SnmpReset)
 
 		// start scavenger
 		chScavenger := make(chan timedSession, 128)
 		go scavenger(chScavenger, &config)
 
-        // start listener
+		// start control api
+		go generic.ControlServer(config.ControlAddr, config.ControlToken, tun)
+		go generic.ControlSocket(config.ControlSock, tun)
+		go generic.MetricsServer(config.MetricsAddr, tun)
+
+		// with maxstreams, a session full of streams gives way to another one with room,
+		// and a spare one is dialed when all are full, closed once idle with room again.
+		// The expiry date of a spare is when it was last picked.
+		var muxesLock sync.Mutex
+		var spares []timedSession
+		var spareDialing chan struct{}
+		roomy := func(s generic.Mux) bool {
+			return s != nil && !s.IsClosed() && s.NumStreams() < config.MaxStreams
+		}
+		// overflow is called with muxesLock held, released while a spare is dialed
+		overflow := func(muxes []timedSession) generic.Mux {
+			for {
+				for _, m := range muxes {
+					if roomy(m.session) && (config.AutoExpire <= 0 || time.Now().Before(m.expiryDate)) {
+						return m.session
+					}
+				}
+				for i := range spares {
+					if roomy(spares[i].session) {
+						spares[i].expiryDate = time.Now()
+						return spares[i].session
+					}
+				}
+				if spareDialing == nil {
+					break
+				}
+				// another stream is dialing a spare, which may have room for this one too
+				wait := spareDialing
+				muxesLock.Unlock()
+				<-wait
+				muxesLock.Lock()
+			}
+			done := make(chan struct{})
+			spareDialing = done
+			muxesLock.Unlock()
+			session, remote := waitConn(-1)
+			tun.addSpare(session)
+			muxesLock.Lock()
+			spareDialing = nil
+			close(done)
+			hook.connected(remote)
+			spares = append(spares, timedSession{session: session.Mux, expiryDate: time.Now(), remote: remote})
+			generic.LogEvent("spare session opened", "remote", remote, "spares", len(spares))
+			return session.Mux
+		}
+		trimSpares := func() {
+			var kept []timedSession
+			for _, m := range spares {
+				if !m.session.IsClosed() && m.session.NumStreams() == 0 && time.Since(m.expiryDate) >= spareIdle {
+					m.session.Close()
+					generic.LogEvent("spare session closed", "remote", m.remote)
+				}
+				if m.session.IsClosed() {
+					tun.removeSpare(m.session)
+					continue
+				}
+				kept = append(kept, m)
+			}
+			spares = kept
+		}
+
+		// pick a session by the scheduler, with auto expiration && reconnection. The lock
+		// is held to read and install the sessions only: the caller that finds its slot
+		// to re-dial marks it dialing and dials with the lock released, the others landing
+		// on it wait for that dial, and those on healthy slots go on meanwhile.
         numconn := uint16(config.Conn)
         muxes := make([]timedSession, numconn)
-        connes := make([]*kcp.UDPSession, numconn)
+		var sb standby
+		if config.Standby {
+			go sb.keep(tun, createConn, config.Backoff, time.Second)
+		}
+		weights, _ := parseWeights(config.ConnWeights, config.Conn)
+		sched := newScheduler(config.Sched, weights)
+		expired := func(m *timedSession) bool {
+			return config.AutoExpire > 0 && time.Now().After(m.expiryDate)
+		}
+		pick := func() generic.Mux {
+			muxesLock.Lock()
+			defer muxesLock.Unlock()
+			idx := uint16(sched.next(muxes, expired))
+
+			// checked again after every wait, the session dialed by another stream may
+			// have died or expired since
+			for muxes[idx].session == nil || muxes[idx].session.IsClosed() || expired(&muxes[idx]) {
+				if wait := muxes[idx].dialing; wait != nil {
+					muxesLock.Unlock()
+					<-wait
+					muxesLock.Lock()
+					continue
+				}
+				done := make(chan struct{})
+				muxes[idx].dialing = done
+				// a dead session means the server is unreachable, try the next one
+				dead := muxes[idx].session != nil && muxes[idx].session.IsClosed()
+				stale := muxes[idx].remote
+				first := muxes[idx].expiryDate.IsZero()
+				muxesLock.Unlock()
+
+				if dead {
+					tun.servers().failoverAt(int(idx), stale)
+				}
+				session, remote := sb.take(tun)
+				if session == nil {
+					session, remote = waitConn(int(idx))
+				}
+
+				muxesLock.Lock()
+				// a reconnect counts once the dead session is replaced, however many
+				// dials it took
+				if dead {
+					alarm.reconnected()
+				}
+				muxes[idx] = timedSession{session: session.Mux, conn: session.KCP, remote: remote}
+				tun.setConn(int(idx), session)
+				hook.connected(remote)
+				muxes[idx].expiryDate = time.Now().Add(sessionLifetime(config.AutoExpire, int(idx), int(numconn), first))
+				close(done)
+				if config.AutoExpire > 0 { // only when autoexpire set
+					chScavenger <- muxes[idx]
+				}
+			}
+			if config.MaxStreams > 0 {
+				if !roomy(muxes[idx].session) {
+					return overflow(muxes)
+				}
+				trimSpares()
+			}
+			return sched.track(muxes[idx].session, int(idx))
+		}
+
+        // start listener
         var wg sync.WaitGroup
         wg.Add(1)
         go func() {
             defer wg.Done()
-            rr := uint16(0)
+			if config.UDP {
+				udpRelay(udpconn, pick, time.Duration(config.UDPTimeout)*time.Second, config.Quiet)
+				return
+			}
+			if config.TUN != "" {
+				tunRelay(tunDev, pick, config.Quiet)
+				return
+			}
+
             for {
-                p1, err := listener.AcceptTCP()
+				p1, err := listener.Accept()
                 if err != nil {
                     log.Fatalf("%+v", err)
                 }
-                idx := rr % numconn
-
-                // do auto expiration && reconnection
-                if muxes[idx].session == nil || muxes[idx].session.IsClosed() ||
-                (config.AutoExpire > 0 && time.Now().After(muxes[idx].expiryDate)) {
-                    muxes[idx].session, connes[idx] = waitConn()
-                    muxes[idx].expiryDate = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
-                    if config.AutoExpire > 0 { // only when autoexpire set
-                        chScavenger <- muxes[idx]
-                    }
-                }
-
-                go handleClient(muxes[idx].session, p1, config.Quiet)
-                rr++
+				// picked off the accept loop, a session being dialed holds up its own
+				// streams only
+				go func(p1 net.Conn) {
+					switch {
+					case config.Socks5:
+						handleSocks5(pick(), p1, config.Quiet)
+					case config.HTTPProxy:
+						handleHTTPProxy(pick(), p1, config.Quiet)
+					case config.TProxy:
+						handleTProxy(pick(), p1.(*net.TCPConn), config.Quiet)
+					case len(config.Mappings) > 0:
+						// the server runs in dynamic mode, announce its own target
+						serveMapped(pick(), p1, "", config.Quiet)
+					case config.Mux == generic.MuxNone:
+						// a session of its own, gone with the connection
+						session, remote := waitConn(-1)
+						tun.addSpare(session)
+						hook.connected(remote)
+						handleClient(session.Mux, p1, config.Quiet)
+						tun.removeSpare(session.Mux)
+					default:
+						handleClient(pick(), p1, config.Quiet)
+					}
+				}(p1)
             }
         } ()
 
+		// under systemd, the service is ready once the first session is up
+		if generic.SdNotifying() {
+			go func() {
+				// without a multiplexer sessions are dialed per connection only
+				if config.Mux != generic.MuxNone {
+					pick()
+				}
+				if err := generic.SdNotify("READY=1"); err != nil {
+					log.Println("sd_notify:", err)
+				}
+			}()
+			go generic.SdWatchdog(wd.healthy)
+		}
+
+		for i, m := range config.Mappings {
+			wg.Add(1)
+			go func(listener net.Listener, target string) {
+				defer wg.Done()
+				serveMapping(listener, target, pick, config.Quiet)
+			}(mappings[i], m.Target)
+		}
+
         if config.Fifo != "" {
             wg.Add(1)
             go func() {
                 defer wg.Done()
-                os.Remove(config.Fifo)
-                syscall.Mkfifo(config.Fifo, 0666)
-                log.Println("Open named pipe file for read:", config.Fifo)
-                file, err := os.OpenFile(config.Fifo, os.O_CREATE, os.ModeNamedPipe)
-                if err != nil {
-                    log.Fatal("Open named pipe file error:", err)
-                }
-
-                reader := bufio.NewReader(file)
-
-                for {
-                    //line, err := reader.ReadBytes('\n')
-                    line, _, err := reader.ReadLine()
-                    if err == nil {
-                        //fmt.Print("load string:" + string(line))
-                        message := strings.Split(string(line), " ")
-                        if strings.Contains(message[0], "fec") {
-                            ds, _ := strconv.Atoi(message[1])
-                            ps, _ := strconv.Atoi(message[2])
-                            if ds != config.DataShard || ps != config.ParityShard {
-                                config.DataShard = ds
-                                config.ParityShard = ps
-                                log.Println("ds:", ds, "ps:", ps)
-                                for addr := range connes {
-                                    if connes[addr] != nil {
-                                        connes[addr].SetFEC(config.DataShard, config.ParityShard)
-                                    }
-                                }
-                            }
-                        } else {
-                            log.Println("Unknown call")
-                        }
-                    }
-                    time.Sleep(time.Second)
-                }
+				generic.FifoControl(config.Fifo, tun)
             } ()
         }
         wg.Wait()
@@ -525,6 +1687,35 @@ func main() {
 	myApp.Run(os.Args)
 }
 
+// sessionLifetime returns how long the session at index idx of numconn lives with
+// autoexpire set, within autoExpireJitter of it so that sessions dialed together
+// don't expire together. The first sessions are spread over another autoexpire by
+// their index, as they are all dialed at start.
+func sessionLifetime(autoExpire, idx, numconn int, first bool) time.Duration {
+	lifetime := time.Duration(autoExpire) * time.Second
+	if jitter := int64(float64(lifetime) * autoExpireJitter); jitter > 0 {
+		lifetime += time.Duration(rand.Int63n(2*jitter+1) - jitter)
+	}
+	if first {
+		lifetime += time.Duration(autoExpire) * time.Second * time.Duration(idx) / time.Duration(numconn)
+	}
+	return lifetime
+}
+
+// backoffDelay returns how long to wait after the failed dial attempt, doubling from
+// a second up to backoff seconds, within backoffJitter of it so that clients cut off
+// together don't re-dial together
+func backoffDelay(attempt, backoff int) time.Duration {
+	delay := time.Duration(backoff) * time.Second
+	if attempt < 32 && time.Second<<uint(attempt-1) < delay {
+		delay = time.Second << uint(attempt-1)
+	}
+	if jitter := int64(float64(delay) * backoffJitter); jitter > 0 {
+		delay += time.Duration(rand.Int63n(2*jitter+1) - jitter)
+	}
+	return delay
+}
+
 func scavenger(ch chan timedSession, config *Config) {
 	// When AutoExpire is set to 0 (default), sessionList will keep empty.
 	// Then this routine won't need to do anything; thus just terminate it.
@@ -538,22 +1729,25 @@ func scavenger(ch chan timedSession, config *Config) {
 	for {
 		select {
 		case item := <-ch:
-			sessionList = append(sessionList, timedSession{
-				item.session,
-				item.expiryDate.Add(time.Duration(config.ScavengeTTL) * time.Second)})
+			sessionList = append(sessionList, item)
 		case <-ticker.C:
 			if len(sessionList) == 0 {
 				continue
 			}
 
+			now := time.Now()
 			var newList []timedSession
 			for k := range sessionList {
 				s := sessionList[k]
 				if s.session.IsClosed() {
-					log.Println("scavenger: session normally closed:", s.session.LocalAddr())
-				} else if time.Now().After(s.expiryDate) {
+					generic.LogEvent("scavenger: session closed", "reason", "normal", "local", s.session.LocalAddr(), "remote", s.remote)
+				} else if now.After(s.expiryDate.Add(time.Duration(config.ScavengeTTL) * time.Second)) {
+					s.session.Close()
+					generic.LogEvent("scavenger: session closed", "reason", "ttl", "local", s.session.LocalAddr(), "remote", s.remote)
+				} else if config.ScavengeIdle && now.After(s.expiryDate) && s.session.NumStreams() == 0 {
+					// expired sessions get no new streams
 					s.session.Close()
-					log.Println("scavenger: session closed due to ttl:", s.session.LocalAddr())
+					generic.LogEvent("scavenger: session closed", "reason", "idle", "local", s.session.LocalAddr(), "remote", s.remote)
 				} else {
 					newList = append(newList, sessionList[k])
 				}
@@ -562,9 +1756,3 @@ func scavenger(ch chan timedSession, config *Config) {
 		}
 	}
 }
-
-
-func pipe_read(kcpconn *kcp.UDPSession, config *Config) {
-    if config.Fifo != "" {
-    }
-}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// Mapping forwards the connections accepted on LocalAddr to Target on the server side
+type Mapping struct {
+	LocalAddr string `json:"localaddr"`
+	Target    string `json:"target"`
+}
+
+// serveMapping accepts connections on listener and announces target on each stream,
+// the server must run with -dynamic
+func serveMapping(listener net.Listener, target string, pick func() generic.Mux, quiet bool) {
+	for {
+		p1, err := listener.Accept()
+		if err != nil {
+			log.Fatalf("%+v", err)
+		}
+		go func(p1 net.Conn) {
+			serveMapped(pick(), p1, target, quiet)
+		}(p1)
+	}
+}
+
+// serveMapped forwards p1 to target, an empty target is the one configured on the server
+func serveMapped(session generic.Mux, p1 net.Conn, target string, quiet bool) {
+	span := generic.StartSpan("stream", nil, "peer", p1.RemoteAddr())
+	defer span.End()
+
+	p2, err := openStream(session, &generic.StreamHeader{Network: generic.NetTCP, Addr: target, Source: sourceOf(p1)}, span)
+	if err != nil {
+		log.Println("mapping:", target, err)
+		p1.Close()
+		return
+	}
+	relay(p1, p2, span, quiet)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// probes sent to the current server in each period of the link monitor
+const monitorProbes = 5
+
+// linkQuality is the last summary of the link monitor
+type linkQuality struct {
+	mu      sync.Mutex
+	remote  string
+	rtt     time.Duration // average of the probes answered
+	jitter  time.Duration // average difference between consecutive rtts
+	loss    float64       // ratio of probes unanswered
+	retrans float64       // ratio of the segments sent retransmitted in the period
+	valid   bool
+}
+
+// monitor probes the current server every interval seconds through fresh sessions, so
+// that the quality of the link is known with or without traffic, and logs a summary of
+// the rtt, jitter and loss of the probes and of the retransmissions of the period
+func (t *tuner) monitor(interval int) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	last := kcp.DefaultSnmp.Copy()
+	for range ticker.C {
+		remote := t.servers().current()
+		var rtts []time.Duration
+		for i := 0; i < monitorProbes; i++ {
+			if rtt, err := t.probe(remote); err == nil {
+				rtts = append(rtts, rtt)
+			}
+		}
+		cur := kcp.DefaultSnmp.Copy()
+		retrans := generic.Retransmitted(cur, last)
+		last = cur
+
+		var sum, diffs time.Duration
+		for i, rtt := range rtts {
+			sum += rtt
+			if i > 0 {
+				d := rtt - rtts[i-1]
+				if d < 0 {
+					d = -d
+				}
+				diffs += d
+			}
+		}
+		var rtt, jitter time.Duration
+		if len(rtts) > 0 {
+			rtt = sum / time.Duration(len(rtts))
+		}
+		if len(rtts) > 1 {
+			jitter = diffs / time.Duration(len(rtts)-1)
+		}
+		loss := float64(monitorProbes-len(rtts)) / monitorProbes
+
+		t.link.mu.Lock()
+		t.link.remote, t.link.rtt, t.link.jitter, t.link.loss, t.link.retrans, t.link.valid = remote, rtt, jitter, loss, retrans, true
+		t.link.mu.Unlock()
+		generic.LogEvent("link quality", "remote", remote, "rtt", rtt.Round(time.Microsecond), "jitter", jitter.Round(time.Microsecond),
+			"loss", fmt.Sprintf("%v%%", math.Round(loss*100)), "retrans", fmt.Sprintf("%.2f%%", retrans*100))
+	}
+}
+
+// writeLinkMetrics exports the last summary of the link monitor
+func (t *tuner) writeLinkMetrics(w io.Writer) {
+	t.link.mu.Lock()
+	defer t.link.mu.Unlock()
+	if !t.link.valid {
+		return
+	}
+	metrics := []struct {
+		name, help string
+		value      interface{}
+	}{
+		{"kcptun_link_rtt_ms", "average rtt of the probes of the last period", float64(t.link.rtt.Microseconds()) / 1000},
+		{"kcptun_link_jitter_ms", "average difference between consecutive probe rtts of the last period", float64(t.link.jitter.Microseconds()) / 1000},
+		{"kcptun_link_loss", "ratio of the probes of the last period unanswered", t.link.loss},
+		{"kcptun_link_retrans", "ratio of the segments sent in the last period retransmitted", t.link.retrans},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n%v{remote=%q} %v\n", m.name, m.help, m.name, m.name, t.link.remote, m.value)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// checkNAT prints the nat type and public address the stun servers see, and reports
+// whether udp got through to any of them
+func checkNAT(servers string) bool {
+	r, err := generic.DetectNAT(strings.Split(servers, ","))
+	if err != nil {
+		fmt.Println("nat:", err)
+		return false
+	}
+	for _, err := range r.Errors {
+		fmt.Println("nat:", err)
+	}
+	fmt.Println("nat:", r)
+	if r.Type == generic.NATSymmetric {
+		fmt.Println("nat: a symmetric nat maps every destination anew, sessions lost to it can't be resumed and need a short keepalive")
+	}
+	return r.Type != generic.NATBlocked
+}
+
+// publicIP is the ip the stun servers saw, once logNAT learned it
+var publicIP atomic.Value // net.IP
+
+// logNAT logs the nat type and public address the stun servers see
+func logNAT(servers string) {
+	r, err := generic.DetectNAT(strings.Split(servers, ","))
+	if err != nil {
+		log.Println("nat:", err)
+		return
+	}
+	for _, err := range r.Errors {
+		log.Println("nat:", err)
+	}
+	log.Println("nat:", r)
+	for _, addr := range r.Mapped {
+		if addr != nil {
+			publicIP.Store(addr.IP)
+			return
+		}
+	}
+}
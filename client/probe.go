@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+)
+
+const (
+	// how long a probe waits for the server to acknowledge
+	probeTimeout = 3 * time.Second
+	// number of recent probes the loss rate is computed from
+	probeWindow = 10
+)
+
+// probeStats holds the measurements of a kcp server
+type probeStats struct {
+	rtt     time.Duration // smoothed rtt of successful probes
+	results []bool        // recent probe results, true for success
+}
+
+// loss returns the ratio of failed probes in the window
+func (ps *probeStats) loss() float64 {
+	if len(ps.results) == 0 {
+		return 0
+	}
+	failed := 0
+	for _, ok := range ps.results {
+		if !ok {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(ps.results))
+}
+
+// score ranks servers, lower is better; servers never reached rank last
+func (ps *probeStats) score() float64 {
+	loss := ps.loss()
+	if ps.rtt == 0 || loss >= 1 {
+		return 1e18
+	}
+	return float64(ps.rtt) / (1 - loss)
+}
+
+func (ps *probeStats) add(ok bool, rtt time.Duration) {
+	ps.results = append(ps.results, ok)
+	if len(ps.results) > probeWindow {
+		ps.results = ps.results[1:]
+	}
+	if ok {
+		if ps.rtt == 0 {
+			ps.rtt = rtt
+		} else {
+			ps.rtt = (ps.rtt*7 + rtt) / 8
+		}
+	}
+}
+
+// probe measures the rtt to a kcp server by sending a smux NOP frame through a
+// fresh kcp session and waiting for the kcp layer to acknowledge it.
+func (t *tuner) probe(remote string) (time.Duration, error) {
+	cfg, block := t.transport()
+	cfg.WS = "" // probes measure the udp path
+	kcpconn, err := dial(remote, &cfg, block, t.psk())
+	if err != nil {
+		return 0, err
+	}
+	defer kcpconn.Close()
+	kcpconn.SetStreamMode(true)
+	kcpconn.SetWriteDelay(false)
+	kcpconn.SetACKNoDelay(true)
+	p := t.Params()
+	p.ApplyTo(kcpconn.UDPSession)
+
+	codec, _ := generic.ParseComp(cfg.Comp)
+	w, err := generic.DialComp(kcpconn, codec, cfg.CompLevel, cfg.CompThreshold, cfg.CompAdaptive, cfg.Mux)
+	if err != nil {
+		return 0, err
+	}
+
+	nop := generic.MuxNop(cfg.Mux, cfg.SmuxVer)
+	start := time.Now()
+	if _, err := w.Write(nop); err != nil {
+		return 0, err
+	}
+	for time.Since(start) < probeTimeout {
+		if kcpconn.GetSRTT() > 0 {
+			return time.Since(start), nil
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return 0, errors.New("probe timeout")
+}
+
+// prober periodically measures all servers and lets remotes prefer the best one
+func (t *tuner) prober(interval int) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		r := t.servers()
+		if len(r.addrs) > 1 {
+			for _, addr := range r.addrs {
+				rtt, err := t.probe(addr)
+				r.report(addr, err == nil, rtt)
+				if err != nil {
+					log.Println("probe:", addr, err)
+				}
+			}
+			r.selectBest()
+		}
+		<-ticker.C
+	}
+}
+
+// WriteMetrics exports the probe measurements and the summary of the link monitor
+func (t *tuner) WriteMetrics(w io.Writer) {
+	r := t.servers()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(w, "# TYPE kcptun_probe_rtt_ms gauge\n")
+	for _, addr := range r.addrs {
+		if ps, ok := r.stats[addr]; ok {
+			fmt.Fprintf(w, "kcptun_probe_rtt_ms{remote=%q} %v\n", addr, ps.rtt.Milliseconds())
+		}
+	}
+	fmt.Fprintf(w, "# TYPE kcptun_probe_loss gauge\n")
+	for _, addr := range r.addrs {
+		if ps, ok := r.stats[addr]; ok {
+			fmt.Fprintf(w, "kcptun_probe_loss{remote=%q} %v\n", addr, ps.loss())
+		}
+	}
+	fmt.Fprintf(w, "# TYPE kcptun_probe_selected gauge\n")
+	for k, addr := range r.addrs {
+		selected := 0
+		if k == r.cur {
+			selected = 1
+		}
+		fmt.Fprintf(w, "kcptun_probe_selected{remote=%q} %v\n", addr, selected)
+	}
+	t.writeLinkMetrics(w)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// how long the handshake with an upstream proxy or a websocket server may take
+const proxyTimeout = 10 * time.Second
+
+// dialProxy reaches the kcp server at remote through an upstream proxy, a socks5 proxy
+// relays the udp packets with UDP ASSOCIATE, an http proxy carries them on a CONNECT
+// tunnel which the server must accept with -stream.
+func dialProxy(proxy string, remote *net.UDPAddr) (net.PacketConn, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	switch u.Scheme {
+	case "socks5":
+		return dialSocks5UDP(u, remote)
+	case "http":
+		return dialHTTPConnect(u, remote)
+	default:
+		return nil, errors.Errorf("unsupported proxy: %v", proxy)
+	}
+}
+
+// socksUDPConn relays udp packets through a socks5 proxy, the association lasts as
+// long as the control connection.
+type socksUDPConn struct {
+	*net.UDPConn
+	relay *net.UDPAddr
+	ctrl  net.Conn
+	buf   []byte
+}
+
+func dialSocks5UDP(u *url.URL, remote *net.UDPAddr) (net.PacketConn, error) {
+	ctrl, err := net.DialTimeout("tcp", u.Host, proxyTimeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ctrl.SetDeadline(time.Now().Add(proxyTimeout))
+
+	relay, err := socks5Associate(ctrl, u.User)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() {
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	udpconn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		ctrl.Close()
+		return nil, errors.WithStack(err)
+	}
+	c := &socksUDPConn{UDPConn: udpconn, relay: relay, ctrl: ctrl, buf: make([]byte, 1500+262)}
+	// the relay stops once the proxy closes the control connection
+	go func() {
+		io.Copy(ioutil.Discard, ctrl)
+		c.Close()
+	}()
+	return c, nil
+}
+
+// socks5Associate negotiates a UDP ASSOCIATE on conn and returns the relay address
+func socks5Associate(conn net.Conn, user *url.Userinfo) (*net.UDPAddr, error) {
+	methods := []byte{socks5Version, 1, 0}
+	if user != nil {
+		methods = []byte{socks5Version, 2, 0, 2}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	switch reply[1] {
+	case 0:
+	case 2: // username/password, RFC 1929
+		if user == nil {
+			return nil, errors.New("socks5: proxy requires authentication")
+		}
+		name := user.Username()
+		pass, _ := user.Password()
+		auth := []byte{1, byte(len(name))}
+		auth = append(auth, name...)
+		auth = append(auth, byte(len(pass)))
+		auth = append(auth, pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if reply[1] != 0 {
+			return nil, errors.New("socks5: authentication failed")
+		}
+	default:
+		return nil, errors.New("socks5: no acceptable authentication method")
+	}
+
+	// the address packets will be sent from is unknown, 0.0.0.0:0
+	if _, err := conn.Write([]byte{socks5Version, socks5CmdUDPAssociate, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// | VER | REP | RSV | ATYP | BND.ADDR | BND.PORT |
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if hdr[1] != socks5RepSucceeded {
+		return nil, errors.Errorf("socks5: UDP ASSOCIATE failed with %v", hdr[1])
+	}
+	addr, err := socks5ReadAddr(conn, hdr[3])
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
+
+func (c *socksUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, _, err := c.UDPConn.ReadFrom(c.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// | RSV | FRAG | ATYP | DST.ADDR | DST.PORT | DATA |
+		if n < 4 || c.buf[2] != 0 {
+			continue
+		}
+		r := &byteReader{data: c.buf[4:n]}
+		addr, err := socks5ReadAddr(r, c.buf[3])
+		if err != nil {
+			continue
+		}
+		from, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			continue
+		}
+		return copy(b, r.data), from, nil
+	}
+}
+
+func (c *socksUDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpaddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.Errorf("socks5: unsupported address %v", addr)
+	}
+	pkt := []byte{0, 0, 0}
+	if ip4 := udpaddr.IP.To4(); ip4 != nil {
+		pkt = append(append(pkt, socks5AtypIPv4), ip4...)
+	} else {
+		pkt = append(append(pkt, socks5AtypIPv6), udpaddr.IP.To16()...)
+	}
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], uint16(udpaddr.Port))
+	pkt = append(append(pkt, port[:]...), p...)
+	if _, err := c.UDPConn.WriteTo(pkt, c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socksUDPConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+// byteReader reads a byte slice, leaving the unread part in data
+type byteReader struct {
+	data []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// dialHTTPConnect opens a CONNECT tunnel to remote carrying length prefixed packets
+func dialHTTPConnect(u *url.URL, remote *net.UDPAddr) (net.PacketConn, error) {
+	conn, err := net.DialTimeout("tcp", u.Host, proxyTimeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	conn.SetDeadline(time.Now().Add(proxyTimeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: remote.String()},
+		Host:   remote.String(),
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf("http proxy: CONNECT %v: %v", remote, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return generic.NewStreamPacketConn(conn, br), nil
+}
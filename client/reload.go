@@ -0,0 +1,181 @@
+package main
+
+import (
+	"log"
+	"reflect"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// reloadSignal is notified by the signal handler to reload the json config
+var reloadSignal = make(chan struct{}, 1)
+
+// reload re-reads the json config at path on top of the command line config base, the
+// settings of the shell winning with precedence flags, and applies the changes which
+// are safe at runtime. Sessions are re-dialed only if a transport level setting has
+// changed.
+func (t *tuner) reload(base Config, path, precedence string, shell generic.ConfigSources) {
+	config := base
+	if _, err := generic.LoadConfig(&config, path, precedence, shell); err != nil {
+		log.Println("reload:", err)
+		return
+	}
+	if nodelay, interval, resend, nc, ok := generic.ModeProfile(config.Mode); ok {
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = nodelay, interval, resend, nc
+	}
+	if config.NoComp {
+		config.Comp = "none"
+	}
+	// the checks done at start, a reload failing any of them is dropped
+	problems := checkConfig(&config, false)
+	for _, w := range problems.Warnings() {
+		log.Println("reload: warning:", w.Error)
+	}
+	if err := problems.Err(); err != nil {
+		log.Println("reload:", err)
+		return
+	}
+
+	old, block := t.transport()
+	if (config.Mux == generic.MuxNone) != (old.Mux == generic.MuxNone) {
+		log.Println("reload: switching to or from mux none requires a restart")
+		return
+	}
+	if config.LocalAddr != old.LocalAddr || config.Conn != old.Conn || config.Sched != old.Sched || config.ConnWeights != old.ConnWeights || config.Backoff != old.Backoff || config.MaxRetries != old.MaxRetries || config.Standby != old.Standby || config.MaxStreams != old.MaxStreams || config.Monitor != old.Monitor || config.AutoExpire != old.AutoExpire ||
+		config.ScavengeTTL != old.ScavengeTTL || config.ScavengeIdle != old.ScavengeIdle || config.Fifo != old.Fifo || config.ControlAddr != old.ControlAddr || config.ControlToken != old.ControlToken ||
+		config.ControlSock != old.ControlSock || config.MetricsAddr != old.MetricsAddr || config.OTLP != old.OTLP ||
+		config.SnmpLog != old.SnmpLog || config.SnmpPeriod != old.SnmpPeriod ||
+		config.SnmpFormat != old.SnmpFormat || config.SnmpReset != old.SnmpReset || config.Quiet != old.Quiet ||
+		config.UDP != old.UDP || config.UDPTimeout != old.UDPTimeout || config.TUN != old.TUN || config.TUNAddr != old.TUNAddr || config.Socks5 != old.Socks5 ||
+		config.HTTPProxy != old.HTTPProxy || config.TProxy != old.TProxy || config.ProxyProtocol != old.ProxyProtocol || config.Resolve != old.Resolve ||
+		config.Reverse != old.Reverse || config.LogFormat != old.LogFormat || !reflect.DeepEqual(config.Mappings, old.Mappings) ||
+		config.AutoFEC != old.AutoFEC || config.AutoKeepAlive != old.AutoKeepAlive || config.MinParity != old.MinParity || config.MaxParity != old.MaxParity ||
+		config.Wnd != old.Wnd || config.MaxWnd != old.MaxWnd || config.GOMAXPROCS != old.GOMAXPROCS || config.CPUs != old.CPUs ||
+		config.Cert != old.Cert || config.CertKey != old.CertKey || config.CA != old.CA {
+		log.Println("reload: changes to localaddr, conn, sched, connweights, backoff, maxretries, standby, maxstreams, monitor, autoexpire, scavengettl, scavengeidle, fifo, controladdr, controltoken, controlsock, metricsaddr, otlp, snmplog, snmpperiod, snmpformat, snmpreset, logformat, quiet, udp, udptimeout, tun, tunaddr, socks5, httpproxy, tproxy, proxyprotocol, resolve, reverse, mappings, autofec, autokeepalive, minparity, maxparity, wnd, maxwnd, gomaxprocs, cpus, cert, certkey and ca require a restart")
+	}
+
+	if config.Log != old.Log {
+		if err := generic.SetLogOutput(config.Log); err != nil {
+			log.Println("reload:", err)
+		}
+	}
+
+	if config.KeyFile != "" {
+		key, err := generic.ReadKeyFile(config.KeyFile)
+		if err != nil {
+			log.Println("reload:", err)
+			return
+		}
+		config.Key = key
+	}
+
+	rekeyed := config.Key != old.Key || config.Crypt != old.Crypt || config.Rekey != old.Rekey || config.AntiReplay != old.AntiReplay ||
+		config.KDF != old.KDF || config.Salt != old.Salt || config.KDFIter != old.KDFIter || config.KDFMem != old.KDFMem
+	var pass []byte
+	if rekeyed {
+		var err error
+		pass, err = deriveKey(&config)
+		if err != nil {
+			log.Println("reload:", err)
+			return
+		}
+		block = newBlockCrypt(&config, pass)
+	}
+
+	if err := t.Apply(paramsOf(&config)); err != nil {
+		log.Println("reload:", err)
+		return
+	}
+
+	redial := config.RemoteAddr != old.RemoteAddr || config.Spread != old.Spread || config.HopInterval != old.HopInterval || config.Family != old.Family || config.BindAddr != old.BindAddr || config.BindIface != old.BindIface || config.FwMark != old.FwMark || rekeyed || config.TCP != old.TCP || config.Padding != old.Padding || config.Proxy != old.Proxy || config.WS != old.WS || config.WSFallback != old.WSFallback || config.Transport != old.Transport || config.Comp != old.Comp || config.CompLevel != old.CompLevel || config.CompThreshold != old.CompThreshold || config.CompAdaptive != old.CompAdaptive ||
+		config.SmuxVer != old.SmuxVer || config.Mux != old.Mux || config.KeyExchange != old.KeyExchange || config.PQKeyExchange != old.PQKeyExchange || config.ConnKey != old.ConnKey || config.Token != old.Token || config.Migrate != old.Migrate || config.P2P != old.P2P || config.ICMP != old.ICMP
+	if old.Reverse && (config.RemoteAddr != old.RemoteAddr || rekeyed || config.TCP != old.TCP || config.Padding != old.Padding || config.Token != old.Token || config.ConnKey != old.ConnKey) {
+		log.Println("reload: in reverse mode changes to remoteaddr, key, crypt, rekey, antireplay, kdf, tcp, padding, token and connkey require a restart")
+	}
+
+	t.mu.Lock()
+	t.block = block
+	if rekeyed {
+		t.pass = pass
+	}
+	if config.RemoteAddr != old.RemoteAddr || config.Spread != old.Spread {
+		t.remotes = newRemotes(config.RemoteAddr, spreadConns(&config))
+	}
+	t.config.RemoteAddr = config.RemoteAddr
+	t.config.Spread = config.Spread
+	t.config.HopInterval = config.HopInterval
+	t.config.Family = config.Family
+	t.config.BindAddr = config.BindAddr
+	t.config.BindIface = config.BindIface
+	t.config.FwMark = config.FwMark
+	t.config.Key = config.Key
+	t.config.Crypt = config.Crypt
+	t.config.Rekey = config.Rekey
+	t.config.AntiReplay = config.AntiReplay
+	t.config.KeyExchange = config.KeyExchange
+	t.config.PQKeyExchange = config.PQKeyExchange
+	t.config.ConnKey = config.ConnKey
+	t.config.Token = config.Token
+	t.config.Migrate = config.Migrate
+	t.config.P2P = config.P2P
+	t.config.KDF = config.KDF
+	t.config.Salt = config.Salt
+	t.config.KDFIter = config.KDFIter
+	t.config.KDFMem = config.KDFMem
+	t.config.TCP = config.TCP
+	t.config.ICMP = config.ICMP
+	t.config.Padding = config.Padding
+	t.config.Proxy = config.Proxy
+	t.config.WS = config.WS
+	t.config.WSFallback = config.WSFallback
+	t.config.Transport = config.Transport
+	t.config.Comp = config.Comp
+	t.config.CompLevel = config.CompLevel
+	t.config.CompThreshold = config.CompThreshold
+	t.config.CompAdaptive = config.CompAdaptive
+	t.config.SmuxVer = config.SmuxVer
+	t.config.Mux = config.Mux
+	t.config.SmuxBuf = config.SmuxBuf
+	t.config.StreamBuf = config.StreamBuf
+	if config.CopyBuf != old.CopyBuf {
+		generic.SetCopyBuffer(config.CopyBuf)
+	}
+	t.config.CopyBuf = config.CopyBuf
+	// the keepalive found by autokeepalive stays
+	if old.AutoKeepAlive == 0 {
+		t.config.KeepAlive = config.KeepAlive
+		t.config.KeepAliveTimeout = config.KeepAliveTimeout
+	}
+	t.config.SockBuf = config.SockBuf
+	t.config.NoOffload = config.NoOffload
+	t.config.DSCP = config.DSCP
+	t.config.AckNodelay = config.AckNodelay
+	t.config.Log = config.Log
+	t.config.OnConnect = config.OnConnect
+	t.config.OnDisconnect = config.OnDisconnect
+	t.config.OnDegraded = config.OnDegraded
+	t.config.Webhook = config.Webhook
+	t.config.WebhookRTT = config.WebhookRTT
+	t.config.WebhookLoss = config.WebhookLoss
+	t.config.WebhookReconnects = config.WebhookReconnects
+	t.config.UpLimit = config.UpLimit
+	t.config.DownLimit = config.DownLimit
+	t.config.StreamLimit = config.StreamLimit
+	bandwidth.Set(config.UpLimit, config.DownLimit, config.StreamLimit)
+	var sessions []*generic.Session
+	if redial {
+		for _, s := range t.conns {
+			if s != nil {
+				sessions = append(sessions, s)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	// closed sessions are re-dialed with the new settings on the next accepted connection
+	for _, s := range sessions {
+		s.Mux.Close()
+	}
+	log.Println("reload: config reloaded from", path, "re-dial:", redial)
+}
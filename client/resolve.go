@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// resolver periodically re-resolves the hostnames of the servers and closes the
+// sessions dialed to addresses a hostname no longer resolves to, they are re-dialed
+// to the new address, as every dial resolves the hostname again.
+func (t *tuner) resolver(interval int) {
+	if interval <= 0 {
+		return
+	}
+	known := make(map[string][]net.IP)
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		for _, addr := range t.servers().addrs {
+			host, _, _, err := generic.ParsePortRange(addr)
+			if err != nil || net.ParseIP(host) != nil {
+				continue
+			}
+			ips, err := net.LookupIP(host)
+			if err != nil {
+				log.Println("resolve:", err)
+				continue
+			}
+			if old, ok := known[host]; ok {
+				if stale := missingIPs(old, ips); len(stale) > 0 {
+					log.Println("resolve:", host, "changed from", old, "to", ips)
+					t.expire(stale)
+				}
+			}
+			known[host] = ips
+		}
+		<-ticker.C
+	}
+}
+
+// missingIPs returns the addresses of old which are not in ips
+func missingIPs(old, ips []net.IP) []net.IP {
+	var missing []net.IP
+	for _, ip := range old {
+		found := false
+		for _, cur := range ips {
+			if ip.Equal(cur) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, ip)
+		}
+	}
+	return missing
+}
+
+// expire closes the sessions to any of ips
+func (t *tuner) expire(ips []net.IP) {
+	var sessions []*generic.Session
+	t.mu.Lock()
+	for _, s := range t.conns {
+		if s == nil {
+			continue
+		}
+		var remote net.IP
+		switch addr := s.Meter.RemoteAddr().(type) {
+		case *net.UDPAddr:
+			remote = addr.IP
+		case *net.TCPAddr:
+			remote = addr.IP
+		}
+		for _, ip := range ips {
+			if remote.Equal(ip) {
+				sessions = append(sessions, s)
+				break
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	for _, s := range sessions {
+		log.Println("resolve: closing session to", s.Meter.RemoteAddr())
+		s.Mux.Close()
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// the policies of -sched picking the session of -conn a new stream is opened on
+const (
+	schedRR          = "rr"
+	schedLeastLoaded = "leastloaded"
+)
+
+// how long a session that failed to open a stream ranks after the others in leastloaded
+const schedPenalty = 10 * time.Second
+
+// scheduler picks the session of -conn each new stream goes to. rr goes round the
+// sessions in proportion to their weights, leastloaded takes the one with the lowest
+// cost, its streams in flight times its rtt divided by its weight, and the sessions
+// that recently failed to open a stream last.
+type scheduler struct {
+	policy  string
+	weights []int
+	current []int   // of the smooth weighted round robin
+	failed  []int64 // unix nanoseconds of the last failure to open a stream
+}
+
+func newScheduler(policy string, weights []int) *scheduler {
+	return &scheduler{
+		policy:  policy,
+		weights: weights,
+		current: make([]int, len(weights)),
+		failed:  make([]int64, len(weights)),
+	}
+}
+
+// next returns the index of the session to open a stream on, called with the sessions
+// locked. A session that is yet to be dialed, closed or expired is returned at once to
+// be dialed anew, while leastloaded passes over those another stream is dialing unless
+// all are.
+func (s *scheduler) next(muxes []timedSession, expired func(m *timedSession) bool) int {
+	if s.policy != schedLeastLoaded {
+		return s.roundRobin()
+	}
+
+	best, bestCost, bestFailed := -1, 0.0, false
+	now := time.Now().UnixNano()
+	for i := range muxes {
+		m := &muxes[i]
+		if m.dialing != nil {
+			continue
+		}
+		if m.session == nil || m.session.IsClosed() || expired(m) {
+			return i
+		}
+		rtt := int32(1)
+		if m.conn != nil && m.conn.GetSRTT() > rtt {
+			rtt = m.conn.GetSRTT()
+		}
+		cost := float64(m.session.NumStreams()+1) * float64(rtt) / float64(s.weights[i])
+		failed := now-atomic.LoadInt64(&s.failed[i]) < int64(schedPenalty)
+		if best < 0 || (!failed && bestFailed) || (failed == bestFailed && cost < bestCost) {
+			best, bestCost, bestFailed = i, cost, failed
+		}
+	}
+	if best < 0 {
+		return 0
+	}
+	return best
+}
+
+// roundRobin is the smooth weighted round robin of nginx, which interleaves the
+// sessions instead of sending a burst to the heaviest, and with equal weights goes
+// round them in order
+func (s *scheduler) roundRobin() int {
+	best, total := 0, 0
+	for i, w := range s.weights {
+		s.current[i] += w
+		total += w
+		if s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	s.current[best] -= total
+	return best
+}
+
+// track returns mux of the session at idx, noting its failures to open a stream
+// for leastloaded
+func (s *scheduler) track(mux generic.Mux, idx int) generic.Mux {
+	if s.policy != schedLeastLoaded {
+		return mux
+	}
+	return &trackedMux{Mux: mux, failed: &s.failed[idx]}
+}
+
+// trackedMux notes the time the streams of its Mux fail to open
+type trackedMux struct {
+	generic.Mux
+	failed *int64
+}
+
+func (m *trackedMux) OpenStream() (generic.Stream, error) {
+	stream, err := m.Mux.OpenStream()
+	if err != nil {
+		atomic.StoreInt64(m.failed, time.Now().UnixNano())
+	}
+	return stream, err
+}
+
+// parseWeights parses the weights of the conn sessions like 3,1,1, the sessions
+// not listed weighing 1
+func parseWeights(s string, conn int) ([]int, error) {
+	weights := make([]int, conn)
+	for i := range weights {
+		weights[i] = 1
+	}
+	if s == "" {
+		return weights, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) > conn {
+		return nil, errors.Errorf("%v weights for %v sessions", len(parts), conn)
+	}
+	for i, part := range parts {
+		w, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || w < 1 {
+			return nil, errors.Errorf("invalid weight: %v", part)
+		}
+		weights[i] = w
+	}
+	return weights, nil
+}
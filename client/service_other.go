@@ -0,0 +1,13 @@
+// +build !windows
+
+package main
+
+import "github.com/pkg/errors"
+
+var errNoService = errors.New("service is only supported on windows")
+
+func installService(name string, args []string) error { return errNoService }
+
+func uninstallService(name string) error { return errNoService }
+
+func runService(name string, config *Config) error { return errNoService }
@@ -0,0 +1,163 @@
+// +build windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+// installService registers the client as a service started at boot, running with args
+func installService(name string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	m, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_ALL_ACCESS)
+	if err != nil {
+		return errors.Wrap(err, "OpenSCManager()")
+	}
+	defer windows.CloseServiceHandle(m)
+
+	cmdline := []string{windows.EscapeArg(exe)}
+	for _, arg := range serviceArgs(args) {
+		cmdline = append(cmdline, windows.EscapeArg(arg))
+	}
+	s, err := windows.CreateService(m, windows.StringToUTF16Ptr(name), windows.StringToUTF16Ptr("kcptun client "+name),
+		windows.SERVICE_ALL_ACCESS, windows.SERVICE_WIN32_OWN_PROCESS, windows.SERVICE_AUTO_START, windows.SERVICE_ERROR_NORMAL,
+		windows.StringToUTF16Ptr(strings.Join(cmdline, " ")), nil, nil, nil, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "CreateService()")
+	}
+	defer windows.CloseServiceHandle(s)
+	return errors.Wrap(windows.StartService(s, 0, nil), "StartService()")
+}
+
+// serviceArgs turns the flags of an install into the flags of the service, the config
+// path is made absolute as the service starts in another directory
+func serviceArgs(args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		value, inline := "", false
+		if eq := strings.IndexByte(name, '='); eq >= 0 {
+			name, value, inline = name[:eq], name[eq+1:], true
+		}
+		switch name {
+		case "service":
+			if !inline {
+				i++
+			}
+			out = append(out, "-service", "run")
+			continue
+		case "c":
+			if !inline && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			if abs, err := filepath.Abs(value); err == nil {
+				value = abs
+			}
+			out = append(out, "-c", value)
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return out
+}
+
+// uninstallService stops and removes the service
+func uninstallService(name string) error {
+	m, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_ALL_ACCESS)
+	if err != nil {
+		return errors.Wrap(err, "OpenSCManager()")
+	}
+	defer windows.CloseServiceHandle(m)
+	s, err := windows.OpenService(m, windows.StringToUTF16Ptr(name), windows.SERVICE_ALL_ACCESS)
+	if err != nil {
+		return errors.Wrap(err, "OpenService()")
+	}
+	defer windows.CloseServiceHandle(s)
+	var status windows.SERVICE_STATUS
+	windows.ControlService(s, windows.SERVICE_CONTROL_STOP, &status)
+	return errors.Wrap(windows.DeleteService(s), "DeleteService()")
+}
+
+// the service of this process, there's only one
+var (
+	serviceName   string
+	serviceHandle windows.Handle
+	serviceStop   = make(chan struct{}, 1)
+)
+
+func setServiceState(state uint32) {
+	status := windows.SERVICE_STATUS{ServiceType: windows.SERVICE_WIN32_OWN_PROCESS, CurrentState: state}
+	if state == windows.SERVICE_RUNNING {
+		status.ControlsAccepted = windows.SERVICE_ACCEPT_STOP | windows.SERVICE_ACCEPT_SHUTDOWN
+	}
+	windows.SetServiceStatus(serviceHandle, &status)
+}
+
+func serviceHandler(ctl, evtype, evdata, context uintptr) uintptr {
+	switch ctl {
+	case windows.SERVICE_CONTROL_STOP, windows.SERVICE_CONTROL_SHUTDOWN:
+		setServiceState(windows.SERVICE_STOP_PENDING)
+		select {
+		case serviceStop <- struct{}{}:
+		default:
+		}
+	case windows.SERVICE_CONTROL_INTERROGATE:
+		setServiceState(windows.SERVICE_RUNNING)
+	}
+	return 0
+}
+
+func serviceMain(argc, argv uintptr) uintptr {
+	h, err := windows.RegisterServiceCtrlHandlerEx(windows.StringToUTF16Ptr(serviceName), windows.NewCallback(serviceHandler), 0)
+	if err != nil {
+		return 1
+	}
+	serviceHandle = h
+	setServiceState(windows.SERVICE_RUNNING)
+	<-serviceStop
+	setServiceState(windows.SERVICE_STOPPED)
+	return 0
+}
+
+// runService connects to the service control manager and exits the process once the
+// service is stopped. Relative paths are resolved against the directory of the
+// executable, and the log goes to a file there unless set otherwise.
+func runService(name string, config *Config) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	dir := filepath.Dir(exe)
+	if err := os.Chdir(dir); err != nil {
+		return errors.WithStack(err)
+	}
+	if config.Log == "" {
+		config.Log = filepath.Join(dir, name+".log")
+	}
+
+	serviceName = name
+	table := []windows.SERVICE_TABLE_ENTRY{
+		{ServiceName: windows.StringToUTF16Ptr(name), ServiceProc: windows.NewCallback(serviceMain)},
+		{},
+	}
+	go func() {
+		err := windows.StartServiceCtrlDispatcher(&table[0])
+		if err != nil {
+			checkError(errors.Wrap(err, "StartServiceCtrlDispatcher()"))
+		}
+		// give the control manager a moment to take the stopped state
+		time.Sleep(100 * time.Millisecond)
+		os.Exit(0)
+	}()
+	return nil
+}
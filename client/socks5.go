@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+)
+
+const (
+	socks5Version = 5
+
+	socks5CmdConnect      = 1
+	socks5CmdUDPAssociate = 3
+
+	socks5AtypIPv4   = 1
+	socks5AtypDomain = 3
+	socks5AtypIPv6   = 4
+
+	socks5RepSucceeded           = 0
+	socks5RepGeneralFailure      = 1
+	socks5RepCommandNotSupported = 7
+	socks5RepAtypNotSupported    = 8
+
+	// how long a local client may take to finish the handshake
+	handshakeTimeout = 30 * time.Second
+)
+
+// socks5Handshake negotiates no authentication and reads the request of a local socks5 client
+func socks5Handshake(conn net.Conn) (cmd byte, addr string, err error) {
+	// | VER | NMETHODS | METHODS |
+	var buf [262]byte
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return 0, "", errors.WithStack(err)
+	}
+	if buf[0] != socks5Version {
+		return 0, "", errors.Errorf("unsupported socks version: %v", buf[0])
+	}
+	if _, err = io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return 0, "", errors.WithStack(err)
+	}
+	if _, err = conn.Write([]byte{socks5Version, 0}); err != nil {
+		return 0, "", errors.WithStack(err)
+	}
+
+	// | VER | CMD | RSV | ATYP | DST.ADDR | DST.PORT |
+	if _, err = io.ReadFull(conn, buf[:4]); err != nil {
+		return 0, "", errors.WithStack(err)
+	}
+	cmd = buf[1]
+	switch buf[3] {
+	case socks5AtypIPv4, socks5AtypIPv6, socks5AtypDomain:
+	default:
+		socks5Reply(conn, socks5RepAtypNotSupported)
+		return 0, "", errors.Errorf("unsupported address type: %v", buf[3])
+	}
+	if addr, err = socks5ReadAddr(conn, buf[3]); err != nil {
+		return 0, "", err
+	}
+	return cmd, addr, nil
+}
+
+// socks5ReadAddr reads a DST.ADDR and DST.PORT of address type atyp
+func socks5ReadAddr(r io.Reader, atyp byte) (string, error) {
+	var buf [255]byte
+	var host string
+	switch atyp {
+	case socks5AtypIPv4:
+		if _, err := io.ReadFull(r, buf[:net.IPv4len]); err != nil {
+			return "", errors.WithStack(err)
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case socks5AtypIPv6:
+		if _, err := io.ReadFull(r, buf[:net.IPv6len]); err != nil {
+			return "", errors.WithStack(err)
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	case socks5AtypDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return "", errors.WithStack(err)
+		}
+		n := buf[0]
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return "", errors.WithStack(err)
+		}
+		host = string(buf[:n])
+	default:
+		return "", errors.Errorf("unsupported address type: %v", atyp)
+	}
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", errors.WithStack(err)
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// socks5Addr encodes addr as ATYP, ADDR and PORT
+func socks5Addr(addr string) []byte {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []byte{socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	var buf []byte
+	if ip := net.ParseIP(host); ip == nil {
+		buf = append([]byte{socks5AtypDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append([]byte{socks5AtypIPv4}, ip4...)
+	} else {
+		buf = append([]byte{socks5AtypIPv6}, ip.To16()...)
+	}
+	p, _ := strconv.Atoi(port)
+	return append(buf, byte(p>>8), byte(p))
+}
+
+// socks5Reply replies to the request with an unspecified bind address
+func socks5Reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socks5Version, rep, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socks5ParseUDP splits a datagram of a local socks5 client into its destination and
+// payload, fragments aren't supported
+//
+//	| RSV(2B) | FRAG(1B) | ATYP | DST.ADDR | DST.PORT | DATA |
+func socks5ParseUDP(p []byte) (string, []byte, error) {
+	if len(p) < 4 {
+		return "", nil, errors.New("short datagram")
+	}
+	if p[2] != 0 {
+		return "", nil, errors.New("fragmented datagram")
+	}
+	r := bytes.NewReader(p[4:])
+	addr, err := socks5ReadAddr(r, p[3])
+	if err != nil {
+		return "", nil, err
+	}
+	return addr, p[len(p)-r.Len():], nil
+}
+
+// handleSocks5 serves a local socks5 client, the destination is dialed by the server
+func handleSocks5(session generic.Mux, p1 net.Conn, quiet bool) {
+	span := generic.StartSpan("stream", nil, "peer", p1.RemoteAddr())
+	defer span.End()
+
+	p1.SetDeadline(time.Now().Add(handshakeTimeout))
+	cmd, addr, err := socks5Handshake(p1)
+	if err != nil {
+		log.Println("socks5:", err)
+		p1.Close()
+		return
+	}
+	if cmd == socks5CmdUDPAssociate {
+		handleSocks5UDP(session, p1, span, quiet)
+		return
+	}
+	if cmd != socks5CmdConnect {
+		socks5Reply(p1, socks5RepCommandNotSupported)
+		p1.Close()
+		return
+	}
+
+	p2, err := openStream(session, &generic.StreamHeader{Network: generic.NetTCP, Addr: addr, Source: sourceOf(p1)}, span)
+	if err != nil {
+		log.Println("socks5:", addr, err)
+		socks5Reply(p1, socks5RepGeneralFailure)
+		p1.Close()
+		return
+	}
+	if err := socks5Reply(p1, socks5RepSucceeded); err != nil {
+		p1.Close()
+		p2.Close()
+		return
+	}
+	p1.SetDeadline(time.Time{})
+	relay(p1, p2, span, quiet)
+}
+
+// handleSocks5UDP serves the udp association requested by a local socks5 client on p1,
+// relaying its datagrams to each destination on a stream of its own, which the server
+// sends on from a udp socket of its own. The association ends with p1.
+func handleSocks5UDP(session generic.Mux, p1 net.Conn, span *generic.Span, quiet bool) {
+	defer p1.Close()
+	// the relay is bound to the address the client reached us on, and accepts its
+	// datagrams only
+	var local, client net.IP
+	if host, _, err := net.SplitHostPort(p1.LocalAddr().String()); err == nil {
+		local = net.ParseIP(host)
+	}
+	if host, _, err := net.SplitHostPort(p1.RemoteAddr().String()); err == nil {
+		client = net.ParseIP(host)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local})
+	if err != nil {
+		log.Println("socks5:", err)
+		socks5Reply(p1, socks5RepGeneralFailure)
+		return
+	}
+	defer conn.Close()
+	reply := append([]byte{socks5Version, socks5RepSucceeded, 0}, socks5Addr(conn.LocalAddr().String())...)
+	if _, err := p1.Write(reply); err != nil {
+		return
+	}
+	p1.SetDeadline(time.Time{})
+
+	var mu sync.Mutex
+	streams := make(map[string]generic.Stream)
+	defer func() {
+		mu.Lock()
+		for _, stream := range streams {
+			stream.Close()
+		}
+		mu.Unlock()
+	}()
+	go func() {
+		io.Copy(ioutil.Discard, p1)
+		conn.Close()
+	}()
+
+	// replies of a destination back to the client, prefixed with its address
+	var peer atomic.Value // *net.UDPAddr
+	replies := func(dst string, stream generic.Stream) {
+		defer func() {
+			stream.Close()
+			mu.Lock()
+			if streams[dst] == stream {
+				delete(streams, dst)
+			}
+			mu.Unlock()
+			if !quiet {
+				generic.LogEvent("udp stream closed", "in", p1.RemoteAddr(), "out", dst, "stream", stream.ID())
+			}
+		}()
+		hdr := append([]byte{0, 0, 0}, socks5Addr(dst)...)
+		buf := make([]byte, len(hdr)+generic.MaxDatagramSize)
+		copy(buf, hdr)
+		for {
+			n, err := generic.ReadDatagram(stream, buf[len(hdr):])
+			if err != nil {
+				return
+			}
+			if _, err := conn.WriteToUDP(buf[:len(hdr)+n], peer.Load().(*net.UDPAddr)); err != nil {
+				return
+			}
+		}
+	}
+
+	buf := make([]byte, generic.MaxDatagramSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if client != nil && !from.IP.Equal(client) {
+			continue
+		}
+		dst, payload, err := socks5ParseUDP(buf[:n])
+		if err != nil {
+			log.Println("socks5:", err)
+			continue
+		}
+		peer.Store(from)
+
+		mu.Lock()
+		stream, ok := streams[dst]
+		mu.Unlock()
+		if !ok {
+			if stream, err = openStream(session, &generic.StreamHeader{Network: generic.NetUDP, Addr: dst, Source: sourceOf(p1)}, span); err != nil {
+				log.Println("socks5:", dst, err)
+				continue
+			}
+			mu.Lock()
+			streams[dst] = stream
+			mu.Unlock()
+			if !quiet {
+				generic.LogEvent("udp stream opened", "in", p1.RemoteAddr(), "out", dst, "stream", stream.ID())
+			}
+			go replies(dst, stream)
+		}
+		if err := generic.WriteDatagram(stream, payload); err != nil {
+			stream.Close()
+		}
+	}
+}
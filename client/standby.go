@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// standby keeps a spare session dialed for the next session of conn that dies or
+// expires, so that new streams don't wait for the re-dial. The keepalives of its mux
+// tell whether it's still healthy, a standby found closed is dialed anew.
+type standby struct {
+	mu      sync.Mutex
+	session *generic.Session
+	remote  string
+}
+
+// keep dials a standby session to the current server whenever there's none, checking
+// every interval. A failed dial is retried after the delays of backoff, quietly: the
+// sessions of conn may be fine, so there are no hooks, alarms or giving up for it.
+func (s *standby) keep(tun *tuner, dial func(remote string) (*generic.Session, error), backoff int, interval time.Duration) {
+	for {
+		s.mu.Lock()
+		session := s.session
+		s.mu.Unlock()
+
+		if session == nil || session.Mux.IsClosed() {
+			if session != nil {
+				tun.removeSpare(session.Mux)
+				generic.LogEvent("standby session lost", "remote", s.remote)
+			}
+			remote := tun.servers().current()
+			session, err := dial(remote)
+			for attempt := 1; err != nil; attempt++ {
+				time.Sleep(backoffDelay(attempt, backoff))
+				remote = tun.servers().current()
+				session, err = dial(remote)
+			}
+			tun.addSpare(session)
+			s.mu.Lock()
+			s.session, s.remote = session, remote
+			s.mu.Unlock()
+			generic.LogEvent("standby session opened", "remote", remote)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// take hands the standby session over to the caller, nil if none is up
+func (s *standby) take(tun *tuner) (*generic.Session, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, remote := s.session, s.remote
+	if session == nil || session.Mux.IsClosed() {
+		return nil, ""
+	}
+	s.session = nil
+	tun.removeSpare(session.Mux)
+	return session, remote
+}
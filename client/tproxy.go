@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// handleTProxy serves a connection diverted by iptables, the original destination
+// is dialed by the server
+func handleTProxy(session generic.Mux, p1 *net.TCPConn, quiet bool) {
+	span := generic.StartSpan("stream", nil, "peer", p1.RemoteAddr())
+	defer span.End()
+
+	addr, err := originalDst(p1)
+	if err != nil {
+		log.Println("tproxy:", err)
+		p1.Close()
+		return
+	}
+
+	p2, err := openStream(session, &generic.StreamHeader{Network: generic.NetTCP, Addr: addr, Source: sourceOf(p1)}, span)
+	if err != nil {
+		log.Println("tproxy:", addr, err)
+		p1.Close()
+		return
+	}
+	relay(p1, p2, span, quiet)
+}
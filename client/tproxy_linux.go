@@ -0,0 +1,98 @@
+// +build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// SO_ORIGINAL_DST(linux/netfilter_ipv4.h) and IP6T_SO_ORIGINAL_DST share the same value
+const soOriginalDst = 80
+
+// listenTransparent listens on addr with IP_TRANSPARENT set, so that connections
+// diverted by an iptables TPROXY rule can be accepted, requires CAP_NET_ADMIN.
+func listenTransparent(addr string) (*net.TCPListener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				if serr == nil && network == "tcp6" {
+					serr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "listen transparent")
+	}
+	return l.(*net.TCPListener), nil
+}
+
+// originalDst recovers the destination the local client was heading to. Connections
+// redirected by REDIRECT/DNAT report it through SO_ORIGINAL_DST, while connections
+// diverted by TPROXY keep it as their local address.
+func originalDst(conn *net.TCPConn) (string, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	var dst string
+	var serr error
+	err = rawConn.Control(func(fd uintptr) {
+		local := conn.LocalAddr().(*net.TCPAddr)
+		if local.IP.To4() != nil {
+			var sa unix.RawSockaddrInet4
+			size := uint32(unsafe.Sizeof(sa))
+			serr = getsockopt(int(fd), unix.SOL_IP, soOriginalDst, unsafe.Pointer(&sa), &size)
+			if serr == nil {
+				port := ntohs(&sa.Port)
+				dst = net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(port))
+			}
+		} else {
+			var sa unix.RawSockaddrInet6
+			size := uint32(unsafe.Sizeof(sa))
+			serr = getsockopt(int(fd), unix.SOL_IPV6, soOriginalDst, unsafe.Pointer(&sa), &size)
+			if serr == nil {
+				port := ntohs(&sa.Port)
+				dst = net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(port))
+			}
+		}
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if serr != nil {
+		// not tracked by conntrack NAT, the connection was diverted by TPROXY
+		return conn.LocalAddr().String(), nil
+	}
+	return dst, nil
+}
+
+// ntohs reads a port stored in network byte order
+func ntohs(p *uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(p))
+	return int(b[0])<<8 | int(b[1])
+}
+
+func getsockopt(fd, level, name int, val unsafe.Pointer, size *uint32) error {
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name),
+		uintptr(val), uintptr(unsafe.Pointer(size)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package main
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+func listenTransparent(addr string) (*net.TCPListener, error) {
+	return nil, errors.New("tproxy is only supported on linux")
+}
+
+func originalDst(conn *net.TCPConn) (string, error) {
+	return "", errors.New("tproxy is only supported on linux")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"log"
+	"time"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// tunRelay carries the IP packets of the tun device dev on a stream to the tun device
+// of the server, opening another one on a session picked anew whenever it breaks
+func tunRelay(dev io.ReadWriteCloser, pick func() generic.Mux, quiet bool) {
+	buf := make([]byte, generic.MaxDatagramSize)
+	for {
+		stream, err := openStream(pick(), &generic.StreamHeader{Network: generic.NetTUN}, nil)
+		if err != nil {
+			log.Println("tun:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if !quiet {
+			generic.LogEvent("tun stream opened", "out", stream.RemoteAddr(), "stream", stream.ID())
+		}
+
+		// packets from the server
+		go func() {
+			defer stream.Close()
+			buf := make([]byte, generic.MaxDatagramSize)
+			for {
+				n, err := generic.ReadDatagram(stream, buf)
+				if err != nil {
+					return
+				}
+				if _, err := dev.Write(buf[:n]); err != nil {
+					log.Println("tun:", err)
+				}
+			}
+		}()
+
+		// packets to the server, until the stream breaks
+		for {
+			n, err := dev.Read(buf)
+			if err != nil {
+				log.Fatalf("%+v", err)
+			}
+			if err := generic.WriteDatagram(stream, buf[:n]); err != nil {
+				break
+			}
+		}
+		stream.Close()
+		if !quiet {
+			generic.LogEvent("tun stream closed", "out", stream.RemoteAddr(), "stream", stream.ID())
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/tls"
+	"sync"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// tuner tracks the live kcp connections and applies runtime parameter changes to them
+type tuner struct {
+	mu      sync.Mutex
+	config  *Config
+	certs   *tls.Config // authenticates each session with cert, nil for none
+	block   kcp.BlockCrypt
+	pass    []byte // key of the plain tcp transport and of key exchanges
+	remotes *remotes
+	conns   []*generic.Session
+	link    linkQuality // last summary of the link monitor
+}
+
+func newTuner(config *Config, block kcp.BlockCrypt, pass []byte) *tuner {
+	t := new(tuner)
+	t.config = config
+	t.block = block
+	t.pass = pass
+	t.remotes = newRemotes(config.RemoteAddr, spreadConns(config))
+	t.conns = make([]*generic.Session, config.Conn)
+	return t
+}
+
+// setConn replaces the session at idx and brings it up to date
+func (t *tuner) setConn(idx int, s *generic.Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[idx] = s
+	p := t.params()
+	p.ApplyTo(s.KCP)
+}
+
+// addSpare tracks a session dialed beyond conn, for the streams the others have no
+// room for, and brings it up to date
+func (t *tuner) addSpare(s *generic.Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns = append(t.conns, s)
+	p := t.params()
+	p.ApplyTo(s.KCP)
+}
+
+// removeSpare forgets the spare session of mux
+func (t *tuner) removeSpare(mux generic.Mux) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := t.config.Conn; i < len(t.conns); i++ {
+		if t.conns[i].Mux == mux {
+			t.conns = append(t.conns[:i], t.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// transport returns a snapshot of the config and the block cipher to dial new sessions with
+func (t *tuner) transport() (Config, kcp.BlockCrypt) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return *t.config, t.block
+}
+
+// streamKey returns the key to encrypt plain tcp transport sessions with, nil for none
+func (t *tuner) streamKey() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.config.Crypt == "null" {
+		return nil
+	}
+	return t.pass
+}
+
+// setKeepAlive changes the keepalive interval of new sessions, the timeout keeping its
+// margin over it
+func (t *tuner) setKeepAlive(interval int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.config.KeepAliveTimeout += interval - t.config.KeepAlive
+	t.config.KeepAlive = interval
+}
+
+// psk returns the key authenticating key exchanges
+func (t *tuner) psk() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pass
+}
+
+// servers returns the kcp servers to dial
+func (t *tuner) servers() *remotes {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.remotes
+}
+
+// Params returns the effective runtime parameters
+func (t *tuner) Params() generic.Params {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.params()
+}
+
+func (t *tuner) params() generic.Params {
+	return paramsOf(t.config)
+}
+
+// paramsOf extracts the runtime parameters from a config
+func paramsOf(config *Config) generic.Params {
+	return generic.Params{
+		Mode:         config.Mode,
+		NoDelay:      config.NoDelay,
+		Interval:     config.Interval,
+		Resend:       config.Resend,
+		NoCongestion: config.NoCongestion,
+		SndWnd:       config.SndWnd,
+		RcvWnd:       config.RcvWnd,
+		DataShard:    config.DataShard,
+		ParityShard:  config.ParityShard,
+		MTU:          config.MTU,
+	}
+}
+
+// Apply changes the parameters of all live connections and the ones created later
+func (t *tuner) Apply(p generic.Params) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.config.Mode = p.Mode
+	t.config.NoDelay, t.config.Interval, t.config.Resend, t.config.NoCongestion = p.NoDelay, p.Interval, p.Resend, p.NoCongestion
+	t.config.SndWnd, t.config.RcvWnd = p.SndWnd, p.RcvWnd
+	t.config.DataShard, t.config.ParityShard = p.DataShard, p.ParityShard
+	t.config.MTU = p.MTU
+	for _, s := range t.conns {
+		if s != nil {
+			p.ApplyTo(s.KCP)
+		}
+	}
+	return nil
+}
+
+// Sessions returns the live sessions
+func (t *tuner) Sessions() []*generic.Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var sessions []*generic.Session
+	for _, s := range t.conns {
+		if s != nil && !s.Mux.IsClosed() {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
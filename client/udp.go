@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// udpStream is a smux stream carrying the datagrams of one local udp peer
+type udpStream struct {
+	stream     generic.Stream
+	lastActive int64
+}
+
+func (us *udpStream) touch() { atomic.StoreInt64(&us.lastActive, time.Now().UnixNano()) }
+
+func (us *udpStream) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&us.lastActive)))
+}
+
+// udpRelay forwards the datagrams received on conn through the tunnel, tracking each
+// source address like a NAT with its own smux stream, and writes replies back to it.
+func udpRelay(conn *net.UDPConn, pick func() generic.Mux, timeout time.Duration, quiet bool) {
+	var mu sync.Mutex
+	peers := make(map[string]*udpStream)
+
+	// expire idle peers
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			mu.Lock()
+			for _, us := range peers {
+				if us.idle() > timeout {
+					us.stream.Close()
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	buf := make([]byte, generic.MaxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Fatalf("%+v", err)
+		}
+
+		key := addr.String()
+		mu.Lock()
+		us, ok := peers[key]
+		mu.Unlock()
+		if !ok {
+			stream, err := pick().OpenStream()
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			us = &udpStream{stream: stream}
+			us.touch()
+			mu.Lock()
+			peers[key] = us
+			mu.Unlock()
+			if !quiet {
+				generic.LogEvent("udp stream opened", "in", addr, "out", stream.RemoteAddr(), "stream", stream.ID())
+			}
+
+			// replies from the tunnel back to the local peer
+			go func(addr *net.UDPAddr, us *udpStream) {
+				defer func() {
+					us.stream.Close()
+					mu.Lock()
+					delete(peers, addr.String())
+					mu.Unlock()
+					if !quiet {
+						generic.LogEvent("udp stream closed", "in", addr, "out", us.stream.RemoteAddr(), "stream", us.stream.ID())
+					}
+				}()
+
+				rbuf := make([]byte, generic.MaxDatagramSize)
+				for {
+					n, err := generic.ReadDatagram(us.stream, rbuf)
+					if err != nil {
+						return
+					}
+					us.touch()
+					if _, err := conn.WriteToUDP(rbuf[:n], addr); err != nil {
+						return
+					}
+				}
+			}(addr, us)
+		}
+
+		us.touch()
+		if err := generic.WriteDatagram(us.stream, buf[:n]); err != nil {
+			us.stream.Close()
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// watchdog judges whether the tunnel makes progress for the systemd watchdog. It is
+// stuck while sessions can't be created, or while open sessions hear nothing from
+// the server, not even its keepalives.
+type watchdog struct {
+	tun        *tuner
+	staleAfter time.Duration
+	connecting int32 // set while creating a session fails
+
+	lastIn     uint64
+	lastChange time.Time
+}
+
+func newWatchdog(tun *tuner, keepalive int) *watchdog {
+	return &watchdog{tun: tun, staleAfter: 3 * time.Duration(keepalive) * time.Second, lastChange: time.Now()}
+}
+
+// failing records the outcome of an attempt to create a session
+func (w *watchdog) failing(failed bool) {
+	if failed {
+		atomic.StoreInt32(&w.connecting, 1)
+	} else {
+		atomic.StoreInt32(&w.connecting, 0)
+	}
+}
+
+// healthy is called from the watchdog loop only
+func (w *watchdog) healthy() bool {
+	if atomic.LoadInt32(&w.connecting) != 0 {
+		return false
+	}
+	sessions := w.tun.Sessions()
+	var in uint64
+	for _, s := range sessions {
+		in += s.Meter.BytesIn()
+	}
+	if in != w.lastIn || len(sessions) == 0 {
+		w.lastIn, w.lastChange = in, time.Now()
+	}
+	return w.staleAfter <= 0 || time.Since(w.lastChange) < w.staleAfter
+}
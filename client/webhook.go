@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/generic"
+)
+
+const (
+	// period the link is measured over against the thresholds of the webhook
+	webhookPeriod = time.Minute
+	// the time the webhook has to answer
+	webhookTimeout = 10 * time.Second
+	// segments sent or received in a period at least for its loss to count
+	webhookMinSegs = 100
+)
+
+// webhookEvent is the json posted to the webhook
+type webhookEvent struct {
+	Event      string   `json:"event"` // degraded, recovered
+	Time       string   `json:"time"`
+	Remote     string   `json:"remote"`
+	Local      string   `json:"local"`
+	Exceeded   []string `json:"exceeded"` // rtt, loss, reconnects
+	RTT        int32    `json:"rtt"`      // ms, average of the sessions
+	Loss       float64  `json:"loss"`     // percent, -1 without enough traffic to tell
+	Reconnects uint32   `json:"reconnects"`
+	Period     int      `json:"period"` // seconds measured over
+}
+
+// webhook posts to the url of -webhook when the rtt, loss or reconnects of a period
+// cross their thresholds, and again once they are all back below
+type webhook struct {
+	tun        *tuner
+	reconnects uint32 // in the current period
+	alarmed    bool
+}
+
+func newWebhook(tun *tuner) *webhook {
+	return &webhook{tun: tun}
+}
+
+// reconnected counts a dead session replaced
+func (w *webhook) reconnected() {
+	atomic.AddUint32(&w.reconnects, 1)
+}
+
+// watch measures the link every period and posts the changes
+func (w *webhook) watch() {
+	ticker := time.NewTicker(webhookPeriod)
+	defer ticker.Stop()
+	last := kcp.DefaultSnmp.Copy()
+	for range ticker.C {
+		config, _ := w.tun.transport()
+		cur := kcp.DefaultSnmp.Copy()
+		loss, lossKnown := generic.Loss(cur, last, webhookMinSegs)
+		last = cur
+		reconnects := atomic.SwapUint32(&w.reconnects, 0)
+		if config.Webhook == "" {
+			w.alarmed = false
+			continue
+		}
+
+		var rtt, n int32
+		for _, s := range w.tun.Sessions() {
+			if s.KCP != nil {
+				rtt += s.KCP.GetSRTT()
+				n++
+			}
+		}
+		if n > 0 {
+			rtt /= n
+		}
+
+		ev := webhookEvent{
+			Time:       time.Now().Format(time.RFC3339),
+			Remote:     w.tun.servers().current(),
+			Local:      config.LocalAddr,
+			Exceeded:   []string{},
+			RTT:        rtt,
+			Loss:       -1,
+			Reconnects: reconnects,
+			Period:     int(webhookPeriod / time.Second),
+		}
+		if lossKnown {
+			ev.Loss = math.Round(loss*1000) / 10
+		}
+		if config.WebhookRTT > 0 && n > 0 && int(rtt) >= config.WebhookRTT {
+			ev.Exceeded = append(ev.Exceeded, "rtt")
+		}
+		if config.WebhookLoss > 0 && lossKnown && ev.Loss >= float64(config.WebhookLoss) {
+			ev.Exceeded = append(ev.Exceeded, "loss")
+		}
+		if config.WebhookReconnects > 0 && int(reconnects) >= config.WebhookReconnects {
+			ev.Exceeded = append(ev.Exceeded, "reconnects")
+		}
+
+		switch {
+		case len(ev.Exceeded) > 0 && !w.alarmed:
+			ev.Event = "degraded"
+		case len(ev.Exceeded) == 0 && w.alarmed:
+			ev.Event = "recovered"
+		default:
+			continue
+		}
+		w.alarmed = ev.Event == "degraded"
+		generic.LogEvent("link "+ev.Event, "exceeded", ev.Exceeded, "rtt", ev.RTT, "loss", ev.Loss, "reconnects", ev.Reconnects)
+		go postWebhook(config.Webhook, &ev)
+	}
+}
+
+// postWebhook posts ev to url, logging failures
+func postWebhook(url string, ev *webhookEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Println("webhook:", err)
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("webhook:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Println("webhook:", url, resp.Status)
+	}
+}
@@ -0,0 +1,235 @@
+package generic
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+type aclRule struct {
+	allow bool
+	net   *net.IPNet
+}
+
+// aclRules is a loaded access list, sources matching no rule are denied if there's an
+// allow rule at all
+type aclRules struct {
+	rules        []aclRule
+	defaultAllow bool
+}
+
+// ACL filters sources by an access list file of allow and deny rules, one per line,
+// like "allow 10.0.0.0/8", "deny 192.0.2.1" or "deny all", the first matching rule
+// applies. Without a file all sources are allowed.
+type ACL struct {
+	rules atomic.Value // *aclRules
+}
+
+// NewACL loads the access list at path, an empty path allows all
+func NewACL(path string) (*ACL, error) {
+	acl := new(ACL)
+	if err := acl.Load(path); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Load replaces the access list with the one at path, it's kept if the file is invalid
+func (acl *ACL) Load(path string) error {
+	rules := &aclRules{defaultAllow: true}
+	if path == "" {
+		acl.rules.Store(rules)
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+			return errors.Errorf("%v:%v: invalid rule: %v", path, n, line)
+		}
+		allow := fields[0] == "allow"
+		nets, err := parseACLSource(fields[1])
+		if err != nil {
+			return errors.Errorf("%v:%v: %v", path, n, err)
+		}
+		for _, ipnet := range nets {
+			rules.rules = append(rules.rules, aclRule{allow, ipnet})
+		}
+		if allow {
+			rules.defaultAllow = false
+		}
+	}
+	acl.rules.Store(rules)
+	return nil
+}
+
+// parseACLSource parses all, an ip or a cidr
+func parseACLSource(s string) ([]*net.IPNet, error) {
+	if s == "all" {
+		_, all4, _ := net.ParseCIDR("0.0.0.0/0")
+		_, all6, _ := net.ParseCIDR("::/0")
+		return []*net.IPNet{all4, all6}, nil
+	}
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.Errorf("invalid address: %v", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return []*net.IPNet{{IP: ip4, Mask: net.CIDRMask(32, 32)}}, nil
+		}
+		return []*net.IPNet{{IP: ip, Mask: net.CIDRMask(128, 128)}}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errors.Errorf("invalid cidr: %v", s)
+	}
+	return []*net.IPNet{ipnet}, nil
+}
+
+// Allowed reports whether packets and connections from addr are accepted
+func (acl *ACL) Allowed(addr net.Addr) bool {
+	rules, _ := acl.rules.Load().(*aclRules)
+	if rules == nil || len(rules.rules) == 0 {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return rules.defaultAllow
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, r := range rules.rules {
+		if r.net.Contains(ip) {
+			return r.allow
+		}
+	}
+	return rules.defaultAllow
+}
+
+// aclPacketConn drops the packets of sources denied by the access list
+type aclPacketConn struct {
+	net.PacketConn
+	acl   *ACL
+	xconn batchConn
+}
+
+// NewACLPacketConn filters the packets read from conn by acl
+func NewACLPacketConn(conn net.PacketConn, acl *ACL) net.PacketConn {
+	return &aclPacketConn{PacketConn: conn, acl: acl, xconn: newBatchConn(conn)}
+}
+
+func (c *aclPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || c.acl.Allowed(addr) {
+			return n, addr, err
+		}
+	}
+}
+
+// ReadBatch reads packets like ReadFrom, moving the ones allowed to the front
+func (c *aclPacketConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	for {
+		n, err := c.xconn.ReadBatch(ms, flags)
+		if err != nil {
+			return n, err
+		}
+		allowed := 0
+		for i := 0; i < n; i++ {
+			if c.acl.Allowed(ms[i].Addr) {
+				ms[allowed], ms[i] = ms[i], ms[allowed]
+				allowed++
+			}
+		}
+		if allowed > 0 {
+			return allowed, nil
+		}
+	}
+}
+
+func (c *aclPacketConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	return c.xconn.WriteBatch(ms, flags)
+}
+
+func (c *aclPacketConn) SetReadBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errors.New("SetReadBuffer: not supported")
+}
+
+func (c *aclPacketConn) SetWriteBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errors.New("SetWriteBuffer: not supported")
+}
+
+func (c *aclPacketConn) SetDSCP(dscp int) error {
+	if nc, ok := c.PacketConn.(interface{ SetDSCP(int) error }); ok {
+		return nc.SetDSCP(dscp)
+	}
+	if nc, ok := c.PacketConn.(net.Conn); ok {
+		err4 := ipv4.NewConn(nc).SetTOS(dscp << 2)
+		err6 := ipv6.NewConn(nc).SetTrafficClass(dscp)
+		if err4 == nil || err6 == nil {
+			return nil
+		}
+	}
+	return errors.New("SetDSCP: not supported")
+}
+
+// aclListener closes the connections of sources denied by the access list
+type aclListener struct {
+	net.Listener
+	acl *ACL
+}
+
+// NewACLListener filters the connections accepted on lis by acl
+func NewACLListener(lis net.Listener, acl *ACL) net.Listener {
+	return &aclListener{Listener: lis, acl: acl}
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.acl.Allowed(conn.RemoteAddr()) {
+			return conn, err
+		}
+		conn.Close()
+	}
+}
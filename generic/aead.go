@@ -0,0 +1,190 @@
+package generic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"hash/crc32"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// kcp-go prepends a 16 bytes nonce and a 4 bytes crc32 to every packet and expects
+// encryption to preserve the length. An AEAD fits in the same 20 bytes by carrying an
+// 8 bytes nonce and a 12 bytes tag instead:
+//
+//	plaintext:  | NONCE(16B) | CRC32(4B) | DATA |
+//	ciphertext: | NONCE(8B) | SEALED DATA | TAG(12B) |
+//
+// the ciphers with a longer tag, like aes-gcm-siv, carry a shorter nonce instead. On
+// decryption the crc32 is recomputed for authenticated packets and deliberately broken
+// for forged ones, so that kcp-go drops them as checksum errors.
+//
+// Random 8 bytes nonces under the key every session and client shares repeat after
+// about 2^32 packets, and a repeated nonce would give away the authentication key of
+// AES-GCM or Poly1305 for good. So aes-gcm counts its nonces up from a random start
+// instead, which never repeat within a process, and chacha20-poly1305 seals every
+// packet under a subkey derived from its nonce, like XChaCha20 does, so that a repeat
+// only exposes the two packets of that subkey.
+const (
+	aeadHeaderSize = 20
+	aeadTagSize    = 12
+)
+
+var errOpen = errors.New("chacha20poly1305: message authentication failed")
+
+type aeadBlockCrypt struct {
+	next uint64 // the nonce of the next packet with counted nonces, first for atomic alignment
+	aead cipher.AEAD
+	// counted replaces the random nonce of kcp-go by next
+	counted bool
+	// derive returns the cipher of the packet with nonce, sealed with a zero nonce,
+	// nil for aead with the nonce itself
+	derive func(nonce []byte) cipher.AEAD
+}
+
+// nonceSize is the part of the header left to the nonce by the tag
+func (c *aeadBlockCrypt) nonceSize() int { return aeadHeaderSize - c.aead.Overhead() }
+
+// NewAESGCMBlockCrypt creates an authenticated AES-GCM cipher, key is 16, 24 or 32 bytes
+func NewAESGCMBlockCrypt(key []byte) (kcp.BlockCrypt, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCMWithTagSize(block, aeadTagSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c := &aeadBlockCrypt{aead: aead, counted: true}
+	var start [8]byte
+	if _, err := rand.Read(start[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c.next = binary.BigEndian.Uint64(start[:])
+	return c, nil
+}
+
+// NewChaCha20Poly1305BlockCrypt creates an authenticated ChaCha20-Poly1305 cipher with a 32 bytes key
+func NewChaCha20Poly1305BlockCrypt(key []byte) (kcp.BlockCrypt, error) {
+	aead, err := newChaCha20Poly1305(append([]byte(nil), key...))
+	if err != nil {
+		return nil, err
+	}
+	// the subkey is the HChaCha20 of the nonce, as in XChaCha20-Poly1305
+	master := aead.(*chacha20poly1305Trunc).key
+	derive := func(nonce []byte) cipher.AEAD {
+		var in [16]byte
+		copy(in[:], nonce)
+		// the sizes of the key and the nonce are the only errors, both are right
+		subkey, _ := chacha20.HChaCha20(master, in[:])
+		sub, _ := newChaCha20Poly1305(subkey)
+		return sub
+	}
+	return &aeadBlockCrypt{aead: aead, derive: derive}, nil
+}
+
+// chacha20poly1305Trunc is the ChaCha20-Poly1305 of RFC 8439 with the tag cut to
+// aeadTagSize bytes. x/crypto only opens full tags, so a packet is opened by
+// decrypting it with the keystream of the seal and sealing the result again.
+type chacha20poly1305Trunc struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+func newChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &chacha20poly1305Trunc{key: key, aead: aead}, nil
+}
+
+func (c *chacha20poly1305Trunc) NonceSize() int { return chacha20poly1305.NonceSize }
+func (c *chacha20poly1305Trunc) Overhead() int  { return aeadTagSize }
+
+func (c *chacha20poly1305Trunc) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	sealed := c.aead.Seal(nil, nonce, plaintext, additionalData)
+	ret, out := sliceForAppend(dst, len(plaintext)+aeadTagSize)
+	copy(out, sealed)
+	return ret
+}
+
+func (c *chacha20poly1305Trunc) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aeadTagSize {
+		return nil, errOpen
+	}
+	n := len(ciphertext) - aeadTagSize
+	s, err := chacha20.NewUnauthenticatedCipher(c.key, nonce)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// the first block of the keystream is the poly1305 key
+	s.SetCounter(1)
+	ret, out := sliceForAppend(dst, n)
+	s.XORKeyStream(out, ciphertext[:n])
+	sealed := c.aead.Seal(nil, nonce, out, additionalData)
+	if subtle.ConstantTimeCompare(sealed[n:n+aeadTagSize], ciphertext[n:]) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errOpen
+	}
+	return ret, nil
+}
+
+// cipherOf returns the cipher and the nonce to seal or open the packet p with
+func (c *aeadBlockCrypt) cipherOf(p []byte) (cipher.AEAD, []byte) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if c.derive != nil {
+		return c.derive(p[:c.nonceSize()]), nonce
+	}
+	copy(nonce, p[:c.nonceSize()])
+	return c.aead, nonce
+}
+
+func (c *aeadBlockCrypt) Encrypt(dst, src []byte) {
+	n := len(src)
+	ns := c.nonceSize()
+	copy(dst, src[:ns])
+	if c.counted {
+		binary.BigEndian.PutUint64(dst, atomic.AddUint64(&c.next, 1))
+	}
+	copy(dst[ns:], src[aeadHeaderSize:n])
+	data := dst[ns : n-c.aead.Overhead()]
+	aead, nonce := c.cipherOf(dst)
+	aead.Seal(data[:0], nonce, data, nil)
+}
+
+func (c *aeadBlockCrypt) Decrypt(dst, src []byte) {
+	n := len(src)
+	ns := c.nonceSize()
+	copy(dst, src[:n])
+	data := dst[ns:n]
+	aead, nonce := c.cipherOf(dst)
+	plain, err := aead.Open(data[:0], nonce, data, nil)
+	copy(dst[aeadHeaderSize:n], dst[ns:n-c.aead.Overhead()])
+	checksum := crc32.ChecksumIEEE(dst[aeadHeaderSize:n])
+	if err != nil || len(plain) != n-aeadHeaderSize {
+		checksum = ^checksum
+	}
+	binary.LittleEndian.PutUint32(dst[aeadHeaderSize-4:], checksum)
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the extension
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
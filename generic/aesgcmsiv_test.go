@@ -0,0 +1,87 @@
+package generic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// the test vectors of RFC 8452 appendix C
+var gcmsivVectors = []struct {
+	key, nonce, ad, plaintext, result string
+}{
+	{"01000000000000000000000000000000", "030000000000000000000000", "", "", "dc20e2d83f25705bb49e439eca56de25"},
+	{"01000000000000000000000000000000", "030000000000000000000000", "", "0100000000000000", "b5d839330ac7b786578782fff6013b815b287c22493a364c"},
+	{"01000000000000000000000000000000", "030000000000000000000000", "", "010000000000000000000000", "7323ea61d05932260047d942a4978db357391a0bc4fdec8b0d106639"},
+	{"01000000000000000000000000000000", "030000000000000000000000", "", "01000000000000000000000000000000", "743f7c8077ab25f8624e2e948579cf77303aaf90f6fe21199c6068577437a0c4"},
+	{"01000000000000000000000000000000", "030000000000000000000000", "", "0100000000000000000000000000000002000000000000000000000000000000", "84e07e62ba83a6585417245d7ec413a9fe427d6315c09b57ce45f2e3936a94451a8e45dcd4578c667cd86847bf6155ff"},
+	{"01000000000000000000000000000000", "030000000000000000000000", "01", "0200000000000000", "1e6daba35669f4273b0a1a2560969cdf790d99759abd1508"},
+	{"0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "", "", "07f5f4169bbf55a8400cd47ea6fd400f"},
+	{"0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "", "0100000000000000", "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28"},
+	{"0000000000000000000000000000000000000000000000000000000000000000", "000000000000000000000000", "", "000000000000000000000000000000004db923dc793ee6497c76dcc03a98e108", "f3f80f2cf0cb2dd9c5984fcda908456cc537703b5ba70324a6793a7bf218d3eaffffffff000000000000000000000000"},
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestAESGCMSIV(t *testing.T) {
+	for i, v := range gcmsivVectors {
+		key, nonce, ad := decodeHex(t, v.key), decodeHex(t, v.nonce), decodeHex(t, v.ad)
+		plaintext, result := decodeHex(t, v.plaintext), decodeHex(t, v.result)
+		aead, err := newAESGCMSIV(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sealed := aead.Seal(nil, nonce, plaintext, ad); !bytes.Equal(sealed, result) {
+			t.Errorf("#%v: sealed %x, want %x", i, sealed, result)
+		}
+		opened, err := aead.Open(nil, nonce, result, ad)
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("#%v: opened %x, %v, want %x", i, opened, err, plaintext)
+		}
+		result[0] ^= 1
+		if _, err := aead.Open(nil, nonce, result, ad); err == nil {
+			t.Errorf("#%v: opened a forged message", i)
+		}
+	}
+}
+
+// benchBlockCrypt encrypts and decrypts packets of the default mtu with block
+func benchBlockCrypt(b *testing.B, block kcp.BlockCrypt) {
+	data := make([]byte, 1350)
+	rand.Read(data)
+	enc, dec := make([]byte, len(data)), make([]byte, len(data))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data) * 2))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		block.Encrypt(enc, data)
+		block.Decrypt(dec, enc)
+	}
+}
+
+func BenchmarkAESGCMSIV(b *testing.B) {
+	block, err := NewAESGCMSIVBlockCrypt(make([]byte, 32))
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchBlockCrypt(b, block)
+}
+
+// BenchmarkAESGCM is the baseline aes-gcm-siv is measured against
+func BenchmarkAESGCM(b *testing.B) {
+	block, err := NewAESGCMBlockCrypt(make([]byte, 32))
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchBlockCrypt(b, block)
+}
@@ -0,0 +1,35 @@
+// +build linux
+
+package generic
+
+import (
+	"io/ioutil"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// setAffinity pins every thread of the process to cpus, threads started afterwards
+// inherit it from the thread starting them
+func setAffinity(cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		// a thread may have exited since
+		if err := unix.SchedSetaffinity(tid, &set); err != nil && err != unix.ESRCH {
+			return errors.Wrapf(err, "cpus %v", cpus)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+// +build !linux
+
+package generic
+
+import "github.com/pkg/errors"
+
+// setAffinity is only supported on linux
+func setAffinity(cpus []int) error {
+	return errors.New("cpus is only supported on linux")
+}
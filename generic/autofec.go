@@ -0,0 +1,109 @@
+package generic
+
+import (
+	"log"
+	"math"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+const (
+	// period of estimating the loss and adjusting the parity shards
+	autoFECInterval = 10 * time.Second
+	// segments sent or received in a period at least for its loss to count
+	autoFECMinSegs = 100
+	// periods in a row the loss has to allow fewer parity shards before lowering them
+	autoFECLowerAfter = 3
+)
+
+// AutoFEC adjusts the parity shards of t to the packet loss, between minParity and
+// maxParity, keeping the data shards. Parity shards are raised at once, and lowered
+// one at a time once the loss stays low for a while.
+func AutoFEC(t Tuner, minParity, maxParity int) {
+	ticker := time.NewTicker(autoFECInterval)
+	defer ticker.Stop()
+	last := kcp.DefaultSnmp.Copy()
+	var calm int
+	for range ticker.C {
+		cur := kcp.DefaultSnmp.Copy()
+		loss, ok := Loss(cur, last, autoFECMinSegs)
+		last = cur
+		if !ok {
+			continue
+		}
+
+		p := t.Params()
+		if p.DataShard <= 0 {
+			continue
+		}
+		parity := fecParity(p.DataShard, loss, minParity, maxParity)
+		switch {
+		case parity > p.ParityShard:
+			calm = 0
+		case parity < p.ParityShard:
+			if calm++; calm < autoFECLowerAfter {
+				continue
+			}
+			calm = 0
+			parity = p.ParityShard - 1
+		default:
+			calm = 0
+			continue
+		}
+
+		p.ParityShard = parity
+		if err := t.Apply(p); err != nil {
+			log.Println("autofec:", err)
+			continue
+		}
+		LogEvent("fec adjusted", "loss", math.Round(loss*1000)/1000, "datashard", p.DataShard, "parityshard", p.ParityShard)
+	}
+}
+
+// Loss estimates the packet loss between the snmp counters last and cur, as the larger
+// of the segments sent which had to be retransmitted and the segments received which
+// the peer's fec had to recover, as the loss fec repairs causes no retransmissions.
+// It isn't known unless minSegs segments were sent or received.
+func Loss(cur, last *kcp.Snmp, minSegs uint64) (loss float64, ok bool) {
+	outSegs, retrans := counterDelta(cur.OutSegs, last.OutSegs), counterDelta(cur.RetransSegs, last.RetransSegs)
+	inSegs, recovered := counterDelta(cur.InSegs, last.InSegs), counterDelta(cur.FECRecovered, last.FECRecovered)
+	if outSegs >= minSegs {
+		loss, ok = float64(retrans)/float64(outSegs), true
+	}
+	if inSegs >= minSegs {
+		loss, ok = math.Max(loss, float64(recovered)/float64(inSegs)), true
+	}
+	return loss, ok
+}
+
+// Retransmitted returns the ratio of the segments sent between the snmp counters last
+// and cur which were retransmissions, 0 without any sent
+func Retransmitted(cur, last *kcp.Snmp) float64 {
+	outSegs, retrans := counterDelta(cur.OutSegs, last.OutSegs), counterDelta(cur.RetransSegs, last.RetransSegs)
+	if outSegs == 0 {
+		return 0
+	}
+	return float64(retrans) / float64(outSegs)
+}
+
+// fecParity returns the parity shards protecting dataShards against twice the loss,
+// within minParity and maxParity
+func fecParity(dataShards int, loss float64, minParity, maxParity int) int {
+	parity := int(math.Ceil(2 * loss * float64(dataShards)))
+	if parity < minParity {
+		parity = minParity
+	}
+	if parity > maxParity {
+		parity = maxParity
+	}
+	return parity
+}
+
+// counterDelta returns how much a counter grew, the counters start over after a reset
+func counterDelta(cur, last uint64) uint64 {
+	if cur < last {
+		return cur
+	}
+	return cur - last
+}
@@ -0,0 +1,111 @@
+package generic
+
+import (
+	"log"
+	"math"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// ModeAuto is the mode switching between the profiles by the loss and rtt measured,
+// starting at fast
+const ModeAuto = "auto"
+
+const (
+	// period of estimating the loss and rtt and switching the profile
+	autoModeInterval = 10 * time.Second
+	// rtt from which the loss costs a profile more, as a retransmission waits longer
+	autoModeHighRTT = 150 // ms
+	// periods in a row the link has to allow a calmer profile before switching to it
+	autoModeLowerAfter = 3
+)
+
+// autoModeProfiles are the profiles of -mode auto, calmest first
+var autoModeProfiles = []string{"normal", "fast", "fast2", "fast3"}
+
+// AutoMode switches the nodelay parameters of t between the profiles normal, fast,
+// fast2 and fast3 while its mode is auto: by the loss, estimated like AutoFEC does,
+// under 1%, 3% or 8% and above, one profile more aggressive from autoModeHighRTT on
+// with any loss. More aggressive profiles are switched to at once, calmer ones one at
+// a time once the link stays clean for a while, so that clean links don't pay for
+// retransmissions they don't need.
+func AutoMode(t Tuner) {
+	ticker := time.NewTicker(autoModeInterval)
+	defer ticker.Stop()
+	last := kcp.DefaultSnmp.Copy()
+	var calm int
+	for range ticker.C {
+		cur := kcp.DefaultSnmp.Copy()
+		loss, ok := Loss(cur, last, autoFECMinSegs)
+		last = cur
+
+		p := t.Params()
+		if p.Mode != ModeAuto {
+			calm = 0
+			continue
+		}
+		if !ok {
+			continue
+		}
+		level := autoModeLevel(&p)
+
+		var rtt, n int32
+		for _, s := range t.Sessions() {
+			if s.KCP != nil {
+				rtt += s.KCP.GetSRTT()
+				n++
+			}
+		}
+		if n > 0 {
+			rtt /= n
+		}
+
+		target := 0
+		switch {
+		case loss >= 0.08:
+			target = 3
+		case loss >= 0.03:
+			target = 2
+		case loss >= 0.01:
+			target = 1
+		}
+		if rtt >= autoModeHighRTT && target > 0 && target < len(autoModeProfiles)-1 {
+			target++
+		}
+
+		switch {
+		case target > level:
+			calm = 0
+		case target < level:
+			if calm++; calm < autoModeLowerAfter {
+				continue
+			}
+			calm = 0
+			target = level - 1
+		default:
+			calm = 0
+			continue
+		}
+
+		profile := autoModeProfiles[target]
+		p.NoDelay, p.Interval, p.Resend, p.NoCongestion, _ = ModeProfile(profile)
+		if err := t.Apply(p); err != nil {
+			log.Println("automode:", err)
+			continue
+		}
+		LogEvent("mode adjusted", "loss", math.Round(loss*1000)/1000, "rtt", rtt, "profile", profile)
+	}
+}
+
+// autoModeLevel returns the index of the profile p is at, fast if it's at none, as
+// after a reload
+func autoModeLevel(p *Params) int {
+	for i, profile := range autoModeProfiles {
+		nodelay, interval, resend, nc, _ := ModeProfile(profile)
+		if p.NoDelay == nodelay && p.Interval == interval && p.Resend == resend && p.NoCongestion == nc {
+			return i
+		}
+	}
+	return 1
+}
@@ -0,0 +1,92 @@
+package generic
+
+import (
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+const (
+	// period of measuring the sessions and resizing their windows
+	autoWndInterval = time.Second
+	// share of a window in use at which it's considered the bottleneck and doubled
+	autoWndGrow = 0.8
+	// share of a window in use below which it's halved
+	autoWndShrink = 0.25
+)
+
+// wndState is the last measure of a session and the windows given to it
+type wndState struct {
+	bytesIn, bytesOut uint64
+	sndwnd, rcvwnd    int
+}
+
+// AutoWindow resizes the windows of each session of t to its bandwidth-delay product.
+// Every second the bytes sent and received are compared to what the windows allow at
+// the session's smoothed rtt, a window nearly filled is doubled, one mostly idle is
+// halved. The windows of t are the least a session gets, maxWnd the most.
+func AutoWindow(t Tuner, maxWnd int) {
+	ticker := time.NewTicker(autoWndInterval)
+	defer ticker.Stop()
+	states := make(map[*Session]*wndState)
+	last := time.Now()
+	for now := range ticker.C {
+		elapsed := now.Sub(last).Seconds()
+		last = now
+		p := t.Params()
+		mss := float64(p.MTU - kcp.IKCP_OVERHEAD)
+
+		live := make(map[*Session]*wndState)
+		for _, s := range t.Sessions() {
+			if s.KCP == nil {
+				continue
+			}
+			in, out := s.Meter.BytesIn(), s.Meter.BytesOut()
+			st, ok := states[s]
+			if !ok {
+				// measure from the next period on
+				live[s] = &wndState{in, out, p.SndWnd, p.RcvWnd}
+				continue
+			}
+			live[s] = st
+
+			// packets in flight the rates measured need, at the current rtt
+			rtt := float64(s.KCP.GetSRTT()) / 1000
+			if rtt <= 0 {
+				rtt = float64(p.Interval) / 1000
+			}
+			sndNeed := float64(out-st.bytesOut) / elapsed * rtt / mss
+			rcvNeed := float64(in-st.bytesIn) / elapsed * rtt / mss
+			st.bytesIn, st.bytesOut = in, out
+
+			sndwnd := resizeWindow(st.sndwnd, sndNeed, p.SndWnd, maxWnd)
+			rcvwnd := resizeWindow(st.rcvwnd, rcvNeed, p.RcvWnd, maxWnd)
+			// set every period, as changes of the parameters reset the windows
+			s.KCP.SetWindowSize(sndwnd, rcvwnd)
+			if sndwnd != st.sndwnd || rcvwnd != st.rcvwnd {
+				st.sndwnd, st.rcvwnd = sndwnd, rcvwnd
+				LogEvent("window resized", "remote", s.KCP.RemoteAddr(), "rtt", time.Duration(rtt*float64(time.Second)).Round(time.Millisecond),
+					"sndwnd", sndwnd, "rcvwnd", rcvwnd)
+			}
+		}
+		states = live
+	}
+}
+
+// resizeWindow doubles wnd if need nearly fills it, halves it if need is far below,
+// keeping it within least and most
+func resizeWindow(wnd int, need float64, least, most int) int {
+	switch {
+	case need >= autoWndGrow*float64(wnd):
+		wnd *= 2
+	case need < autoWndShrink*float64(wnd):
+		wnd /= 2
+	}
+	if wnd > most {
+		wnd = most
+	}
+	if wnd < least {
+		wnd = least
+	}
+	return wnd
+}
@@ -0,0 +1,56 @@
+package generic
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchConn moves many packets in one call, with recvmmsg and sendmmsg on linux. kcp
+// uses the methods of a conn that has them, so wrappers of a udp conn keep the batching
+// by passing them on.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// newBatchConn returns the batching of conn, or one falling back to a packet at a time
+func newBatchConn(conn net.PacketConn) batchConn {
+	if bc, ok := conn.(batchConn); ok {
+		return bc
+	}
+	if _, ok := conn.(*net.UDPConn); ok {
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+			return ipv6.NewPacketConn(conn)
+		}
+		return ipv4.NewPacketConn(conn)
+	}
+	return &singleConn{conn}
+}
+
+// singleConn batches a conn without batching support a packet at a time
+type singleConn struct {
+	net.PacketConn
+}
+
+func (c *singleConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	n, addr, err := c.ReadFrom(ms[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].Addr = n, addr
+	return 1, nil
+}
+
+func (c *singleConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	for i := range ms {
+		if _, err := c.WriteTo(ms[i].Buffers[0], ms[i].Addr); err != nil {
+			return i, err
+		}
+	}
+	return len(ms), nil
+}
@@ -0,0 +1,124 @@
+package generic
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/urfave/cli"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// benchShards are the data and parity shards reed-solomon is benchmarked with, the
+// default 10/3 among them
+var benchShards = [][2]int{{5, 2}, {10, 3}, {20, 5}, {40, 10}}
+
+// BenchCryptoCommand benchmarks every cipher of -crypt and reed-solomon on the current
+// hardware, one core at a time, so that the fastest viable cipher can be picked for
+// slow devices like routers instead of guessed
+func BenchCryptoCommand() cli.Command {
+	return cli.Command{
+		Name:  "bench-crypto",
+		Usage: "benchmark the ciphers and reed-solomon codes on this machine, print MB/s and exit",
+		Flags: []cli.Flag{
+			cli.IntFlag{Name: "mtu", Value: 1350, Usage: "size of the packets encrypted and of the fec shards"},
+			cli.Float64Flag{Name: "time", Value: 0.5, Usage: "seconds each benchmark runs for"},
+		},
+		Action: func(c *cli.Context) error {
+			mtu, d := c.Int("mtu"), time.Duration(c.Float64("time")*float64(time.Second))
+			if mtu < aeadHeaderSize+kcp.IKCP_OVERHEAD {
+				log.Fatal("mtu too small")
+			}
+			if d <= 0 {
+				log.Fatal("time must be positive")
+			}
+			BenchCrypto(mtu, d)
+			return nil
+		},
+	}
+}
+
+// BenchCrypto prints the encryption and decryption rates of the ciphers, fastest first,
+// and the encoding and reconstruction rates of reed-solomon, of packets of mtu bytes
+// each processed for d
+func BenchCrypto(mtu int, d time.Duration) {
+	pass := make([]byte, 32)
+	rand.Read(pass)
+
+	type result struct {
+		name             string
+		encrypt, decrypt float64
+	}
+	var results []result
+	for name := range cryptNames {
+		block, _ := NewBlockCrypt(name, pass)
+		if block == nil {
+			continue
+		}
+		plain, enc, dec := make([]byte, mtu), make([]byte, mtu), make([]byte, mtu)
+		rand.Read(plain)
+		r := result{name: name}
+		r.encrypt = benchRate(d, mtu, func() { block.Encrypt(enc, plain) })
+		r.decrypt = benchRate(d, mtu, func() { block.Decrypt(dec, enc) })
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].encrypt > results[j].encrypt })
+
+	fmt.Printf("%-20v %12v %12v\n", "crypt", "encrypt", "decrypt")
+	for _, r := range results {
+		var note string
+		switch {
+		case IsAEAD(r.name):
+			note = "authenticated"
+		case r.name == "none" || r.name == "xor":
+			note = "insecure"
+		}
+		line := fmt.Sprintf("%-20v %7.1f MB/s %7.1f MB/s  %v", r.name, r.encrypt/1e6, r.decrypt/1e6, note)
+		fmt.Println(strings.TrimSpace(line))
+	}
+
+	fmt.Printf("\n%-20v %12v %12v\n", "datashard/parity", "encode", "reconstruct")
+	for _, s := range benchShards {
+		codec, err := reedsolomon.New(s[0], s[1])
+		if err != nil {
+			fmt.Printf("%v/%v: %v\n", s[0], s[1], err)
+			continue
+		}
+		shards := make([][]byte, s[0]+s[1])
+		for i := range shards {
+			shards[i] = make([]byte, mtu)
+			rand.Read(shards[i])
+		}
+		data := mtu * s[0]
+		encode := benchRate(d, data, func() { codec.Encode(shards) })
+		// the worst case, as many data shards lost as there are parity shards
+		lost := make([][]byte, len(shards))
+		reconstruct := benchRate(d, data, func() {
+			copy(lost, shards)
+			for i := 0; i < s[1]; i++ {
+				lost[i] = lost[i][:0]
+			}
+			codec.ReconstructData(lost)
+		})
+		fmt.Printf("%-20v %7.1f MB/s %7.1f MB/s\n", fmt.Sprintf("%v/%v", s[0], s[1]), encode/1e6, reconstruct/1e6)
+	}
+}
+
+// benchRate runs f repeatedly for d and returns the bytes per second, f processing n
+// bytes per run
+func benchRate(d time.Duration, n int, f func()) float64 {
+	var runs int
+	start := time.Now()
+	for time.Since(start) < d {
+		// check the clock every few runs only
+		for i := 0; i < 64; i++ {
+			f()
+		}
+		runs += 64
+	}
+	return float64(runs*n) / time.Since(start).Seconds()
+}
@@ -0,0 +1,78 @@
+package generic
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ExecCommand parses a single line control command and applies it, available commands:
+//
+//	fec datashard parityshard
+//	wnd sndwnd rcvwnd
+//	mtu mtu
+//	nodelay nodelay interval resend nc
+//	mode fast3|fast2|fast|normal|auto
+func ExecCommand(t Tuner, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	args := make([]int, len(fields)-1)
+	for k := range args {
+		v, err := strconv.Atoi(fields[k+1])
+		if err != nil && fields[0] != "mode" {
+			return errors.Errorf("invalid argument %q for %v", fields[k+1], fields[0])
+		}
+		args[k] = v
+	}
+	expect := func(n int) error {
+		if len(args) != n {
+			return errors.Errorf("%v expects %v arguments, got %v", fields[0], n, len(args))
+		}
+		return nil
+	}
+
+	p := t.Params()
+	switch fields[0] {
+	case "fec":
+		if err := expect(2); err != nil {
+			return err
+		}
+		p.DataShard, p.ParityShard = args[0], args[1]
+	case "wnd":
+		if err := expect(2); err != nil {
+			return err
+		}
+		p.SndWnd, p.RcvWnd = args[0], args[1]
+	case "mtu":
+		if err := expect(1); err != nil {
+			return err
+		}
+		p.MTU = args[0]
+	case "nodelay":
+		if err := expect(4); err != nil {
+			return err
+		}
+		p.Mode = "manual"
+		p.NoDelay, p.Interval, p.Resend, p.NoCongestion = args[0], args[1], args[2], args[3]
+	case "mode":
+		if err := expect(1); err != nil {
+			return err
+		}
+		if err := p.SetMode(fields[1]); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unknown command: %v", fields[0])
+	}
+
+	if err := t.Apply(p); err != nil {
+		return err
+	}
+	log.Printf("control: %v applied: %+v", fields[0], p)
+	return nil
+}
@@ -1,6 +1,10 @@
 package generic
 
 import (
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
 	"net"
 	"time"
 
@@ -9,9 +13,13 @@ import (
 )
 
 type CompStream struct {
-	conn net.Conn
-	w    *snappy.Writer
-	r    *snappy.Reader
+	conn      net.Conn
+	w         *snappy.Writer
+	r         *snappy.Reader
+	threshold int  // writes shorter than this are sent uncompressed
+	wroteID   bool // stream identifier sent ahead of an uncompressed chunk
+	sampler   *compSampler
+	counter   *countWriter
 }
 
 func (c *CompStream) Read(p []byte) (n int, err error) {
@@ -19,6 +27,11 @@ func (c *CompStream) Read(p []byte) (n int, err error) {
 }
 
 func (c *CompStream) Write(p []byte) (n int, err error) {
+	sample := c.sampler.sample(p)
+	if len(p) < c.threshold || sample.skip() {
+		return c.writeRaw(p)
+	}
+	before := c.counter.n
 	if _, err := c.w.Write(p); err != nil {
 		return 0, errors.WithStack(err)
 	}
@@ -26,9 +39,45 @@ func (c *CompStream) Write(p []byte) (n int, err error) {
 	if err := c.w.Flush(); err != nil {
 		return 0, errors.WithStack(err)
 	}
+	sample.record(len(p), c.counter.n-before)
 	return len(p), err
 }
 
+var (
+	snappyMagicChunk = []byte("\xff\x06\x00\x00sNaPpY")
+	crcTable         = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// snappyMaxBlock is the largest payload of a snappy chunk
+const snappyMaxBlock = 65536
+
+// writeRaw sends p in uncompressed chunks of the snappy framing format, the reader
+// can't tell them from the chunks snappy itself leaves uncompressed
+func (c *CompStream) writeRaw(p []byte) (int, error) {
+	var out []byte
+	if !c.wroteID {
+		// repeated identifiers are allowed, snappy writes its own before its first chunk
+		out = append(out, snappyMagicChunk...)
+		c.wroteID = true
+	}
+	for b := p; len(b) > 0; {
+		n := len(b)
+		if n > snappyMaxBlock {
+			n = snappyMaxBlock
+		}
+		crc := crc32.Update(0, crcTable, b[:n])
+		var hdr [8]byte
+		binary.LittleEndian.PutUint32(hdr[:], uint32(n+4)<<8|0x01)
+		binary.LittleEndian.PutUint32(hdr[4:], (crc>>15|crc<<17)+0xa282ead8)
+		out = append(append(out, hdr[:]...), b[:n]...)
+		b = b[n:]
+	}
+	if _, err := c.conn.Write(out); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return len(p), nil
+}
+
 func (c *CompStream) Close() error {
 	return c.conn.Close()
 }
@@ -56,7 +105,186 @@ func (c *CompStream) SetWriteDeadline(t time.Time) error {
 func NewCompStream(conn net.Conn) *CompStream {
 	c := new(CompStream)
 	c.conn = conn
-	c.w = snappy.NewBufferedWriter(conn)
+	c.counter = &countWriter{w: conn}
+	c.w = snappy.NewBufferedWriter(c.counter)
 	c.r = snappy.NewReader(conn)
 	return c
 }
+
+// Compression codecs, the side opening a session announces its codec in the first
+// byte. Sessions of older versions start with the snappy stream identifier or the
+// smux version instead, which are outside this range.
+const (
+	CompNone    byte = 0xc0
+	CompSnappy  byte = 0xc1
+	CompDeflate byte = 0xc2
+	CompLZ4     byte = 0xc3
+	CompZstd    byte = 0xc4
+)
+
+// ParseComp returns the codec named by name
+func ParseComp(name string) (byte, error) {
+	switch name {
+	case "none":
+		return CompNone, nil
+	case "snappy":
+		return CompSnappy, nil
+	case "deflate":
+		return CompDeflate, nil
+	case "lz4":
+		return CompLZ4, nil
+	case "zstd":
+		return CompZstd, nil
+	}
+	return 0, errors.Errorf("unsupported compression: %v", name)
+}
+
+// snappyStreamID is the first byte of a snappy framed stream
+const snappyStreamID = 0xff
+
+// DialComp announces codec on conn and returns conn compressed with it. level is the
+// deflate or zstd level, 0 for the default, writes shorter than threshold are sent uncompressed,
+// and with adaptive so are the streams of mux which don't compress well.
+func DialComp(conn net.Conn, codec byte, level, threshold int, adaptive bool, mux string) (net.Conn, error) {
+	if _, err := conn.Write([]byte{codec}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return newComp(conn, codec, level, threshold, adaptive, mux)
+}
+
+// AcceptComp reads the codec announced on conn and returns conn compressed with it,
+// sessions without an announcement are snappy or uncompressed by their first byte.
+func AcceptComp(conn net.Conn, level, threshold int, adaptive bool, mux string) (net.Conn, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	switch {
+	case b[0] == snappyStreamID:
+		return newComp(&prefixConn{Conn: conn, prefix: b[:]}, CompSnappy, level, threshold, adaptive, mux)
+	case b[0] < CompNone || b[0] > CompZstd:
+		return &prefixConn{Conn: conn, prefix: b[:]}, nil
+	}
+	return newComp(conn, b[0], level, threshold, adaptive, mux)
+}
+
+func newComp(conn net.Conn, codec byte, level, threshold int, adaptive bool, mux string) (net.Conn, error) {
+	var sampler *compSampler
+	if adaptive {
+		sampler = newCompSampler(mux)
+	}
+	switch codec {
+	case CompNone:
+		return conn, nil
+	case CompSnappy:
+		c := NewCompStream(conn)
+		c.threshold, c.sampler = threshold, sampler
+		return c, nil
+	case CompDeflate:
+		c, err := newFlateStream(conn, level)
+		if err != nil {
+			return nil, err
+		}
+		c.threshold, c.sampler = threshold, sampler
+		return c, nil
+	case CompLZ4:
+		c := newLZ4Stream(conn)
+		c.threshold, c.sampler = threshold, sampler
+		return c, nil
+	case CompZstd:
+		c, err := newZstdStream(conn, level)
+		if err != nil {
+			return nil, err
+		}
+		c.threshold, c.sampler = threshold, sampler
+		return c, nil
+	}
+	return nil, errors.Errorf("unsupported compression codec: %#x", codec)
+}
+
+// prefixConn replays bytes already read from a conn
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// flateStream compresses a conn with deflate, flushed after every write
+type flateStream struct {
+	net.Conn
+	w         *flate.Writer
+	r         io.ReadCloser
+	threshold int  // writes shorter than this are sent in stored blocks
+	stale     bool // the window of w misses stored blocks sent since
+	sampler   *compSampler
+	counter   *countWriter
+}
+
+func newFlateStream(conn net.Conn, level int) (*flateStream, error) {
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	counter := &countWriter{w: conn}
+	w, err := flate.NewWriter(counter, level)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &flateStream{Conn: conn, w: w, r: flate.NewReader(conn), counter: counter}, nil
+}
+
+func (c *flateStream) Read(p []byte) (n int, err error) {
+	return c.r.Read(p)
+}
+
+func (c *flateStream) Write(p []byte) (n int, err error) {
+	sample := c.sampler.sample(p)
+	if len(p) < c.threshold || sample.skip() {
+		return c.writeStored(p)
+	}
+	if c.stale {
+		// back references would miss the stored data, start over with an empty window
+		c.w.Reset(c.counter)
+		c.stale = false
+	}
+	before := c.counter.n
+	if _, err := c.w.Write(p); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	sample.record(len(p), c.counter.n-before)
+	return len(p), nil
+}
+
+// writeStored sends p in deflate stored blocks, the stream is byte aligned after the
+// flush of every write
+func (c *flateStream) writeStored(p []byte) (int, error) {
+	var out []byte
+	for b := p; len(b) > 0; {
+		n := len(b)
+		if n > 0xffff {
+			n = 0xffff
+		}
+		// BFINAL 0, BTYPE 00, LEN, NLEN
+		out = append(out, 0, byte(n), byte(n>>8), ^byte(n), ^byte(n>>8))
+		out = append(out, b[:n]...)
+		b = b[n:]
+	}
+	// an empty stored block like the sync flush of w, the reader holds the data back
+	// until the next block otherwise
+	out = append(out, 0, 0, 0, 0xff, 0xff)
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	c.stale = true
+	return len(p), nil
+}
@@ -0,0 +1,112 @@
+package generic
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// bytes of a stream compressed to judge how well it compresses
+	compSampleSize = 64 << 10
+	// streams whose sample doesn't shrink below this percentage are sent uncompressed
+	compSkipPercent = 90
+	// streams tracked by a sampler before it starts over
+	maxCompSamples = 65536
+)
+
+// smux frames, written one per call: |VER(1)|CMD(1)|LENGTH(2)|SID(4)|DATA|
+const (
+	smuxHeaderSize = 8
+	smuxCmdFIN     = 1
+	smuxCmdPSH     = 2
+)
+
+// compSample holds the compression ratio achieved on the start of a stream
+type compSample struct {
+	in, out int
+}
+
+// skip reports whether the stream turned out to be incompressible
+func (s *compSample) skip() bool {
+	return s != nil && s.in >= compSampleSize && s.out*100 > s.in*compSkipPercent
+}
+
+// record counts in bytes of the stream sent as out compressed bytes
+func (s *compSample) record(in, out int) {
+	if s != nil && s.in < compSampleSize {
+		s.in += in
+		s.out += out
+	}
+}
+
+// compSampler tells apart the streams of mux passing through a compressed conn, so
+// already compressed data like https or video is sent as is, sparing the cpu. Without
+// a multiplexer the conn is a single stream.
+type compSampler struct {
+	mux     string
+	streams map[uint32]*compSample
+}
+
+func newCompSampler(mux string) *compSampler {
+	return &compSampler{mux: mux, streams: make(map[uint32]*compSample)}
+}
+
+// sample returns the sample of the stream frame p carries data for, nil for other frames
+func (c *compSampler) sample(p []byte) *compSample {
+	if c == nil {
+		return nil
+	}
+	switch c.mux {
+	case MuxNone:
+		return c.stream(0)
+	case MuxYamux:
+		if len(p) < yamuxHeaderSize {
+			return nil
+		}
+		sid := binary.BigEndian.Uint32(p[4:])
+		if binary.BigEndian.Uint16(p[2:])&(yamuxFlagFIN|yamuxFlagRST) != 0 {
+			delete(c.streams, sid)
+			return nil
+		}
+		if p[1] == yamuxTypeData && len(p) > yamuxHeaderSize {
+			return c.stream(sid)
+		}
+		return nil
+	}
+	if len(p) < smuxHeaderSize {
+		return nil
+	}
+	sid := binary.LittleEndian.Uint32(p[4:])
+	switch p[1] {
+	case smuxCmdPSH:
+		return c.stream(sid)
+	case smuxCmdFIN:
+		delete(c.streams, sid)
+	}
+	return nil
+}
+
+// stream returns the sample of the stream sid, started anew if there's none
+func (c *compSampler) stream(sid uint32) *compSample {
+	s, ok := c.streams[sid]
+	if !ok {
+		if len(c.streams) >= maxCompSamples {
+			c.streams = make(map[uint32]*compSample)
+		}
+		s = new(compSample)
+		c.streams[sid] = s
+	}
+	return s
+}
+
+// countWriter counts the bytes written through it
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
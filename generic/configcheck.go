@@ -0,0 +1,169 @@
+package generic
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+const (
+	// the largest mtu kcp accepts
+	maxMTU = 1500
+	// windows are advertised in 16 bits
+	maxWnd = 65535
+	// reed-solomon codes can't have more shards
+	maxShards = 256
+)
+
+// cryptNames are the ciphers NewBlockCrypt knows
+var cryptNames = map[string]bool{
+	"aes": true, "aes-128": true, "aes-192": true, "aes-gcm": true, "aes-gcm-siv": true,
+	"chacha20-poly1305": true, "xchacha20": true, "salsa20": true, "blowfish": true, "twofish": true, "cast5": true, "3des": true,
+	"tea": true, "xtea": true, "xor": true, "sm4": true, "none": true, "null": true,
+}
+
+// ConfigProblem is a setting a config check found invalid
+type ConfigProblem struct {
+	Field   string `json:"field"`
+	Error   string `json:"error"`
+	warning bool
+}
+
+// ConfigCheck collects the problems of a config, so that all of them can be reported at
+// once instead of failing on the first
+type ConfigCheck []ConfigProblem
+
+// Fail records a problem of field, with a message formatted like fmt.Sprintln does
+// without the newline
+func (c *ConfigCheck) Fail(field string, v ...interface{}) {
+	*c = append(*c, ConfigProblem{Field: field, Error: strings.TrimSuffix(fmt.Sprintln(v...), "\n")})
+}
+
+// Warn records a problem of field which doesn't stop the start, for the settings that
+// have always fallen back to a default when invalid
+func (c *ConfigCheck) Warn(field string, v ...interface{}) {
+	*c = append(*c, ConfigProblem{Field: field, Error: strings.TrimSuffix(fmt.Sprintln(v...), "\n"), warning: true})
+}
+
+// split returns the problems recorded by Fail and those recorded by Warn
+func (c ConfigCheck) split() (errs, warnings []ConfigProblem) {
+	errs, warnings = []ConfigProblem{}, []ConfigProblem{}
+	for _, p := range c {
+		if p.warning {
+			warnings = append(warnings, p)
+		} else {
+			errs = append(errs, p)
+		}
+	}
+	return errs, warnings
+}
+
+// Err returns the first problem recorded by Fail, or nil if there is none
+func (c ConfigCheck) Err() error {
+	if errs, _ := c.split(); len(errs) > 0 {
+		return errors.New(errs[0].Error)
+	}
+	return nil
+}
+
+// Warnings returns the problems recorded by Warn
+func (c ConfigCheck) Warnings() []ConfigProblem {
+	_, warnings := c.split()
+	return warnings
+}
+
+// Report writes the problems to w as a json object, and reports whether there were none
+// but warnings
+func (c ConfigCheck) Report(w io.Writer) bool {
+	errs, warnings := c.split()
+	json.NewEncoder(w).Encode(struct {
+		OK       bool            `json:"ok"`
+		Errors   []ConfigProblem `json:"errors"`
+		Warnings []ConfigProblem `json:"warnings"`
+	}{len(errs) == 0, errs, warnings})
+	return len(errs) == 0
+}
+
+// Transport checks the cipher, mode, mtu, windows and fec shards of kcp
+func (c *ConfigCheck) Transport(crypt, mode string, mtu, sndwnd, rcvwnd, datashard, parityshard int) {
+	if !cryptNames[crypt] {
+		c.Warn("crypt", "unsupported crypt:", crypt+", falling back to aes")
+	}
+	if _, _, _, _, ok := ModeProfile(mode); !ok && mode != "manual" {
+		c.Warn("mode", "unsupported mode:", mode+", falling back to manual")
+	}
+	if mtu < 50 || mtu > maxMTU {
+		c.Fail("mtu", "mtu must be between 50 and", maxMTU)
+	}
+	if sndwnd <= 0 || sndwnd > maxWnd {
+		c.Fail("sndwnd", "sndwnd must be between 1 and", maxWnd)
+	}
+	if rcvwnd <= 0 || rcvwnd > maxWnd {
+		c.Fail("rcvwnd", "rcvwnd must be between 1 and", maxWnd)
+	}
+	switch {
+	case datashard < 0 || parityshard < 0:
+		c.Fail("datashard", "datashard and parityshard can't be negative")
+	case datashard == 0 && parityshard > 0:
+		c.Fail("parityshard", "parityshard requires datashard above 0")
+	case datashard+parityshard > maxShards:
+		c.Fail("datashard", "datashard and parityshard can't add up to more than", maxShards)
+	}
+}
+
+// Smux checks the version, buffers and keepalive of the smux sessions, keepalive and
+// keepalivetimeout in seconds
+func (c *ConfigCheck) Smux(version, smuxbuf, streambuf, keepalive, keepalivetimeout int) {
+	config := smux.DefaultConfig()
+	config.Version = version
+	config.MaxReceiveBuffer = smuxbuf
+	config.MaxStreamBuffer = streambuf
+	config.KeepAliveInterval = time.Duration(keepalive) * time.Second
+	config.KeepAliveTimeout = time.Duration(keepalivetimeout) * time.Second
+	if err := smux.VerifyConfig(config); err != nil {
+		c.Fail("smux", "smux:", err)
+	}
+}
+
+// Listen checks that addr can be listened on with network, tcp or udp, by listening on
+// it for a moment. Sockets passed by systemd are left out, and for udp addr may be a port
+// range.
+func (c *ConfigCheck) Listen(field, network, addr string) {
+	if IsSystemd(addr) {
+		return
+	}
+	host, lo, hi, err := ParsePortRange(addr)
+	if err != nil {
+		c.Fail(field, err)
+		return
+	}
+	if network == "tcp" {
+		hi = lo
+	}
+	for port := lo; port <= hi; port++ {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		var err error
+		if network == "tcp" {
+			var l net.Listener
+			if l, err = net.Listen(network, addr); err == nil {
+				l.Close()
+			}
+		} else {
+			var conn net.PacketConn
+			if conn, err = net.ListenPacket(network, addr); err == nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			c.Fail(field, err)
+			return
+		}
+	}
+}
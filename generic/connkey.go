@@ -0,0 +1,119 @@
+package generic
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// size of the nonce each side contributes to the key of a kcp connection
+const connKeyNonceSize = 16
+
+// connKeyBlockCrypt is the block of a single kcp session, which starts out on the
+// block of the pre-shared key and moves to a key of the session's own once both sides
+// derived it. Packets are encrypted with the session's key only once the peer is known
+// to have it, and the pre-shared key still decrypts the packets the peer sent before.
+type connKeyBlockCrypt struct {
+	base      kcp.BlockCrypt
+	session   atomic.Value // kcp.BlockCrypt of the session's key
+	confirmed int32        // whether the peer is known to use the session's key
+	pool      sync.Pool
+}
+
+// NewConnKeyBlockCrypt creates the block of a session on base, keyed by ConnKeyExchange
+func NewConnKeyBlockCrypt(base kcp.BlockCrypt) kcp.BlockCrypt {
+	c := &connKeyBlockCrypt{base: base}
+	c.pool.New = func() interface{} { return make([]byte, 0, 1500) }
+	return c
+}
+
+func (c *connKeyBlockCrypt) Encrypt(dst, src []byte) {
+	if atomic.LoadInt32(&c.confirmed) == 1 {
+		c.session.Load().(kcp.BlockCrypt).Encrypt(dst, src)
+		return
+	}
+	c.base.Encrypt(dst, src)
+}
+
+// Decrypt tries the session's key first, the first packet it opens shows that the peer
+// uses it
+func (c *connKeyBlockCrypt) Decrypt(dst, src []byte) {
+	session, ok := c.session.Load().(kcp.BlockCrypt)
+	if !ok {
+		c.base.Decrypt(dst, src)
+		return
+	}
+
+	orig := append(c.pool.Get().([]byte)[:0], src...)
+	defer c.pool.Put(orig[:0])
+	session.Decrypt(dst, orig)
+	if len(dst) >= aeadHeaderSize &&
+		crc32.ChecksumIEEE(dst[aeadHeaderSize:]) == binary.LittleEndian.Uint32(dst[aeadHeaderSize-4:]) {
+		atomic.StoreInt32(&c.confirmed, 1)
+		return
+	}
+	c.base.Decrypt(dst, orig)
+}
+
+// ConnKeyExchange derives a key of its own for the kcp session conn, whose block was
+// created by NewConnKeyBlockCrypt, from nonces exchanged by both sides in its first
+// bytes, and moves the session to the block newBlock creates with it. The side dialing
+// the session initiates, the peer must do the other half with the same psk:
+//
+//	initiator: | NONCE_I(16B) | HMAC-SHA256(psk, NONCE_I)(32B) |
+//	responder: | NONCE_R(16B) | HMAC-SHA256(psk, NONCE_I NONCE_R)(32B) |
+//
+// and the key is HKDF-SHA256(psk, NONCE_I || NONCE_R), so that the -conn sessions and
+// the sessions re-dialed don't share one key.
+func ConnKeyExchange(conn *kcp.UDPSession, psk []byte, newBlock func(key []byte) kcp.BlockCrypt, initiator bool) error {
+	c, ok := conn.GetBlockCrypt().(*connKeyBlockCrypt)
+	if !ok {
+		return errors.New("connection key: session without a block of its own")
+	}
+
+	nonce := make([]byte, connKeyNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return errors.WithStack(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(keyExchangeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	key := func(salt []byte) []byte {
+		k, _ := hkdf.Key(sha256.New, psk, salt, "kcptun connection key", 32)
+		return k
+	}
+	if initiator {
+		if _, err := conn.Write(append(nonce, keyExchangeMAC(psk, nonce)...)); err != nil {
+			return errors.Wrap(err, "connection key")
+		}
+		peer, err := readKeyExchange(conn, psk, nonce, connKeyNonceSize)
+		if err != nil {
+			return err
+		}
+		// the reply shows that the responder has the key, so it's used at once
+		c.session.Store(newBlock(key(append(nonce, peer...))))
+		atomic.StoreInt32(&c.confirmed, 1)
+	} else {
+		peer, err := readKeyExchange(conn, psk, nil, connKeyNonceSize)
+		if err != nil {
+			return err
+		}
+		// the key opens packets before the reply is sent, and is used once one opens
+		salt := append(peer, nonce...)
+		c.session.Store(newBlock(key(salt)))
+		if _, err := conn.Write(append(nonce, keyExchangeMAC(psk, salt)...)); err != nil {
+			return errors.Wrap(err, "connection key")
+		}
+	}
+	return nil
+}
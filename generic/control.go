@@ -0,0 +1,121 @@
+package generic
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// NewControlHandler returns a http handler to query and change runtime parameters.
+//
+// GET /params returns the effective parameters as json, POST /params accepts
+// a (partial) json object of the same form and applies it to all sessions. GET
+// /sources returns the accounting of the clients by address, if the tuner keeps it.
+// A POST must be sent as "Content-Type: application/json", which a web page can't do
+// cross-site without a preflight. With a token, requests without the header
+// "Authorization: Bearer <token>" are refused. Without one, requests whose Host isn't
+// a loopback name or address are refused too, against dns rebinding.
+func NewControlHandler(t Tuner, token string) http.Handler {
+	mux := http.NewServeMux()
+	if sr, ok := t.(SourceReporter); ok {
+		mux.HandleFunc("/sources", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(sr.Sources())
+		})
+	}
+	mux.HandleFunc("/params", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+				http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p, err := MergeParams(t, data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := t.Apply(p); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("control: parameters changed by %v: %+v", r.RemoteAddr, p)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.Params())
+	})
+	if token == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isLoopbackHost(r.Host) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// ControlServer serves the control api on addr
+func ControlServer(addr, token string, t Tuner) {
+	if addr == "" {
+		return
+	}
+	log.Println("control api listening on:", addr)
+	if err := http.ListenAndServe(addr, NewControlHandler(t, token)); err != nil {
+		log.Println("control api:", err)
+	}
+}
+
+// IsLoopbackAddr reports whether the host of addr, like 127.0.0.1:12949, is a loopback
+// address, an empty host binding all addresses is not
+func IsLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return isLoopbackName(host)
+}
+
+// isLoopbackHost reports whether the Host header of a request, with or without a port,
+// names a loopback address
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return isLoopbackName(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+}
+
+func isLoopbackName(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -2,23 +2,54 @@ package generic
 
 import (
 	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 )
 
-const bufSize = 4096
+// DefaultCopyBuffer is the size of the buffers of copies unless changed by SetCopyBuffer
+const DefaultCopyBuffer = 32768
 
-// Memory optimized io.Copy function specified for this library
+// copyBuffers shares the buffers of copies between streams, a *sync.Pool replaced as a
+// whole when the size changes
+var copyBuffers atomic.Value
+
+func init() {
+	SetCopyBuffer(DefaultCopyBuffer)
+}
+
+// SetCopyBuffer changes the size of the buffers of copies started afterwards
+func SetCopyBuffer(size int) {
+	copyBuffers.Store(&sync.Pool{New: func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}})
+}
+
+// Memory optimized io.Copy function specified for this library. Every copy has a
+// stream on one side, framed, metered and encrypted in userspace, so a tcp
+// connection's ReadFrom and WriteTo never find the socket on the other side they
+// would splice to, and are skipped for the pooled buffer.
 func Copy(dst io.Writer, src io.Reader) (written int64, err error) {
 	// If the reader has a WriteTo method, use it to do the copy.
-	// Avoids an allocation and a copy.
-	if wt, ok := src.(io.WriterTo); ok {
-		return wt.WriteTo(dst)
+	// Avoids an allocation and a copy. A tcp connection's allocates a
+	// buffer on each call unless it splices, so it's read with a pooled one.
+	if _, ok := src.(*net.TCPConn); !ok {
+		if wt, ok := src.(io.WriterTo); ok {
+			return wt.WriteTo(dst)
+		}
 	}
 	// Similarly, if the writer has a ReadFrom method, use it to do the copy.
 	if rt, ok := dst.(io.ReaderFrom); ok {
-		return rt.ReadFrom(src)
+		if _, ok := dst.(*net.TCPConn); !ok {
+			return rt.ReadFrom(src)
+		}
 	}
 
-	// fallback to standard io.CopyBuffer
-	buf := make([]byte, bufSize)
-	return io.CopyBuffer(dst, src, buf)
+	// fallback to standard io.CopyBuffer with a buffer of the pool, hiding
+	// the methods above which io.CopyBuffer would use instead
+	pool := copyBuffers.Load().(*sync.Pool)
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
 }
@@ -0,0 +1,55 @@
+package generic
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseCPUList parses a list of cpus like 0-3,6, as in /sys/devices/system/cpu
+func ParseCPUList(s string) ([]int, error) {
+	var cpus []int
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		first, last := part, part
+		if i := strings.IndexByte(part, '-'); i >= 0 {
+			first, last = part[:i], part[i+1:]
+		}
+		lo, err1 := strconv.Atoi(first)
+		hi, err2 := strconv.Atoi(last)
+		if err1 != nil || err2 != nil || lo < 0 || lo > hi {
+			return nil, errors.Errorf("invalid cpu list: %v", s)
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			if !seen[cpu] {
+				seen[cpu] = true
+				cpus = append(cpus, cpu)
+			}
+		}
+	}
+	return cpus, nil
+}
+
+// SetCPUs pins the process to the cpus in list if not empty, and runs goroutines on
+// procs threads at once, or on as many as the cpus pinned to if procs is 0
+func SetCPUs(list string, procs int) error {
+	if list != "" {
+		cpus, err := ParseCPUList(list)
+		if err != nil {
+			return err
+		}
+		if err := setAffinity(cpus); err != nil {
+			return err
+		}
+		if procs == 0 {
+			procs = len(cpus)
+		}
+	}
+	if procs > 0 {
+		runtime.GOMAXPROCS(procs)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+// +build !windows
+
+package generic
+
+import (
+	"syscall"
+	"time"
+)
+
+// CPUTime returns the cpu time the process has used so far, in user and system mode
+func CPUTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
@@ -0,0 +1,25 @@
+package generic
+
+import (
+	"syscall"
+	"time"
+)
+
+// CPUTime returns the cpu time the process has used so far, in user and system mode
+func CPUTime() time.Duration {
+	var creation, exit, kernel, user syscall.Filetime
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0
+	}
+	if err := syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return 0
+	}
+	return filetimeDuration(kernel) + filetimeDuration(user)
+}
+
+// filetimeDuration converts a span of 100-nanosecond intervals, Nanoseconds of
+// syscall.Filetime counts from 1970 instead
+func filetimeDuration(ft syscall.Filetime) time.Duration {
+	return time.Duration(int64(ft.HighDateTime)<<32|int64(ft.LowDateTime)) * 100
+}
@@ -0,0 +1,55 @@
+package generic
+
+import (
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// NewBlockCrypt creates the block cipher named by crypt from the derived key pass,
+// unknown names fall back to aes and the effective name is returned.
+func NewBlockCrypt(crypt string, pass []byte) (block kcp.BlockCrypt, name string) {
+	switch crypt {
+	case "null":
+		block = nil
+	case "sm4":
+		block, _ = kcp.NewSM4BlockCrypt(pass[:16])
+	case "tea":
+		block, _ = kcp.NewTEABlockCrypt(pass[:16])
+	case "xor":
+		block, _ = kcp.NewSimpleXORBlockCrypt(pass)
+	case "none":
+		block, _ = kcp.NewNoneBlockCrypt(pass)
+	case "aes-128":
+		block, _ = kcp.NewAESBlockCrypt(pass[:16])
+	case "aes-192":
+		block, _ = kcp.NewAESBlockCrypt(pass[:24])
+	case "blowfish":
+		block, _ = kcp.NewBlowfishBlockCrypt(pass)
+	case "twofish":
+		block, _ = kcp.NewTwofishBlockCrypt(pass)
+	case "cast5":
+		block, _ = kcp.NewCast5BlockCrypt(pass[:16])
+	case "3des":
+		block, _ = kcp.NewTripleDESBlockCrypt(pass[:24])
+	case "xtea":
+		block, _ = kcp.NewXTEABlockCrypt(pass[:16])
+	case "aes-gcm":
+		block, _ = NewAESGCMBlockCrypt(pass)
+	case "aes-gcm-siv":
+		block, _ = NewAESGCMSIVBlockCrypt(pass)
+	case "chacha20-poly1305":
+		block, _ = NewChaCha20Poly1305BlockCrypt(pass)
+	case "xchacha20":
+		block, _ = NewXChaCha20BlockCrypt(pass)
+	case "salsa20":
+		block, _ = kcp.NewSalsa20BlockCrypt(pass)
+	default:
+		crypt = "aes"
+		block, _ = kcp.NewAESBlockCrypt(pass)
+	}
+	return block, crypt
+}
+
+// IsAEAD reports whether crypt is one of the authenticated ciphers
+func IsAEAD(crypt string) bool {
+	return crypt == "aes-gcm" || crypt == "aes-gcm-siv" || crypt == "chacha20-poly1305"
+}
@@ -0,0 +1,151 @@
+package generic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// each direction starts with a random salt the sub-key is derived with
+	cryptConnSaltSize = 32
+	// largest payload sealed in one chunk
+	cryptConnMaxChunk = 0x3fff
+)
+
+// cryptConn encrypts a stream in AES-256-GCM sealed chunks of |LEN|PAYLOAD|, both
+// sealed with a counter nonce, under a sub-key derived from the key and a random salt
+// per direction.
+type cryptConn struct {
+	net.Conn
+	pass []byte
+
+	wmu      sync.Mutex
+	enc      cipher.AEAD
+	encNonce []byte
+	dec      cipher.AEAD
+	decNonce []byte
+	pending  []byte // decrypted data not yet read
+	buf      []byte
+}
+
+// NewCryptConn encrypts conn with pass, the peer must use the same pass
+func NewCryptConn(conn net.Conn, pass []byte) net.Conn {
+	return &cryptConn{Conn: conn, pass: pass}
+}
+
+func (c *cryptConn) newAEAD(salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, c.pass, salt, "kcptun tcp", 32)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// incrementNonce advances a little endian nonce counter
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *cryptConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var out []byte
+	if c.enc == nil {
+		salt := make([]byte, cryptConnSaltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return 0, errors.WithStack(err)
+		}
+		aead, err := c.newAEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.enc, c.encNonce = aead, make([]byte, aead.NonceSize())
+		out = salt
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > cryptConnMaxChunk {
+			n = cryptConnMaxChunk
+		}
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(n))
+		out = c.enc.Seal(out, c.encNonce, length[:], nil)
+		incrementNonce(c.encNonce)
+		out = c.enc.Seal(out, c.encNonce, p[:n], nil)
+		incrementNonce(c.encNonce)
+		p = p[n:]
+		written += n
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+func (c *cryptConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *cryptConn) readChunk() error {
+	if c.dec == nil {
+		salt := make([]byte, cryptConnSaltSize)
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+		aead, err := c.newAEAD(salt)
+		if err != nil {
+			return err
+		}
+		c.dec, c.decNonce = aead, make([]byte, aead.NonceSize())
+		c.buf = make([]byte, cryptConnMaxChunk+aead.Overhead())
+	}
+
+	overhead := c.dec.Overhead()
+	sealed := c.buf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		return err
+	}
+	length, err := c.dec.Open(sealed[:0], c.decNonce, sealed, nil)
+	if err != nil {
+		return errors.New("cryptconn: message authentication failed")
+	}
+	incrementNonce(c.decNonce)
+
+	sealed = c.buf[:int(binary.BigEndian.Uint16(length))+overhead]
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		return err
+	}
+	if c.pending, err = c.dec.Open(sealed[:0], c.decNonce, sealed, nil); err != nil {
+		return errors.New("cryptconn: message authentication failed")
+	}
+	incrementNonce(c.decNonce)
+	return nil
+}
@@ -0,0 +1,182 @@
+package generic
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// ControlRequest is a single line of json sent to the control socket
+type ControlRequest struct {
+	Cmd    string          `json:"cmd"`              // get, set, exec, stats, sources, streams, close, rekey
+	Params json.RawMessage `json:"params,omitempty"` // for set, a (partial) parameter object
+	Line   string          `json:"line,omitempty"`   // for exec, a fifo style command line
+	ID     uint64          `json:"id,omitempty"`     // for close, the id of a stream listed by streams
+}
+
+// ControlResponse is the single line of json replied for each request
+type ControlResponse struct {
+	OK      bool          `json:"ok"`
+	Error   string        `json:"error,omitempty"`
+	Params  *Params       `json:"params,omitempty"`
+	Conns   []ConnStats   `json:"conns,omitempty"`
+	Snmp    *kcp.Snmp     `json:"snmp,omitempty"`
+	Sources []SourceStats `json:"sources,omitempty"`
+	Streams []StreamInfo  `json:"streams,omitempty"`
+}
+
+// ConnStats describes a live kcp session
+type ConnStats struct {
+	Conv       uint32 `json:"conv"`
+	User       string `json:"user,omitempty"`
+	LocalAddr  string `json:"localaddr"`
+	RemoteAddr string `json:"remoteaddr"`
+	RTO        uint32 `json:"rto"`
+	SRTT       int32  `json:"srtt"`
+	SRTTVar    int32  `json:"srttvar"`
+	Streams    int    `json:"streams"`
+	BytesIn    uint64 `json:"bytesin"`
+	BytesOut   uint64 `json:"bytesout"`
+}
+
+// SourceStats accounts for the sessions of a client address
+type SourceStats struct {
+	Source        string `json:"source"`
+	Sessions      int    `json:"sessions"`      // open now
+	SessionsTotal uint64 `json:"sessionstotal"` // opened since first seen
+	Streams       int    `json:"streams"`       // open now
+	StreamsTotal  uint64 `json:"streamstotal"`  // opened since first seen
+	BytesIn       uint64 `json:"bytesin"`
+	BytesOut      uint64 `json:"bytesout"`
+	Uptime        int64  `json:"uptime"`    // seconds with sessions open
+	FirstSeen     int64  `json:"firstseen"` // unix time
+	LastSeen      int64  `json:"lastseen"`  // unix time, now while sessions are open
+}
+
+// SourceReporter is optionally implemented by a Tuner to account for its clients by
+// address
+type SourceReporter interface {
+	Sources() []SourceStats
+}
+
+func sessionStats(sessions []*Session) []ConnStats {
+	stats := make([]ConnStats, 0, len(sessions))
+	for _, s := range sessions {
+		cs := ConnStats{
+			User:       s.User,
+			LocalAddr:  s.Meter.LocalAddr().String(),
+			RemoteAddr: s.Meter.RemoteAddr().String(),
+			Streams:    s.Mux.NumStreams(),
+			BytesIn:    s.Meter.BytesIn(),
+			BytesOut:   s.Meter.BytesOut(),
+		}
+		if conn := s.KCP; conn != nil {
+			cs.Conv = conn.GetConv()
+			cs.RTO = conn.GetRTO()
+			cs.SRTT = conn.GetSRTT()
+			cs.SRTTVar = conn.GetSRTTVar()
+		}
+		stats = append(stats, cs)
+	}
+	return stats
+}
+
+// HandleControlRequest executes a control request against the tuner
+func HandleControlRequest(t Tuner, req *ControlRequest) (resp ControlResponse) {
+	var err error
+	switch req.Cmd {
+	case "get":
+	case "set":
+		var p Params
+		if p, err = MergeParams(t, req.Params); err == nil {
+			err = t.Apply(p)
+		}
+	case "exec":
+		err = ExecCommand(t, req.Line)
+	case "stats":
+		resp.Conns = sessionStats(t.Sessions())
+		resp.Snmp = kcp.DefaultSnmp.Copy()
+	case "sources":
+		sr, ok := t.(SourceReporter)
+		if !ok {
+			resp.Error = "sources not supported"
+			return resp
+		}
+		resp.Sources = sr.Sources()
+	case "streams":
+		resp.Streams = Streams()
+	case "close":
+		if err = CloseStream(req.ID); err == nil {
+			log.Printf("control: stream %v closed", req.ID)
+		}
+	case "rekey":
+		if err = Rekey(); err == nil {
+			log.Println("control: rekeyed")
+		}
+	default:
+		resp.Error = "unknown command: " + req.Cmd
+		return resp
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	p := t.Params()
+	resp.Params = &p
+	resp.OK = true
+	return resp
+}
+
+// ControlSocket serves newline delimited json requests on a unix domain socket at path
+func ControlSocket(path string, t Tuner) {
+	if path == "" {
+		return
+	}
+	// remove a stale socket left by an earlier run, but nothing else a mistyped path names
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			log.Println("control socket:", path, "exists and is not a socket")
+			return
+		}
+		os.Remove(path)
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		log.Println("control socket:", err)
+		return
+	}
+	defer lis.Close()
+	log.Println("control socket listening on:", path)
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			log.Println("control socket:", err)
+			return
+		}
+		go serveControlConn(conn, t)
+	}
+}
+
+func serveControlConn(conn net.Conn, t Tuner) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req ControlRequest
+		var resp ControlResponse
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp = HandleControlRequest(t, &req)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// +build !windows
+
+package generic
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// FifoControl creates a named pipe at path and executes the commands written to it
+func FifoControl(path string, t Tuner) {
+	if path == "" {
+		return
+	}
+	os.Remove(path)
+	syscall.Mkfifo(path, 0666)
+	log.Println("Open named pipe file for read:", path)
+	file, err := os.OpenFile(path, os.O_CREATE, os.ModeNamedPipe)
+	if err != nil {
+		log.Fatal("Open named pipe file error:", err)
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, _, err := reader.ReadLine()
+		if err != nil {
+			// no writer on the other side, poll later
+			time.Sleep(time.Second)
+			continue
+		}
+		if err := ExecCommand(t, string(line)); err != nil {
+			log.Println("fifo:", err)
+		}
+	}
+}
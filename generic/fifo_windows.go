@@ -0,0 +1,10 @@
+package generic
+
+import "log"
+
+// FifoControl is not available on windows
+func FifoControl(path string, t Tuner) {
+	if path != "" {
+		log.Println("fifo is not supported on windows")
+	}
+}
@@ -0,0 +1,109 @@
+package generic
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// the header announcing the destination of a stream in dynamic mode:
+//
+//	| VER(1B) | NETWORK(1B) | LEN(1B) | ADDR(LEN bytes, host:port) |
+//
+// version 2 appends the address the client accepted the stream from:
+//
+//	| VER(1B) | NETWORK(1B) | LEN(1B) | ADDR(LEN bytes) | SLEN(1B) | SOURCE(SLEN bytes) |
+//
+// the server replies a single STATUS byte after dialing the destination, an empty
+// ADDR of a tcp stream stands for the target configured on the server.
+const (
+	headerVersion       = 1
+	headerVersionSource = 2
+
+	// NetTCP dials a tcp destination
+	NetTCP byte = 1
+	// NetUDP relays length prefixed datagrams to a udp destination
+	NetUDP byte = 2
+	// NetEcho asks the server to send back what it receives, for health checks
+	NetEcho byte = 3
+	// NetBench asks the server to discard what it receives reporting the bytes
+	// counted, with ADDR "up", or to send data until the stream closes, with "down"
+	NetBench byte = 4
+	// NetTUN carries the length prefixed IP packets of a tun device to the one of the
+	// server
+	NetTUN byte = 5
+
+	// StatusOK means the destination was dialed successfully
+	StatusOK byte = 0
+	// StatusFailed means the destination could not be dialed
+	StatusFailed byte = 1
+)
+
+// StreamHeader carries the destination of a stream, and the source it was accepted
+// from by the client if known
+type StreamHeader struct {
+	Network byte
+	Addr    string
+	Source  string
+}
+
+// WriteHeader writes h at the beginning of a stream, in version 1 without a source for
+// the servers predating version 2
+func WriteHeader(w io.Writer, h *StreamHeader) error {
+	if len(h.Addr) > 255 || len(h.Source) > 255 {
+		return errors.Errorf("address too long: %v", h.Addr)
+	}
+	version := byte(headerVersion)
+	if h.Source != "" {
+		version = headerVersionSource
+	}
+	buf := make([]byte, 0, 4+len(h.Addr)+len(h.Source))
+	buf = append(buf, version, h.Network, byte(len(h.Addr)))
+	buf = append(buf, h.Addr...)
+	if version == headerVersionSource {
+		buf = append(buf, byte(len(h.Source)))
+		buf = append(buf, h.Source...)
+	}
+	_, err := w.Write(buf)
+	return errors.WithStack(err)
+}
+
+// ReadHeader reads the header at the beginning of a stream
+func ReadHeader(r io.Reader) (*StreamHeader, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if hdr[0] != headerVersion && hdr[0] != headerVersionSource {
+		return nil, errors.Errorf("unsupported header version: %v", hdr[0])
+	}
+	addr := make([]byte, hdr[2])
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	h := &StreamHeader{Network: hdr[1], Addr: string(addr)}
+	if hdr[0] == headerVersionSource {
+		var slen [1]byte
+		if _, err := io.ReadFull(r, slen[:]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		source := make([]byte, slen[0])
+		if _, err := io.ReadFull(r, source); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		h.Source = string(source)
+	}
+	return h, nil
+}
+
+// ReadStatus reads the status replied by the server, returns an error on failure
+func ReadStatus(r io.Reader) error {
+	var status [1]byte
+	if _, err := io.ReadFull(r, status[:]); err != nil {
+		return errors.WithStack(err)
+	}
+	if status[0] != StatusOK {
+		return errors.Errorf("server failed to dial destination, status: %v", status[0])
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package generic
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// peers remembered by a port range conn before the table is reset
+const maxRangePeers = 65536
+
+// ParsePortRange splits an address of the form host:lo-hi, a single port is a range of one
+func ParsePortRange(addr string) (host string, lo, hi int, err error) {
+	host, ports, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, 0, errors.WithStack(err)
+	}
+	first, last := ports, ports
+	if i := strings.IndexByte(ports, '-'); i >= 0 {
+		first, last = ports[:i], ports[i+1:]
+	}
+	if lo, err = strconv.Atoi(first); err != nil {
+		return "", 0, 0, errors.Errorf("invalid port range: %v", ports)
+	}
+	if hi, err = strconv.Atoi(last); err != nil {
+		return "", 0, 0, errors.Errorf("invalid port range: %v", ports)
+	}
+	if lo < 0 || hi > 65535 || lo > hi {
+		return "", 0, 0, errors.Errorf("invalid port range: %v", ports)
+	}
+	return host, lo, hi, nil
+}
+
+// IsPortRange reports whether addr names more than one port
+func IsPortRange(addr string) bool {
+	_, lo, hi, err := ParsePortRange(addr)
+	return err == nil && lo != hi
+}
+
+// hopConn sends to a destination port picked at random from a range, switching to
+// another one every interval. Packets from any port of the server are reported as
+// coming from the first port, so the kcp session is unaware of the hopping.
+type hopConn struct {
+	net.PacketConn
+	remote *net.UDPAddr
+	lo, hi int
+	port   int32
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewHopConn hops between the ports lo to hi of ip on conn every interval
+func NewHopConn(conn net.PacketConn, ip net.IP, lo, hi int, interval time.Duration) net.PacketConn {
+	c := &hopConn{
+		PacketConn: conn,
+		remote:     &net.UDPAddr{IP: ip, Port: lo},
+		lo:         lo,
+		hi:         hi,
+		die:        make(chan struct{}),
+	}
+	c.hop()
+	go c.hopper(interval)
+	return c
+}
+
+func (c *hopConn) hop() {
+	port := int32(c.lo + rand.Intn(c.hi-c.lo+1))
+	if c.hi > c.lo {
+		for port == atomic.LoadInt32(&c.port) {
+			port = int32(c.lo + rand.Intn(c.hi-c.lo+1))
+		}
+	}
+	atomic.StoreInt32(&c.port, port)
+}
+
+func (c *hopConn) hopper(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.hop()
+		case <-c.die:
+			return
+		}
+	}
+}
+
+func (c *hopConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		if udpaddr, ok := addr.(*net.UDPAddr); ok && udpaddr.IP.Equal(c.remote.IP) &&
+			udpaddr.Port >= c.lo && udpaddr.Port <= c.hi {
+			return n, c.remote, nil
+		}
+	}
+}
+
+func (c *hopConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.PacketConn.WriteTo(p, &net.UDPAddr{IP: c.remote.IP, Port: int(atomic.LoadInt32(&c.port))})
+}
+
+func (c *hopConn) Close() error {
+	c.dieOnce.Do(func() { close(c.die) })
+	return c.PacketConn.Close()
+}
+
+func (c *hopConn) SetReadBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errors.New("SetReadBuffer: not supported")
+}
+
+func (c *hopConn) SetWriteBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errors.New("SetWriteBuffer: not supported")
+}
+
+func (c *hopConn) SetDSCP(dscp int) error {
+	if nc, ok := c.PacketConn.(net.Conn); ok {
+		err4 := ipv4.NewConn(nc).SetTOS(dscp << 2)
+		err6 := ipv6.NewConn(nc).SetTrafficClass(dscp)
+		if err4 == nil || err6 == nil {
+			return nil
+		}
+	}
+	return errors.New("SetDSCP: not supported")
+}
+
+type rangePacket struct {
+	data []byte
+	addr net.Addr
+	conn net.PacketConn
+}
+
+// rangeConn listens on every port of a range as a single packet conn, replies to a
+// peer leave from the port it was last heard on.
+type rangeConn struct {
+	conns []net.PacketConn
+	ch    chan rangePacket
+
+	mu    sync.Mutex
+	peers map[string]net.PacketConn
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// ListenPortRange listens for udp packets on the ports lo to hi of host
+func ListenPortRange(host string, lo, hi int) (net.PacketConn, error) {
+	c := &rangeConn{
+		ch:    make(chan rangePacket, 1024),
+		peers: make(map[string]net.PacketConn),
+		die:   make(chan struct{}),
+	}
+	for port := lo; port <= hi; port++ {
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			c.Close()
+			return nil, errors.WithStack(err)
+		}
+		c.conns = append(c.conns, conn)
+	}
+	for _, conn := range c.conns {
+		go c.reader(conn)
+	}
+	return c, nil
+}
+
+func (c *rangeConn) reader(conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			c.Close()
+			return
+		}
+		select {
+		case c.ch <- rangePacket{append([]byte(nil), buf[:n]...), addr, conn}:
+		case <-c.die:
+			return
+		}
+	}
+}
+
+func (c *rangeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.ch:
+		c.mu.Lock()
+		if len(c.peers) >= maxRangePeers {
+			c.peers = make(map[string]net.PacketConn)
+		}
+		c.peers[pkt.addr.String()] = pkt.conn
+		c.mu.Unlock()
+		return copy(b, pkt.data), pkt.addr, nil
+	case <-c.die:
+		return 0, nil, errors.New("use of closed port range connection")
+	}
+}
+
+func (c *rangeConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	conn, ok := c.peers[addr.String()]
+	c.mu.Unlock()
+	if !ok {
+		conn = c.conns[0]
+	}
+	return conn.WriteTo(p, addr)
+}
+
+func (c *rangeConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+		for _, conn := range c.conns {
+			conn.Close()
+		}
+	})
+	return nil
+}
+
+func (c *rangeConn) LocalAddr() net.Addr { return c.conns[0].LocalAddr() }
+
+func (c *rangeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *rangeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *rangeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// the socket options are applied to every port
+func (c *rangeConn) each(f func(conn *net.UDPConn) error) error {
+	var err error
+	for _, conn := range c.conns {
+		if e := f(conn.(*net.UDPConn)); e != nil {
+			err = e
+		}
+	}
+	return errors.WithStack(err)
+}
+
+func (c *rangeConn) SetReadBuffer(bytes int) error {
+	return c.each(func(conn *net.UDPConn) error { return conn.SetReadBuffer(bytes) })
+}
+
+func (c *rangeConn) SetWriteBuffer(bytes int) error {
+	return c.each(func(conn *net.UDPConn) error { return conn.SetWriteBuffer(bytes) })
+}
+
+func (c *rangeConn) SetDSCP(dscp int) error {
+	return c.each(func(conn *net.UDPConn) error {
+		err4 := ipv4.NewConn(conn).SetTOS(dscp << 2)
+		err6 := ipv6.NewConn(conn).SetTrafficClass(dscp)
+		if err4 == nil || err6 == nil {
+			return nil
+		}
+		return errors.New("SetDSCP: not supported")
+	})
+}
@@ -0,0 +1,187 @@
+package generic
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// | TYPE(1B) | CODE(1B) | CHECKSUM(2B) | ID(2B) | SEQ(2B) | MAGIC(4B) | PACKET |
+	icmpHeaderSize = 12
+
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+
+	// told apart from the echo replies the kernel of the server sends on its own, which
+	// carry the magic of the request back
+	icmpRequestMagic = 0x6b637031
+	icmpReplyMagic   = 0x6b637032
+
+	// peers remembered by a server before the table is reset
+	maxICMPPeers = 1 << 16
+)
+
+// icmpAddr is a peer of an icmp server, told apart by the id of its echo requests as
+// nats do, and written in the form of ip:id
+type icmpAddr struct {
+	ip net.IP
+	id uint16
+}
+
+func (a *icmpAddr) Network() string { return "icmp" }
+func (a *icmpAddr) String() string {
+	return net.JoinHostPort(a.ip.String(), strconv.Itoa(int(a.id)))
+}
+
+// icmpChecksum is the internet checksum of p
+func icmpChecksum(p []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(p); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(p[i:]))
+	}
+	if len(p)%2 == 1 {
+		sum += uint32(p[len(p)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// icmpEcho builds an echo message carrying p
+func icmpEcho(typ byte, id, seq uint16, magic uint32, p []byte) []byte {
+	msg := make([]byte, icmpHeaderSize+len(p))
+	msg[0] = typ
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	binary.BigEndian.PutUint32(msg[8:], magic)
+	copy(msg[icmpHeaderSize:], p)
+	binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	return msg
+}
+
+// parseICMPEcho checks an echo message of typ and magic and returns its id and seq, and
+// where its packet starts
+func parseICMPEcho(msg []byte, typ byte, magic uint32) (id, seq uint16, ok bool) {
+	if len(msg) < icmpHeaderSize || msg[0] != typ || msg[1] != 0 || binary.BigEndian.Uint32(msg[8:]) != magic {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint16(msg[4:]), binary.BigEndian.Uint16(msg[6:]), true
+}
+
+// icmpDialConn carries the packets of a client in echo requests to its server, and
+// reads the ones in echo replies of its id back
+type icmpDialConn struct {
+	*net.IPConn
+	id  uint16
+	seq uint32
+}
+
+// DialICMP opens a raw icmp socket for a client to reach an IPv4 server started with
+// ListenICMP, which requires root or CAP_NET_RAW. The packets must be written to a
+// *net.IPAddr.
+func DialICMP() (net.PacketConn, error) {
+	conn, err := net.ListenIP("ip4:icmp", nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var id [2]byte
+	rand.Read(id[:])
+	return &icmpDialConn{IPConn: conn, id: binary.BigEndian.Uint16(id[:])}, nil
+}
+
+func (c *icmpDialConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, icmpHeaderSize+len(b))
+	for {
+		n, addr, err := c.IPConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+		if id, _, ok := parseICMPEcho(buf[:n], icmpEchoReply, icmpReplyMagic); ok && id == c.id {
+			return copy(b, buf[icmpHeaderSize:n]), addr, nil
+		}
+	}
+}
+
+func (c *icmpDialConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	seq := uint16(atomic.AddUint32(&c.seq, 1))
+	if _, err := c.IPConn.WriteTo(icmpEcho(icmpEchoRequest, c.id, seq, icmpRequestMagic, p), addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *icmpDialConn) SetDSCP(dscp int) error {
+	return ipv4.NewConn(c.IPConn).SetTOS(dscp << 2)
+}
+
+// icmpConn reads the packets of clients from their echo requests and answers them in
+// echo replies, with the id and the last seq of the peer, which nats match replies by
+type icmpConn struct {
+	*net.IPConn
+
+	mu   sync.Mutex
+	seqs map[string]uint16 // the last seq of each peer
+}
+
+// ListenICMP opens a raw icmp socket on the IPv4 address laddr for a server, which
+// requires root or CAP_NET_RAW. The kernel goes on answering the echo requests itself,
+// which is best switched off with the sysctl net.ipv4.icmp_echo_ignore_all.
+func ListenICMP(laddr string) (net.PacketConn, error) {
+	host, _, err := net.SplitHostPort(laddr)
+	if err != nil {
+		host = laddr
+	}
+	conn, err := net.ListenPacket("ip4:icmp", host)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &icmpConn{IPConn: conn.(*net.IPConn), seqs: make(map[string]uint16)}, nil
+}
+
+func (c *icmpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, icmpHeaderSize+len(b))
+	for {
+		n, addr, err := c.IPConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+		id, seq, ok := parseICMPEcho(buf[:n], icmpEchoRequest, icmpRequestMagic)
+		if !ok {
+			continue
+		}
+		peer := &icmpAddr{ip: addr.(*net.IPAddr).IP, id: id}
+		c.mu.Lock()
+		if len(c.seqs) >= maxICMPPeers {
+			c.seqs = make(map[string]uint16)
+		}
+		c.seqs[peer.String()] = seq
+		c.mu.Unlock()
+		return copy(b, buf[icmpHeaderSize:n]), peer, nil
+	}
+}
+
+func (c *icmpConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	peer, ok := addr.(*icmpAddr)
+	if !ok {
+		return 0, errors.Errorf("icmp: not a peer: %v", addr)
+	}
+	c.mu.Lock()
+	seq := c.seqs[peer.String()]
+	c.mu.Unlock()
+	if _, err := c.IPConn.WriteTo(icmpEcho(icmpEchoReply, peer.id, seq, icmpReplyMagic, p), &net.IPAddr{IP: peer.ip}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *icmpConn) SetDSCP(dscp int) error {
+	return ipv4.NewConn(c.IPConn).SetTOS(dscp << 2)
+}
@@ -0,0 +1,148 @@
+package generic
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	// PrecedenceConfig lets the json config override the flags and environment variables
+	PrecedenceConfig = "config"
+	// PrecedenceFlags keeps the flags and environment variables over the json config
+	PrecedenceFlags = "flags"
+)
+
+// ConfigSources tells where each setting of a config came from by its json name:
+// default, flag, env or config
+type ConfigSources map[string]string
+
+// String lists the settings not left to their defaults with their sources, by name
+func (s ConfigSources) String() string {
+	var list []string
+	for name, source := range s {
+		if source != "default" {
+			list = append(list, name+"="+source)
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, " ")
+}
+
+// ShellSources returns the settings set by flag or by environment variable, as "flag"
+// or "env" by their json names, which are the names of the flags unless renamed by names
+func ShellSources(c *cli.Context, names map[string]string) ConfigSources {
+	sources := make(ConfigSources)
+	for _, f := range c.App.Flags {
+		name := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+		if !c.IsSet(name) {
+			continue
+		}
+		source := "flag"
+		// a flag given on the command line takes the place of its variable
+		env := reflect.ValueOf(f).FieldByName("EnvVar")
+		if env.IsValid() && env.String() != "" {
+			if v, ok := os.LookupEnv(env.String()); ok {
+				if value, ok := c.Generic(name).(flag.Value); ok && value.String() == v {
+					source = "env"
+				}
+			}
+		}
+		if renamed, ok := names[name]; ok {
+			name = renamed
+		}
+		sources[name] = source
+	}
+	return sources
+}
+
+// LoadConfig decodes the json config at path, if any, into config, a pointer to the
+// config struct filled from the shell whose settings are in shell. With precedence
+// PrecedenceFlags the settings of the shell are kept, with PrecedenceConfig the json
+// config overrides them. It returns where each setting came from.
+func LoadConfig(config interface{}, path, precedence string, shell ConfigSources) (ConfigSources, error) {
+	v := reflect.ValueOf(config).Elem()
+	base := reflect.New(v.Type()).Elem()
+	base.Set(v)
+
+	keys := make(map[string]bool)
+	if path != "" {
+		if err := parseJSONConfig(config, path, make(map[string]bool), keys); err != nil {
+			return nil, err
+		}
+	}
+
+	sources := make(ConfigSources)
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		switch {
+		case shell[name] != "" && (!keys[name] || precedence == PrecedenceFlags):
+			v.Field(i).Set(base.Field(i))
+			sources[name] = shell[name]
+		case keys[name]:
+			sources[name] = "config"
+		default:
+			sources[name] = "default"
+		}
+	}
+	return sources, nil
+}
+
+// ParseJSONConfig decodes the json config at path into v. A config may name a base
+// config in "include", relative to its own directory, which is decoded first, so that
+// it only needs the settings it overrides. Includes may be nested.
+func ParseJSONConfig(v interface{}, path string) error {
+	return parseJSONConfig(v, path, make(map[string]bool), make(map[string]bool))
+}
+
+// parseJSONConfig decodes the config at path and its includes, not already seen, and
+// marks the settings they have in keys
+func parseJSONConfig(v interface{}, path string, seen, keys map[string]bool) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if seen[abs] {
+		return errors.Errorf("include loop: %v", path)
+	}
+	seen[abs] = true
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return errors.Wrap(err, path)
+	}
+	var base string
+	if raw, ok := settings["include"]; ok {
+		if err := json.Unmarshal(raw, &base); err != nil {
+			return errors.Wrap(err, path)
+		}
+	}
+	if base != "" {
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(filepath.Dir(path), base)
+		}
+		if err := parseJSONConfig(v, base, seen, keys); err != nil {
+			return err
+		}
+	}
+	// names are matched case insensitively like encoding/json does
+	for name := range settings {
+		keys[strings.ToLower(name)] = true
+	}
+	return errors.Wrap(json.Unmarshal(data, v), path)
+}
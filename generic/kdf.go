@@ -0,0 +1,30 @@
+package generic
+
+import (
+	"crypto/sha1"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// DeriveKey expands the pre-shared secret to the 32 bytes key for block ciphers, with
+// pbkdf2-sha1 over iter iterations, or argon2id with iter passes over mem KiB.
+func DeriveKey(kdf, key, salt string, iter, mem int) ([]byte, error) {
+	switch kdf {
+	case "pbkdf2":
+		if iter <= 0 {
+			iter = 4096
+		}
+		return pbkdf2.Key([]byte(key), []byte(salt), iter, 32, sha1.New), nil
+	case "argon2id":
+		if iter <= 0 {
+			iter = 3
+		}
+		if mem <= 0 {
+			mem = 65536
+		}
+		return argon2.IDKey([]byte(key), []byte(salt), uint32(iter), uint32(mem), 1, 32), nil
+	}
+	return nil, errors.Errorf("unsupported kdf: %v", kdf)
+}
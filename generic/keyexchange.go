@@ -0,0 +1,168 @@
+package generic
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// time allowed for both messages of a key exchange
+	keyExchangeTimeout = 30 * time.Second
+	// size of an uncompressed p-256 point
+	keyExchangePubSize = 65
+	// size of an x25519 public key
+	x25519Size = 32
+)
+
+// KeyExchange agrees on a fresh key for the session on conn by an ephemeral ecdh
+// exchange on p-256 authenticated with psk, and returns conn encrypted with it, so that
+// traffic recorded now can't be decrypted with psk later. The side dialing the session
+// initiates, the peer must do the other half with the same psk:
+//
+//	initiator: | PUB_I(65B) | HMAC-SHA256(psk, PUB_I)(32B) |
+//	responder: | PUB_R(65B) | HMAC-SHA256(psk, PUB_I PUB_R)(32B) |
+//
+// and the key is derived from the shared secret by hkdf-sha256, salted with psk.
+func KeyExchange(conn net.Conn, psk []byte, initiator bool) (net.Conn, error) {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pub := priv.PublicKey().Bytes()
+
+	conn.SetDeadline(time.Now().Add(keyExchangeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var transcript []byte
+	var peer []byte
+	if initiator {
+		if _, err := conn.Write(append(pub, keyExchangeMAC(psk, pub)...)); err != nil {
+			return nil, errors.Wrap(err, "key exchange")
+		}
+		if peer, err = readKeyExchange(conn, psk, pub, keyExchangePubSize); err != nil {
+			return nil, err
+		}
+		transcript = append(pub, peer...)
+	} else {
+		if peer, err = readKeyExchange(conn, psk, nil, keyExchangePubSize); err != nil {
+			return nil, err
+		}
+		transcript = append(peer, pub...)
+		if _, err := conn.Write(append(pub, keyExchangeMAC(psk, transcript)...)); err != nil {
+			return nil, errors.Wrap(err, "key exchange")
+		}
+	}
+
+	peerPub, err := ecdh.P256().NewPublicKey(peer)
+	if err != nil {
+		return nil, errors.New("key exchange: invalid public key")
+	}
+	secret, err := priv.ECDH(peerPub)
+	if err != nil {
+		return nil, errors.Wrap(err, "key exchange")
+	}
+	key, err := hkdf.Key(sha256.New, secret, psk, "kcptun session"+string(transcript), 32)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return NewCryptConn(conn, key), nil
+}
+
+// HybridKeyExchange is KeyExchange on X25519 and ML-KEM-768 together, the key derived
+// from both shared secrets so that it stays secret as long as either of them does,
+// against quantum computers decrypting traffic recorded today as well:
+//
+//	initiator: | X25519_I(32B) | MLKEM_EK(1184B) | HMAC-SHA256(psk, X25519_I MLKEM_EK)(32B) |
+//	responder: | X25519_R(32B) | MLKEM_CT(1088B) | HMAC-SHA256(psk, X25519_I MLKEM_EK X25519_R MLKEM_CT)(32B) |
+//
+// the key is derived from X25519 || ML-KEM shared secrets by hkdf-sha256, salted with psk.
+func HybridKeyExchange(conn net.Conn, psk []byte, initiator bool) (net.Conn, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pub := priv.PublicKey().Bytes()
+
+	conn.SetDeadline(time.Now().Add(keyExchangeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var transcript, peer, kemShared []byte
+	if initiator {
+		dk, err := mlkem.GenerateKey768()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		msg := append(pub, dk.EncapsulationKey().Bytes()...)
+		if _, err := conn.Write(append(msg, keyExchangeMAC(psk, msg)...)); err != nil {
+			return nil, errors.Wrap(err, "key exchange")
+		}
+		if peer, err = readKeyExchange(conn, psk, msg, x25519Size+mlkem.CiphertextSize768); err != nil {
+			return nil, err
+		}
+		if kemShared, err = dk.Decapsulate(peer[x25519Size:]); err != nil {
+			return nil, errors.Wrap(err, "key exchange")
+		}
+		transcript = append(append([]byte{}, msg...), peer...)
+	} else {
+		if peer, err = readKeyExchange(conn, psk, nil, x25519Size+mlkem.EncapsulationKeySize768); err != nil {
+			return nil, err
+		}
+		ek, err := mlkem.NewEncapsulationKey768(peer[x25519Size:])
+		if err != nil {
+			return nil, errors.Wrap(err, "key exchange")
+		}
+		var ct []byte
+		kemShared, ct = ek.Encapsulate()
+		transcript = append(append(append([]byte{}, peer...), pub...), ct...)
+		msg := append(pub, ct...)
+		if _, err := conn.Write(append(msg, keyExchangeMAC(psk, transcript)...)); err != nil {
+			return nil, errors.Wrap(err, "key exchange")
+		}
+	}
+
+	peerPub, err := ecdh.X25519().NewPublicKey(peer[:x25519Size])
+	if err != nil {
+		return nil, errors.Wrap(err, "key exchange")
+	}
+	ecdhShared, err := priv.ECDH(peerPub)
+	if err != nil {
+		return nil, errors.Wrap(err, "key exchange")
+	}
+	secret := append(ecdhShared, kemShared...)
+	key, err := hkdf.Key(sha256.New, secret, psk, "kcptun hybrid session"+string(transcript), 32)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return NewCryptConn(conn, key), nil
+}
+
+// readKeyExchange reads the size bytes message of the peer and checks its mac over
+// prefix and the message
+func readKeyExchange(conn net.Conn, psk, prefix []byte, size int) ([]byte, error) {
+	msg := make([]byte, size+sha256.Size)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, errors.Wrap(err, "key exchange")
+	}
+	peer, mac := msg[:size], msg[size:]
+	if !hmac.Equal(mac, keyExchangeMAC(psk, append(append([]byte{}, prefix...), peer...))) {
+		return nil, errors.New("key exchange: authentication failed")
+	}
+	return peer, nil
+}
+
+// keyExchangeMAC authenticates msg with psk
+func keyExchangeMAC(psk, msg []byte) []byte {
+	mac := hmac.New(sha256.New, psk)
+	mac.Write([]byte("kcptun key exchange"))
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,54 @@
+package generic
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	keyFileMu    sync.Mutex
+	keyFileCache = make(map[string]string)
+)
+
+// ReadKeyFile reads the pre-shared key from the file at path, from stdin if path is "-",
+// or from an inherited file descriptor like fd:3, surrounding whitespace is trimmed.
+// Keys from stdin and file descriptors can only be read once and are remembered.
+func ReadKeyFile(path string) (string, error) {
+	keyFileMu.Lock()
+	defer keyFileMu.Unlock()
+	if key, ok := keyFileCache[path]; ok {
+		return key, nil
+	}
+
+	var f *os.File
+	switch {
+	case path == "-":
+		f = os.Stdin
+	case strings.HasPrefix(path, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(path, "fd:"))
+		if err != nil {
+			return "", errors.Errorf("invalid key file descriptor: %v", path)
+		}
+		f = os.NewFile(uintptr(fd), path)
+	default:
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	key := strings.TrimSpace(string(data))
+	keyFileCache[path] = key
+	return key, nil
+}
@@ -0,0 +1,141 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	logMu   sync.Mutex
+	logFile *os.File
+	logJSON bool
+)
+
+// SetLogFormat selects text or json logs, it must be called before SetLogOutput.
+// In json each line is an object with time and msg, plus the fields of LogEvent.
+func SetLogFormat(format string) error {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	switch format {
+	case "", "text":
+		logJSON = false
+	case "json":
+		logJSON = true
+		log.SetFlags(0)
+	default:
+		return errors.Errorf("unknown log format: %v", format)
+	}
+	return nil
+}
+
+// SetLogOutput redirects the log to the file at path, or to stderr if path is empty.
+// The previously opened log file is closed.
+func SetLogOutput(path string) error {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	var f *os.File
+	var w io.Writer = os.Stderr
+	if path != "" {
+		var err error
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	if logJSON {
+		w = &jsonLogWriter{w}
+	}
+	log.SetOutput(w)
+
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+	return nil
+}
+
+// LogEvent logs msg with fields given as key, value pairs. Text logs print them as
+// key: value after msg, json logs as fields of the object to query on.
+func LogEvent(msg string, fields ...interface{}) {
+	logMu.Lock()
+	jsonFormat := logJSON
+	logMu.Unlock()
+
+	if !jsonFormat {
+		v := []interface{}{msg}
+		for i := 0; i+1 < len(fields); i += 2 {
+			v = append(v, fmt.Sprint(fields[i], ":"), fields[i+1])
+		}
+		log.Println(v...)
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeJSONValue(&b, time.Now().Format(time.RFC3339Nano))
+	b.WriteString(`,"msg":`)
+	writeJSONValue(&b, msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		b.WriteByte(',')
+		writeJSONValue(&b, fmt.Sprint(fields[i]))
+		b.WriteByte(':')
+		writeJSONValue(&b, fields[i+1])
+	}
+	b.WriteByte('}')
+	log.Println(b.String())
+}
+
+// writeJSONValue writes v as json, numbers and booleans as they are, anything else as
+// its string
+func writeJSONValue(b *bytes.Buffer, v interface{}) {
+	switch x := v.(type) {
+	case nil:
+		b.WriteString("null")
+		return
+	case bool, int, int32, int64, uint, uint16, uint32, uint64, float64, string:
+	case error:
+		v = x.Error()
+	case fmt.Stringer:
+		v = x.String()
+	default:
+		v = fmt.Sprint(x)
+	}
+	data, _ := json.Marshal(v)
+	b.Write(data)
+}
+
+// jsonLogWriter turns the plain lines of the log package into json objects, lines of
+// LogEvent are objects already
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	line := bytes.TrimRight(p, "\n")
+	if len(line) > 0 && line[0] == '{' && json.Valid(line) {
+		return w.w.Write(p)
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeJSONValue(&b, time.Now().Format(time.RFC3339Nano))
+	b.WriteString(`,"msg":`)
+	writeJSONValue(&b, strings.TrimSpace(string(line)))
+	b.WriteString("}\n")
+	if _, err := w.w.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
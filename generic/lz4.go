@@ -0,0 +1,234 @@
+package generic
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// LZ4 block format, https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md
+
+const (
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5  // the last bytes of a block are always literals
+	lz4MFLimit      = 12 // the last match starts this far from the end of a block at least
+	lz4MaxOffset    = 0xffff
+	lz4HashLog      = 12
+
+	// largest chunk compressed as one block
+	lz4MaxChunk = 0xffff
+)
+
+var errLZ4Corrupt = errors.New("lz4: corrupt block")
+
+// lz4Compress appends the lz4 block of src to dst, table is a scratch hash table
+func lz4Compress(dst, src []byte, table *[1 << lz4HashLog]int32) []byte {
+	for i := range table {
+		table[i] = 0
+	}
+	n := len(src)
+	anchor := 0
+	for i := 0; i < n-lz4MFLimit; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lz4HashLog)
+		ref := int(table[h]) - 1 // positions are stored plus one, zero is empty
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+		length := lz4MinMatch
+		for i+length < n-lz4LastLiterals && src[ref+length] == src[i+length] {
+			length++
+		}
+		dst = lz4Sequence(dst, src[anchor:i], i-ref, length)
+		i += length
+		anchor = i
+	}
+	return lz4Sequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4Sequence appends literals followed by a match, the last sequence has no match
+func lz4Sequence(dst, literals []byte, offset, length int) []byte {
+	token := byte(0)
+	if len(literals) >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(len(literals)) << 4
+	}
+	if offset > 0 {
+		if length-lz4MinMatch >= 15 {
+			token |= 15
+		} else {
+			token |= byte(length - lz4MinMatch)
+		}
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if offset > 0 {
+		dst = append(dst, byte(offset), byte(offset>>8))
+		if length-lz4MinMatch >= 15 {
+			dst = lz4AppendLength(dst, length-lz4MinMatch-15)
+		}
+	}
+	return dst
+}
+
+func lz4AppendLength(dst []byte, v int) []byte {
+	for ; v >= 255; v -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(v))
+}
+
+// lz4Decompress appends the data of an lz4 block to dst, which must not grow beyond size
+func lz4Decompress(dst, src []byte, size int) ([]byte, error) {
+	readLength := func(i, v int) (int, int, error) {
+		for {
+			if i >= len(src) {
+				return 0, 0, errLZ4Corrupt
+			}
+			b := src[i]
+			i++
+			v += int(b)
+			if b != 255 {
+				return i, v, nil
+			}
+		}
+	}
+
+	base := len(dst)
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+		literals := int(token >> 4)
+		if literals == 15 {
+			var err error
+			if i, literals, err = readLength(i, literals); err != nil {
+				return nil, err
+			}
+		}
+		if i+literals > len(src) || len(dst)-base+literals > size {
+			return nil, errLZ4Corrupt
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+		if i == len(src) {
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, errLZ4Corrupt
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		length := int(token & 15)
+		if length == 15 {
+			var err error
+			if i, length, err = readLength(i, length); err != nil {
+				return nil, err
+			}
+		}
+		length += lz4MinMatch
+		if offset == 0 || offset > len(dst)-base || len(dst)-base+length > size {
+			return nil, errLZ4Corrupt
+		}
+		start := len(dst) - offset
+		if offset >= length {
+			dst = append(dst, dst[start:start+length]...)
+		} else {
+			for k := 0; k < length; k++ { // overlapping, repeats the last offset bytes
+				dst = append(dst, dst[start+k])
+			}
+		}
+	}
+	return dst, nil
+}
+
+// lz4Stream compresses a conn in lz4 blocks of |RAWLEN(2)|BLOCKLEN(2)|BLOCK|, a zero
+// BLOCKLEN stores a chunk that didn't compress as is
+type lz4Stream struct {
+	net.Conn
+	table     [1 << lz4HashLog]int32
+	threshold int // writes shorter than this are stored uncompressed
+	sampler   *compSampler
+	out       []byte
+	pending   []byte // decompressed data not yet read
+	buf       []byte
+	block     []byte
+}
+
+func newLZ4Stream(conn net.Conn) *lz4Stream {
+	return &lz4Stream{Conn: conn, buf: make([]byte, lz4MaxChunk), block: make([]byte, lz4MaxChunk)}
+}
+
+func (c *lz4Stream) Write(p []byte) (int, error) {
+	out := c.out[:0]
+	written := 0
+	sample := c.sampler.sample(p)
+	compress := len(p) >= c.threshold && !sample.skip()
+	for len(p) > 0 {
+		n := len(p)
+		if n > lz4MaxChunk {
+			n = lz4MaxChunk
+		}
+		hdr := len(out)
+		out = append(out, byte(n>>8), byte(n), 0, 0)
+		if compress {
+			out = lz4Compress(out, p[:n], &c.table)
+		}
+		if blockLen := len(out) - hdr - 4; blockLen > 0 && blockLen < n {
+			binary.BigEndian.PutUint16(out[hdr+2:], uint16(blockLen))
+			sample.record(n, blockLen)
+		} else {
+			out = append(out[:hdr+4], p[:n]...)
+			if compress {
+				sample.record(n, n)
+			}
+		}
+		p = p[n:]
+		written += n
+	}
+	c.out = out
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return written, nil
+}
+
+func (c *lz4Stream) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		rawLen := int(binary.BigEndian.Uint16(hdr[:]))
+		blockLen := int(binary.BigEndian.Uint16(hdr[2:]))
+		if blockLen == 0 {
+			if _, err := io.ReadFull(c.Conn, c.buf[:rawLen]); err != nil {
+				return 0, err
+			}
+			c.pending = c.buf[:rawLen]
+			continue
+		}
+		if _, err := io.ReadFull(c.Conn, c.block[:blockLen]); err != nil {
+			return 0, err
+		}
+		data, err := lz4Decompress(c.buf[:0], c.block[:blockLen], rawLen)
+		if err != nil {
+			return 0, err
+		}
+		if len(data) != rawLen {
+			return 0, errLZ4Corrupt
+		}
+		c.pending = data
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
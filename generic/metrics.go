@@ -0,0 +1,97 @@
+package generic
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"unicode"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// snakeCase converts snmp field names like FECParityShards to fec_parity_shards
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var out []rune
+	for k, r := range runes {
+		if k > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[k-1])
+			nextLower := k+1 < len(runes) && unicode.IsLower(runes[k+1])
+			if prevLower || (unicode.IsUpper(runes[k-1]) && nextLower) {
+				out = append(out, '_')
+			}
+		}
+		out = append(out, unicode.ToLower(r))
+	}
+	return string(out)
+}
+
+// WriteMetrics writes snmp counters and per-session metrics in prometheus text format
+func WriteMetrics(w io.Writer, sessions []*Session) error {
+	bw := bufio.NewWriter(w)
+	header := kcp.DefaultSnmp.Header()
+	values := kcp.DefaultSnmp.ToSlice()
+	for k := range header {
+		name := "kcptun_snmp_" + snakeCase(header[k])
+		fmt.Fprintf(bw, "# TYPE %v counter\n%v %v\n", name, name, values[k])
+	}
+
+	type metric struct {
+		name, typ, help string
+		value           func(s *Session) interface{}
+	}
+	metrics := []metric{
+		{"kcptun_session_streams", "gauge", "open smux streams", func(s *Session) interface{} { return s.Mux.NumStreams() }},
+		{"kcptun_session_bytes_in", "counter", "bytes received from the tunnel", func(s *Session) interface{} { return s.Meter.BytesIn() }},
+		{"kcptun_session_bytes_out", "counter", "bytes sent into the tunnel", func(s *Session) interface{} { return s.Meter.BytesOut() }},
+		{"kcptun_session_srtt_ms", "gauge", "smoothed round trip time", func(s *Session) interface{} { return s.KCP.GetSRTT() }},
+		{"kcptun_session_rto_ms", "gauge", "retransmission timeout", func(s *Session) interface{} { return s.KCP.GetRTO() }},
+	}
+	for i, m := range metrics {
+		fmt.Fprintf(bw, "# HELP %v %v\n# TYPE %v %v\n", m.name, m.help, m.name, m.typ)
+		for _, s := range sessions {
+			var conv uint32
+			if s.KCP != nil {
+				conv = s.KCP.GetConv()
+			} else if i >= 3 {
+				continue // kcp only metrics, the session is on the plain tcp transport
+			}
+			fmt.Fprintf(bw, "%v{conv=\"%v\",remote=\"%v\",user=\"%v\"} %v\n", m.name, conv, s.Meter.RemoteAddr(), s.User, m.value(s))
+		}
+	}
+	streams := 0
+	for _, s := range sessions {
+		streams += s.Mux.NumStreams()
+	}
+	fmt.Fprintf(bw, "# TYPE kcptun_sessions gauge\nkcptun_sessions %v\n", len(sessions))
+	fmt.Fprintf(bw, "# TYPE kcptun_streams gauge\nkcptun_streams %v\n", streams)
+	writeStreamMetrics(bw)
+	writeReplayMetrics(bw)
+	return bw.Flush()
+}
+
+// MetricsWriter is optionally implemented by a Tuner to export additional metrics
+type MetricsWriter interface {
+	WriteMetrics(w io.Writer)
+}
+
+// MetricsServer serves prometheus metrics on addr at /metrics
+func MetricsServer(addr string, t Tuner) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w, t.Sessions())
+		if mw, ok := t.(MetricsWriter); ok {
+			mw.WriteMetrics(w)
+		}
+	})
+	log.Println("metrics listening on:", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("metrics:", err)
+	}
+}
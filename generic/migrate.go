@@ -0,0 +1,253 @@
+package generic
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// every packet of a migrating peer starts with its id
+	migrateIDSize = 8
+	// how often the local addresses are checked for a change
+	migrateCheck = 2 * time.Second
+	// peers silent this long are forgotten
+	migrateIdle = 5 * time.Minute
+	// peers remembered before the silent ones are purged
+	maxMigratePeers = 1 << 16
+)
+
+// migrateMask hides the id with the bytes following it, which are random on encrypted
+// connections, so that it isn't the same on every packet
+func migrateMask(p []byte) uint64 {
+	if len(p) < migrateIDSize {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(p)
+}
+
+// migrateAddr is the address a migrating peer is known by to the layers above, the one
+// its first packet came from told apart by its id, while its packets are sent to the
+// one its last packet came from
+type migrateAddr struct {
+	first net.Addr
+	id    uint64
+	last  atomic.Value // net.Addr
+	seen  int64        // unix time of the last packet
+}
+
+func (a *migrateAddr) Network() string { return a.first.Network() }
+func (a *migrateAddr) String() string  { return fmt.Sprintf("%v/%08x", a.first, uint32(a.id)) }
+
+// migrateConn lets the peers of a server move to another address without their kcp
+// sessions noticing. Every packet of a peer is prefixed with an id it picked at random,
+// and the packets of an id are reported as coming from one address whichever they came
+// from, while the packets to it go where the last one came from.
+type migrateConn struct {
+	net.PacketConn
+
+	mu       sync.Mutex
+	peers    map[uint64]*migrateAddr
+	purgedAt time.Time
+}
+
+// NewMigrateConn wraps the packet conn of a server, its peers must dial with
+// NewMigrateDialConn
+func NewMigrateConn(conn net.PacketConn) net.PacketConn {
+	return &migrateConn{PacketConn: conn, peers: make(map[uint64]*migrateAddr), purgedAt: time.Now()}
+}
+
+// peer returns the address of id, updated to from
+func (c *migrateConn) peer(id uint64, from net.Addr) *migrateAddr {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.purgedAt) >= migrateIdle || len(c.peers) >= maxMigratePeers {
+		for k, a := range c.peers {
+			if now.Unix()-atomic.LoadInt64(&a.seen) >= int64(migrateIdle/time.Second) {
+				delete(c.peers, k)
+			}
+		}
+		if len(c.peers) >= maxMigratePeers {
+			c.peers = make(map[uint64]*migrateAddr)
+		}
+		c.purgedAt = now
+	}
+
+	a, ok := c.peers[id]
+	if !ok {
+		a = &migrateAddr{first: from, id: id}
+		a.last.Store(from)
+		c.peers[id] = a
+	} else if last := a.last.Load().(net.Addr); last.String() != from.String() {
+		log.Println("migrate:", a, "moved from", last, "to", from)
+		a.last.Store(from)
+	}
+	atomic.StoreInt64(&a.seen, now.Unix())
+	return a
+}
+
+func (c *migrateConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, from, err
+		}
+		if n < migrateIDSize {
+			continue
+		}
+		id := binary.LittleEndian.Uint64(b) ^ migrateMask(b[migrateIDSize:n])
+		a := c.peer(id, from)
+		// a packet of the id alone announces a new address
+		if n = copy(b, b[migrateIDSize:n]); n > 0 {
+			return n, a, nil
+		}
+	}
+}
+
+func (c *migrateConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if a, ok := addr.(*migrateAddr); ok {
+		addr = a.last.Load().(net.Addr)
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *migrateConn) SetReadBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errors.New("SetReadBuffer: not supported")
+}
+
+func (c *migrateConn) SetWriteBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errors.New("SetWriteBuffer: not supported")
+}
+
+func (c *migrateConn) SetDSCP(dscp int) error {
+	if nc, ok := c.PacketConn.(interface{ SetDSCP(int) error }); ok {
+		return nc.SetDSCP(dscp)
+	}
+	if nc, ok := c.PacketConn.(net.Conn); ok {
+		err4 := ipv4.NewConn(nc).SetTOS(dscp << 2)
+		err6 := ipv6.NewConn(nc).SetTrafficClass(dscp)
+		if err4 == nil || err6 == nil {
+			return nil
+		}
+	}
+	return errors.New("SetDSCP: not supported")
+}
+
+// migrateDialConn prefixes the packets of a client with its id, and announces the id
+// from the new address as soon as the local addresses change
+type migrateDialConn struct {
+	net.PacketConn
+	id     uint64
+	remote atomic.Value // net.Addr written to last
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewMigrateDialConn wraps the packet conn of a client dialing a server wrapped by
+// NewMigrateConn
+func NewMigrateDialConn(conn net.PacketConn) net.PacketConn {
+	var id [migrateIDSize]byte
+	rand.Read(id[:])
+	c := &migrateDialConn{PacketConn: conn, id: binary.LittleEndian.Uint64(id[:]), die: make(chan struct{})}
+	go c.watch()
+	return c
+}
+
+// localAddrs lists the addresses of the local interfaces
+func localAddrs() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	list := make([]string, len(addrs))
+	for k, addr := range addrs {
+		list[k] = addr.String()
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// watch announces the id to the server whenever the local addresses change, rather
+// than waiting for the next packet of the session
+func (c *migrateDialConn) watch() {
+	ticker := time.NewTicker(migrateCheck)
+	defer ticker.Stop()
+	addrs := localAddrs()
+	for {
+		select {
+		case <-ticker.C:
+			if now := localAddrs(); now != addrs {
+				addrs = now
+				if remote, ok := c.remote.Load().(net.Addr); ok {
+					log.Println("migrate: local addresses changed, announcing to", remote)
+					c.WriteTo(nil, remote)
+				}
+			}
+		case <-c.die:
+			return
+		}
+	}
+}
+
+func (c *migrateDialConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.remote.Store(addr)
+	out := make([]byte, migrateIDSize+len(p))
+	copy(out[migrateIDSize:], p)
+	binary.LittleEndian.PutUint64(out, c.id^migrateMask(p))
+	if _, err := c.PacketConn.WriteTo(out, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *migrateDialConn) Close() error {
+	c.dieOnce.Do(func() { close(c.die) })
+	return c.PacketConn.Close()
+}
+
+func (c *migrateDialConn) SetReadBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errors.New("SetReadBuffer: not supported")
+}
+
+func (c *migrateDialConn) SetWriteBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errors.New("SetWriteBuffer: not supported")
+}
+
+func (c *migrateDialConn) SetDSCP(dscp int) error {
+	if nc, ok := c.PacketConn.(interface{ SetDSCP(int) error }); ok {
+		return nc.SetDSCP(dscp)
+	}
+	if nc, ok := c.PacketConn.(net.Conn); ok {
+		err4 := ipv4.NewConn(nc).SetTOS(dscp << 2)
+		err6 := ipv6.NewConn(nc).SetTrafficClass(dscp)
+		if err4 == nil || err6 == nil {
+			return nil
+		}
+	}
+	return errors.New("SetDSCP: not supported")
+}
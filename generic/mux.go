@@ -0,0 +1,108 @@
+package generic
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// the stream multiplexers of -mux, see MuxNone for none
+const (
+	MuxSmux  = "smux"
+	MuxYamux = "yamux"
+)
+
+// Mux is a session multiplexing streams over one connection. The multiplexers report
+// the errors of smux, like smux.ErrTimeout and smux.ErrInvalidProtocol.
+type Mux interface {
+	OpenStream() (Stream, error)
+	AcceptStream() (Stream, error)
+	NumStreams() int
+	IsClosed() bool
+	Close() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// Stream is a stream of a Mux
+type Stream interface {
+	net.Conn
+	ID() uint32
+}
+
+// NewMux starts the multiplexer mux on conn, the client side if client is set. yamux
+// takes its keepalive, frame size and stream window from config like smux does, the
+// window of at least the 256KB yamux starts with. Its streams are listed by Streams.
+func NewMux(conn io.ReadWriteCloser, mux string, config *smux.Config, client bool) (Mux, error) {
+	m, err := newMux(conn, mux, config, client)
+	if err != nil {
+		return nil, err
+	}
+	return trackStreams(m), nil
+}
+
+func newMux(conn io.ReadWriteCloser, mux string, config *smux.Config, client bool) (Mux, error) {
+	switch mux {
+	case MuxSmux:
+		var s *smux.Session
+		var err error
+		if client {
+			s, err = smux.Client(conn, config)
+		} else {
+			s, err = smux.Server(conn, config)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return smuxSession{s}, nil
+	case MuxYamux:
+		if err := smux.VerifyConfig(config); err != nil {
+			return nil, err
+		}
+		return newYamux(conn, config, client), nil
+	case MuxNone:
+		return newRawMux(conn)
+	}
+	return nil, errors.Errorf("unknown mux: %v", mux)
+}
+
+// MuxNop returns a frame of mux that the peer ignores, for making a fresh session known
+// to it before any stream is opened. There's none without a multiplexer.
+func MuxNop(mux string, smuxVer int) []byte {
+	switch mux {
+	case MuxNone:
+		return nil
+	case MuxYamux:
+		// ping, syn, stream 0, opaque value 0
+		nop := make([]byte, yamuxHeaderSize)
+		nop[1] = yamuxTypePing
+		binary.BigEndian.PutUint16(nop[2:], yamuxFlagSYN)
+		return nop
+	}
+	// ver, cmd NOP, length 0, sid 0
+	return []byte{byte(smuxVer), 3, 0, 0, 0, 0, 0, 0}
+}
+
+// smuxSession adapts a smux session to Mux
+type smuxSession struct {
+	*smux.Session
+}
+
+func (s smuxSession) OpenStream() (Stream, error) {
+	stream, err := s.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s smuxSession) AcceptStream() (Stream, error) {
+	stream, err := s.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
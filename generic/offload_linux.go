@@ -0,0 +1,309 @@
+// +build linux
+
+package generic
+
+import (
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// socket options of udp segmentation offload(linux 4.18) and receive offload(linux 5.0)
+	udpSegment = 103 // UDP_SEGMENT
+	udpGRO     = 104 // UDP_GRO
+	// datagrams sent in one segmented write at most
+	gsoMaxSegments = 64
+	// bytes of a segmented write at most
+	gsoMaxSize = 65000
+	// bytes of a coalesced read at most
+	groBufferSize = 65535
+)
+
+// offloadConn moves runs of datagrams of the same size to the same peer as one large
+// buffer, split into datagrams by the kernel or the nic(GSO), and reads datagrams
+// coalesced by the kernel(GRO) at once, splitting them again for kcp.
+//
+// The writes and reads carrying control messages are made here with sendmsg and
+// recvmsg, not through x/net: the message headers x/net pools keep the control of a
+// previous message when the next has none, which would hand a stale segment size or
+// receive buffer to the plain writes and reads of kcp.
+type offloadConn struct {
+	*net.UDPConn
+	raw   syscall.RawConn
+	xconn batchConn
+	inet6 bool  // the socket is AF_INET6, peers are given as ipv6 addresses
+	gso   int32 // 1 while segmentation works, cleared on the first EIO
+	gro   bool
+
+	// reads are made by a single goroutine, kcp's read loop or the users' demux
+	rbuf    []byte
+	roob    []byte
+	pending []groSegment
+}
+
+// groSegment is a datagram split off a coalesced read
+type groSegment struct {
+	data []byte
+	addr net.Addr
+}
+
+// NewOffloadConn enables udp segmentation and receive offload on conn if it's a udp
+// socket and the kernel supports them, conn is returned as is otherwise
+func NewOffloadConn(conn net.PacketConn) net.PacketConn {
+	udpconn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return conn
+	}
+	raw, err := udpconn.SyscallConn()
+	if err != nil {
+		return conn
+	}
+	var gso, gro, inet6 bool
+	raw.Control(func(fd uintptr) {
+		_, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, udpSegment)
+		gso = err == nil
+		gro = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, udpGRO, 1) == nil
+		sa, _ := unix.Getsockname(int(fd))
+		_, inet6 = sa.(*unix.SockaddrInet6)
+	})
+	log.Println("udp offload:", "gso:", gso, "gro:", gro)
+	if !gso && !gro {
+		return conn
+	}
+
+	c := &offloadConn{UDPConn: udpconn, raw: raw, xconn: newBatchConn(udpconn), inet6: inet6, gro: gro}
+	if gso {
+		c.gso = 1
+	}
+	if gro {
+		c.rbuf = make([]byte, groBufferSize)
+		c.roob = make([]byte, unix.CmsgSpace(4))
+	}
+	return c
+}
+
+func (c *offloadConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if !c.gro {
+		return c.UDPConn.ReadFrom(b)
+	}
+	ms := []ipv4.Message{{Buffers: [][]byte{b}}}
+	if _, err := c.ReadBatch(ms, 0); err != nil {
+		return 0, nil, err
+	}
+	return ms[0].N, ms[0].Addr, nil
+}
+
+// ReadBatch reads datagrams into ms, splitting the ones coalesced by the kernel
+func (c *offloadConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	if !c.gro {
+		return c.xconn.ReadBatch(ms, flags)
+	}
+	if len(c.pending) == 0 {
+		var n, oobn int
+		var from unix.Sockaddr
+		var err error
+		rerr := c.raw.Read(func(fd uintptr) bool {
+			n, oobn, _, from, err = unix.Recvmsg(int(fd), c.rbuf, c.roob, flags)
+			return err != unix.EAGAIN
+		})
+		if rerr != nil {
+			return 0, rerr
+		}
+		if err != nil {
+			return 0, os.NewSyscallError("recvmsg", err)
+		}
+		addr := sockaddrUDP(from)
+		data := c.rbuf[:n]
+		size := groSegmentSize(c.roob[:oobn])
+		if size <= 0 {
+			size = len(data)
+		}
+		for len(data) > 0 {
+			seg := data
+			if len(seg) > size {
+				seg = seg[:size]
+			}
+			c.pending = append(c.pending, groSegment{seg, addr})
+			data = data[len(seg):]
+		}
+	}
+
+	n := 0
+	for n < len(ms) && n < len(c.pending) {
+		ms[n].N = copy(ms[n].Buffers[0], c.pending[n].data)
+		ms[n].Addr = c.pending[n].addr
+		n++
+	}
+	c.pending = c.pending[:copy(c.pending, c.pending[n:])]
+	return n, nil
+}
+
+// groSegmentSize returns the size of the datagrams coalesced in a read, 0 if it's one
+func groSegmentSize(oob []byte) int {
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, cmsg := range cmsgs {
+		if cmsg.Header.Level == unix.IPPROTO_UDP && cmsg.Header.Type == udpGRO && len(cmsg.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&cmsg.Data[0])))
+		}
+	}
+	return 0
+}
+
+// WriteBatch writes the datagrams of ms, a run of datagrams of the same size to the
+// same peer in one segmented write and the datagrams between runs in one batch
+func (c *offloadConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	if atomic.LoadInt32(&c.gso) == 0 {
+		return c.xconn.WriteBatch(ms, flags)
+	}
+
+	written := 0
+	for written < len(ms) {
+		i, j := written, written
+		for ; i < len(ms); i = j {
+			if j = gsoRun(ms, i); j-i > 1 {
+				break
+			}
+		}
+		if i > written {
+			n, err := c.xconn.WriteBatch(ms[written:i], flags)
+			if n > 0 {
+				written += n
+			}
+			if err != nil || n <= 0 {
+				return written, err
+			}
+			continue
+		}
+
+		if err := c.writeSegments(ms[i:j], flags); err != nil {
+			if errors.Is(err, unix.EIO) {
+				// the nic can't checksum segmented writes, send a datagram at a time
+				atomic.StoreInt32(&c.gso, 0)
+				log.Println("udp offload: gso disabled:", err)
+				n, err := c.xconn.WriteBatch(ms[written:], flags)
+				return written + n, err
+			}
+			return written, err
+		}
+		written = j
+	}
+	return written, nil
+}
+
+// gsoRun returns the end of the run of datagrams starting at i that can be sent in
+// one segmented write
+func gsoRun(ms []ipv4.Message, i int) int {
+	size := len(ms[i].Buffers[0])
+	j, total := i+1, size
+	for j < len(ms) && j-i < gsoMaxSegments && total+size <= gsoMaxSize && sameUDPAddr(ms[j].Addr, ms[i].Addr) {
+		n := len(ms[j].Buffers[0])
+		if n > size {
+			break
+		}
+		j++
+		total += n
+		if n < size { // only the last datagram may be shorter
+			break
+		}
+	}
+	return j
+}
+
+// writeSegments sends the datagrams of ms, of the size of the first, to their peer
+// in one write segmented by the kernel
+func (c *offloadConn) writeSegments(ms []ipv4.Message, flags int) error {
+	to, err := c.udpSockaddr(ms[0].Addr)
+	if err != nil {
+		return err
+	}
+	bufs := make([][]byte, len(ms))
+	for k := range ms {
+		bufs[k] = ms[k].Buffers[0]
+	}
+	oob := gsoControl(make([]byte, unix.CmsgSpace(2)), len(bufs[0]))
+
+	werr := c.raw.Write(func(fd uintptr) bool {
+		_, err = unix.SendmsgBuffers(int(fd), bufs, oob, to, flags)
+		return err != unix.EAGAIN
+	})
+	if werr != nil {
+		return werr
+	}
+	if err != nil {
+		return os.NewSyscallError("sendmsg", err)
+	}
+	return nil
+}
+
+// udpSockaddr returns addr in the family of the socket
+func (c *offloadConn) udpSockaddr(addr net.Addr) (unix.Sockaddr, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil, errors.Errorf("not a udp address: %v", addr)
+	}
+	if !c.inet6 {
+		ip := ua.IP.To4()
+		if ip == nil {
+			return nil, errors.Errorf("not an ipv4 address: %v", addr)
+		}
+		sa := &unix.SockaddrInet4{Port: ua.Port}
+		copy(sa.Addr[:], ip)
+		return sa, nil
+	}
+	sa := &unix.SockaddrInet6{Port: ua.Port}
+	copy(sa.Addr[:], ua.IP.To16())
+	if ua.Zone != "" {
+		if ifi, err := net.InterfaceByName(ua.Zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		}
+	}
+	return sa, nil
+}
+
+// sockaddrUDP returns the udp address of a peer read
+func sockaddrUDP(sa unix.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.UDPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: sa.Port}
+	case *unix.SockaddrInet6:
+		addr := &net.UDPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: sa.Port}
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	}
+	return nil
+}
+
+// gsoControl fills oob with the control message of the segment size of a write
+func gsoControl(oob []byte, size int) []byte {
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = udpSegment
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = uint16(size)
+	return oob
+}
+
+// sameUDPAddr reports whether a and b are the same peer
+func sameUDPAddr(a, b net.Addr) bool {
+	if a == b {
+		return true
+	}
+	ua, ok1 := a.(*net.UDPAddr)
+	ub, ok2 := b.(*net.UDPAddr)
+	return ok1 && ok2 && ua.Port == ub.Port && ua.IP.Equal(ub.IP) && ua.Zone == ub.Zone
+}
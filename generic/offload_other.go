@@ -0,0 +1,10 @@
+// +build !linux
+
+package generic
+
+import "net"
+
+// NewOffloadConn returns conn as is, udp offload is only supported on linux
+func NewOffloadConn(conn net.PacketConn) net.PacketConn {
+	return conn
+}
@@ -0,0 +1,242 @@
+package generic
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// | MAGIC(8B) | TYPE(1B) | ID(16B) | ADDR |
+	p2pMagic      = "KCPTUNP2"
+	p2pIDSize     = 16
+	p2pHeaderSize = len(p2pMagic) + 1 + p2pIDSize
+
+	p2pRegister = 1 // server to rendezvous, to be found by its id
+	p2pLookup   = 2 // client to rendezvous, to be told the server of an id
+	p2pPeer     = 3 // rendezvous to both, the address the other one was seen from
+	p2pPunch    = 4 // between the peers, to open their nats to each other
+
+	// how often a server registers, which also keeps its nat mapping to the rendezvous
+	p2pRegisterInterval = 10 * time.Second
+	// a server not registered for this long is forgotten
+	p2pTTL = time.Minute
+	// servers remembered before the forgotten ones are purged
+	maxP2PServers = 1 << 16
+	// punches sent on learning the address of the peer
+	p2pPunches = 5
+)
+
+// P2PID is the id a server and its clients meet under at a rendezvous, derived from
+// their key so that the rendezvous learns nothing of it
+func P2PID(pass []byte) []byte {
+	mac := hmac.New(sha256.New, pass)
+	mac.Write([]byte("kcptun p2p"))
+	return mac.Sum(nil)[:p2pIDSize]
+}
+
+// p2pPacket builds a control packet
+func p2pPacket(typ byte, id []byte, addr string) []byte {
+	p := make([]byte, 0, p2pHeaderSize+len(addr))
+	p = append(p, p2pMagic...)
+	p = append(p, typ)
+	p = append(p, id...)
+	return append(p, addr...)
+}
+
+// parseP2P splits a control packet, ok is false for anything else
+func parseP2P(p []byte) (typ byte, id []byte, addr string, ok bool) {
+	if len(p) < p2pHeaderSize || string(p[:len(p2pMagic)]) != p2pMagic {
+		return 0, nil, "", false
+	}
+	return p[len(p2pMagic)], p[len(p2pMagic)+1 : p2pHeaderSize], string(p[p2pHeaderSize:]), true
+}
+
+// punch sends a few packets to peer, each opening the local nat to its answers
+func punch(conn net.PacketConn, id []byte, peer net.Addr) {
+	for i := 0; i < p2pPunches; i++ {
+		conn.WriteTo(p2pPacket(p2pPunch, id, ""), peer)
+	}
+}
+
+// ServeRendezvous brokers the sessions of peers behind nats on conn: servers register
+// under their id, and a client looking up an id is told the address the server was seen
+// from while the server is told the client's, so that they can punch through to each
+// other. No session traffic passes the rendezvous.
+func ServeRendezvous(conn net.PacketConn) error {
+	type server struct {
+		addr net.Addr
+		seen time.Time
+	}
+	servers := make(map[string]*server)
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		typ, id, _, ok := parseP2P(buf[:n])
+		if !ok {
+			continue
+		}
+		now := time.Now()
+		switch typ {
+		case p2pRegister:
+			if len(servers) >= maxP2PServers {
+				for k, s := range servers {
+					if now.Sub(s.seen) >= p2pTTL {
+						delete(servers, k)
+					}
+				}
+				if len(servers) >= maxP2PServers {
+					servers = make(map[string]*server)
+				}
+			}
+			s, ok := servers[string(id)]
+			if !ok || s.addr.String() != from.String() {
+				log.Printf("rendezvous: server %x at %v", id[:4], from)
+				s = &server{addr: from}
+				servers[string(id)] = s
+			}
+			s.seen = now
+		case p2pLookup:
+			s, ok := servers[string(id)]
+			if !ok || now.Sub(s.seen) >= p2pTTL {
+				continue
+			}
+			log.Printf("rendezvous: client %v to server %x at %v", from, id[:4], s.addr)
+			conn.WriteTo(p2pPacket(p2pPeer, id, s.addr.String()), from)
+			conn.WriteTo(p2pPacket(p2pPeer, id, from.String()), s.addr)
+		}
+	}
+}
+
+// P2PLookup asks the rendezvous on conn for the address of the server of id, and
+// punches through to it once told. conn mustn't be read from elsewhere meanwhile.
+func P2PLookup(conn net.PacketConn, rendezvous net.Addr, id []byte, timeout time.Duration) (net.Addr, error) {
+	defer conn.SetReadDeadline(time.Time{})
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteTo(p2pPacket(p2pLookup, id, ""), rendezvous); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			typ, pid, addr, ok := parseP2P(buf[:n])
+			if !ok || typ != p2pPeer || !bytes.Equal(pid, id) || from.String() != rendezvous.String() {
+				continue
+			}
+			peer, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			punch(conn, id, peer)
+			return peer, nil
+		}
+	}
+	return nil, errors.Errorf("p2p: no server registered at %v", rendezvous)
+}
+
+// p2pConn drops the control packets of the rendezvous and the peers from what is read,
+// punching through to the peers the rendezvous tells of. With a rendezvous given it
+// registers there under its id, as servers do.
+type p2pConn struct {
+	net.PacketConn
+	rendezvous net.Addr
+	id         []byte
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewP2PConn wraps conn of a peer meeting others under id at rendezvous, a server
+// registers with it while a client passes nil, having found the server with P2PLookup
+func NewP2PConn(conn net.PacketConn, rendezvous net.Addr, id []byte) net.PacketConn {
+	c := &p2pConn{PacketConn: conn, rendezvous: rendezvous, id: id, die: make(chan struct{})}
+	if rendezvous != nil {
+		go c.register()
+	}
+	return c
+}
+
+// register keeps the server registered at the rendezvous
+func (c *p2pConn) register() {
+	ticker := time.NewTicker(p2pRegisterInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := c.PacketConn.WriteTo(p2pPacket(p2pRegister, c.id, ""), c.rendezvous); err != nil {
+			log.Println("p2p:", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-c.die:
+			return
+		}
+	}
+}
+
+func (c *p2pConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, from, err
+		}
+		typ, id, addr, ok := parseP2P(b[:n])
+		if !ok {
+			return n, from, nil
+		}
+		if typ != p2pPeer || !bytes.Equal(id, c.id) || c.rendezvous == nil || from.String() != c.rendezvous.String() {
+			continue
+		}
+		if peer, err := net.ResolveUDPAddr("udp", addr); err == nil {
+			log.Println("p2p: punching to", peer)
+			punch(c.PacketConn, c.id, peer)
+		}
+	}
+}
+
+func (c *p2pConn) Close() error {
+	c.dieOnce.Do(func() { close(c.die) })
+	return c.PacketConn.Close()
+}
+
+func (c *p2pConn) SetReadBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errors.New("SetReadBuffer: not supported")
+}
+
+func (c *p2pConn) SetWriteBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errors.New("SetWriteBuffer: not supported")
+}
+
+func (c *p2pConn) SetDSCP(dscp int) error {
+	if nc, ok := c.PacketConn.(interface{ SetDSCP(int) error }); ok {
+		return nc.SetDSCP(dscp)
+	}
+	if nc, ok := c.PacketConn.(net.Conn); ok {
+		err4 := ipv4.NewConn(nc).SetTOS(dscp << 2)
+		err6 := ipv6.NewConn(nc).SetTrafficClass(dscp)
+		if err4 == nil || err6 == nil {
+			return nil
+		}
+	}
+	return errors.New("SetDSCP: not supported")
+}
@@ -0,0 +1,122 @@
+package generic
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// the padding length is appended to every packet
+	paddingTrailerSize = 2
+	// one in dummyRatio packets written is followed by a dummy packet
+	dummyRatio = 32
+)
+
+// the sizes packets are padded to, a packet may skip to the next larger bucket
+var paddingBuckets = []int{160, 256, 384, 512, 768, 1024, 1280, 1400}
+
+// paddingConn blurs the packet length signature of a kcp connection. Every packet is
+// padded with random bytes to one of a few bucket sizes and followed by the padding
+// length, masked with the first bytes of the packet which are random on encrypted
+// connections. Dummy packets consisting of padding only are injected occasionally and
+// dropped by the receiver.
+type paddingConn struct {
+	net.PacketConn
+}
+
+// NewPaddingConn wraps conn to pad the packets written and strip the padding of the
+// packets read, both sides of a connection must use it.
+func NewPaddingConn(conn net.PacketConn) net.PacketConn {
+	return &paddingConn{PacketConn: conn}
+}
+
+// paddingMask is xored with the padding length to hide it
+func paddingMask(p []byte) uint16 {
+	if len(p) < 2 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(p)
+}
+
+// paddedSize picks the size of a packet carrying n bytes
+func paddedSize(n int) int {
+	for i, size := range paddingBuckets {
+		if size >= n+paddingTrailerSize {
+			if i+1 < len(paddingBuckets) && rand.Intn(4) == 0 {
+				return paddingBuckets[i+1]
+			}
+			return size
+		}
+	}
+	return n + paddingTrailerSize
+}
+
+func (c *paddingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		if n < paddingTrailerSize {
+			continue
+		}
+		pad := int(binary.LittleEndian.Uint16(b[n-paddingTrailerSize:]) ^ paddingMask(b[:n]))
+		if n -= paddingTrailerSize + pad; n > 0 {
+			return n, addr, nil
+		}
+		// dummy or malformed
+	}
+}
+
+func (c *paddingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if _, err := c.PacketConn.WriteTo(padPacket(p, paddedSize(len(p))), addr); err != nil {
+		return 0, err
+	}
+	if rand.Intn(dummyRatio) == 0 {
+		c.PacketConn.WriteTo(padPacket(nil, paddingBuckets[rand.Intn(len(paddingBuckets))]), addr)
+	}
+	return len(p), nil
+}
+
+// padPacket builds a packet of size bytes carrying p, a packet without payload is a dummy
+func padPacket(p []byte, size int) []byte {
+	out := make([]byte, size)
+	copy(out, p)
+	pad := size - len(p) - paddingTrailerSize
+	rand.Read(out[len(p) : len(p)+pad])
+	binary.LittleEndian.PutUint16(out[size-paddingTrailerSize:], uint16(pad)^paddingMask(out))
+	return out
+}
+
+func (c *paddingConn) SetReadBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errors.New("SetReadBuffer: not supported")
+}
+
+func (c *paddingConn) SetWriteBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errors.New("SetWriteBuffer: not supported")
+}
+
+func (c *paddingConn) SetDSCP(dscp int) error {
+	if nc, ok := c.PacketConn.(interface{ SetDSCP(int) error }); ok {
+		return nc.SetDSCP(dscp)
+	}
+	if nc, ok := c.PacketConn.(net.Conn); ok {
+		err4 := ipv4.NewConn(nc).SetTOS(dscp << 2)
+		err6 := ipv6.NewConn(nc).SetTrafficClass(dscp)
+		if err4 == nil || err6 == nil {
+			return nil
+		}
+	}
+	return errors.New("SetDSCP: not supported")
+}
@@ -0,0 +1,103 @@
+package generic
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// Params holds the kcp parameters which can be changed on a live session
+type Params struct {
+	Mode         string `json:"mode"`
+	NoDelay      int    `json:"nodelay"`
+	Interval     int    `json:"interval"`
+	Resend       int    `json:"resend"`
+	NoCongestion int    `json:"nc"`
+	SndWnd       int    `json:"sndwnd"`
+	RcvWnd       int    `json:"rcvwnd"`
+	DataShard    int    `json:"datashard"`
+	ParityShard  int    `json:"parityshard"`
+	MTU          int    `json:"mtu"`
+}
+
+// Tuner is implemented by client and server to expose runtime parameters
+type Tuner interface {
+	Params() Params
+	Apply(p Params) error
+	Sessions() []*Session
+}
+
+// ModeProfile returns the nodelay parameters of a named mode profile
+func ModeProfile(mode string) (nodelay, interval, resend, nc int, ok bool) {
+	switch mode {
+	case "normal":
+		return 0, 40, 2, 1, true
+	case "fast", ModeAuto: // auto starts at fast
+		return 0, 30, 2, 1, true
+	case "fast2":
+		return 1, 20, 2, 1, true
+	case "fast3":
+		return 1, 10, 2, 1, true
+	}
+	return 0, 0, 0, 0, false
+}
+
+// SetMode switches to the named profile, "manual" keeps the current nodelay parameters
+func (p *Params) SetMode(mode string) error {
+	if mode == "manual" {
+		p.Mode = mode
+		return nil
+	}
+	nodelay, interval, resend, nc, ok := ModeProfile(mode)
+	if !ok {
+		return errors.Errorf("unknown mode: %v", mode)
+	}
+	p.Mode = mode
+	p.NoDelay, p.Interval, p.Resend, p.NoCongestion = nodelay, interval, resend, nc
+	return nil
+}
+
+// MergeParams decodes a (partial) json object of parameters on top of the current ones
+func MergeParams(t Tuner, data []byte) (Params, error) {
+	p := t.Params()
+	mode := p.Mode
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, errors.WithStack(err)
+	}
+	if p.Mode != mode {
+		if err := p.SetMode(p.Mode); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// Validate checks whether the parameters are acceptable by kcp
+func (p *Params) Validate() error {
+	if p.SndWnd <= 0 || p.RcvWnd <= 0 {
+		return errors.Errorf("invalid window size: sndwnd %v rcvwnd %v", p.SndWnd, p.RcvWnd)
+	}
+	if p.MTU < 50 || p.MTU > 1500 {
+		return errors.Errorf("invalid mtu: %v", p.MTU)
+	}
+	if p.DataShard < 0 || p.ParityShard < 0 {
+		return errors.Errorf("invalid fec: datashard %v parityshard %v", p.DataShard, p.ParityShard)
+	}
+	if p.Interval <= 0 {
+		return errors.Errorf("invalid interval: %v", p.Interval)
+	}
+	return nil
+}
+
+// ApplyTo sets the parameters on a live session, sessions of the plain tcp transport
+// have none
+func (p *Params) ApplyTo(conn *kcp.UDPSession) {
+	if conn == nil {
+		return
+	}
+	conn.SetNoDelay(p.NoDelay, p.Interval, p.Resend, p.NoCongestion)
+	conn.SetWindowSize(p.SndWnd, p.RcvWnd)
+	conn.SetMtu(p.MTU)
+	conn.SetFEC(p.DataShard, p.ParityShard)
+}
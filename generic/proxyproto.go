@@ -0,0 +1,199 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// | SIGNATURE(12B) | VER_CMD(1B) | FAM(1B) | LEN(2B) | ADDRESSES(LEN bytes) |
+	proxySignature = "\r\n\r\n\x00\r\nQUIT\n"
+
+	proxyLocal = 0x20 // version 2, the connection was not proxied
+	proxyProxy = 0x21 // version 2, on behalf of the source in the addresses
+
+	proxyTCP4 = 0x11
+	proxyTCP6 = 0x21
+
+	// | "PROXY " | PROTO | SRC | DST | SPORT | DPORT | "\r\n" |, 107 bytes at most
+	proxyV1Prefix = "PROXY "
+	proxyV1MaxLen = 107
+
+	// the time for a connection to send its header
+	proxyHeaderTimeout = 10 * time.Second
+)
+
+// WriteProxyHeader writes a PROXY protocol version 2 header at the beginning of a
+// connection to w, telling the backend it carries a tcp connection from src to dst.
+// With src unknown, a LOCAL header lets the backend use the addresses of the
+// connection itself.
+func WriteProxyHeader(w io.Writer, src, dst *net.TCPAddr) error {
+	buf := make([]byte, 0, 16+36)
+	buf = append(buf, proxySignature...)
+	if src == nil || dst == nil {
+		buf = append(buf, proxyLocal, 0, 0, 0)
+		_, err := w.Write(buf)
+		return errors.WithStack(err)
+	}
+
+	// both addresses must be of the same family, IPv4 is mapped into IPv6 otherwise
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	fam := byte(proxyTCP4)
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP, fam = src.IP.To16(), dst.IP.To16(), proxyTCP6
+	}
+	buf = append(buf, proxyProxy, fam, 0, 0)
+	buf = append(buf, srcIP...)
+	buf = append(buf, dstIP...)
+	buf = append(buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(buf[len(buf)-4:], uint16(src.Port))
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(buf[len(proxySignature)+2:], uint16(len(buf)-len(proxySignature)-4))
+	_, err := w.Write(buf)
+	return errors.WithStack(err)
+}
+
+// ReadProxyHeader reads a PROXY protocol header of version 1 or 2 from r, and returns
+// the source of the connection it tells of, nil for LOCAL and UNKNOWN ones. Nothing
+// past the header is read.
+func ReadProxyHeader(r io.Reader) (*net.TCPAddr, error) {
+	prefix := make([]byte, len(proxyV1Prefix))
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	switch {
+	case string(prefix) == proxyV1Prefix:
+		return readProxyV1(r)
+	case string(prefix) == proxySignature[:len(prefix)]:
+		return readProxyV2(r)
+	}
+	return nil, errors.New("proxy protocol: no header")
+}
+
+// readProxyV1 reads the rest of a text header, like "TCP4 192.0.2.1 192.0.2.2 5000 80\r\n"
+func readProxyV1(r io.Reader) (*net.TCPAddr, error) {
+	line := make([]byte, 0, proxyV1MaxLen-len(proxyV1Prefix))
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return nil, errors.New("proxy protocol: header too long")
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, errors.Errorf("proxy protocol: malformed header: %q", line)
+	}
+	ip := net.ParseIP(fields[1])
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.Errorf("proxy protocol: malformed header: %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the rest of a binary header
+func readProxyV2(r io.Reader) (*net.TCPAddr, error) {
+	hdr := make([]byte, 16-len(proxyV1Prefix))
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if string(hdr[:len(proxySignature)-len(proxyV1Prefix)]) != proxySignature[len(proxyV1Prefix):] {
+		return nil, errors.New("proxy protocol: no header")
+	}
+	cmd, fam := hdr[6], hdr[7]
+	addrs := make([]byte, binary.BigEndian.Uint16(hdr[8:]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if cmd == proxyLocal {
+		return nil, nil
+	}
+	if cmd != proxyProxy {
+		return nil, errors.Errorf("proxy protocol: unsupported command: %#x", cmd)
+	}
+	switch {
+	case fam == proxyTCP4 && len(addrs) >= 12:
+		return &net.TCPAddr{IP: net.IP(addrs[:4]), Port: int(binary.BigEndian.Uint16(addrs[8:]))}, nil
+	case fam == proxyTCP6 && len(addrs) >= 36:
+		return &net.TCPAddr{IP: net.IP(addrs[:16]), Port: int(binary.BigEndian.Uint16(addrs[32:]))}, nil
+	}
+	// udp or unix sources, the connection tells nothing better
+	return nil, nil
+}
+
+// proxyListener accepts connections prefixed by a PROXY protocol header
+type proxyListener struct {
+	net.Listener
+}
+
+// NewProxyListener expects a PROXY protocol header, of version 1 or 2, at the beginning
+// of each connection accepted on lis, as load balancers like HAProxy send. The header
+// is read in the first call to Read or RemoteAddr, which then returns the source it
+// tells of, so that a slow peer doesn't hold up Accept.
+func NewProxyListener(lis net.Listener) net.Listener {
+	return &proxyListener{Listener: lis}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn}, nil
+}
+
+// proxyConn is a connection behind a PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	source net.Addr
+	err    error
+}
+
+// readHeader reads the header once, a connection without a valid one is closed
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		src, err := ReadProxyHeader(c.Conn)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = errors.Wrapf(err, "%v", c.Conn.RemoteAddr())
+			c.Conn.Close()
+			return
+		}
+		if src != nil {
+			c.source = src
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
@@ -0,0 +1,154 @@
+package generic
+
+import (
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rate units as in tc(8), bits or bytes per second with decimal multiples
+var rateUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"kbit", 1e3 / 8}, {"mbit", 1e6 / 8}, {"gbit", 1e9 / 8}, {"bit", 1.0 / 8},
+	{"kbps", 1e3}, {"mbps", 1e6}, {"gbps", 1e9}, {"bps", 1},
+}
+
+// ParseRate parses a rate like 10mbit, 512kbit or 2mbps into bytes per second. An empty
+// rate, or a number without unit which is bytes per second, of 0 means unlimited.
+func ParseRate(s string) (int64, error) {
+	num := strings.ToLower(strings.TrimSpace(s))
+	if num == "" {
+		return 0, nil
+	}
+	scale := 1.0
+	for _, u := range rateUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, scale = strings.TrimSuffix(num, u.suffix), u.scale
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, errors.Errorf("invalid rate: %v", s)
+	}
+	return int64(v * scale), nil
+}
+
+// RateLimiter is a token bucket of bytes. Writes take their size in tokens up front and
+// wait for the debt to be paid off, so the rate holds for writes of any size.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second, 0 is unlimited
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter of bps bytes per second, 0 is unlimited
+func NewRateLimiter(bps int64) *RateLimiter {
+	l := new(RateLimiter)
+	l.SetRate(bps)
+	return l
+}
+
+// SetRate changes the rate to bps bytes per second, 0 is unlimited
+func (l *RateLimiter) SetRate(bps int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(bps)
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+// Wait blocks until n bytes may be sent
+func (l *RateLimiter) Wait(n int) {
+	time.Sleep(l.reserve(n))
+}
+
+// reserve takes n bytes and returns how long to wait before sending them
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	// an idle limiter saves up a tenth of a second, but not less than a few packets
+	burst := math.Max(l.rate/10, 16<<10)
+	l.tokens = math.Min(l.tokens+now.Sub(l.last).Seconds()*l.rate, burst)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// rateLimitedWriter waits for the slowest of its limiters before each write
+type rateLimitedWriter struct {
+	w        io.Writer
+	limiters []*RateLimiter
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	var delay time.Duration
+	for _, l := range w.limiters {
+		if d := l.reserve(len(p)); d > delay {
+			delay = d
+		}
+	}
+	time.Sleep(delay)
+	return w.w.Write(p)
+}
+
+// Bandwidth holds the limits shared by all streams, and the limit of each stream
+type Bandwidth struct {
+	up, down *RateLimiter
+	stream   int64 // bytes per second of each stream and direction
+}
+
+// NewBandwidth creates unlimited bandwidth
+func NewBandwidth() *Bandwidth {
+	return &Bandwidth{up: NewRateLimiter(0), down: NewRateLimiter(0)}
+}
+
+// Set changes the limits of all streams to the rates up and down, and the limit of
+// each new stream to stream, in a format ParseRate understands. Nothing is changed if
+// a rate is invalid.
+func (b *Bandwidth) Set(up, down, stream string) error {
+	var rates [3]int64
+	for i, s := range []string{up, down, stream} {
+		rate, err := ParseRate(s)
+		if err != nil {
+			return err
+		}
+		rates[i] = rate
+	}
+	b.up.SetRate(rates[0])
+	b.down.SetRate(rates[1])
+	atomic.StoreInt64(&b.stream, rates[2])
+	return nil
+}
+
+// Limit wraps the writers of a stream, up towards the target and down towards the
+// local peer, in the shared limits and limits of the stream's own, and in the shared
+// limits of others like the ones of a client
+func (b *Bandwidth) Limit(up, down io.Writer, others ...*Bandwidth) (io.Writer, io.Writer) {
+	upLimiters, downLimiters := []*RateLimiter{b.up}, []*RateLimiter{b.down}
+	for _, o := range others {
+		upLimiters = append(upLimiters, o.up)
+		downLimiters = append(downLimiters, o.down)
+	}
+	if stream := atomic.LoadInt64(&b.stream); stream > 0 {
+		upLimiters = append(upLimiters, NewRateLimiter(stream))
+		downLimiters = append(downLimiters, NewRateLimiter(stream))
+	}
+	return &rateLimitedWriter{up, upLimiters}, &rateLimitedWriter{down, downLimiters}
+}
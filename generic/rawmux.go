@@ -0,0 +1,97 @@
+package generic
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// MuxNone maps every connection to a session of its own, without a multiplexer
+const MuxNone = "none"
+
+// rawMux carries a single stream, the session itself, opened by the client and
+// accepted by the server at once. Without frames there are neither keepalives nor FINs,
+// and an idle kcp session sends nothing either, so like a tcp connection without
+// keepalives it stays open however long it's silent, until the connection relayed
+// through it closes or the server's idletimeout reaps it.
+type rawMux struct {
+	stream *rawStream
+	taken  int32
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+type rawStream struct {
+	net.Conn
+	mux *rawMux
+}
+
+func newRawMux(conn io.ReadWriteCloser) (*rawMux, error) {
+	c, ok := conn.(net.Conn)
+	if !ok {
+		return nil, errors.New("mux none needs a connection")
+	}
+	m := &rawMux{die: make(chan struct{})}
+	m.stream = &rawStream{Conn: c, mux: m}
+	return m, nil
+}
+
+// OpenStream returns the session as a stream to the client, once
+func (m *rawMux) OpenStream() (Stream, error) {
+	if m.IsClosed() {
+		return nil, io.ErrClosedPipe
+	}
+	if !atomic.CompareAndSwapInt32(&m.taken, 0, 1) {
+		return nil, smux.ErrGoAway
+	}
+	return m.stream, nil
+}
+
+// AcceptStream returns the session as a stream to the server, then blocks until it closes
+func (m *rawMux) AcceptStream() (Stream, error) {
+	if atomic.CompareAndSwapInt32(&m.taken, 0, 1) {
+		return m.stream, nil
+	}
+	<-m.die
+	return nil, io.ErrClosedPipe
+}
+
+func (m *rawMux) NumStreams() int {
+	if m.IsClosed() {
+		return 0
+	}
+	return int(atomic.LoadInt32(&m.taken))
+}
+
+func (m *rawMux) IsClosed() bool {
+	select {
+	case <-m.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *rawMux) Close() error {
+	err := io.ErrClosedPipe
+	m.dieOnce.Do(func() {
+		close(m.die)
+		err = m.stream.Conn.Close()
+	})
+	return err
+}
+
+func (m *rawMux) LocalAddr() net.Addr  { return m.stream.LocalAddr() }
+func (m *rawMux) RemoteAddr() net.Addr { return m.stream.RemoteAddr() }
+
+func (s *rawStream) ID() uint32 { return 1 }
+
+// Close closes the session with its stream
+func (s *rawStream) Close() error {
+	return s.mux.Close()
+}
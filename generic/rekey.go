@@ -0,0 +1,174 @@
+package generic
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// rekeyBlockCrypt rolls over to a fresh sub-key every interval. The sub-key of an epoch
+// is derived from the pre-shared key with HKDF, so both sides agree on it without a
+// handshake as long as their clocks are roughly in sync. Packets of the neighbouring
+// epochs are still accepted, which keeps the kcp sessions and their smux streams alive
+// across the rollover and tolerates a clock skew of up to one interval.
+//
+// Rekey moves to the next generation of sub-keys of the epoch at once. The peer tries
+// the next generation on packets it can't decrypt otherwise and follows on the first
+// one it accepts, and packets of the previous generation are still accepted meanwhile.
+// A new epoch starts at generation 0 again.
+type rekeyBlockCrypt struct {
+	crypt    string
+	pass     []byte
+	interval int64
+
+	mu        sync.Mutex
+	epoch     int64
+	gen       uint64
+	requested uint64 // rekeyRequests seen
+	blocks    rekeyBlocks
+	pool      sync.Pool
+}
+
+// rekeyBlocks are the ciphers a packet may be encrypted with
+type rekeyBlocks struct {
+	gen       uint64
+	confirmed bool              // whether the peer is known to use gen
+	epochs    [3]kcp.BlockCrypt // previous, current and next epoch
+	older     kcp.BlockCrypt    // current epoch of the previous generation, nil at 0
+	newer     kcp.BlockCrypt    // current epoch of the next generation
+}
+
+var (
+	// rekeyRequests counts the calls to Rekey
+	rekeyRequests uint64
+	// rekeyCiphers counts the ciphers created by NewRekeyBlockCrypt
+	rekeyCiphers int64
+)
+
+// Rekey moves all ciphers of NewRekeyBlockCrypt to fresh sub-keys at once, instead of
+// at the end of the period. A cipher whose peer hasn't followed its last rekey yet
+// skips it, as the peer only follows one generation ahead.
+func Rekey() error {
+	if atomic.LoadInt64(&rekeyCiphers) == 0 {
+		return errors.New("rekey is not enabled, see -rekey")
+	}
+	atomic.AddUint64(&rekeyRequests, 1)
+	return nil
+}
+
+// NewRekeyBlockCrypt creates the cipher named by crypt with a sub-key per interval
+func NewRekeyBlockCrypt(crypt string, pass []byte, interval time.Duration) kcp.BlockCrypt {
+	c := &rekeyBlockCrypt{crypt: crypt, pass: pass, interval: int64(interval / time.Second)}
+	if c.interval <= 0 {
+		c.interval = 1
+	}
+	c.pool.New = func() interface{} { return make([]byte, 0, 1500) }
+	c.requested = atomic.LoadUint64(&rekeyRequests)
+	c.rotate(time.Now().Unix()/c.interval, 0, true)
+	atomic.AddInt64(&rekeyCiphers, 1)
+	return c
+}
+
+// subkey derives the cipher of generation gen of epoch, generation 0 keeps the
+// derivation of the epochs alone
+func (c *rekeyBlockCrypt) subkey(epoch int64, gen uint64) kcp.BlockCrypt {
+	info := make([]byte, 8, 16)
+	binary.BigEndian.PutUint64(info, uint64(epoch))
+	if gen > 0 {
+		info = info[:16]
+		binary.BigEndian.PutUint64(info[8:], gen)
+	}
+	key, _ := hkdf.Key(sha256.New, c.pass, []byte("kcptun rekey"), string(info), 32)
+	block, _ := NewBlockCrypt(c.crypt, key)
+	return block
+}
+
+// rotate derives the ciphers around epoch for generation gen
+func (c *rekeyBlockCrypt) rotate(epoch int64, gen uint64, confirmed bool) {
+	for i := range c.blocks.epochs {
+		c.blocks.epochs[i] = c.subkey(epoch+int64(i)-1, gen)
+	}
+	c.blocks.older = nil
+	if gen > 0 {
+		c.blocks.older = c.subkey(epoch, gen-1)
+	}
+	c.blocks.newer = c.subkey(epoch, gen+1)
+	c.blocks.gen, c.blocks.confirmed = gen, confirmed
+	c.epoch, c.gen = epoch, gen
+}
+
+// current returns the ciphers of the epoch and generation in use
+func (c *rekeyBlockCrypt) current() rekeyBlocks {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch := time.Now().Unix() / c.interval; epoch != c.epoch {
+		c.rotate(epoch, 0, true)
+	}
+	if r := atomic.LoadUint64(&rekeyRequests); r != c.requested {
+		c.requested = r
+		if c.blocks.confirmed {
+			c.rotate(c.epoch, c.gen+1, false)
+		}
+	}
+	return c.blocks
+}
+
+// follow moves to the generation after gen, which the peer moved to
+func (c *rekeyBlockCrypt) follow(gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen == gen {
+		c.rotate(c.epoch, gen+1, true)
+	}
+}
+
+// confirm notes that the peer uses generation gen
+func (c *rekeyBlockCrypt) confirm(gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen == gen {
+		c.blocks.confirmed = true
+	}
+}
+
+func (c *rekeyBlockCrypt) Encrypt(dst, src []byte) {
+	blocks := c.current()
+	blocks.epochs[1].Encrypt(dst, src)
+}
+
+// Decrypt tries the current epoch first, a packet belongs to the epoch whose key
+// makes the checksum written by kcp-go match. The generations around the current one
+// are tried last.
+func (c *rekeyBlockCrypt) Decrypt(dst, src []byte) {
+	blocks := c.current()
+	orig := append(c.pool.Get().([]byte)[:0], src...)
+	defer c.pool.Put(orig[:0])
+
+	try := func(block kcp.BlockCrypt) bool {
+		copy(dst, orig)
+		block.Decrypt(dst, dst)
+		return len(dst) >= aeadHeaderSize &&
+			crc32.ChecksumIEEE(dst[aeadHeaderSize:]) == binary.LittleEndian.Uint32(dst[aeadHeaderSize-4:])
+	}
+	for _, i := range [...]int{1, 0, 2} {
+		if try(blocks.epochs[i]) {
+			if i == 1 && !blocks.confirmed {
+				c.confirm(blocks.gen)
+			}
+			return
+		}
+	}
+	if blocks.older != nil && try(blocks.older) {
+		return
+	}
+	if try(blocks.newer) {
+		c.follow(blocks.gen)
+	}
+}
@@ -0,0 +1,109 @@
+package generic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// nonces remembered per generation before rotating early, bounds the memory
+const maxReplayEntries = 1 << 20
+
+// replayEarlyRotations counts the generations rotated early by maxReplayEntries,
+// exported as metrics
+var replayEarlyRotations uint64
+
+// replayBlockCrypt rejects replayed packets. The sender stamps the second half of the
+// 16 bytes nonce kcp-go encrypts with every packet with the current unix time, the
+// receiver drops packets stamped outside the window or whose nonce it has already seen,
+// by breaking their checksum so that kcp-go discards them.
+//
+// The stamp travels inside the encrypted nonce, so the aead ciphers which only carry
+// 8 bytes of it are not supported.
+type replayBlockCrypt struct {
+	kcp.BlockCrypt
+	window int64
+
+	mu        sync.Mutex
+	seen      map[[12]byte]struct{}
+	prev      map[[12]byte]struct{}
+	rotatedAt int64
+}
+
+// NewReplayBlockCrypt protects block against packets replayed after window or twice
+func NewReplayBlockCrypt(block kcp.BlockCrypt, window time.Duration) kcp.BlockCrypt {
+	c := &replayBlockCrypt{BlockCrypt: block, window: int64(window / time.Second)}
+	if c.window <= 0 {
+		c.window = 1
+	}
+	c.seen = make(map[[12]byte]struct{})
+	c.prev = make(map[[12]byte]struct{})
+	c.rotatedAt = time.Now().Unix()
+	return c
+}
+
+func (c *replayBlockCrypt) Encrypt(dst, src []byte) {
+	copy(dst, src)
+	binary.LittleEndian.PutUint32(dst[8:], uint32(time.Now().Unix()))
+	c.BlockCrypt.Encrypt(dst, dst)
+}
+
+func (c *replayBlockCrypt) Decrypt(dst, src []byte) {
+	c.BlockCrypt.Decrypt(dst, src)
+	if len(dst) < aeadHeaderSize {
+		return
+	}
+	checksum := crc32.ChecksumIEEE(dst[aeadHeaderSize:])
+	if checksum != binary.LittleEndian.Uint32(dst[aeadHeaderSize-4:]) {
+		return
+	}
+	if !c.fresh(dst) {
+		binary.LittleEndian.PutUint32(dst[aeadHeaderSize-4:], ^checksum)
+	}
+}
+
+// fresh checks the stamp of a decrypted packet and remembers its nonce
+func (c *replayBlockCrypt) fresh(p []byte) bool {
+	now := time.Now().Unix()
+	skew := int64(int32(uint32(now) - binary.LittleEndian.Uint32(p[8:])))
+	if skew > c.window || skew < -c.window {
+		return false
+	}
+
+	var nonce [12]byte
+	copy(nonce[:], p)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a stamp stays acceptable for up to twice the window after it was first seen
+	if now-c.rotatedAt >= 2*c.window || len(c.seen) >= maxReplayEntries {
+		if len(c.seen) >= maxReplayEntries {
+			// the older generation is forgotten before its stamps are out of the
+			// window, so its packets could be replayed until then
+			atomic.AddUint64(&replayEarlyRotations, 1)
+			log.Printf("antireplay: %v packets in %vs, forgetting older ones early, replays of them may pass", len(c.seen), now-c.rotatedAt)
+		}
+		c.prev, c.seen = c.seen, make(map[[12]byte]struct{})
+		c.rotatedAt = now
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	if _, ok := c.prev[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = struct{}{}
+	return true
+}
+
+// writeReplayMetrics writes the early rotations of antireplay in prometheus text format
+func writeReplayMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP kcptun_replay_early_rotations_total antireplay generations forgotten early, when full\n# TYPE kcptun_replay_early_rotations_total counter\nkcptun_replay_early_rotations_total %v\n", atomic.LoadUint64(&replayEarlyRotations))
+}
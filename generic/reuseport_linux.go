@@ -0,0 +1,46 @@
+// +build linux
+
+package generic
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ListenReusePort opens n udp sockets on addr with SO_REUSEPORT, the kernel spreads the
+// peers among them by their addresses, so that each socket can be read by its own
+// goroutine instead of all the packets passing through the lock of a single socket
+func ListenReusePort(addr string, n int) ([]net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+
+	var conns []net.PacketConn
+	for i := 0; i < n; i++ {
+		// the port picked by the first socket if addr has none
+		if i == 1 {
+			addr = conns[0].LocalAddr().String()
+		}
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, errors.WithStack(err)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
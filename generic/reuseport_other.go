@@ -0,0 +1,21 @@
+// +build !linux
+
+package generic
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// ListenReusePort opens a single udp socket on addr, SO_REUSEPORT is only supported on linux
+func ListenReusePort(addr string, n int) ([]net.PacketConn, error) {
+	if n > 1 {
+		return nil, errors.New("reuseport is only supported on linux")
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return []net.PacketConn{conn}, nil
+}
@@ -0,0 +1,62 @@
+package generic
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SdNotify sends state like READY=1 to the service manager, see sd_notify(3). It
+// does nothing unless started by systemd with Type=notify.
+func SdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' { // abstract namespace
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return errors.WithStack(err)
+}
+
+// SdNotifying reports whether the service manager waits for notifications
+func SdNotifying() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// sdWatchdogInterval returns the WatchdogSec= of the service, 0 if it's not enabled
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// SdWatchdog keeps the systemd watchdog fed as long as healthy reports true, so the
+// service is restarted once it stops making progress
+func SdWatchdog(healthy func() bool) {
+	interval := sdWatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if healthy() {
+			SdNotify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package generic
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// Session bundles the layers of an established tunnel session
+type Session struct {
+	KCP   *kcp.UDPSession
+	Mux   Mux
+	Meter *Meter
+	User  string // the user whose key the session was accepted with, if any
+}
+
+// Meter counts the bytes passing through a connection
+type Meter struct {
+	net.Conn
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+// NewMeter wraps conn to count the bytes read from and written to it
+func NewMeter(conn net.Conn) *Meter {
+	return &Meter{Conn: conn}
+}
+
+func (m *Meter) Read(p []byte) (n int, err error) {
+	n, err = m.Conn.Read(p)
+	atomic.AddUint64(&m.bytesIn, uint64(n))
+	return
+}
+
+func (m *Meter) Write(p []byte) (n int, err error) {
+	n, err = m.Conn.Write(p)
+	atomic.AddUint64(&m.bytesOut, uint64(n))
+	return
+}
+
+// WriteBuffers keeps the vectored write path of kcp available to smux
+func (m *Meter) WriteBuffers(v [][]byte) (n int, err error) {
+	if bw, ok := m.Conn.(interface {
+		WriteBuffers(v [][]byte) (n int, err error)
+	}); ok {
+		n, err = bw.WriteBuffers(v)
+		atomic.AddUint64(&m.bytesOut, uint64(n))
+		return
+	}
+	for _, b := range v {
+		nw, err := m.Write(b)
+		n += nw
+		if err != nil {
+			return n, errors.WithStack(err)
+		}
+	}
+	return n, nil
+}
+
+// BytesIn returns the number of bytes read
+func (m *Meter) BytesIn() uint64 { return atomic.LoadUint64(&m.bytesIn) }
+
+// BytesOut returns the number of bytes written
+func (m *Meter) BytesOut() uint64 { return atomic.LoadUint64(&m.bytesOut) }
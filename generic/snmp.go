@@ -2,16 +2,28 @@ package generic
 
 import (
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	kcp "github.com/xtaci/kcp-go/v5"
 )
 
-func SnmpLogger(path string, interval int) {
+// SNMP log formats
+const (
+	SnmpCSV  = "csv"  // a row per period, with a header row on top of each file
+	SnmpJSON = "json" // an object per line
+)
+
+// SnmpLogger appends the snmp counters to the file at path every interval seconds, the
+// path is formatted with the current time so files can be rotated like snmp-20060102.log.
+// With reset the counters start over after each period, so each line holds the deltas.
+func SnmpLogger(path string, interval int, format string, reset bool) {
 	if path == "" || interval == 0 {
 		return
 	}
@@ -28,19 +40,50 @@ func SnmpLogger(path string, interval int) {
 				log.Println(err)
 				return
 			}
-			w := csv.NewWriter(f)
-			// write header in empty file
-			if stat, err := f.Stat(); err == nil && stat.Size() == 0 {
-				if err := w.Write(append([]string{"Unix"}, kcp.DefaultSnmp.Header()...)); err != nil {
-					log.Println(err)
-				}
+			snmp := kcp.DefaultSnmp.Copy()
+			if reset {
+				kcp.DefaultSnmp.Reset()
+			}
+			if format == SnmpJSON {
+				err = writeSnmpJSON(f, snmp)
+			} else {
+				err = writeSnmpCSV(f, snmp)
 			}
-			if err := w.Write(append([]string{fmt.Sprint(time.Now().Unix())}, kcp.DefaultSnmp.ToSlice()...)); err != nil {
+			if err != nil {
 				log.Println(err)
 			}
-			// kcp.DefaultSnmp.Reset()
-			w.Flush()
 			f.Close()
 		}
 	}
 }
+
+// writeSnmpCSV writes a row of snmp, with the header first in an empty file
+func writeSnmpCSV(f *os.File, snmp *kcp.Snmp) error {
+	w := csv.NewWriter(f)
+	if stat, err := f.Stat(); err == nil && stat.Size() == 0 {
+		if err := w.Write(append([]string{"Unix"}, snmp.Header()...)); err != nil {
+			return err
+		}
+	}
+	if err := w.Write(append([]string{fmt.Sprint(time.Now().Unix())}, snmp.ToSlice()...)); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// writeSnmpJSON writes snmp as a line of {"Unix":...,"BytesSent":...}
+func writeSnmpJSON(w io.Writer, snmp *kcp.Snmp) error {
+	line := []byte(`{"Unix":` + strconv.FormatInt(time.Now().Unix(), 10))
+	header, values := snmp.Header(), snmp.ToSlice()
+	for k := range header {
+		name, _ := json.Marshal(header[k])
+		line = append(line, ',')
+		line = append(line, name...)
+		line = append(line, ':')
+		line = append(line, values[k]...)
+	}
+	line = append(line, "}\n"...)
+	_, err := w.Write(line)
+	return err
+}
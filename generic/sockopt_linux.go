@@ -0,0 +1,49 @@
+// +build linux
+
+package generic
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// SocketControl returns the Control of a dialer or listener binding its sockets to the
+// interface iface with SO_BINDTODEVICE, so that they send through it whatever the
+// routes say, and marking them with SO_MARK for policy routing and firewall rules, nil
+// if iface is empty and mark 0
+func SocketControl(iface string, mark int) func(network, address string, c syscall.RawConn) error {
+	if iface == "" && mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			if iface != "" {
+				if serr = unix.BindToDevice(int(fd), iface); serr != nil {
+					return
+				}
+			}
+			if mark != 0 {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+			}
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// SetMark marks the socket of conn with SO_MARK, for sockets opened elsewhere
+func SetMark(conn interface{}, mark int) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("SetMark: not supported")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(SocketControl("", mark)("", "", rc))
+}
@@ -0,0 +1,25 @@
+// +build !linux
+
+package generic
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// SocketControl returns nil if iface is empty and mark 0, SO_BINDTODEVICE and SO_MARK
+// are only supported on linux
+func SocketControl(iface string, mark int) func(network, address string, c syscall.RawConn) error {
+	if iface == "" && mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("binding to an interface and marking sockets are only supported on linux")
+	}
+}
+
+// SetMark fails, SO_MARK is only supported on linux
+func SetMark(conn interface{}, mark int) error {
+	return errors.New("SetMark: only supported on linux")
+}
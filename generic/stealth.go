@@ -0,0 +1,62 @@
+package generic
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// a rejected connection is read until the peer stays silent this long
+const stealthIdle = time.Minute
+
+// stealthConn keeps quiet on an accepted connection until something authentic has been
+// read from it, and on close drains instead of hanging up on a peer which never got that
+// far, so that a prober can't tell it from a server waiting for more
+type stealthConn struct {
+	net.Conn
+	raw   net.Conn
+	heard int32
+}
+
+// NewStealthConn wraps conn, which decrypts and authenticates what is read from raw,
+// the connection it was accepted as. The peer must speak first.
+func NewStealthConn(conn, raw net.Conn) net.Conn {
+	return &stealthConn{Conn: conn, raw: raw}
+}
+
+func (c *stealthConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt32(&c.heard, 1)
+	}
+	return n, err
+}
+
+func (c *stealthConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.heard) == 0 {
+		return 0, errors.New("stealth: peer not authenticated")
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *stealthConn) Close() error {
+	if atomic.LoadInt32(&c.heard) == 0 {
+		go drain(c.raw)
+		return nil
+	}
+	return c.Conn.Close()
+}
+
+// drain reads and discards conn until the peer closes it or goes silent, then closes it
+func drain(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(stealthIdle))
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package generic
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// streams served by a stream listener at most, an arbitrary one is dropped beyond
+const maxStreams = 1024
+
+// streamPacketConn carries packets on a stream, each with a length prefix, for paths
+// where only streams get through, like an http proxy. All packets are reported as
+// coming from the remote address of the stream.
+type streamPacketConn struct {
+	conn net.Conn
+	r    io.Reader
+	wmu  sync.Mutex
+}
+
+// NewStreamPacketConn carries packets on conn, r reads from conn and may hold data
+// already buffered from it, nil to read from conn directly.
+func NewStreamPacketConn(conn net.Conn, r io.Reader) net.PacketConn {
+	if r == nil {
+		r = conn
+	}
+	return &streamPacketConn{conn: conn, r: r}
+}
+
+func (c *streamPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := ReadDatagram(c.r, b)
+	return n, c.conn.RemoteAddr(), err
+}
+
+func (c *streamPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := WriteDatagram(c.conn, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *streamPacketConn) Close() error                       { return c.conn.Close() }
+func (c *streamPacketConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *streamPacketConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *streamPacketConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *streamPacketConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+type streamPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// streamListener serves the packets of all streams accepted by a listener as a single
+// packet conn, every stream is a peer of its own.
+type streamListener struct {
+	lis net.Listener
+	ch  chan streamPacket
+
+	mu      sync.Mutex
+	streams map[string]*streamPacketConn
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// ListenStream accepts streams carrying length prefixed packets on lis
+func ListenStream(lis net.Listener) net.PacketConn {
+	l := &streamListener{
+		lis:     lis,
+		ch:      make(chan streamPacket, 1024),
+		streams: make(map[string]*streamPacketConn),
+		die:     make(chan struct{}),
+	}
+	go l.acceptor()
+	return l
+}
+
+func (l *streamListener) acceptor() {
+	for {
+		conn, err := l.lis.Accept()
+		if err != nil {
+			l.Close()
+			return
+		}
+		l.serve(conn)
+	}
+}
+
+func (l *streamListener) serve(conn net.Conn) {
+	s := &streamPacketConn{conn: conn, r: conn}
+	key := conn.RemoteAddr().String()
+	l.mu.Lock()
+	if len(l.streams) >= maxStreams {
+		for k, old := range l.streams {
+			old.Close()
+			delete(l.streams, k)
+			break
+		}
+	}
+	l.streams[key] = s
+	l.mu.Unlock()
+	go l.reader(key, s)
+}
+
+func (l *streamListener) reader(key string, s *streamPacketConn) {
+	defer func() {
+		s.Close()
+		l.mu.Lock()
+		if l.streams[key] == s {
+			delete(l.streams, key)
+		}
+		l.mu.Unlock()
+	}()
+
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, addr, err := s.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case l.ch <- streamPacket{append([]byte(nil), buf[:n]...), addr}:
+		case <-l.die:
+			return
+		}
+	}
+}
+
+func (l *streamListener) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-l.ch:
+		return copy(b, pkt.data), pkt.addr, nil
+	case <-l.die:
+		return 0, nil, errors.New("use of closed stream listener")
+	}
+}
+
+func (l *streamListener) WriteTo(p []byte, addr net.Addr) (int, error) {
+	l.mu.Lock()
+	s, ok := l.streams[addr.String()]
+	l.mu.Unlock()
+	if !ok {
+		return 0, errors.Errorf("no stream from %v", addr)
+	}
+	return s.WriteTo(p, addr)
+}
+
+func (l *streamListener) Close() error {
+	l.dieOnce.Do(func() {
+		close(l.die)
+		l.lis.Close()
+		l.mu.Lock()
+		for _, s := range l.streams {
+			s.Close()
+		}
+		l.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *streamListener) LocalAddr() net.Addr                { return l.lis.Addr() }
+func (l *streamListener) SetDeadline(t time.Time) error      { return nil }
+func (l *streamListener) SetReadDeadline(t time.Time) error  { return nil }
+func (l *streamListener) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,32 @@
+package generic
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// totals of the streams closed so far, exported as metrics
+var streamTotals struct {
+	closed  uint64
+	up      uint64 // bytes from the local peer towards the target
+	down    uint64
+	seconds uint64 // in milliseconds
+}
+
+// RecordStream adds a closed stream which transferred up and down bytes during d
+func RecordStream(up, down int64, d time.Duration) {
+	atomic.AddUint64(&streamTotals.closed, 1)
+	atomic.AddUint64(&streamTotals.up, uint64(up))
+	atomic.AddUint64(&streamTotals.down, uint64(down))
+	atomic.AddUint64(&streamTotals.seconds, uint64(d.Milliseconds()))
+}
+
+// writeStreamMetrics writes the totals of closed streams in prometheus text format
+func writeStreamMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP kcptun_streams_closed_total smux streams closed\n# TYPE kcptun_streams_closed_total counter\nkcptun_streams_closed_total %v\n", atomic.LoadUint64(&streamTotals.closed))
+	fmt.Fprintf(w, "# HELP kcptun_stream_bytes_up_total bytes of closed streams sent from the local peer\n# TYPE kcptun_stream_bytes_up_total counter\nkcptun_stream_bytes_up_total %v\n", atomic.LoadUint64(&streamTotals.up))
+	fmt.Fprintf(w, "# HELP kcptun_stream_bytes_down_total bytes of closed streams received by the local peer\n# TYPE kcptun_stream_bytes_down_total counter\nkcptun_stream_bytes_down_total %v\n", atomic.LoadUint64(&streamTotals.down))
+	fmt.Fprintf(w, "# HELP kcptun_stream_seconds_total lifetime of closed streams\n# TYPE kcptun_stream_seconds_total counter\nkcptun_stream_seconds_total %v\n", float64(atomic.LoadUint64(&streamTotals.seconds))/1000)
+}
@@ -0,0 +1,129 @@
+package generic
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StreamInfo describes an open stream for the control socket
+type StreamInfo struct {
+	ID         uint64 `json:"id"`     // unique in the process, for close
+	Stream     uint32 `json:"stream"` // id of the stream within its session
+	LocalAddr  string `json:"localaddr"`
+	RemoteAddr string `json:"remoteaddr"`
+	Age        int64  `json:"age"` // seconds since opened
+}
+
+// openStreams tracks the streams opened and accepted by all multiplexers
+var openStreams struct {
+	mu      sync.Mutex
+	lastID  uint64
+	streams map[uint64]*trackedStream
+}
+
+// trackedMux registers the streams of a Mux in openStreams until they are closed
+type trackedMux struct {
+	Mux
+}
+
+type trackedStream struct {
+	Stream
+	id     uint64
+	mux    Mux
+	opened time.Time
+	once   sync.Once
+}
+
+// trackedWriterTo keeps the WriteTo of the stream, like smux's, available to Copy
+type trackedWriterTo struct {
+	*trackedStream
+}
+
+func (s trackedWriterTo) WriteTo(w io.Writer) (int64, error) {
+	return s.Stream.(io.WriterTo).WriteTo(w)
+}
+
+func trackStreams(m Mux) Mux {
+	return &trackedMux{m}
+}
+
+func (m *trackedMux) OpenStream() (Stream, error) {
+	s, err := m.Mux.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return m.track(s), nil
+}
+
+func (m *trackedMux) AcceptStream() (Stream, error) {
+	s, err := m.Mux.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return m.track(s), nil
+}
+
+func (m *trackedMux) track(s Stream) Stream {
+	ts := &trackedStream{Stream: s, mux: m.Mux, opened: time.Now()}
+	openStreams.mu.Lock()
+	if openStreams.streams == nil {
+		openStreams.streams = make(map[uint64]*trackedStream)
+	}
+	openStreams.lastID++
+	ts.id = openStreams.lastID
+	openStreams.streams[ts.id] = ts
+	openStreams.mu.Unlock()
+
+	if _, ok := s.(io.WriterTo); ok {
+		return trackedWriterTo{ts}
+	}
+	return ts
+}
+
+// Close closes the stream and forgets it
+func (s *trackedStream) Close() error {
+	s.once.Do(func() {
+		openStreams.mu.Lock()
+		delete(openStreams.streams, s.id)
+		openStreams.mu.Unlock()
+	})
+	return s.Stream.Close()
+}
+
+// Streams returns the open streams, the oldest first
+func Streams() []StreamInfo {
+	openStreams.mu.Lock()
+	defer openStreams.mu.Unlock()
+	now := time.Now()
+	infos := make([]StreamInfo, 0, len(openStreams.streams))
+	for _, s := range openStreams.streams {
+		if s.mux.IsClosed() {
+			continue
+		}
+		infos = append(infos, StreamInfo{
+			ID:         s.id,
+			Stream:     s.ID(),
+			LocalAddr:  s.mux.LocalAddr().String(),
+			RemoteAddr: s.mux.RemoteAddr().String(),
+			Age:        int64(now.Sub(s.opened) / time.Second),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CloseStream closes the open stream with id as given by Streams, which ends the
+// connection relayed through it
+func CloseStream(id uint64) error {
+	openStreams.mu.Lock()
+	s, ok := openStreams.streams[id]
+	openStreams.mu.Unlock()
+	if !ok {
+		return errors.Errorf("no stream %v", id)
+	}
+	return s.Close()
+}
@@ -0,0 +1,210 @@
+package generic
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunHeaderSize      = 20
+
+	stunMappedAddress    = 0x0001
+	stunXorMappedAddress = 0x0020
+
+	// a binding request is sent this many times before giving up on a server
+	stunAttempts = 3
+	// and answers are awaited this long each time
+	stunTimeout = time.Second
+)
+
+// NAT types told apart by DetectNAT
+const (
+	NATNone        = "none"
+	NATIndependent = "endpoint-independent mapping"
+	NATSymmetric   = "symmetric"
+	NATUnknown     = "unknown"
+	NATBlocked     = "udp blocked"
+)
+
+// NATReport is what the stun servers saw of a local udp socket
+type NATReport struct {
+	Type   string
+	Local  *net.UDPAddr   // the local address the servers were asked from
+	Mapped []*net.UDPAddr // the address each server saw, nil for no answer
+	Errors []error
+}
+
+func (r *NATReport) String() string {
+	var mapped []string
+	for _, addr := range r.Mapped {
+		if addr != nil {
+			mapped = append(mapped, addr.String())
+		}
+	}
+	if len(mapped) == 0 {
+		return fmt.Sprintf("type %v, local %v", r.Type, r.Local)
+	}
+	return fmt.Sprintf("type %v, local %v, public %v", r.Type, r.Local, strings.Join(mapped, " "))
+}
+
+// DetectNAT asks every stun server which address it sees a single local udp socket
+// from. A socket seen from its own address has no nat in front, one seen from the same
+// address by all servers has an endpoint independent mapping, and one seen from a
+// different address by each server a symmetric nat, which needs two servers to tell.
+func DetectNAT(servers []string) (*NATReport, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no stun server")
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	r := &NATReport{Local: conn.LocalAddr().(*net.UDPAddr)}
+	for _, server := range servers {
+		raddr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(server))
+		if err == nil && r.Local.IP.IsUnspecified() {
+			// the address of the route to the server stands in for the wildcard
+			if probe, err := net.DialUDP("udp", nil, raddr); err == nil {
+				r.Local = &net.UDPAddr{IP: probe.LocalAddr().(*net.UDPAddr).IP, Port: r.Local.Port}
+				probe.Close()
+			}
+		}
+		var mapped *net.UDPAddr
+		if err == nil {
+			mapped, err = stunBinding(conn, raddr)
+		}
+		if err != nil {
+			r.Errors = append(r.Errors, errors.Wrap(err, server))
+		}
+		r.Mapped = append(r.Mapped, mapped)
+	}
+
+	var answered []*net.UDPAddr
+	for _, addr := range r.Mapped {
+		if addr != nil {
+			answered = append(answered, addr)
+		}
+	}
+	switch {
+	case len(answered) == 0:
+		r.Type = NATBlocked
+		return r, nil
+	case answered[0].IP.Equal(r.Local.IP) && answered[0].Port == r.Local.Port:
+		r.Type = NATNone
+	case len(answered) == 1:
+		r.Type = NATUnknown
+	default:
+		r.Type = NATIndependent
+	}
+	for _, addr := range answered[1:] {
+		if addr.String() != answered[0].String() {
+			r.Type = NATSymmetric
+		}
+	}
+	return r, nil
+}
+
+// stunBinding sends a binding request to server on conn and returns the address the
+// server saw it from
+func stunBinding(conn *net.UDPConn, server *net.UDPAddr) (*net.UDPAddr, error) {
+	req := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(req, stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	if _, err := rand.Read(req[8:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	buf := make([]byte, 1500)
+	for i := 0; i < stunAttempts; i++ {
+		if _, err := conn.WriteTo(req, server); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(stunTimeout))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if n < stunHeaderSize || binary.BigEndian.Uint16(buf) != stunBindingResponse || string(buf[8:20]) != string(req[8:20]) {
+				continue
+			}
+			return parseSTUNResponse(buf[:n])
+		}
+	}
+	return nil, errors.New("stun: no answer")
+}
+
+// parseSTUNResponse finds the mapped address in a binding response
+func parseSTUNResponse(p []byte) (*net.UDPAddr, error) {
+	var mapped *net.UDPAddr
+	attrs := p[stunHeaderSize:]
+	if length := int(binary.BigEndian.Uint16(p[2:])); length < len(attrs) {
+		attrs = attrs[:length]
+	}
+	for len(attrs) >= 4 {
+		typ, length := binary.BigEndian.Uint16(attrs), int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+length > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+length]
+		switch typ {
+		case stunXorMappedAddress:
+			if addr := parseSTUNAddress(value, p[4:20]); addr != nil {
+				return addr, nil
+			}
+		case stunMappedAddress:
+			mapped = parseSTUNAddress(value, nil)
+		}
+		// attributes are padded to 4 bytes
+		if next := 4 + (length+3)&^3; next < len(attrs) {
+			attrs = attrs[next:]
+		} else {
+			break
+		}
+	}
+	if mapped == nil {
+		return nil, errors.New("stun: no mapped address in answer")
+	}
+	return mapped, nil
+}
+
+// parseSTUNAddress decodes an address attribute, xored with the magic cookie and the
+// transaction id if xor is given
+func parseSTUNAddress(value, xor []byte) *net.UDPAddr {
+	if len(value) < 4 {
+		return nil
+	}
+	var size int
+	switch value[1] {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		return nil
+	}
+	if len(value) < 4+size {
+		return nil
+	}
+	port := int(binary.BigEndian.Uint16(value[2:]))
+	ip := make(net.IP, size)
+	copy(ip, value[4:4+size])
+	if xor != nil {
+		port ^= stunMagicCookie >> 16
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: port}
+}
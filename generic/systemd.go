@@ -0,0 +1,98 @@
+package generic
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SystemdPrefix marks an address as a socket passed by systemd socket activation, like
+// systemd: for the next one or systemd:NAME for the one named by FileDescriptorName=
+const SystemdPrefix = "systemd:"
+
+// the first file descriptor passed by systemd, see sd_listen_fds(3)
+const systemdFDStart = 3
+
+type systemdSocket struct {
+	name string
+	file *os.File
+}
+
+var (
+	systemdOnce    sync.Once
+	systemdMu      sync.Mutex
+	systemdSockets []systemdSocket
+)
+
+// loadSystemdSockets takes over the sockets passed in LISTEN_FDS, unless they are
+// meant for another process
+func loadSystemdSockets() {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		fd := systemdFDStart + i
+		systemdSockets = append(systemdSockets, systemdSocket{name, os.NewFile(uintptr(fd), "systemd:"+strconv.Itoa(fd))})
+	}
+}
+
+// systemdFile hands out the socket of addr, each socket is handed out once
+func systemdFile(addr string) (*os.File, error) {
+	systemdOnce.Do(loadSystemdSockets)
+	name := strings.TrimPrefix(addr, SystemdPrefix)
+
+	systemdMu.Lock()
+	defer systemdMu.Unlock()
+	for i, s := range systemdSockets {
+		if name == "" || s.name == name {
+			systemdSockets = append(systemdSockets[:i], systemdSockets[i+1:]...)
+			return s.file, nil
+		}
+	}
+	return nil, errors.Errorf("no socket passed by systemd for %v", addr)
+}
+
+// IsSystemd reports whether addr names a socket passed by systemd
+func IsSystemd(addr string) bool {
+	return strings.HasPrefix(addr, SystemdPrefix)
+}
+
+// SystemdListener returns the stream socket passed by systemd for addr
+func SystemdListener(addr string) (net.Listener, error) {
+	f, err := systemdFile(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	l, err := net.FileListener(f)
+	return l, errors.WithStack(err)
+}
+
+// SystemdPacketConn returns the datagram socket passed by systemd for addr
+func SystemdPacketConn(addr string) (net.PacketConn, error) {
+	f, err := systemdFile(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	conn, err := net.FilePacketConn(f)
+	return conn, errors.WithStack(err)
+}
@@ -0,0 +1,272 @@
+package generic
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// | STAMP(4B) | HMAC-SHA256(key, STAMP IP)(8B) |, IP the 16 bytes ip of the side
+	// dialing the sessions, zero on stream transports
+	tokenSize = 12
+	// the first packets to a peer all carry a token
+	tokenFirst = 16
+	// and then one every so often
+	tokenRefresh = 5 * time.Second
+	// a peer is admitted for this long after its last token
+	tokenTTL = time.Minute
+	// admitted peers remembered before the expired ones are purged
+	maxTokenPeers = 1 << 16
+)
+
+// tokenPeer is the token state of a peer, by ip
+type tokenPeer struct {
+	key      int       // index of the key the peer's tokens are under
+	expires  time.Time // until when packets without token are admitted
+	sent     int       // packets written to the peer
+	tokenAt  time.Time // when a token was last written to the peer
+	admitted bool
+}
+
+// tokenConn drops the packets of peers which haven't shown a token under one of the
+// keys before anything is spent on decrypting them. The first packets to a peer, and
+// one every few seconds after, are prefixed with a token of the current unix time and
+// the ip of the dialing side under the key; a peer whose token is within window of the
+// local clock, and bound to the ip the listening side sees, is admitted by ip for a
+// minute from its last token. A token checks no more than the key, the packets
+// themselves are still authenticated by their cipher.
+type tokenConn struct {
+	net.PacketConn
+	keys   [][]byte
+	window int64
+	self   func() net.IP // the ip of the dialing side, nil on the listening side
+	bound  bool          // tokens carry an ip, not on stream transports
+
+	mu     sync.Mutex
+	selfIP [16]byte // the last of self
+	peers  map[string]*tokenPeer
+	tokens map[tokenStamp][][]byte // the tokens of a stamp and ip under each key
+}
+
+type tokenStamp struct {
+	stamp uint32
+	ip    [16]byte
+}
+
+// NewTokenConn wraps conn to prefix the packets written with tokens under keys[0], or
+// the key of the peer's tokens, and drop the packets read from peers without a token
+// under any of keys stamped within window. Both sides of a connection must use it. The
+// tokens are bound to the ip of the side dialing the sessions, which passes self to
+// tell the ip the other side sees, while the listening side passes nil and checks the
+// ip of every peer. On the stream transports, whose peers can't spoof their address,
+// the tokens carry no ip.
+func NewTokenConn(conn net.PacketConn, keys [][]byte, window time.Duration, self func() net.IP) net.PacketConn {
+	c := &tokenConn{PacketConn: conn, keys: keys, window: int64(window / time.Second), self: self}
+	if c.window <= 0 {
+		c.window = 1
+	}
+	_, stream := conn.(*streamPacketConn)
+	c.bound = !stream
+	c.peers = make(map[string]*tokenPeer)
+	c.tokens = make(map[tokenStamp][][]byte)
+	return c
+}
+
+// RouteIP returns the local address of the route to addr, nil if there is none
+func RouteIP(addr net.Addr) net.IP {
+	ip := addrIP(addr)
+	if ip == nil {
+		return nil
+	}
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// addrIP returns the ip of addr
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return net.ParseIP(tokenIP(addr))
+}
+
+// boundIP returns the ip the tokens exchanged with addr are bound to, c.mu held
+func (c *tokenConn) boundIP(addr net.Addr) (ip [16]byte) {
+	switch {
+	case !c.bound:
+	case c.self != nil:
+		ip = c.selfIP
+	default:
+		copy(ip[:], addrIP(addr).To16())
+	}
+	return ip
+}
+
+// tokenIP is the key of a peer, packets from any port of its ip are admitted
+func tokenIP(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// tokensOf returns the tokens of stamp and ip under every key, c.mu held
+func (c *tokenConn) tokensOf(stamp uint32, ip [16]byte) [][]byte {
+	ts := tokenStamp{stamp, ip}
+	if tokens, ok := c.tokens[ts]; ok {
+		return tokens
+	}
+	if len(c.tokens) >= maxTokenPeers {
+		now := uint32(time.Now().Unix())
+		for s := range c.tokens {
+			if skew := int64(int32(now - s.stamp)); skew > c.window || skew < -c.window {
+				delete(c.tokens, s)
+			}
+		}
+		if len(c.tokens) >= maxTokenPeers {
+			c.tokens = make(map[tokenStamp][][]byte)
+		}
+	}
+	tokens := make([][]byte, len(c.keys))
+	for i, key := range c.keys {
+		token := make([]byte, tokenSize)
+		binary.LittleEndian.PutUint32(token, stamp)
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("kcptun token"))
+		mac.Write(token[:4])
+		mac.Write(ip[:])
+		copy(token[4:], mac.Sum(nil))
+		tokens[i] = token
+	}
+	c.tokens[ts] = tokens
+	return tokens
+}
+
+// peer returns the state of the peer with ip, c.mu held
+func (c *tokenConn) peer(ip string, now time.Time) *tokenPeer {
+	if p, ok := c.peers[ip]; ok {
+		return p
+	}
+	if len(c.peers) >= maxTokenPeers {
+		for k, p := range c.peers {
+			if now.After(p.expires) {
+				delete(c.peers, k)
+			}
+		}
+		if len(c.peers) >= maxTokenPeers {
+			c.peers = make(map[string]*tokenPeer)
+		}
+	}
+	p := new(tokenPeer)
+	c.peers[ip] = p
+	return p
+}
+
+// admit strips the token of a packet read from addr, and reports whether the packet is
+// to be passed on
+func (c *tokenConn) admit(p []byte, addr net.Addr) (int, bool) {
+	now := time.Now()
+	ip := tokenIP(addr)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(p) >= tokenSize {
+		stamp := binary.LittleEndian.Uint32(p)
+		if skew := int64(int32(uint32(now.Unix()) - stamp)); skew <= c.window && skew >= -c.window {
+			for i, token := range c.tokensOf(stamp, c.boundIP(addr)) {
+				if bytes.Equal(p[:tokenSize], token) {
+					peer := c.peer(ip, now)
+					peer.key, peer.admitted, peer.expires = i, true, now.Add(tokenTTL)
+					return copy(p, p[tokenSize:]), true
+				}
+			}
+		}
+	}
+	if peer, ok := c.peers[ip]; ok && peer.admitted && now.Before(peer.expires) {
+		return len(p), true
+	}
+	return 0, false
+}
+
+func (c *tokenConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		if n, ok := c.admit(b[:n], addr); ok && n > 0 {
+			return n, addr, nil
+		}
+	}
+}
+
+func (c *tokenConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	now := time.Now()
+	c.mu.Lock()
+	peer := c.peer(tokenIP(addr), now)
+	var token []byte
+	if peer.sent < tokenFirst || now.Sub(peer.tokenAt) >= tokenRefresh {
+		if c.self != nil && c.bound && (peer.sent == 0 || now.Sub(peer.tokenAt) >= tokenRefresh) {
+			// the ip of a dialing side may change, with migrate
+			copy(c.selfIP[:], c.self().To16())
+		}
+		token = c.tokensOf(uint32(now.Unix()), c.boundIP(addr))[peer.key]
+		peer.tokenAt = now
+	}
+	peer.sent++
+	c.mu.Unlock()
+
+	if token == nil {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	if _, err := c.PacketConn.WriteTo(append(append(make([]byte, 0, tokenSize+len(p)), token...), p...), addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *tokenConn) SetReadBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errors.New("SetReadBuffer: not supported")
+}
+
+func (c *tokenConn) SetWriteBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errors.New("SetWriteBuffer: not supported")
+}
+
+func (c *tokenConn) SetDSCP(dscp int) error {
+	if nc, ok := c.PacketConn.(interface{ SetDSCP(int) error }); ok {
+		return nc.SetDSCP(dscp)
+	}
+	if nc, ok := c.PacketConn.(net.Conn); ok {
+		err4 := ipv4.NewConn(nc).SetTOS(dscp << 2)
+		err6 := ipv6.NewConn(nc).SetTrafficClass(dscp)
+		if err4 == nil || err6 == nil {
+			return nil
+		}
+	}
+	return errors.New("SetDSCP: not supported")
+}
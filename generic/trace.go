@@ -0,0 +1,239 @@
+package generic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// spans exported in one request at most
+	traceBatchSize = 256
+	// spans waiting for export, newer ones are dropped once full
+	traceQueueSize = 4096
+	// period of exporting the spans waiting
+	traceFlushInterval = 5 * time.Second
+)
+
+// otlpExporter posts spans to an OpenTelemetry collector in the OTLP/HTTP json encoding
+type otlpExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	queue    chan *Span
+}
+
+var traceExporter *otlpExporter
+
+// SetTraceExporter exports spans to the OTLP/HTTP endpoint of a collector, like
+// http://127.0.0.1:4318, under the service name. Without it spans are not recorded.
+func SetTraceExporter(endpoint, service string) error {
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Errorf("unsupported otlp endpoint: %v", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	e := &otlpExporter{
+		endpoint: u.String(),
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *Span, traceQueueSize),
+	}
+	traceExporter = e
+	go e.loop()
+	return nil
+}
+
+func (e *otlpExporter) loop() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := e.export(batch); err != nil {
+			log.Println("otlp:", err)
+		}
+		batch = nil
+	}
+}
+
+func (e *otlpExporter) export(batch []*Span) error {
+	type anyValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	}
+	type keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	type status struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	type span struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         int        `json:"kind"`
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []keyValue `json:"attributes,omitempty"`
+		Status       status     `json:"status"`
+	}
+
+	attr := func(k string, v interface{}) keyValue {
+		switch x := v.(type) {
+		case bool:
+			return keyValue{k, anyValue{BoolValue: &x}}
+		case int, int32, int64, uint16, uint32, uint64:
+			s := fmt.Sprint(x)
+			return keyValue{k, anyValue{IntValue: &s}}
+		default:
+			s := fmt.Sprint(x)
+			return keyValue{k, anyValue{StringValue: &s}}
+		}
+	}
+
+	var spans []span
+	for _, s := range batch {
+		s.mu.Lock()
+		out := span{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.spanID[:]),
+			Name:    s.name,
+			Kind:    1, // SPAN_KIND_INTERNAL
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for i := 0; i+1 < len(s.attrs); i += 2 {
+			out.Attributes = append(out.Attributes, attr(fmt.Sprint(s.attrs[i]), s.attrs[i+1]))
+		}
+		if s.err != nil {
+			out.Status = status{2, s.err.Error()} // STATUS_CODE_ERROR
+		}
+		s.mu.Unlock()
+		spans = append(spans, out)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource":   map[string]interface{}{"attributes": []keyValue{attr("service.name", e.service)}},
+			"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]string{"name": "kcptun"}, "spans": spans}},
+		}},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("%v: %v", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// Span is an operation exported to the trace collector when it ends. All methods do
+// nothing on a nil Span, which is what StartSpan returns while tracing is off.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+
+	mu    sync.Mutex
+	attrs []interface{} // key, value pairs
+	err   error
+	ended bool
+}
+
+// StartSpan starts the span name, a child of parent or the root of a new trace if
+// parent is nil, with attributes given as key, value pairs
+func StartSpan(name string, parent *Span, attrs ...interface{}) *Span {
+	if traceExporter == nil {
+		return nil
+	}
+	s := &Span{name: name, start: time.Now(), attrs: attrs}
+	if parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// SetAttr adds attributes given as key, value pairs
+func (s *Span) SetAttr(attrs ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed with err, a nil err is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// End ends the span and queues it for export, only the first call counts
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	select {
+	case traceExporter.queue <- s:
+	default:
+	}
+}
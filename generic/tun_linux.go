@@ -0,0 +1,87 @@
+// +build linux
+
+package generic
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// OpenTUN creates the tun device name, or attaches to it if it exists, and brings it up
+// with the IPv4 address and prefix of cidr if not empty. It needs root or
+// CAP_NET_ADMIN, and reads and writes one IP packet at a time.
+func OpenTUN(name, cidr string) (io.ReadWriteCloser, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "open /dev/net/tun")
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, errors.Errorf("invalid tun name: %v", name)
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "TUNSETIFF")
+	}
+	// non blocking, for the runtime poller to wake up the reads on close
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, errors.WithStack(err)
+	}
+	dev := os.NewFile(uintptr(fd), "/dev/net/tun")
+	if err := setupTUN(ifr.Name(), cidr); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// setupTUN sets the address of the interface name and brings it up
+func setupTUN(name, cidr string) error {
+	sock, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer unix.Close(sock)
+
+	ioctl := func(req uint, set func(*unix.Ifreq) error) (*unix.Ifreq, error) {
+		ifr, err := unix.NewIfreq(name)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if set != nil {
+			if err := set(ifr); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+		return ifr, errors.WithStack(unix.IoctlIfreq(sock, req, ifr))
+	}
+
+	if cidr != "" {
+		ip, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil || ip.To4() == nil {
+			return errors.Errorf("invalid tun address: %v", cidr)
+		}
+		if _, err := ioctl(unix.SIOCSIFADDR, func(ifr *unix.Ifreq) error { return ifr.SetInet4Addr(ip.To4()) }); err != nil {
+			return errors.Wrap(err, "SIOCSIFADDR")
+		}
+		if _, err := ioctl(unix.SIOCSIFNETMASK, func(ifr *unix.Ifreq) error { return ifr.SetInet4Addr(net.IP(ipnet.Mask).To4()) }); err != nil {
+			return errors.Wrap(err, "SIOCSIFNETMASK")
+		}
+	}
+	flags, err := ioctl(unix.SIOCGIFFLAGS, nil)
+	if err != nil {
+		return errors.Wrap(err, "SIOCGIFFLAGS")
+	}
+	up := flags.Uint16() | unix.IFF_UP | unix.IFF_RUNNING
+	if _, err := ioctl(unix.SIOCSIFFLAGS, func(ifr *unix.Ifreq) error { ifr.SetUint16(up); return nil }); err != nil {
+		return errors.Wrap(err, "SIOCSIFFLAGS")
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+// +build !linux
+
+package generic
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// OpenTUN fails, tun devices are only supported on linux
+func OpenTUN(name, cidr string) (io.ReadWriteCloser, error) {
+	return nil, errors.New("tun is only supported on linux")
+}
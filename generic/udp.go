@@ -0,0 +1,84 @@
+package generic
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MaxDatagramSize is the largest datagram that can be framed on a stream
+const MaxDatagramSize = 65535
+
+// WriteDatagram writes a datagram on a stream with a 2 bytes big endian length prefix
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > MaxDatagramSize {
+		return errors.Errorf("datagram too large: %v", len(p))
+	}
+	buf := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[2:], p)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadDatagram reads a length prefixed datagram from a stream into buf
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n > len(buf) {
+		return 0, errors.Errorf("datagram too large: %v", n)
+	}
+	return io.ReadFull(r, buf[:n])
+}
+
+// RelayDatagrams forwards length prefixed datagrams between a stream and a connected
+// udp socket, until either side fails or no datagram passed for timeout.
+func RelayDatagrams(stream io.ReadWriteCloser, conn net.Conn, timeout time.Duration) {
+	defer stream.Close()
+	defer conn.Close()
+
+	var lastActive int64
+	touch := func() { atomic.StoreInt64(&lastActive, time.Now().UnixNano()) }
+	touch()
+
+	// udp -> stream, also watches the idle timeout
+	go func() {
+		defer stream.Close()
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() &&
+					time.Since(time.Unix(0, atomic.LoadInt64(&lastActive))) < timeout {
+					continue
+				}
+				return
+			}
+			touch()
+			if err := WriteDatagram(stream, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	// stream -> udp
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, err := ReadDatagram(stream, buf)
+		if err != nil {
+			return
+		}
+		touch()
+		if _, err := conn.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package generic
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A minimal RFC 6455 websocket, carrying a byte stream in binary messages
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	// largest control frame payload
+	wsMaxControl = 125
+)
+
+// wsConn is a websocket connection read and written as a byte stream
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool // frames sent by the client are masked
+
+	wmu       sync.Mutex
+	remaining uint64 // unread payload of the current data frame
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+}
+
+func wsAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// DialWebSocket connects to a ws:// or wss:// url
+func DialWebSocket(rawurl string, timeout time.Duration) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: timeout}
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", host)
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, errors.Errorf("unsupported websocket url: %v", rawurl)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var nonce [16]byte
+	io.ReadFull(rand.Reader, nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, errors.Errorf("websocket handshake with %v failed: %v", rawurl, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{Conn: conn, r: br, client: true}, nil
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame, answering control frames
+func (c *wsConn) nextFrame() error {
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+			return err
+		}
+		opcode := hdr[0] & 0x0f
+		c.masked = hdr[1]&0x80 != 0
+		length := uint64(hdr[1] & 0x7f)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		if c.masked {
+			if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+				return err
+			}
+		}
+		c.maskPos = 0
+
+		switch opcode {
+		case wsOpContinuation, wsOpText, wsOpBinary:
+			c.remaining = length
+			if length > 0 {
+				return nil
+			}
+		default:
+			if length > wsMaxControl {
+				return errors.New("websocket control frame too large")
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(c.r, payload); err != nil {
+				return err
+			}
+			if c.masked {
+				for i := range payload {
+					payload[i] ^= c.mask[i&3]
+				}
+			}
+			switch opcode {
+			case wsOpClose:
+				c.writeFrame(wsOpClose, nil)
+				return io.EOF
+			case wsOpPing:
+				if err := c.writeFrame(wsOpPong, payload); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, p []byte) error {
+	frame := make([]byte, 0, 14+len(p))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(p) < 126:
+		frame = append(frame, maskBit|byte(len(p)))
+	case len(p) <= 0xffff:
+		frame = append(frame, maskBit|126, byte(len(p)>>8), byte(len(p)))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(len(p)))
+		frame = append(append(frame, maskBit|127), ext[:]...)
+	}
+	if c.client {
+		var mask [4]byte
+		io.ReadFull(rand.Reader, mask[:])
+		frame = append(frame, mask[:]...)
+		for i, b := range p {
+			frame = append(frame, b^mask[i&3])
+		}
+	} else {
+		frame = append(frame, p...)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// wsListener upgrades the http requests accepted on a listener to websocket connections
+type wsListener struct {
+	lis   net.Listener
+	conns chan net.Conn
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// ListenWebSocket serves websocket upgrades on lis and returns the upgraded connections
+// as a listener, other requests get a 404 like from any web server.
+func ListenWebSocket(lis net.Listener) net.Listener {
+	l := &wsListener{lis: lis, conns: make(chan net.Conn), die: make(chan struct{})}
+	go func() {
+		http.Serve(lis, l)
+		l.Close()
+	}()
+	return l
+}
+
+func (l *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.NotFound(w, r)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket: hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	select {
+	case l.conns <- &wsConn{Conn: conn, r: brw.Reader}:
+	case <-l.die:
+		conn.Close()
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.die:
+		return nil, errors.New("use of closed websocket listener")
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.dieOnce.Do(func() {
+		close(l.die)
+		l.lis.Close()
+	})
+	return nil
+}
+
+func (l *wsListener) Addr() net.Addr { return l.lis.Addr() }
@@ -0,0 +1,41 @@
+package generic
+
+import (
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"golang.org/x/crypto/chacha20"
+)
+
+// XChaCha20 as specified in draft-irtf-cfrg-xchacha, keyed per packet by HChaCha20 on
+// all 16 bytes of the random nonce kcp-go sends, where salsa20 only uses 8 of them. The
+// nonce never repeats in practice however many packets are sent under one key.
+//
+//	plaintext:  | NONCE(16B) | CRC32(4B) | DATA |
+//	ciphertext: | NONCE(16B) | ENCRYPTED CRC32 AND DATA |
+const xchachaNonceSize = 16
+
+type xchacha20BlockCrypt struct {
+	key []byte
+}
+
+// NewXChaCha20BlockCrypt creates an XChaCha20 stream cipher with a 32 bytes key
+func NewXChaCha20BlockCrypt(key []byte) (kcp.BlockCrypt, error) {
+	if len(key) != chacha20.KeySize {
+		return nil, errors.Errorf("xchacha20: invalid key size %v", len(key))
+	}
+	return &xchacha20BlockCrypt{key: append([]byte(nil), key...)}, nil
+}
+
+func (c *xchacha20BlockCrypt) Encrypt(dst, src []byte) { c.xorKeyStream(dst, src) }
+func (c *xchacha20BlockCrypt) Decrypt(dst, src []byte) { c.xorKeyStream(dst, src) }
+
+// xorKeyStream encrypts or decrypts src after the nonce into dst, with the keystream of
+// the 24 bytes nonce made of the packet nonce and 8 zero bytes
+func (c *xchacha20BlockCrypt) xorKeyStream(dst, src []byte) {
+	var nonce [chacha20.NonceSizeX]byte
+	copy(nonce[:], src[:xchachaNonceSize])
+	// the sizes of the key and the nonce are the only errors, both are right
+	s, _ := chacha20.NewUnauthenticatedCipher(c.key, nonce[:])
+	s.XORKeyStream(dst[xchachaNonceSize:], src[xchachaNonceSize:])
+	copy(dst[:xchachaNonceSize], src[:xchachaNonceSize])
+}
@@ -0,0 +1,543 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// yamux as specified in the spec of hashicorp/yamux, written in plain go as it isn't
+// vendored. Every stream has a window of its own which the receiver grows as the
+// stream is read, so a stream nobody reads never stalls the others. Frames start with
+// a 12 bytes big endian header:
+//
+//	| VERSION(1B) | TYPE(1B) | FLAGS(2B) | STREAM ID(4B) | LENGTH(4B) |
+//
+// followed by LENGTH bytes for data frames, the other types carry their value in it.
+const (
+	yamuxVersion    = 0
+	yamuxHeaderSize = 12
+
+	yamuxTypeData         = 0
+	yamuxTypeWindowUpdate = 1
+	yamuxTypePing         = 2
+	yamuxTypeGoAway       = 3
+
+	yamuxFlagSYN = 1
+	yamuxFlagACK = 2
+	yamuxFlagFIN = 4
+	yamuxFlagRST = 8
+
+	// the window every stream starts with, larger ones are announced with the SYN or ACK
+	yamuxInitialWindow = 256 * 1024
+	// streams opened by the peer and not accepted yet before new ones are reset
+	yamuxAcceptBacklog = 1024
+)
+
+var errYamuxReset = errors.New("stream reset")
+
+type yamuxSession struct {
+	conn      io.ReadWriteCloser
+	window    uint32 // receive window of the streams
+	frameSize int
+
+	mu      sync.Mutex
+	streams map[uint32]*yamuxStream
+	nextID  uint32
+	goAway  bool  // the peer takes no new streams
+	err     error // why the session died, io.EOF or smux.ErrInvalidProtocol
+
+	accepts chan *yamuxStream
+	wmu     sync.Mutex // frames are written whole
+	heard   int32      // set by every frame received, for the keepalive
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newYamux(conn io.ReadWriteCloser, config *smux.Config, client bool) *yamuxSession {
+	s := &yamuxSession{
+		conn:      conn,
+		window:    yamuxInitialWindow,
+		frameSize: config.MaxFrameSize,
+		streams:   make(map[uint32]*yamuxStream),
+		nextID:    2,
+		err:       io.EOF,
+		accepts:   make(chan *yamuxStream, yamuxAcceptBacklog),
+		die:       make(chan struct{}),
+	}
+	if config.MaxStreamBuffer > yamuxInitialWindow {
+		s.window = uint32(config.MaxStreamBuffer)
+	}
+	if client {
+		s.nextID = 1
+	}
+	go s.recvLoop()
+	if !config.KeepAliveDisabled {
+		go s.keepalive(config.KeepAliveInterval, config.KeepAliveTimeout)
+	}
+	return s
+}
+
+func (s *yamuxSession) OpenStream() (Stream, error) {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil, io.ErrClosedPipe
+	}
+	if s.goAway || s.nextID > 1<<32-2 {
+		s.mu.Unlock()
+		return nil, smux.ErrGoAway
+	}
+	st := newYamuxStream(s, s.nextID)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(yamuxTypeWindowUpdate, yamuxFlagSYN, st.id, s.window-yamuxInitialWindow, nil); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *yamuxSession) AcceptStream() (Stream, error) {
+	select {
+	case st := <-s.accepts:
+		if err := s.writeFrame(yamuxTypeWindowUpdate, yamuxFlagACK, st.id, s.window-yamuxInitialWindow, nil); err != nil {
+			return nil, err
+		}
+		return st, nil
+	case <-s.die:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+func (s *yamuxSession) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *yamuxSession) IsClosed() bool {
+	return s.isClosed()
+}
+
+func (s *yamuxSession) isClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *yamuxSession) Close() error {
+	err := io.ErrClosedPipe
+	s.dieOnce.Do(func() {
+		close(s.die)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+// fail closes the session for err
+func (s *yamuxSession) fail(err error) {
+	s.mu.Lock()
+	if !s.isClosed() {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.Close()
+}
+
+func (s *yamuxSession) LocalAddr() net.Addr {
+	if conn, ok := s.conn.(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+func (s *yamuxSession) RemoteAddr() net.Addr {
+	if conn, ok := s.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (s *yamuxSession) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// writeFrame writes a frame with data or the value length
+func (s *yamuxSession) writeFrame(typ byte, flags uint16, id, length uint32, data []byte) error {
+	if data != nil {
+		length = uint32(len(data))
+	}
+	frame := make([]byte, yamuxHeaderSize+len(data))
+	frame[0], frame[1] = yamuxVersion, typ
+	binary.BigEndian.PutUint16(frame[2:], flags)
+	binary.BigEndian.PutUint32(frame[4:], id)
+	binary.BigEndian.PutUint32(frame[8:], length)
+	copy(frame[yamuxHeaderSize:], data)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.isClosed() {
+		return io.ErrClosedPipe
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		s.fail(io.EOF)
+		return err
+	}
+	return nil
+}
+
+func (s *yamuxSession) recvLoop() {
+	hdr := make([]byte, yamuxHeaderSize)
+	for {
+		if _, err := io.ReadFull(s.conn, hdr); err != nil {
+			s.fail(io.EOF)
+			return
+		}
+		atomic.StoreInt32(&s.heard, 1)
+		if hdr[0] != yamuxVersion {
+			s.fail(smux.ErrInvalidProtocol)
+			return
+		}
+		typ, flags := hdr[1], binary.BigEndian.Uint16(hdr[2:])
+		id, length := binary.BigEndian.Uint32(hdr[4:]), binary.BigEndian.Uint32(hdr[8:])
+
+		var err error
+		switch typ {
+		case yamuxTypeData, yamuxTypeWindowUpdate:
+			err = s.handleStream(typ, flags, id, length)
+		case yamuxTypePing:
+			if flags&yamuxFlagSYN != 0 {
+				go s.writeFrame(yamuxTypePing, yamuxFlagACK, 0, length, nil)
+			}
+		case yamuxTypeGoAway:
+			s.mu.Lock()
+			s.goAway = true
+			s.mu.Unlock()
+		default:
+			err = smux.ErrInvalidProtocol
+		}
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// handleStream handles a data or window update frame of the stream id
+func (s *yamuxSession) handleStream(typ byte, flags uint16, id, length uint32) error {
+	s.mu.Lock()
+	st := s.streams[id]
+	if st == nil && flags&yamuxFlagSYN != 0 {
+		// the ids of the peer are odd if it's the client
+		if id == 0 || id%2 == s.nextID%2 {
+			s.mu.Unlock()
+			return smux.ErrInvalidProtocol
+		}
+		st = newYamuxStream(s, id)
+		s.streams[id] = st
+		select {
+		case s.accepts <- st:
+		default:
+			delete(s.streams, id)
+			st = nil
+			go s.writeFrame(yamuxTypeWindowUpdate, yamuxFlagRST, id, 0, nil)
+		}
+	}
+	s.mu.Unlock()
+
+	if typ == yamuxTypeWindowUpdate {
+		if st != nil {
+			st.grow(length)
+		}
+	} else if st == nil {
+		// data of a stream closed or reset already
+		if _, err := io.CopyN(ioutil.Discard, s.conn, int64(length)); err != nil {
+			return io.EOF
+		}
+		return nil
+	} else if length > 0 {
+		// checked before allocating what the peer announces
+		if length > st.receivable() {
+			return smux.ErrInvalidProtocol
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			return io.EOF
+		}
+		if !st.push(data) {
+			return smux.ErrInvalidProtocol
+		}
+	}
+	if st != nil && flags&yamuxFlagFIN != 0 {
+		st.remoteClose()
+	}
+	if st != nil && flags&yamuxFlagRST != 0 {
+		st.reset()
+	}
+	return nil
+}
+
+// keepalive pings the peer every interval and closes the session if nothing arrived
+// from it for timeout
+func (s *yamuxSession) keepalive(interval, timeout time.Duration) {
+	ping := time.NewTicker(interval)
+	defer ping.Stop()
+	check := time.NewTicker(timeout)
+	defer check.Stop()
+	for {
+		select {
+		case <-ping.C:
+			s.writeFrame(yamuxTypePing, yamuxFlagSYN, 0, 0, nil)
+		case <-check.C:
+			if !atomic.CompareAndSwapInt32(&s.heard, 1, 0) {
+				s.Close()
+				return
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
+
+type yamuxStream struct {
+	id   uint32
+	sess *yamuxSession
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	recvWindow    uint32 // bytes the peer may still send
+	consumed      uint32 // bytes read since the last window update
+	sendWindow    uint32
+	finRecv       bool
+	closed        bool
+	rst           bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+}
+
+func newYamuxStream(s *yamuxSession, id uint32) *yamuxStream {
+	return &yamuxStream{
+		id:         id,
+		sess:       s,
+		recvWindow: s.window,
+		sendWindow: yamuxInitialWindow,
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is notified, the deadline passes or the session dies
+func (st *yamuxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return smux.ErrTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return smux.ErrTimeout
+	case <-st.sess.die:
+		return io.ErrClosedPipe
+	}
+}
+
+func (st *yamuxStream) ID() uint32 { return st.id }
+
+func (st *yamuxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			st.consumed += uint32(n)
+			var delta uint32
+			if st.consumed >= st.sess.window/2 && !st.finRecv {
+				delta, st.consumed = st.consumed, 0
+				st.recvWindow += delta
+			}
+			st.mu.Unlock()
+			if delta > 0 {
+				st.sess.writeFrame(yamuxTypeWindowUpdate, 0, st.id, delta, nil)
+			}
+			return n, nil
+		}
+		rst, fin, closed, deadline := st.rst, st.finRecv, st.closed, st.readDeadline
+		st.mu.Unlock()
+
+		switch {
+		case rst:
+			return 0, errYamuxReset
+		case fin:
+			return 0, io.EOF
+		case closed:
+			return 0, io.ErrClosedPipe
+		}
+		if err := st.wait(st.readEvent, deadline); err == io.ErrClosedPipe {
+			st.sess.mu.Lock()
+			err = st.sess.err
+			st.sess.mu.Unlock()
+			return 0, err
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *yamuxStream) Write(p []byte) (int, error) {
+	var sent int
+	for len(p) > 0 {
+		st.mu.Lock()
+		if st.rst {
+			st.mu.Unlock()
+			return sent, errYamuxReset
+		}
+		if st.closed {
+			st.mu.Unlock()
+			return sent, io.ErrClosedPipe
+		}
+		if n := int(st.sendWindow); n > 0 {
+			if n > len(p) {
+				n = len(p)
+			}
+			if n > st.sess.frameSize {
+				n = st.sess.frameSize
+			}
+			st.sendWindow -= uint32(n)
+			st.mu.Unlock()
+			if err := st.sess.writeFrame(yamuxTypeData, 0, st.id, 0, p[:n]); err != nil {
+				return sent, err
+			}
+			sent += n
+			p = p[n:]
+			continue
+		}
+		deadline := st.writeDeadline
+		st.mu.Unlock()
+		if err := st.wait(st.writeEvent, deadline); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// Close sends a FIN and forgets the stream, what the peer still sends is discarded
+func (st *yamuxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+	st.closed = true
+	rst := st.rst
+	st.buf.Reset()
+	st.mu.Unlock()
+	notify(st.readEvent)
+	notify(st.writeEvent)
+	st.sess.remove(st.id)
+	if rst {
+		return nil
+	}
+	return st.sess.writeFrame(yamuxTypeWindowUpdate, yamuxFlagFIN, st.id, 0, nil)
+}
+
+// push buffers data received, reporting whether it fitted in the window
+func (st *yamuxStream) push(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if uint32(len(data)) > st.recvWindow {
+		return false
+	}
+	st.recvWindow -= uint32(len(data))
+	if !st.closed {
+		st.buf.Write(data)
+		notify(st.readEvent)
+	}
+	return true
+}
+
+func (st *yamuxStream) receivable() uint32 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.recvWindow
+}
+
+func (st *yamuxStream) grow(delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	notify(st.writeEvent)
+}
+
+func (st *yamuxStream) remoteClose() {
+	st.mu.Lock()
+	st.finRecv = true
+	st.mu.Unlock()
+	notify(st.readEvent)
+}
+
+func (st *yamuxStream) reset() {
+	st.mu.Lock()
+	st.rst = true
+	st.mu.Unlock()
+	notify(st.readEvent)
+	notify(st.writeEvent)
+	st.sess.remove(st.id)
+}
+
+func (st *yamuxStream) LocalAddr() net.Addr  { return st.sess.LocalAddr() }
+func (st *yamuxStream) RemoteAddr() net.Addr { return st.sess.RemoteAddr() }
+
+func (st *yamuxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readEvent)
+	return nil
+}
+
+func (st *yamuxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeEvent)
+	return nil
+}
+
+func (st *yamuxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
@@ -0,0 +1,126 @@
+package generic
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	// zstdMaxBlock is the largest raw block of a zstd frame
+	zstdMaxBlock = 128 << 10
+	// zstdWindow is the window of the encoder, smaller than zstd's default of 8MB for
+	// its history to stay small on a server with many sessions
+	zstdWindow = 1 << 20
+)
+
+// zstdStream compresses a conn with zstd, flushed after every write. Writes sent
+// uncompressed end the frame of the encoder and go in a frame of raw blocks.
+type zstdStream struct {
+	net.Conn
+	w         *zstd.Encoder
+	r         *zstd.Decoder
+	threshold int  // writes shorter than this are sent in raw frames
+	open      bool // the encoder's frame is not ended yet
+	stale     bool // the window of w misses raw frames sent since
+	sampler   *compSampler
+	counter   *countWriter
+}
+
+func newZstdStream(conn net.Conn, level int) (*zstdStream, error) {
+	encLevel := zstd.SpeedDefault
+	if level != 0 {
+		encLevel = zstd.EncoderLevelFromZstd(level)
+	}
+	counter := &countWriter{w: conn}
+	w, err := zstd.NewWriter(counter, zstd.WithEncoderLevel(encLevel), zstd.WithWindowSize(zstdWindow),
+		zstd.WithEncoderConcurrency(1), zstd.WithEncoderCRC(false))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// a single goroutine decodes as data is read, with no read ahead past what's flushed
+	r, err := zstd.NewReader(conn, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &zstdStream{Conn: conn, w: w, r: r, counter: counter}, nil
+}
+
+func (c *zstdStream) Read(p []byte) (n int, err error) {
+	return c.r.Read(p)
+}
+
+func (c *zstdStream) Write(p []byte) (n int, err error) {
+	sample := c.sampler.sample(p)
+	if len(p) < c.threshold || sample.skip() {
+		return c.writeRaw(p)
+	}
+	if c.stale {
+		// a new frame, back references would miss the raw frames
+		c.w.Reset(c.counter)
+		c.stale = false
+	}
+	before := c.counter.n
+	if _, err := c.w.Write(p); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	c.open = true
+	sample.record(len(p), c.counter.n-before)
+	return len(p), nil
+}
+
+// writeRaw ends the encoder's frame and sends p in a single segment frame of raw blocks
+func (c *zstdStream) writeRaw(p []byte) (int, error) {
+	if c.open {
+		if err := c.w.Close(); err != nil {
+			return 0, errors.WithStack(err)
+		}
+		c.open = false
+	}
+
+	// magic, then a frame header descriptor with the single segment flag and the size
+	// of the frame content size field, which a single segment frame must give
+	out := []byte{0x28, 0xb5, 0x2f, 0xfd}
+	switch {
+	case len(p) < 256:
+		out = append(out, 0x20, byte(len(p)))
+	case len(p) < 65536+256:
+		out = append(out, 0x60, 0, 0)
+		binary.LittleEndian.PutUint16(out[len(out)-2:], uint16(len(p)-256))
+	default:
+		out = append(out, 0xa0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(out[len(out)-4:], uint32(len(p)))
+	}
+	for b := p; ; {
+		n := len(b)
+		if n > zstdMaxBlock {
+			n = zstdMaxBlock
+		}
+		// Last_Block, Block_Type 0 for raw, Block_Size
+		hdr := uint32(n) << 3
+		if n == len(b) {
+			hdr |= 1
+		}
+		out = append(out, byte(hdr), byte(hdr>>8), byte(hdr>>16))
+		out = append(out, b[:n]...)
+		b = b[n:]
+		if len(b) == 0 {
+			break
+		}
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	c.stale = true
+	return len(p), nil
+}
+
+func (c *zstdStream) Close() error {
+	c.r.Close()
+	return c.Conn.Close()
+}
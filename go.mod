@@ -4,16 +4,22 @@ require (
 	github.com/coreos/go-iptables v0.4.2 // indirect
 	github.com/golang/snappy v0.0.1
 	github.com/google/gopacket v1.1.17 // indirect
-	github.com/klauspost/reedsolomon v1.10.0 // indirect
+	github.com/klauspost/compress v1.18.0
+	github.com/klauspost/cpuid/v2 v2.0.14 // indirect
+	github.com/klauspost/reedsolomon v1.10.0
 	github.com/pkg/errors v0.9.1
+	github.com/templexxx/cpu v0.0.7 // indirect
+	github.com/templexxx/xorsimd v0.4.1 // indirect
 	github.com/tjfoc/gmsm v1.4.1 // indirect
 	github.com/urfave/cli v1.21.0
 	github.com/xtaci/kcp-go/v5 v5.6.1
 	github.com/xtaci/smux v1.5.16
 	github.com/xtaci/tcpraw v1.2.25
-	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
-	golang.org/x/net v0.0.0-20220624214902-1bab6f366d9e // indirect
-	golang.org/x/sys v0.0.0-20220624220833-87e55d714810 // indirect
+	golang.org/x/crypto v0.48.0
+	golang.org/x/net v0.50.0
+	golang.org/x/sys v0.41.0
 )
 
-go 1.14
+go 1.24
+
+replace github.com/xtaci/kcp-go/v5 => ./third_party/kcp-go
@@ -1,49 +1,117 @@
 package main
 
-import (
-	"encoding/json"
-	"os"
-)
-
 // Config for server
 type Config struct {
-	Listen       string `json:"listen"`
-	Target       string `json:"target"`
-	Key          string `json:"key"`
-	Crypt        string `json:"crypt"`
-	Mode         string `json:"mode"`
-	MTU          int    `json:"mtu"`
-	SndWnd       int    `json:"sndwnd"`
-	RcvWnd       int    `json:"rcvwnd"`
-	DataShard    int    `json:"datashard"`
-	ParityShard  int    `json:"parityshard"`
-	DSCP         int    `json:"dscp"`
-	NoComp       bool   `json:"nocomp"`
-	AckNodelay   bool   `json:"acknodelay"`
-	NoDelay      int    `json:"nodelay"`
-	Interval     int    `json:"interval"`
-	Resend       int    `json:"resend"`
-	NoCongestion int    `json:"nc"`
-	SockBuf      int    `json:"sockbuf"`
-	SmuxBuf      int    `json:"smuxbuf"`
-	StreamBuf    int    `json:"streambuf"`
-	SmuxVer      int    `json:"smuxver"`
-	KeepAlive    int    `json:"keepalive"`
-	Log          string `json:"log"`
-	Fifo         string `json:"fifo"`
-	SnmpLog      string `json:"snmplog"`
-	SnmpPeriod   int    `json:"snmpperiod"`
-	Pprof        bool   `json:"pprof"`
-	Quiet        bool   `json:"quiet"`
-	TCP          bool   `json:"tcp"`
-}
+	Listen           string `json:"listen"`
+	Target           string `json:"target"`
+	Balance          string `json:"balance"`
+	HealthCheck      int    `json:"healthcheck"`
+	Reverse          string `json:"reverse"`
+	P2P              string `json:"p2p"`
+	Broker           bool   `json:"broker"`
+	Conn             int    `json:"conn"`
+	Key              string `json:"key"`
+	KeyFile          string `json:"keyfile"`
+	Users            string `json:"users"`
+	Crypt            string `json:"crypt"`
+	Rekey            int    `json:"rekey"`
+	AntiReplay       int    `json:"antireplay"`
+	Token            int    `json:"token"`
+	Migrate          bool   `json:"migrate"`
+	KeyExchange      bool   `json:"keyexchange"`
+	PQKeyExchange    bool   `json:"pqkeyexchange"`
+	ConnKey          bool   `json:"connkey"`
+	Cert             string `json:"cert"`
+	CertKey          string `json:"certkey"`
+	CA               string `json:"ca"`
+	Stealth          bool   `json:"stealth"`
+	KDF              string `json:"kdf"`
+	Salt             string `json:"salt"`
+	KDFIter          int    `json:"kdfiter"`
+	KDFMem           int    `json:"kdfmem"`
+	Mode             string `json:"mode"`
+	MTU              int    `json:"mtu"`
+	SndWnd           int    `json:"sndwnd"`
+	RcvWnd           int    `json:"rcvwnd"`
+	Wnd              string `json:"wnd"`
+	MaxWnd           int    `json:"maxwnd"`
+	DataShard        int    `json:"datashard"`
+	ParityShard      int    `json:"parityshard"`
+	AutoFEC          bool   `json:"autofec"`
+	MinParity        int    `json:"minparity"`
+	MaxParity        int    `json:"maxparity"`
+	DSCP             int    `json:"dscp"`
+	FwMark           int    `json:"fwmark"`
+	NoComp           bool   `json:"nocomp"`
+	Comp             string `json:"comp"`
+	CompLevel        int    `json:"complevel"`
+	CompThreshold    int    `json:"compthreshold"`
+	CompAdaptive     bool   `json:"compadaptive"`
+	AckNodelay       bool   `json:"acknodelay"`
+	NoDelay          int    `json:"nodelay"`
+	Interval         int    `json:"interval"`
+	Resend           int    `json:"resend"`
+	NoCongestion     int    `json:"nc"`
+	SockBuf          int    `json:"sockbuf"`
+	NoOffload        bool   `json:"nooffload"`
+	ReusePort        int    `json:"reuseport"`
+	SmuxBuf          int    `json:"smuxbuf"`
+	StreamBuf        int    `json:"streambuf"`
+	CopyBuf          int    `json:"copybuf"`
+	GOMAXPROCS       int    `json:"gomaxprocs"`
+	CPUs             string `json:"cpus"`
+	SmuxVer          int    `json:"smuxver"`
+	Mux              string `json:"mux"`
+	KeepAlive        int    `json:"keepalive"`
+	KeepAliveTimeout int    `json:"keepalivetimeout"`
+	Log              string `json:"log"`
+	LogFormat        string `json:"logformat"`
+	Fifo             string `json:"fifo"`
+	ControlAddr      string `json:"controladdr"`
+	ControlToken     string `json:"controltoken"`
+	ControlSock      string `json:"controlsock"`
+	MetricsAddr      string `json:"metricsaddr"`
+	OTLP             string `json:"otlp"`
+	SnmpLog          string `json:"snmplog"`
+	SnmpPeriod       int    `json:"snmpperiod"`
+	SnmpFormat       string `json:"snmpformat"`
+	SnmpReset        bool   `json:"snmpreset"`
+	Pprof            bool   `json:"pprof"`
+	Quiet            bool   `json:"quiet"`
+	TCP              bool   `json:"tcp"`
+	ICMP             bool   `json:"icmp"`
+	Padding          bool   `json:"padding"`
+	Stream           string `json:"stream"`
+	Transport        string `json:"transport"`
+	WS               string `json:"ws"`
+	WSCert           string `json:"wscert"`
+	WSKey            string `json:"wskey"`
+	Dynamic          bool   `json:"dynamic"`
+	ProxyProtocol    bool   `json:"proxyprotocol"`
+	UDP              bool   `json:"udp"`
+	UDPTimeout       int    `json:"udptimeout"`
+	TUN              string `json:"tun"`
+	TUNAddr          string `json:"tunaddr"`
+	UpLimit          string `json:"uplimit"`
+	DownLimit        string `json:"downlimit"`
+	StreamLimit      string `json:"streamlimit"`
+	ClientLimit      string `json:"clientlimit"`
+	Quota            string `json:"quota"`
+	QuotaFile        string `json:"quotafile"`
+	MaxSessions      int    `json:"maxsessions"`
+	IdleTimeout      int    `json:"idletimeout"`
+	MaxStreams       int    `json:"maxstreams"`
+	StreamRate       int    `json:"streamrate"`
+	ACL              string `json:"acl"`
+	StreamACL        string `json:"streamacl"`
+	Targets          string `json:"targets"`
 
-func parseJSONConfig(config *Config, path string) error {
-	file, err := os.Open(path) // For read access.
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+	Listeners []Listener `json:"listeners"`
+}
 
-	return json.NewDecoder(file).Decode(config)
+// Listener serves the sessions of clients on an additional udp address, forwarding
+// their streams to a Target of its own
+type Listener struct {
+	Listen string `json:"listen"`
+	Target string `json:"target"`
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"net"
+	"runtime"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// checkConfig collects the problems of config, and if listen is set whether its listen
+// addresses can be listened on
+func checkConfig(config *Config, listen bool) generic.ConfigCheck {
+	var c generic.ConfigCheck
+	if config.PQKeyExchange && !config.KeyExchange {
+		c.Fail("pqkeyexchange", "pqkeyexchange needs keyexchange")
+	}
+	if config.ConnKey && config.Crypt == "null" {
+		c.Fail("connkey", "connkey needs a crypt other than null")
+	}
+	if config.ConnKey && config.Users != "" {
+		c.Fail("connkey", "connkey can't be used with users, whose packets are told apart by their keys")
+	}
+	if config.SmuxVer < 1 || config.SmuxVer > maxSmuxVer {
+		c.Fail("smuxver", "unsupported smux version:", config.SmuxVer)
+	} else {
+		c.Smux(config.SmuxVer, config.SmuxBuf, config.StreamBuf, config.KeepAlive, config.KeepAliveTimeout)
+	}
+	if config.Mux != generic.MuxSmux && config.Mux != generic.MuxYamux && config.Mux != generic.MuxNone {
+		c.Fail("mux", "unknown mux:", config.Mux)
+	}
+	if config.Mux == generic.MuxNone && (config.Dynamic || config.UDP || config.TUN != "" || config.Reverse != "") {
+		c.Fail("mux", "mux none can't be used with dynamic, udp, tun or reverse")
+	}
+	if config.SnmpFormat != generic.SnmpCSV && config.SnmpFormat != generic.SnmpJSON {
+		c.Fail("snmpformat", "unsupported snmpformat:", config.SnmpFormat)
+	}
+	if config.AutoFEC && (config.DataShard <= 0 || config.ParityShard <= 0) {
+		c.Fail("autofec", "autofec requires datashard and parityshard above 0")
+	}
+	if config.AutoFEC && (config.MinParity < 1 || config.MinParity > config.MaxParity) {
+		c.Fail("minparity", "invalid autofec bounds: minparity", config.MinParity, "maxparity", config.MaxParity)
+	}
+	if config.Wnd != "" && config.Wnd != "auto" {
+		c.Fail("wnd", "unsupported wnd:", config.Wnd)
+	}
+	if config.Wnd == "auto" && (config.MaxWnd < config.SndWnd || config.MaxWnd < config.RcvWnd) {
+		c.Fail("maxwnd", "maxwnd can't be below sndwnd or rcvwnd")
+	}
+	for field, rate := range map[string]string{"uplimit": config.UpLimit, "downlimit": config.DownLimit, "streamlimit": config.StreamLimit, "clientlimit": config.ClientLimit} {
+		if _, err := generic.ParseRate(rate); err != nil {
+			c.Fail(field, err)
+		}
+	}
+	if config.KeepAliveTimeout < config.KeepAlive {
+		c.Fail("keepalivetimeout", "keepalivetimeout can't be below keepalive")
+	}
+	if config.CopyBuf <= 0 {
+		c.Fail("copybuf", "copybuf must be positive")
+	}
+	if config.GOMAXPROCS < 0 {
+		c.Fail("gomaxprocs", "gomaxprocs can't be negative")
+	}
+	if config.ControlAddr != "" && config.ControlToken == "" && !generic.IsLoopbackAddr(config.ControlAddr) {
+		c.Fail("controladdr", "controladdr on a non-loopback address needs a controltoken")
+	}
+	if config.CPUs != "" {
+		if _, err := generic.ParseCPUList(config.CPUs); err != nil {
+			c.Fail("cpus", err)
+		}
+	}
+	if _, err := parseSize(config.Quota); err != nil {
+		c.Fail("quota", err)
+	}
+	if _, err := newClients(config.QuotaFile); err != nil {
+		c.Fail("quotafile", err)
+	}
+	if config.IdleTimeout < 0 {
+		c.Fail("idletimeout", "idletimeout can't be negative")
+	}
+	if config.MaxSessions < 0 || config.MaxStreams < 0 || config.StreamRate < 0 {
+		c.Fail("maxsessions", "maxsessions, maxstreams and streamrate can't be negative")
+	}
+	if _, err := generic.NewACL(config.ACL); err != nil {
+		c.Fail("acl", err)
+	}
+	if _, err := generic.NewACL(config.StreamACL); err != nil {
+		c.Fail("streamacl", err)
+	}
+	if config.StreamACL != "" && !config.Dynamic {
+		c.Fail("streamacl", "streamacl needs dynamic")
+	}
+	for _, target := range configTargets(config) {
+		if isTargetPool(target) {
+			if err := parseTargetPool(target); err != nil {
+				c.Fail("target", err)
+			}
+			if config.UDP {
+				c.Fail("target", "a target of several backends can't be used with udp:", target)
+			}
+		}
+	}
+	if config.Balance != balanceRoundRobin && config.Balance != balanceLeastConn {
+		c.Fail("balance", "balance must be roundrobin or leastconn:", config.Balance)
+	}
+	if config.HealthCheck < 0 {
+		c.Fail("healthcheck", "healthcheck can't be negative")
+	}
+	if err := new(targetList).set(config.Targets); err != nil {
+		c.Fail("targets", err)
+	}
+	if _, err := generic.ParseComp(config.Comp); err != nil {
+		c.Fail("comp", err)
+	}
+	if config.CompLevel < 0 || config.CompLevel > 9 {
+		c.Fail("complevel", "unsupported complevel:", config.CompLevel)
+	}
+	if generic.IsSystemd(config.Listen) && (config.TCP || config.Transport != "kcp") {
+		c.Fail("listen", "a listen socket passed by systemd can't be used with tcp or transport")
+	}
+	if config.TCP && runtime.GOOS != "linux" {
+		c.Fail("tcp", "tcp is only supported on linux, see icmp, transport and ws")
+	}
+	if config.FwMark < 0 || (config.FwMark != 0 && runtime.GOOS != "linux") {
+		c.Fail("fwmark", "fwmark must be positive and is only supported on linux")
+	}
+	if config.FwMark != 0 && (config.TCP || generic.IsPortRange(config.Listen)) {
+		c.Fail("fwmark", "fwmark can't be used with tcp or a port range")
+	}
+	if config.TUNAddr != "" {
+		if ip, _, err := net.ParseCIDR(config.TUNAddr); err != nil || ip.To4() == nil || config.TUN == "" {
+			c.Fail("tunaddr", "tunaddr must be an IPv4 address and prefix of a tun device:", config.TUNAddr)
+		}
+	}
+	if config.ProxyProtocol && !config.Dynamic {
+		c.Fail("proxyprotocol", "proxyprotocol needs dynamic")
+	}
+	if config.TUN != "" && (!config.Dynamic || runtime.GOOS != "linux") {
+		c.Fail("tun", "tun needs dynamic, and only on linux")
+	}
+	if config.ReusePort < 1 {
+		c.Fail("reuseport", "reuseport must be at least 1")
+	}
+	if config.ReusePort > 1 {
+		if generic.IsSystemd(config.Listen) || config.TCP {
+			c.Fail("reuseport", "reuseport can't be used with a systemd socket or tcp")
+		}
+		if generic.IsPortRange(config.Listen) {
+			c.Fail("reuseport", "reuseport can't be used with a port range")
+		}
+	}
+	if config.Migrate && (config.ReusePort > 1 || config.Reverse != "") {
+		c.Fail("migrate", "migrate can't be used with reuseport or reverse")
+	}
+	if config.P2P != "" && (config.TCP || config.Users != "" || config.Reverse != "" || config.Transport == "tcp" || config.Broker) {
+		c.Fail("p2p", "p2p can't be used with tcp, users, reverse, transport tcp or broker")
+	}
+	if config.ICMP && (config.Reverse != "" || generic.IsSystemd(config.Listen)) {
+		c.Fail("icmp", "icmp can't be used with reverse or a systemd socket")
+	}
+	if config.Broker && generic.IsPortRange(config.Listen) {
+		c.Fail("broker", "broker can't listen on a port range")
+	}
+	switch config.Transport {
+	case "kcp":
+	case "tcp", "both":
+		if config.TCP || config.Users != "" || config.Reverse != "" {
+			c.Fail("transport", "transport tcp and both can't be used with tcp, users or reverse")
+		}
+	default:
+		c.Fail("transport", "unsupported transport:", config.Transport)
+	}
+	if config.KeyFile != "" {
+		if _, err := generic.ReadKeyFile(config.KeyFile); err != nil {
+			c.Fail("keyfile", err)
+		}
+	}
+	if config.Cert != "" || config.CertKey != "" || config.CA != "" {
+		if config.Cert == "" || config.CertKey == "" || config.CA == "" {
+			c.Fail("cert", "cert, certkey and ca must be set together")
+		} else if _, err := generic.LoadCertAuth(config.Cert, config.CertKey, config.CA); err != nil {
+			c.Fail("cert", err)
+		}
+	}
+	if config.Stealth && !generic.IsAEAD(config.Crypt) {
+		c.Fail("stealth", "stealth requires aes-gcm, aes-gcm-siv or chacha20-poly1305, the other ciphers don't stop forged packets")
+	}
+	if config.Token < 0 {
+		c.Fail("token", "token can't be negative")
+	}
+	if config.AntiReplay > 0 && (config.Crypt == "null" || generic.IsAEAD(config.Crypt)) {
+		c.Fail("antireplay", "antireplay requires a cipher other than null, aes-gcm, aes-gcm-siv and chacha20-poly1305")
+	}
+	if config.Crypt == "aes-gcm-siv" && config.Rekey <= 0 {
+		c.Fail("rekey", "aes-gcm-siv requires rekey, its 4 bytes nonces don't last a long-lived key")
+	}
+	if config.Users != "" {
+		if _, err := loadUsers(config.Users); err != nil {
+			c.Fail("users", err)
+		}
+		if config.Crypt == "null" {
+			c.Fail("users", "multiple users require encryption")
+		}
+	}
+	for _, l := range config.Listeners {
+		if _, err := net.ResolveUDPAddr("udp", l.Listen); err != nil || l.Target == "" {
+			c.Fail("listeners", "listeners need a udp address and a target each:", l.Listen, l.Target)
+		}
+	}
+	if len(config.Listeners) > 0 && (config.Reverse != "" || config.P2P != "" || config.Broker || config.Transport == "tcp") {
+		c.Fail("listeners", "listeners can't be used with reverse, p2p, broker or transport tcp")
+	}
+	c.Transport(config.Crypt, config.Mode, config.MTU, config.SndWnd, config.RcvWnd, config.DataShard, config.ParityShard)
+
+	// nothing is listened on in reverse mode
+	if listen && config.Reverse == "" {
+		if config.Transport != "tcp" {
+			c.Listen("listen", "udp", config.Listen)
+		}
+		if config.Transport != "kcp" || config.TCP {
+			c.Listen("listen", "tcp", config.Listen)
+		}
+		if config.Stream != "" {
+			c.Listen("stream", "tcp", config.Stream)
+		}
+		if config.WS != "" {
+			c.Listen("ws", "tcp", config.WS)
+		}
+		for _, l := range config.Listeners {
+			c.Listen("listeners", "udp", l.Listen)
+		}
+	}
+	return c
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/generic"
+	"github.com/xtaci/tcpraw"
+)
+
+// ownedSession is a kcp session on a packet conn created for it alone, which kcp-go
+// leaves open when the session is closed
+type ownedSession struct {
+	*kcp.UDPSession
+	conn net.PacketConn
+}
+
+func (s *ownedSession) Close() error {
+	err := s.UDPSession.Close()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return err
+}
+
+// dial connects to a kcp client started with -reverse, pass is the key tokens are under
+func dial(remote string, config *Config, block kcp.BlockCrypt, pass []byte) (*ownedSession, error) {
+	if config.ConnKey && block != nil {
+		block = generic.NewConnKeyBlockCrypt(block)
+	}
+	var conn net.PacketConn
+	if config.TCP {
+		tcpconn, err := tcpraw.Dial("tcp", remote)
+		if err != nil {
+			return nil, errors.Wrap(err, "tcpraw.Dial()")
+		}
+		conn = tcpconn
+	} else if config.Padding || config.Token > 0 || config.FwMark != 0 {
+		lc := net.ListenConfig{Control: generic.SocketControl("", config.FwMark)}
+		udpconn, err := lc.ListenPacket(context.Background(), "udp", "")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		conn = udpconn
+	}
+
+	var sess *kcp.UDPSession
+	var err error
+	if conn != nil {
+		if config.Token > 0 {
+			// the tokens are bound to the ip of the dialing side, this one
+			raddr, err := net.ResolveUDPAddr("udp", remote)
+			if err != nil {
+				conn.Close()
+				return nil, errors.WithStack(err)
+			}
+			conn = generic.NewTokenConn(conn, [][]byte{pass}, time.Duration(config.Token)*time.Second, func() net.IP {
+				return generic.RouteIP(raddr)
+			})
+		}
+		if config.Padding {
+			conn = generic.NewPaddingConn(conn)
+		}
+		if sess, err = kcp.NewConn(remote, block, config.DataShard, config.ParityShard, conn); err != nil {
+			conn.Close()
+		}
+	} else {
+		sess, err = kcp.DialWithOptions(remote, block, config.DataShard, config.ParityShard)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "dial()")
+	}
+
+	if err := sess.SetDSCP(config.DSCP); err != nil {
+		log.Println("SetDSCP:", err)
+	}
+	if err := sess.SetReadBuffer(config.SockBuf); err != nil {
+		log.Println("SetReadBuffer:", err)
+	}
+	if err := sess.SetWriteBuffer(config.SockBuf); err != nil {
+		log.Println("SetWriteBuffer:", err)
+	}
+	return &ownedSession{sess, conn}, nil
+}
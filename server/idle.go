@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// the longest between two looks at a session for -idletimeout
+const maxIdleCheck = 10 * time.Second
+
+// activity tracks when the streams of a session last carried data
+type activity struct {
+	last int64 // unix nanoseconds
+	held int32 // streams keeping the session active whatever they carry, like tun ones
+}
+
+func newActivity() *activity {
+	return &activity{last: time.Now().UnixNano()}
+}
+
+// touch records data carried now
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// hold keeps the session active until the function returned is called
+func (a *activity) hold() func() {
+	atomic.AddInt32(&a.held, 1)
+	return func() {
+		a.touch()
+		atomic.AddInt32(&a.held, -1)
+	}
+}
+
+// idle returns how long the session has carried no data, 0 while held
+func (a *activity) idle() time.Duration {
+	if atomic.LoadInt32(&a.held) > 0 {
+		return 0
+	}
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&a.last))
+}
+
+// activeConn touches an activity on every read and write of a target
+type activeConn struct {
+	net.Conn
+	act *activity
+}
+
+func (c *activeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.act.touch()
+	}
+	return n, err
+}
+
+func (c *activeConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.act.touch()
+	}
+	return n, err
+}
+
+// reapIdle closes mux once its streams have carried no data for timeout, keepalives
+// aside, reclaiming the sessions of clients gone quiet or without closing them
+func reapIdle(mux generic.Mux, act *activity, timeout time.Duration) {
+	interval := timeout / 4
+	if interval > maxIdleCheck {
+		interval = maxIdleCheck
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if mux.IsClosed() {
+			return
+		}
+		if idle := act.idle(); idle >= timeout {
+			generic.LogEvent("idle session closed", "remote", mux.RemoteAddr(), "idle", idle.Round(time.Second))
+			mux.Close()
+			return
+		}
+	}
+}
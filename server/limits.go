@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// acceptLimiter caps the streams accepted each second, across all sessions
+type acceptLimiter struct {
+	mu     sync.Mutex
+	rate   int // 0 is unlimited
+	second int64
+	count  int
+}
+
+// set changes the streams accepted each second to rate
+func (l *acceptLimiter) set(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+}
+
+// allow reports whether another stream may be accepted in this second
+func (l *acceptLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	if now := time.Now().Unix(); now != l.second {
+		l.second, l.count = now, 0
+	}
+	if l.count >= l.rate {
+		return false
+	}
+	l.count++
+	return true
+}
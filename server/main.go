@@ -1,8 +1,8 @@
 package main
 
 import (
-	"crypto/sha1"
-	"fmt"
+	"crypto/tls"
+	"encoding/binary"
 	"io"
 	"log"
 	"math/rand"
@@ -10,15 +10,13 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"bufio"
-	"strings"
 	"strconv"
-	"syscall"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/crypto/pbkdf2"
-
+	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	kcp "github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/kcptun/generic"
@@ -27,26 +25,70 @@ import (
 )
 
 const (
-	// SALT is use for pbkdf2 key expansion
+	// SALT is the default salt for key derivation
 	SALT = "kcp-go"
 	// maximum supported smux version
 	maxSmuxVer = 2
-	// stream copy buffer size
-	bufSize = 4096
+	// how long a client may take to announce the destination of a stream
+	handshakeTimeout = 30 * time.Second
+	// how long a benchmark stream may last
+	benchTimeout = 10 * time.Minute
+	// period of reporting the bytes of a benchmark upload received
+	benchReport = 250 * time.Millisecond
 )
 
 // VERSION is injected by buildflags
 //var VERSION = "SELFBUILD"
 var VERSION = "KOOLCABUILD"
 
-// handle multiplex-ed connection
-func handleMux(conn net.Conn, config *Config) {
-	// check if target is unix domain socket
-	var isUnix bool
-	if _, _, err := net.SplitHostPort(config.Target); err != nil {
-		isUnix = true
+// bandwidth limits the streams relayed
+var bandwidth = generic.NewBandwidth()
+
+// clientLimits limits the bandwidth and traffic of each client
+var clientLimits *clients
+
+// streamAccepts limits the streams accepted each second
+var streamAccepts acceptLimiter
+
+// sourceACL filters the sources of packets and connections accepted
+var sourceACL *generic.ACL
+
+// streamACL filters the sources clients in dynamic mode announce for their streams
+var streamACL *generic.ACL
+
+// allowedTargets restricts the destinations of clients in dynamic mode
+var allowedTargets targetList
+
+// targetPools balance the streams to the targets listing several backends
+var targetPools backendPools
+
+// deriveKey expands a pre-shared secret to the key for block ciphers
+func deriveKey(config *Config, key string) ([]byte, error) {
+	return generic.DeriveKey(config.KDF, key, config.Salt, config.KDFIter, config.KDFMem)
+}
+
+// newBlockCrypt creates the packet cipher of config, rekeyed periodically if enabled
+func newBlockCrypt(config *Config, pass []byte) kcp.BlockCrypt {
+	block, crypt := generic.NewBlockCrypt(config.Crypt, pass)
+	config.Crypt = crypt
+	if block != nil && config.Rekey > 0 {
+		block = generic.NewRekeyBlockCrypt(crypt, pass, time.Duration(config.Rekey)*time.Second)
 	}
-	log.Println("smux version:", config.SmuxVer, "on connection:", conn.LocalAddr(), "->", conn.RemoteAddr())
+	return block
+}
+
+// replayGuard drops replayed packets before they reach the kcp sessions, it is applied
+// per listener as the trial decryption of multiple users must not mark nonces as seen
+func replayGuard(config *Config, block kcp.BlockCrypt) kcp.BlockCrypt {
+	if config.AntiReplay <= 0 {
+		return block
+	}
+	return generic.NewReplayBlockCrypt(block, time.Duration(config.AntiReplay)*time.Second)
+}
+
+// newMux creates the stream multiplexer on an accepted connection
+func newMux(conn net.Conn, config *Config) (generic.Mux, error) {
+	log.Println("smux version:", config.SmuxVer, "mux:", config.Mux, "on connection:", conn.LocalAddr(), "->", conn.RemoteAddr())
 
 	// stream multiplex
 	smuxConfig := smux.DefaultConfig()
@@ -54,11 +96,22 @@ func handleMux(conn net.Conn, config *Config) {
 	smuxConfig.MaxReceiveBuffer = config.SmuxBuf
 	smuxConfig.MaxStreamBuffer = config.StreamBuf
 	smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
+	smuxConfig.KeepAliveTimeout = time.Duration(config.KeepAliveTimeout) * time.Second
+	return generic.NewMux(conn, config.Mux, smuxConfig, false)
+}
 
-	mux, err := smux.Server(conn, smuxConfig)
-	if err != nil {
-		log.Println(err)
-		return
+// handle multiplex-ed connection of the client name, counting its streams in streams
+func handleMux(mux generic.Mux, config *Config, name string, act *activity, streams *uint64) {
+	// check if target is unix domain socket
+	network, target := "tcp", config.Target
+	if config.UDP {
+		network = "udp"
+	} else if isTargetPool(target) {
+		// the backends are dialed by the pool
+	} else if strings.HasPrefix(target, "unix:") {
+		network, target = "unix", strings.TrimPrefix(target, "unix:")
+	} else if _, _, err := net.SplitHostPort(target); err != nil {
+		network = "unix"
 	}
 	defer mux.Close()
 
@@ -69,51 +122,301 @@ func handleMux(conn net.Conn, config *Config) {
 			return
 		}
 
-		go func(p1 *smux.Stream) {
+		if config.MaxStreams > 0 && mux.NumStreams() > config.MaxStreams {
+			rejectStream(stream, config, "maxstreams reached")
+			continue
+		}
+		if !streamAccepts.allow() {
+			rejectStream(stream, config, "streamrate reached")
+			continue
+		}
+		act.touch()
+		atomic.AddUint64(streams, 1)
+
+		go func(p1 generic.Stream) {
+			span := generic.StartSpan("stream", nil, "in", p1.RemoteAddr(), "stream", p1.ID())
+			defer span.End()
+
+			var cl *client
 			var p2 net.Conn
 			var err error
-			if !isUnix {
-				p2, err = net.Dial("tcp", config.Target)
-			} else {
-				p2, err = net.Dial("unix", config.Target)
+			network, target := network, target
+			var source string
+			if config.Dynamic {
+				hdr, err := readHeader(p1)
+				if err != nil {
+					span.SetError(err)
+					log.Println("dynamic:", err)
+					p1.Close()
+					return
+				}
+				switch hdr.network {
+				case "echo":
+					handleEcho(p1)
+					return
+				case "bench":
+					defer act.hold()()
+					handleBench(p1, hdr.Addr)
+					return
+				case "tun":
+					defer act.hold()()
+					handleTUN(p1, config)
+					return
+				}
+				if source = hdr.Source; source != "" {
+					span.SetAttr("source", source)
+				}
+				// an empty address stands for the configured target
+				if hdr.Addr != "" || hdr.network != "tcp" {
+					network, target = hdr.network, hdr.Addr
+				}
+			}
+			if target != config.Target {
+				target, err = allowedTargets.resolve(target)
+			}
+			if err == nil && !streamACL.Allowed(sourceAddr(source)) {
+				err = errors.Errorf("source denied by streamacl: %v", source)
+			}
+			if err == nil && clientLimits.enabled() {
+				cl = clientLimits.client(name)
+				if !clientLimits.allowed(cl) {
+					err = errQuotaExceeded
+				}
+			}
+			if err == nil {
+				dial := generic.StartSpan("dial", span, "network", network, "target", target)
+				if pool := targetPools.get(target); pool != nil {
+					var b *backend
+					if p2, b, err = pool.dial(); err == nil {
+						defer pool.release(b)
+					}
+				} else {
+					p2, err = net.Dial(network, target)
+				}
+				dial.SetError(err)
+				dial.End()
+			}
+			if err == nil && network == "tcp" && config.ProxyProtocol {
+				if err = writeProxyHeader(p2, source); err != nil {
+					p2.Close()
+				}
+			}
+			if config.Dynamic {
+				status := generic.StatusOK
+				if err != nil {
+					status = generic.StatusFailed
+				}
+				p1.Write([]byte{status})
 			}
-
 			if err != nil {
+				span.SetError(err)
 				log.Println(err)
 				p1.Close()
 				return
 			}
-			handleClient(p1, p2, config.Quiet)
+
+			if config.IdleTimeout > 0 {
+				p2 = &activeConn{Conn: p2, act: act}
+			}
+			if network == "udp" {
+				handleDatagrams(p1, p2, config)
+			} else {
+				handleClient(p1, p2, cl, source, span, config.Quiet)
+			}
 		}(stream)
 	}
 }
 
-func handleClient(p1 *smux.Stream, p2 net.Conn, quiet bool) {
-	logln := func(v ...interface{}) {
+// sourceAddr parses the source a client accepted a stream from, without an IP if it
+// announced none
+func sourceAddr(source string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(source)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	n, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: n}
+}
+
+// writeProxyHeader tells the tcp target p2 about the source a client accepted the
+// stream from, or that it is unknown for the clients predating stream header version 2
+func writeProxyHeader(p2 net.Conn, source string) error {
+	src := sourceAddr(source)
+	if src.IP == nil {
+		src = nil
+	}
+	dst, _ := p2.RemoteAddr().(*net.TCPAddr)
+	p2.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	defer p2.SetWriteDeadline(time.Time{})
+	return generic.WriteProxyHeader(p2, src, dst)
+}
+
+// rejectStream closes an accepted stream, telling a client in dynamic mode it failed
+// rather than letting it wait for the header to be read
+func rejectStream(p1 generic.Stream, config *Config, reason string) {
+	if !config.Quiet {
+		log.Println(reason+", rejecting stream", "in:", p1.RemoteAddr(), "stream:", p1.ID())
+	}
+	if config.Dynamic {
+		p1.SetWriteDeadline(time.Now().Add(time.Second))
+		p1.Write([]byte{generic.StatusFailed})
+	}
+	p1.Close()
+}
+
+// destination is a stream header with the network name to dial
+type destination struct {
+	*generic.StreamHeader
+	network string
+}
+
+// readHeader reads the destination announced by the client in dynamic mode
+func readHeader(p1 generic.Stream) (*destination, error) {
+	p1.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer p1.SetReadDeadline(time.Time{})
+	hdr, err := generic.ReadHeader(p1)
+	if err != nil {
+		return nil, err
+	}
+	switch hdr.Network {
+	case generic.NetTCP:
+		return &destination{hdr, "tcp"}, nil
+	case generic.NetUDP:
+		return &destination{hdr, "udp"}, nil
+	case generic.NetEcho:
+		return &destination{hdr, "echo"}, nil
+	case generic.NetBench:
+		return &destination{hdr, "bench"}, nil
+	case generic.NetTUN:
+		return &destination{hdr, "tun"}, nil
+	}
+	p1.Write([]byte{generic.StatusFailed})
+	return nil, errors.Errorf("unsupported network: %v", hdr.Network)
+}
+
+// handleEcho sends back what the client writes on p1, for its health checks
+func handleEcho(p1 generic.Stream) {
+	defer p1.Close()
+	p1.SetDeadline(time.Now().Add(handshakeTimeout))
+	if _, err := p1.Write([]byte{generic.StatusOK}); err != nil {
+		return
+	}
+	generic.Copy(p1, p1)
+}
+
+// handleBench serves a benchmark of the client on p1, discarding the upload and
+// reporting the bytes received every benchReport as 8 bytes big endian, or sending
+// a download until the client closes the stream
+func handleBench(p1 generic.Stream, direction string) {
+	defer p1.Close()
+	p1.SetDeadline(time.Now().Add(benchTimeout))
+	status := generic.StatusOK
+	if direction != "up" && direction != "down" {
+		status = generic.StatusFailed
+	}
+	if _, err := p1.Write([]byte{status}); err != nil || status != generic.StatusOK {
+		return
+	}
+
+	if direction == "down" {
+		buf := make([]byte, 32768)
+		rand.Read(buf)
+		for {
+			if _, err := p1.Write(buf); err != nil {
+				return
+			}
+		}
+	}
+
+	var received uint64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 32768)
+		for {
+			n, err := p1.Read(buf)
+			atomic.AddUint64(&received, uint64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(benchReport)
+	defer ticker.Stop()
+	var report [8]byte
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			binary.BigEndian.PutUint64(report[:], atomic.LoadUint64(&received))
+			if _, err := p1.Write(report[:]); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleDatagrams relays the length prefixed datagrams on p1 to the udp target p2
+func handleDatagrams(p1 generic.Stream, p2 net.Conn, config *Config) {
+	if !config.Quiet {
+		generic.LogEvent("udp stream opened", "in", p1.RemoteAddr(), "stream", p1.ID(), "out", p2.RemoteAddr())
+		defer generic.LogEvent("udp stream closed", "in", p1.RemoteAddr(), "stream", p1.ID(), "out", p2.RemoteAddr())
+	}
+	generic.RelayDatagrams(p1, p2, time.Duration(config.UDPTimeout)*time.Second)
+}
+
+// handleClient copies between stream p1 and target p2 until either side closes, within
+// the limits of client cl if not nil, traced as a child of span. source is where the
+// client accepted the stream from, if it told.
+func handleClient(p1 generic.Stream, p2 net.Conn, cl *client, source string, span *generic.Span, quiet bool) {
+	logEvent := func(msg string, fields ...interface{}) {
 		if !quiet {
-			log.Println(v...)
+			head := []interface{}{"in", p1.RemoteAddr(), "stream", p1.ID(), "out", p2.RemoteAddr()}
+			if source != "" {
+				head = append(head, "source", source)
+			}
+			generic.LogEvent(msg, append(head, fields...)...)
 		}
 	}
 
 	defer p1.Close()
 	defer p2.Close()
 
-	logln("stream opened", "in:", fmt.Sprint(p1.RemoteAddr(), "(", p1.ID(), ")"), "out:", p2.RemoteAddr())
-	defer logln("stream closed", "in:", fmt.Sprint(p1.RemoteAddr(), "(", p1.ID(), ")"), "out:", p2.RemoteAddr())
+	logEvent("stream opened")
+	start := time.Now()
+	copying := generic.StartSpan("copy", span)
 
 	// start tunnel & wait for tunnel termination
-	streamCopy := func(dst io.Writer, src io.ReadCloser) {
-		if _, err := generic.Copy(dst, src); err != nil {
+	streamCopy := func(dst io.Writer, src io.ReadCloser) int64 {
+		n, err := generic.Copy(dst, src)
+		if err != nil {
 			if err == smux.ErrInvalidProtocol {
-				log.Println("smux", err, "in:", fmt.Sprint(p1.RemoteAddr(), "(", p1.ID(), ")"), "out:", p2.RemoteAddr())
+				generic.LogEvent("smux error", "error", err, "in", p1.RemoteAddr(), "stream", p1.ID(), "out", p2.RemoteAddr())
 			}
 		}
 		p1.Close()
 		p2.Close()
+		return n
+	}
+
+	var upWriter, downWriter io.Writer
+	if cl != nil {
+		upWriter, downWriter = bandwidth.Limit(p2, p1, cl.bandwidth)
+		upWriter, downWriter = clientLimits.limit(cl, upWriter, downWriter)
+	} else {
+		upWriter, downWriter = bandwidth.Limit(p2, p1)
 	}
+	chUp := make(chan int64, 1)
+	go func() { chUp <- streamCopy(upWriter, p1) }()
+	down := streamCopy(downWriter, p2)
+	up := <-chUp
 
-	go streamCopy(p2, p1)
-	streamCopy(p1, p2)
+	duration := time.Since(start)
+	generic.RecordStream(up, down, duration)
+	copying.SetAttr("up", up, "down", down)
+	copying.End()
+	logEvent("stream closed", "up", up, "down", down, "duration", duration.Round(time.Millisecond))
 }
 
 func checkError(err error) {
@@ -136,14 +439,28 @@ func main() {
 	myApp.Version = VERSION
 	myApp.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "listen,l",
-			Value: ":29900",
-			Usage: "kcp server listen address",
+			Name:   "listen,l",
+			Value:  ":29900",
+			Usage:  "kcp server listen address, or a port range like :4000-5000 for clients hopping between its ports, or systemd:[name] for a udp socket passed by systemd",
+			EnvVar: "KCPTUN_LISTEN",
 		},
 		cli.StringFlag{
-			Name:  "target, t",
-			Value: "127.0.0.1:12948",
-			Usage: "target server address, or path/to/unix_socket",
+			Name:   "target, t",
+			Value:  "127.0.0.1:12948",
+			Usage:  "target server address, or path/to/unix_socket, or unix:path/to/unix_socket, or several addresses separated by commas to balance the streams over",
+			EnvVar: "KCPTUN_TARGET",
+		},
+		cli.StringFlag{
+			Name:   "balance",
+			Value:  "roundrobin",
+			Usage:  "how the streams are spread over the addresses of a target: roundrobin, leastconn",
+			EnvVar: "KCPTUN_BALANCE",
+		},
+		cli.IntFlag{
+			Name:   "healthcheck",
+			Value:  10,
+			Usage:  "seconds between tcp health checks of the addresses of a target, skipping the ones down, 0 to only find them down by failing streams",
+			EnvVar: "KCPTUN_HEALTHCHECK",
 		},
 		cli.StringFlag{
 			Name:   "key",
@@ -152,265 +469,1023 @@ func main() {
 			EnvVar: "KCPTUN_KEY",
 		},
 		cli.StringFlag{
-			Name:  "crypt",
-			Value: "aes",
-			Usage: "aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none, null",
+			Name:   "keyfile",
+			Value:  "",
+			Usage:  "read the pre-shared secret from this file instead of key, - for stdin, fd:N for file descriptor N",
+			EnvVar: "KCPTUN_KEYFILE",
+		},
+		cli.StringFlag{
+			Name:   "crypt",
+			Value:  "aes",
+			Usage:  "aes, aes-128, aes-192, aes-gcm, aes-gcm-siv, chacha20-poly1305, xchacha20, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none, null",
+			EnvVar: "KCPTUN_CRYPT",
 		},
 		cli.StringFlag{
-			Name:  "mode",
-			Value: "fast",
-			Usage: "profiles: fast3, fast2, fast, normal, manual",
+			Name:   "users",
+			Value:  "",
+			Usage:  "accept the named keys in this json or csv file instead of key, sessions are tagged with the user",
+			EnvVar: "KCPTUN_USERS",
+		},
+		cli.StringFlag{
+			Name:   "kdf",
+			Value:  "pbkdf2",
+			Usage:  "key derivation function: pbkdf2, argon2id",
+			EnvVar: "KCPTUN_KDF",
+		},
+		cli.StringFlag{
+			Name:   "salt",
+			Value:  SALT,
+			Usage:  "salt for key derivation",
+			EnvVar: "KCPTUN_SALT",
 		},
 		cli.IntFlag{
-			Name:  "mtu",
-			Value: 1350,
-			Usage: "set maximum transmission unit for UDP packets",
+			Name:   "kdfiter",
+			Value:  0,
+			Usage:  "iterations of pbkdf2 or passes of argon2id, 0 for the defaults 4096 and 3",
+			EnvVar: "KCPTUN_KDFITER",
 		},
 		cli.IntFlag{
-			Name:  "sndwnd",
-			Value: 1024,
-			Usage: "set send window size(num of packets)",
+			Name:   "kdfmem",
+			Value:  65536,
+			Usage:  "memory cost of argon2id in KiB",
+			EnvVar: "KCPTUN_KDFMEM",
 		},
 		cli.IntFlag{
-			Name:  "rcvwnd",
-			Value: 1024,
-			Usage: "set receive window size(num of packets)",
+			Name:   "rekey",
+			Value:  0,
+			Usage:  "derive a fresh sub-key from the key every N seconds, needs clocks in sync, 0 to disable",
+			EnvVar: "KCPTUN_REKEY",
 		},
 		cli.IntFlag{
-			Name:  "datashard,ds",
-			Value: 10,
-			Usage: "set reed-solomon erasure coding - datashard",
+			Name:   "antireplay",
+			Value:  0,
+			Usage:  "drop packets older than N seconds or seen before, needs clocks in sync and a non-aead cipher, remembers about a million packets per 2N seconds, 0 to disable",
+			EnvVar: "KCPTUN_ANTIREPLAY",
 		},
 		cli.IntFlag{
-			Name:  "parityshard,ps",
-			Value: 3,
-			Usage: "set reed-solomon erasure coding - parityshard",
+			Name:   "token",
+			Value:  0,
+			Usage:  "prefix the first packets to a peer with a token of the key and the client ip valid for N seconds, and drop the packets of peers without one before decrypting them, needs clocks in sync, 0 to disable",
+			EnvVar: "KCPTUN_TOKEN",
+		},
+		cli.BoolFlag{
+			Name:   "migrate",
+			Usage:  "let sessions of clients with migrate move to another address, for udp",
+			EnvVar: "KCPTUN_MIGRATE",
+		},
+		cli.BoolFlag{
+			Name:   "keyexchange",
+			Usage:  "encrypt each session with a key of its own from an ecdh exchange authenticated by the key, for forward secrecy",
+			EnvVar: "KCPTUN_KEYEXCHANGE",
+		},
+		cli.BoolFlag{
+			Name:   "pqkeyexchange",
+			Usage:  "with keyexchange, exchange the keys on x25519 and ml-kem-768 together, against quantum computers decrypting recorded traffic later",
+			EnvVar: "KCPTUN_PQKEYEXCHANGE",
+		},
+		cli.BoolFlag{
+			Name:   "connkey",
+			Usage:  "encrypt the packets of each kcp connection with a key of its own, derived from nonces exchanged by both sides",
+			EnvVar: "KCPTUN_CONNKEY",
+		},
+		cli.StringFlag{
+			Name:   "cert",
+			Value:  "",
+			Usage:  "certificate file presented to the peer in a tls handshake on each session, requires certkey and ca",
+			EnvVar: "KCPTUN_CERT",
+		},
+		cli.StringFlag{
+			Name:   "certkey",
+			Value:  "",
+			Usage:  "private key file of cert",
+			EnvVar: "KCPTUN_CERTKEY",
+		},
+		cli.StringFlag{
+			Name:   "ca",
+			Value:  "",
+			Usage:  "ca file the certificate of the peer must be signed by, sessions without one are rejected",
+			EnvVar: "KCPTUN_CA",
+		},
+		cli.BoolFlag{
+			Name:   "stealth",
+			Usage:  "never answer peers before they have proven the key, needs aes-gcm, aes-gcm-siv or chacha20-poly1305",
+			EnvVar: "KCPTUN_STEALTH",
+		},
+		cli.StringFlag{
+			Name:   "mode",
+			Value:  "fast",
+			Usage:  "profiles: fast3, fast2, fast, normal, manual, or auto to switch between the first four by the loss and rtt",
+			EnvVar: "KCPTUN_MODE",
 		},
 		cli.IntFlag{
-			Name:  "dscp",
-			Value: 0,
-			Usage: "set DSCP(6bit)",
+			Name:   "mtu",
+			Value:  1350,
+			Usage:  "set maximum transmission unit for UDP packets",
+			EnvVar: "KCPTUN_MTU",
+		},
+		cli.IntFlag{
+			Name:   "sndwnd",
+			Value:  1024,
+			Usage:  "set send window size(num of packets)",
+			EnvVar: "KCPTUN_SNDWND",
+		},
+		cli.IntFlag{
+			Name:   "rcvwnd",
+			Value:  1024,
+			Usage:  "set receive window size(num of packets)",
+			EnvVar: "KCPTUN_RCVWND",
+		},
+		cli.StringFlag{
+			Name:   "wnd",
+			Value:  "",
+			Usage:  "auto to size the windows of each session to its bandwidth-delay product, with sndwnd and rcvwnd the least",
+			EnvVar: "KCPTUN_WND",
+		},
+		cli.IntFlag{
+			Name:   "maxwnd",
+			Value:  8192,
+			Usage:  "the largest window(num of packets) of -wnd auto",
+			EnvVar: "KCPTUN_MAXWND",
+		},
+		cli.IntFlag{
+			Name:   "datashard,ds",
+			Value:  10,
+			Usage:  "set reed-solomon erasure coding - datashard",
+			EnvVar: "KCPTUN_DATASHARD",
+		},
+		cli.IntFlag{
+			Name:   "parityshard,ps",
+			Value:  3,
+			Usage:  "set reed-solomon erasure coding - parityshard",
+			EnvVar: "KCPTUN_PARITYSHARD",
 		},
 		cli.BoolFlag{
-			Name:  "nocomp",
-			Usage: "disable compression",
+			Name:   "autofec",
+			Usage:  "adjust parityshard to the packet loss observed, between minparity and maxparity",
+			EnvVar: "KCPTUN_AUTOFEC",
+		},
+		cli.IntFlag{
+			Name:   "minparity",
+			Value:  1,
+			Usage:  "the fewest parity shards autofec lowers to",
+			EnvVar: "KCPTUN_MINPARITY",
+		},
+		cli.IntFlag{
+			Name:   "maxparity",
+			Value:  10,
+			Usage:  "the most parity shards autofec raises to",
+			EnvVar: "KCPTUN_MAXPARITY",
+		},
+		cli.IntFlag{
+			Name:   "dscp",
+			Value:  0,
+			Usage:  "set DSCP(6bit)",
+			EnvVar: "KCPTUN_DSCP",
+		},
+		cli.IntFlag{
+			Name:   "fwmark",
+			Value:  0,
+			Usage:  "set SO_MARK on the udp sockets for policy routing and firewall rules (linux), needs root or CAP_NET_ADMIN, 0 to disable",
+			EnvVar: "KCPTUN_FWMARK",
+		},
+		cli.StringFlag{
+			Name:   "comp",
+			Value:  "snappy",
+			Usage:  "compression of the sessions dialed in reverse mode: snappy, deflate, lz4, zstd or none, accepted sessions use the codec of the client",
+			EnvVar: "KCPTUN_COMP",
+		},
+		cli.IntFlag{
+			Name:   "complevel",
+			Value:  0,
+			Usage:  "deflate or zstd compression level 1-9, 0 for the default",
+			EnvVar: "KCPTUN_COMPLEVEL",
+		},
+		cli.IntFlag{
+			Name:   "compthreshold",
+			Value:  0,
+			Usage:  "send writes shorter than this many bytes uncompressed, sparing small interactive packets the compression latency",
+			EnvVar: "KCPTUN_COMPTHRESHOLD",
+		},
+		cli.BoolFlag{
+			Name:   "compadaptive",
+			Usage:  "send streams uncompressed whose first 64KB didn't compress, like https or video",
+			EnvVar: "KCPTUN_COMPADAPTIVE",
+		},
+		cli.BoolFlag{
+			Name:   "nocomp",
+			Usage:  "disable compression, same as -comp none",
+			EnvVar: "KCPTUN_NOCOMP",
 		},
 		cli.BoolFlag{
 			Name:   "acknodelay",
 			Usage:  "flush ack immediately when a packet is received",
 			Hidden: true,
+			EnvVar: "KCPTUN_ACKNODELAY",
 		},
 		cli.IntFlag{
 			Name:   "nodelay",
 			Value:  0,
 			Hidden: true,
+			EnvVar: "KCPTUN_NODELAY",
 		},
 		cli.IntFlag{
 			Name:   "interval",
 			Value:  50,
 			Hidden: true,
+			EnvVar: "KCPTUN_INTERVAL",
 		},
 		cli.IntFlag{
 			Name:   "resend",
 			Value:  0,
 			Hidden: true,
+			EnvVar: "KCPTUN_RESEND",
 		},
 		cli.IntFlag{
 			Name:   "nc",
 			Value:  0,
 			Hidden: true,
+			EnvVar: "KCPTUN_NC",
+		},
+		cli.IntFlag{
+			Name:   "sockbuf",
+			Value:  4194304, // socket buffer size in bytes
+			Usage:  "per-socket buffer in bytes",
+			EnvVar: "KCPTUN_SOCKBUF",
+		},
+		cli.BoolFlag{
+			Name:   "nooffload",
+			Usage:  "disable udp segmentation and receive offload(linux)",
+			EnvVar: "KCPTUN_NOOFFLOAD",
+		},
+		cli.IntFlag{
+			Name:   "reuseport",
+			Value:  1,
+			Usage:  "listen on this many udp sockets with SO_REUSEPORT, each read on its own goroutine(linux)",
+			EnvVar: "KCPTUN_REUSEPORT",
+		},
+		cli.IntFlag{
+			Name:   "gomaxprocs",
+			Value:  0,
+			Usage:  "run goroutines on this many threads at once, 0 for the number of cpus",
+			EnvVar: "KCPTUN_GOMAXPROCS",
+		},
+		cli.StringFlag{
+			Name:   "cpus",
+			Value:  "",
+			Usage:  "pin the process to a list of cpus like 0-3,6(linux)",
+			EnvVar: "KCPTUN_CPUS",
+		},
+		cli.IntFlag{
+			Name:   "smuxver",
+			Value:  1,
+			Usage:  "specify smux version, available 1,2",
+			EnvVar: "KCPTUN_SMUXVER",
+		},
+		cli.StringFlag{
+			Name:   "mux",
+			Value:  generic.MuxSmux,
+			Usage:  "stream multiplexer, smux, yamux or none for a kcp connection per tcp connection, yamux takes the keepalive and streambuf settings too",
+			EnvVar: "KCPTUN_MUX",
 		},
 		cli.IntFlag{
-			Name:  "sockbuf",
-			Value: 4194304, // socket buffer size in bytes
-			Usage: "per-socket buffer in bytes",
+			Name:   "smuxbuf",
+			Value:  4194304,
+			Usage:  "the overall de-mux buffer in bytes",
+			EnvVar: "KCPTUN_SMUXBUF",
 		},
 		cli.IntFlag{
-			Name:  "smuxver",
-			Value: 1,
-			Usage: "specify smux version, available 1,2",
+			Name:   "streambuf",
+			Value:  2097152,
+			Usage:  "per stream receive buffer in bytes, smux v2+",
+			EnvVar: "KCPTUN_STREAMBUF",
 		},
 		cli.IntFlag{
-			Name:  "smuxbuf",
-			Value: 4194304,
-			Usage: "the overall de-mux buffer in bytes",
+			Name:   "copybuf",
+			Value:  generic.DefaultCopyBuffer,
+			Usage:  "buffer in bytes of each copy between a connection and a stream, pooled among streams",
+			EnvVar: "KCPTUN_COPYBUF",
 		},
 		cli.IntFlag{
-			Name:  "streambuf",
-			Value: 2097152,
-			Usage: "per stream receive buffer in bytes, smux v2+",
+			Name:   "keepalive",
+			Value:  10, // nat keepalive interval in seconds
+			Usage:  "seconds between heartbeats",
+			EnvVar: "KCPTUN_KEEPALIVE",
 		},
 		cli.IntFlag{
-			Name:  "keepalive",
-			Value: 10, // nat keepalive interval in seconds
-			Usage: "seconds between heartbeats",
+			Name:   "keepalivetimeout",
+			Value:  30,
+			Usage:  "seconds without hearing from the peer before a session is closed as dead",
+			EnvVar: "KCPTUN_KEEPALIVETIMEOUT",
 		},
 		cli.StringFlag{
-			Name:  "snmplog",
-			Value: "",
-			Usage: "collect snmp to file, aware of timeformat in golang, like: ./snmp-20060102.log",
+			Name:   "snmplog",
+			Value:  "",
+			Usage:  "collect snmp to file, aware of timeformat in golang, like: ./snmp-20060102.log",
+			EnvVar: "KCPTUN_SNMPLOG",
 		},
 		cli.IntFlag{
-			Name:  "snmpperiod",
-			Value: 60,
-			Usage: "snmp collect period, in seconds",
+			Name:   "snmpperiod",
+			Value:  60,
+			Usage:  "snmp collect period, in seconds",
+			EnvVar: "KCPTUN_SNMPPERIOD",
+		},
+		cli.StringFlag{
+			Name:   "snmpformat",
+			Value:  "csv",
+			Usage:  "snmp log format, csv with a header row or json lines",
+			EnvVar: "KCPTUN_SNMPFORMAT",
+		},
+		cli.BoolFlag{
+			Name:   "snmpreset",
+			Usage:  "reset the snmp counters after each period, to log deltas instead of totals",
+			EnvVar: "KCPTUN_SNMPRESET",
+		},
+		cli.BoolFlag{
+			Name:   "pprof",
+			Usage:  "start profiling server on :6060",
+			EnvVar: "KCPTUN_PPROF",
+		},
+		cli.StringFlag{
+			Name:   "log",
+			Value:  "",
+			Usage:  "specify a log file to output, default goes to stderr",
+			EnvVar: "KCPTUN_LOG",
+		},
+		cli.StringFlag{
+			Name:   "logformat",
+			Value:  "text",
+			Usage:  "text, or json for one object per line with fields of stream, reconnect and scavenger events",
+			EnvVar: "KCPTUN_LOGFORMAT",
+		},
+		cli.StringFlag{
+			Name:   "fifo",
+			Value:  "",
+			Usage:  "specify a fifo file",
+			EnvVar: "KCPTUN_FIFO",
+		},
+		cli.StringFlag{
+			Name:   "controlsock",
+			Value:  "",
+			Usage:  "serve newline delimited json control requests on this unix socket, like: /var/run/kcptun-server.sock",
+			EnvVar: "KCPTUN_CONTROLSOCK",
+		},
+		cli.StringFlag{
+			Name:   "metricsaddr",
+			Value:  "",
+			Usage:  "serve prometheus metrics at /metrics on this address, like: 127.0.0.1:29902",
+			EnvVar: "KCPTUN_METRICSADDR",
+		},
+		cli.StringFlag{
+			Name:   "otlp",
+			Value:  "",
+			Usage:  "export traces of streams and connects to this OTLP/HTTP collector, like: http://127.0.0.1:4318",
+			EnvVar: "KCPTUN_OTLP",
+		},
+		cli.StringFlag{
+			Name:   "controladdr",
+			Value:  "",
+			Usage:  "serve the http control api for runtime tuning on this address, like: 127.0.0.1:29901",
+			EnvVar: "KCPTUN_CONTROLADDR",
+		},
+		cli.StringFlag{
+			Name:   "controltoken",
+			Value:  "",
+			Usage:  "require this bearer token on requests to the http control api, needed to serve it on a non-loopback address",
+			EnvVar: "KCPTUN_CONTROLTOKEN",
 		},
 		cli.BoolFlag{
-			Name:  "pprof",
-			Usage: "start profiling server on :6060",
+			Name:   "quiet",
+			Usage:  "to suppress the 'stream open/close' messages",
+			EnvVar: "KCPTUN_QUIET",
+		},
+		cli.BoolFlag{
+			Name:   "tcp",
+			Usage:  "to emulate a TCP connection(linux)",
+			EnvVar: "KCPTUN_TCP",
+		},
+		cli.BoolFlag{
+			Name:   "icmp",
+			Usage:  "also accept packets carried in icmp echo requests and answer in echo replies, experimental, needs root",
+			EnvVar: "KCPTUN_ICMP",
+		},
+		cli.StringFlag{
+			Name:   "transport",
+			Value:  "kcp",
+			Usage:  "kcp, tcp to serve smux over encrypted tcp connections on the listen port, or both",
+			EnvVar: "KCPTUN_TRANSPORT",
+		},
+		cli.StringFlag{
+			Name:   "stream",
+			Value:  "",
+			Usage:  "also listen on this tcp address or systemd:[name] for kcp packets carried on streams, for clients behind an http proxy",
+			EnvVar: "KCPTUN_STREAM",
+		},
+		cli.StringFlag{
+			Name:   "ws",
+			Value:  "",
+			Usage:  "also listen on this tcp address or systemd:[name] for kcp packets carried on websockets, for clients whose udp is blocked",
+			EnvVar: "KCPTUN_WS",
+		},
+		cli.StringFlag{
+			Name:   "wscert",
+			Value:  "",
+			Usage:  "certificate file to serve the websockets with tls",
+			EnvVar: "KCPTUN_WSCERT",
+		},
+		cli.StringFlag{
+			Name:   "wskey",
+			Value:  "",
+			Usage:  "private key file of wscert",
+			EnvVar: "KCPTUN_WSKEY",
+		},
+		cli.BoolFlag{
+			Name:   "padding",
+			Usage:  "pad packets to random bucket sizes and inject dummy packets to blur their length signature",
+			EnvVar: "KCPTUN_PADDING",
 		},
 		cli.StringFlag{
-			Name:  "log",
-			Value: "",
-			Usage: "specify a log file to output, default goes to stderr",
+			Name:   "reverse",
+			Value:  "",
+			Usage:  "dial out to the client started with -reverse at this address instead of listening, for servers behind NAT",
+			EnvVar: "KCPTUN_REVERSE",
 		},
 		cli.StringFlag{
-			Name:  "fifo",
-			Value: "",
-			Usage: "specify a fifo file",
+			Name:   "p2p",
+			Value:  "",
+			Usage:  "register at the rendezvous at this address for clients started with -p2p to punch through to, for servers behind NAT",
+			EnvVar: "KCPTUN_P2P",
+		},
+		cli.BoolFlag{
+			Name:   "broker",
+			Usage:  "serve only as the rendezvous of -p2p servers and clients on the listen address, relaying none of their traffic",
+			EnvVar: "KCPTUN_BROKER",
+		},
+		cli.IntFlag{
+			Name:   "conn",
+			Value:  1,
+			Usage:  "set num of UDP connections to the client in reverse mode",
+			EnvVar: "KCPTUN_CONN",
 		},
 		cli.BoolFlag{
-			Name:  "quiet",
-			Usage: "to suppress the 'stream open/close' messages",
+			Name:   "dynamic",
+			Usage:  "dial the destination announced on each stream by clients running with -socks5 or -httpproxy, instead of target",
+			EnvVar: "KCPTUN_DYNAMIC",
+		},
+		cli.BoolFlag{
+			Name:   "proxyprotocol",
+			Usage:  "send a PROXY protocol v2 header with the address clients accepted each stream from to the tcp targets, needs -dynamic",
+			EnvVar: "KCPTUN_PROXYPROTOCOL",
+		},
+		cli.BoolFlag{
+			Name:   "udp",
+			Usage:  "relay the datagrams from clients running with -udp to the udp target",
+			EnvVar: "KCPTUN_UDP",
+		},
+		cli.IntFlag{
+			Name:   "udptimeout",
+			Value:  60,
+			Usage:  "seconds before an idle udp stream is closed",
+			EnvVar: "KCPTUN_UDPTIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "tun",
+			Value:  "",
+			Usage:  "create this tun device for clients with -tun to carry their IP packets to, needs -dynamic (linux) and root or CAP_NET_ADMIN",
+			EnvVar: "KCPTUN_TUN",
+		},
+		cli.StringFlag{
+			Name:   "tunaddr",
+			Value:  "",
+			Usage:  "IPv4 address and prefix to give the tun device, like 10.9.0.1/24, empty to leave it to ip addr",
+			EnvVar: "KCPTUN_TUNADDR",
+		},
+		cli.StringFlag{
+			Name:   "uplimit",
+			Value:  "",
+			Usage:  "limit the bandwidth of all streams from clients to the target, like: 10mbit, 512kbit or 2mbps",
+			EnvVar: "KCPTUN_UPLIMIT",
+		},
+		cli.StringFlag{
+			Name:   "downlimit",
+			Value:  "",
+			Usage:  "limit the bandwidth of all streams in the other direction",
+			EnvVar: "KCPTUN_DOWNLIMIT",
+		},
+		cli.StringFlag{
+			Name:   "streamlimit",
+			Value:  "",
+			Usage:  "limit the bandwidth of each stream in either direction",
+			EnvVar: "KCPTUN_STREAMLIMIT",
+		},
+		cli.StringFlag{
+			Name:   "clientlimit",
+			Value:  "",
+			Usage:  "limit the bandwidth of each client in either direction, a client is a user with -users or else a source ip",
+			EnvVar: "KCPTUN_CLIENTLIMIT",
+		},
+		cli.StringFlag{
+			Name:   "quota",
+			Value:  "",
+			Usage:  "bytes each client may transfer per month, like: 500mb or 100gb",
+			EnvVar: "KCPTUN_QUOTA",
+		},
+		cli.StringFlag{
+			Name:   "quotafile",
+			Value:  "",
+			Usage:  "save the monthly traffic of clients to this file, to survive restarts",
+			EnvVar: "KCPTUN_QUOTAFILE",
+		},
+		cli.IntFlag{
+			Name:   "maxsessions",
+			Value:  0,
+			Usage:  "reject new sessions beyond this many concurrent ones, 0 is unlimited",
+			EnvVar: "KCPTUN_MAXSESSIONS",
+		},
+		cli.IntFlag{
+			Name:   "idletimeout",
+			Value:  0,
+			Usage:  "close sessions whose streams have carried no data for this many seconds, 0 to keep them",
+			EnvVar: "KCPTUN_IDLETIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "maxstreams",
+			Value:  0,
+			Usage:  "reject new streams of a session beyond this many concurrent ones, 0 is unlimited",
+			EnvVar: "KCPTUN_MAXSTREAMS",
+		},
+		cli.IntFlag{
+			Name:   "streamrate",
+			Value:  0,
+			Usage:  "reject new streams beyond this many per second across all sessions, 0 is unlimited",
+			EnvVar: "KCPTUN_STREAMRATE",
+		},
+		cli.StringFlag{
+			Name:   "acl",
+			Value:  "",
+			Usage:  "drop packets and connections of sources denied by this file of allow and deny rules, like: allow 10.0.0.0/8",
+			EnvVar: "KCPTUN_ACL",
+		},
+		cli.StringFlag{
+			Name:   "streamacl",
+			Value:  "",
+			Usage:  "reject the streams whose source announced by clients in dynamic mode is denied by this file of allow and deny rules",
+			EnvVar: "KCPTUN_STREAMACL",
+		},
+		cli.StringFlag{
+			Name:   "targets",
+			Value:  "",
+			Usage:  "restrict the destinations of clients in dynamic mode, like: 10.0.0.0/8:*,example.com:443,db=10.0.0.5:5432",
+			EnvVar: "KCPTUN_TARGETS",
 		},
 		cli.BoolFlag{
-			Name:  "tcp",
-			Usage: "to emulate a TCP connection(linux)",
+			Name:   "checkconfig",
+			Usage:  "check the flags and config without starting, print the problems found as json and exit, non-zero if any",
+			EnvVar: "KCPTUN_CHECKCONFIG",
+		},
+		cli.StringFlag{
+			Name:   "c",
+			Value:  "", // when the value is not empty, the config path must exists
+			Usage:  "config from json file, which will override the command from shell unless precedence is flags",
+			EnvVar: "KCPTUN_C",
 		},
 		cli.StringFlag{
-			Name:  "c",
-			Value: "", // when the value is not empty, the config path must exists
-			Usage: "config from json file, which will override the command from shell",
+			Name:   "precedence",
+			Value:  "config",
+			Usage:  "config: the json config overrides the flags and environment variables, flags: they override the json config",
+			EnvVar: "KCPTUN_PRECEDENCE",
 		},
 	}
+	myApp.Commands = []cli.Command{generic.BenchCryptoCommand()}
 	myApp.Action = func(c *cli.Context) error {
 		config := Config{}
 		config.Listen = c.String("listen")
 		config.Target = c.String("target")
+		config.Balance = c.String("balance")
+		config.HealthCheck = c.Int("healthcheck")
 		config.Key = c.String("key")
+		config.KeyFile = c.String("keyfile")
+		config.Users = c.String("users")
 		config.Crypt = c.String("crypt")
+		config.KDF = c.String("kdf")
+		config.Salt = c.String("salt")
+		config.KDFIter = c.Int("kdfiter")
+		config.KDFMem = c.Int("kdfmem")
+		config.Rekey = c.Int("rekey")
+		config.AntiReplay = c.Int("antireplay")
+		config.Token = c.Int("token")
+		config.Migrate = c.Bool("migrate")
+		config.KeyExchange = c.Bool("keyexchange")
+		config.PQKeyExchange = c.Bool("pqkeyexchange")
+		config.ConnKey = c.Bool("connkey")
+		config.Cert = c.String("cert")
+		config.CertKey = c.String("certkey")
+		config.CA = c.String("ca")
+		config.Stealth = c.Bool("stealth")
 		config.Mode = c.String("mode")
 		config.MTU = c.Int("mtu")
 		config.SndWnd = c.Int("sndwnd")
+		config.Wnd = c.String("wnd")
+		config.MaxWnd = c.Int("maxwnd")
 		config.RcvWnd = c.Int("rcvwnd")
 		config.DataShard = c.Int("datashard")
 		config.ParityShard = c.Int("parityshard")
+		config.AutoFEC = c.Bool("autofec")
+		config.MinParity = c.Int("minparity")
+		config.MaxParity = c.Int("maxparity")
 		config.DSCP = c.Int("dscp")
+		config.FwMark = c.Int("fwmark")
 		config.NoComp = c.Bool("nocomp")
+		config.Comp = c.String("comp")
+		config.CompLevel = c.Int("complevel")
+		config.CompThreshold = c.Int("compthreshold")
+		config.CompAdaptive = c.Bool("compadaptive")
 		config.AckNodelay = c.Bool("acknodelay")
 		config.NoDelay = c.Int("nodelay")
 		config.Interval = c.Int("interval")
 		config.Resend = c.Int("resend")
 		config.NoCongestion = c.Int("nc")
 		config.SockBuf = c.Int("sockbuf")
+		config.NoOffload = c.Bool("nooffload")
+		config.ReusePort = c.Int("reuseport")
 		config.SmuxBuf = c.Int("smuxbuf")
 		config.StreamBuf = c.Int("streambuf")
+		config.CopyBuf = c.Int("copybuf")
+		config.GOMAXPROCS = c.Int("gomaxprocs")
+		config.CPUs = c.String("cpus")
 		config.SmuxVer = c.Int("smuxver")
+		config.Mux = c.String("mux")
 		config.KeepAlive = c.Int("keepalive")
+		config.KeepAliveTimeout = c.Int("keepalivetimeout")
 		config.Log = c.String("log")
+		config.LogFormat = c.String("logformat")
 		config.Fifo = c.String("fifo")
+		config.ControlAddr = c.String("controladdr")
+		config.ControlToken = c.String("controltoken")
+		config.ControlSock = c.String("controlsock")
+		config.MetricsAddr = c.String("metricsaddr")
+		config.OTLP = c.String("otlp")
 		config.SnmpLog = c.String("snmplog")
 		config.SnmpPeriod = c.Int("snmpperiod")
+		config.SnmpFormat = c.String("snmpformat")
+		config.SnmpReset = c.Bool("snmpreset")
 		config.Pprof = c.Bool("pprof")
 		config.Quiet = c.Bool("quiet")
 		config.TCP = c.Bool("tcp")
+		config.ICMP = c.Bool("icmp")
+		config.Padding = c.Bool("padding")
+		config.Stream = c.String("stream")
+		config.Transport = c.String("transport")
+		config.WS = c.String("ws")
+		config.WSCert = c.String("wscert")
+		config.WSKey = c.String("wskey")
+		config.Dynamic = c.Bool("dynamic")
+		config.ProxyProtocol = c.Bool("proxyprotocol")
+		config.Reverse = c.String("reverse")
+		config.P2P = c.String("p2p")
+		config.Broker = c.Bool("broker")
+		config.Conn = c.Int("conn")
+		config.UDP = c.Bool("udp")
+		config.UDPTimeout = c.Int("udptimeout")
+		config.TUN = c.String("tun")
+		config.TUNAddr = c.String("tunaddr")
+		config.UpLimit = c.String("uplimit")
+		config.DownLimit = c.String("downlimit")
+		config.StreamLimit = c.String("streamlimit")
+		config.ClientLimit = c.String("clientlimit")
+		config.Quota = c.String("quota")
+		config.QuotaFile = c.String("quotafile")
+		config.MaxSessions = c.Int("maxsessions")
+		config.IdleTimeout = c.Int("idletimeout")
+		config.MaxStreams = c.Int("maxstreams")
+		config.StreamRate = c.Int("streamrate")
+		config.ACL = c.String("acl")
+		config.StreamACL = c.String("streamacl")
+		config.Targets = c.String("targets")
 
-		if c.String("c") != "" {
-			//Now only support json config file
-			err := parseJSONConfig(&config, c.String("c"))
-			checkError(err)
+		base := config
+		precedence := c.String("precedence")
+		if precedence != generic.PrecedenceConfig && precedence != generic.PrecedenceFlags {
+			log.Fatal("unsupported precedence:", precedence)
 		}
+		shell := generic.ShellSources(c, nil)
+		sources, err := generic.LoadConfig(&config, c.String("c"), precedence, shell)
+		checkError(err)
 
-		// log redirect
-		if config.Log != "" {
-			f, err := os.OpenFile(config.Log, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			checkError(err)
-			defer f.Close()
-			log.SetOutput(f)
+		if nodelay, interval, resend, nc, ok := generic.ModeProfile(config.Mode); ok {
+			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = nodelay, interval, resend, nc
+		}
+		if config.NoComp {
+			config.Comp = "none"
 		}
 
-		switch config.Mode {
-		case "normal":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 40, 2, 1
-		case "fast":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 30, 2, 1
-		case "fast2":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 20, 2, 1
-		case "fast3":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 10, 2, 1
+		// report every problem of the config at once, without starting
+		if c.Bool("checkconfig") {
+			if !checkConfig(&config, true).Report(os.Stdout) {
+				os.Exit(1)
+			}
+			return nil
 		}
 
+		// log redirect
+		checkError(generic.SetLogFormat(config.LogFormat))
+		checkError(generic.SetLogOutput(config.Log))
+		checkError(generic.SetTraceExporter(config.OTLP, "kcptun-server"))
+
 		log.Println("version:", VERSION)
+		log.Println("precedence:", precedence, "sources:", sources)
 		log.Println("smux version:", config.SmuxVer)
+		log.Println("mux:", config.Mux)
 		log.Println("listening on:", config.Listen)
-		log.Println("target:", config.Target)
+		log.Println("target:", config.Target, "balance:", config.Balance, "healthcheck:", config.HealthCheck)
+		for _, l := range config.Listeners {
+			log.Println("listening on:", l.Listen, "target:", l.Target)
+		}
 		log.Println("encryption:", config.Crypt)
+		log.Println("kdf:", config.KDF, "kdfiter:", config.KDFIter, "kdfmem:", config.KDFMem)
+		log.Println("rekey:", config.Rekey)
+		log.Println("antireplay:", config.AntiReplay)
+		log.Println("token:", config.Token)
+		log.Println("migrate:", config.Migrate)
+		log.Println("keyexchange:", config.KeyExchange, "pqkeyexchange:", config.PQKeyExchange, "connkey:", config.ConnKey)
+		log.Println("cert:", config.Cert, "ca:", config.CA)
+		log.Println("stealth:", config.Stealth)
+		log.Println("users:", config.Users)
 		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
-		log.Println("compression:", !config.NoComp)
+		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd, "wnd:", config.Wnd, "maxwnd:", config.MaxWnd)
+		log.Println("compression:", config.Comp, "complevel:", config.CompLevel, "compthreshold:", config.CompThreshold, "compadaptive:", config.CompAdaptive)
 		log.Println("mtu:", config.MTU)
 		log.Println("datashard:", config.DataShard, "parityshard:", config.ParityShard)
+		log.Println("autofec:", config.AutoFEC, "minparity:", config.MinParity, "maxparity:", config.MaxParity)
 		log.Println("acknodelay:", config.AckNodelay)
-		log.Println("dscp:", config.DSCP)
-		log.Println("sockbuf:", config.SockBuf)
+		log.Println("dscp:", config.DSCP, "fwmark:", config.FwMark)
+		log.Println("sockbuf:", config.SockBuf, "nooffload:", config.NoOffload, "reuseport:", config.ReusePort)
 		log.Println("smuxbuf:", config.SmuxBuf)
-		log.Println("streambuf:", config.StreamBuf)
-		log.Println("keepalive:", config.KeepAlive)
+		log.Println("streambuf:", config.StreamBuf, "copybuf:", config.CopyBuf)
+		log.Println("gomaxprocs:", config.GOMAXPROCS, "cpus:", config.CPUs)
+		log.Println("keepalive:", config.KeepAlive, "keepalivetimeout:", config.KeepAliveTimeout)
 		log.Println("snmplog:", config.SnmpLog)
-		log.Println("snmpperiod:", config.SnmpPeriod)
+		log.Println("snmpperiod:", config.SnmpPeriod, "snmpformat:", config.SnmpFormat, "snmpreset:", config.SnmpReset)
 		log.Println("pprof:", config.Pprof)
 		log.Println("quiet:", config.Quiet)
 		log.Println("tcp:", config.TCP)
+		log.Println("icmp:", config.ICMP)
+		log.Println("padding:", config.Padding)
+		log.Println("stream:", config.Stream)
+		log.Println("transport:", config.Transport)
+		log.Println("ws:", config.WS, "wscert:", config.WSCert)
+		log.Println("udp:", config.UDP, "udptimeout:", config.UDPTimeout)
+		log.Println("tun:", config.TUN, "tunaddr:", config.TUNAddr)
+		log.Println("uplimit:", config.UpLimit, "downlimit:", config.DownLimit, "streamlimit:", config.StreamLimit)
+		log.Println("clientlimit:", config.ClientLimit, "quota:", config.Quota, "quotafile:", config.QuotaFile)
+		log.Println("maxsessions:", config.MaxSessions, "maxstreams:", config.MaxStreams, "streamrate:", config.StreamRate, "idletimeout:", config.IdleTimeout)
+		log.Println("acl:", config.ACL, "streamacl:", config.StreamACL)
+		log.Println("dynamic:", config.Dynamic, "targets:", config.Targets, "proxyprotocol:", config.ProxyProtocol)
+		log.Println("reverse:", config.Reverse, "conn:", config.Conn)
+		log.Println("p2p:", config.P2P, "broker:", config.Broker)
+		log.Println("controladdr:", config.ControlAddr)
+		log.Println("controlsock:", config.ControlSock)
+		log.Println("metricsaddr:", config.MetricsAddr)
+		log.Println("otlp:", config.OTLP)
 
 		// parameters check
-		if config.SmuxVer > maxSmuxVer {
-			log.Fatal("unsupported smux version:", config.SmuxVer)
+		problems := checkConfig(&config, false)
+		for _, w := range problems.Warnings() {
+			log.Println("warning:", w.Error)
+		}
+		if err := problems.Err(); err != nil {
+			log.Fatal(err)
+		}
+
+		// a rendezvous brokers the sessions of -p2p peers and serves nothing else
+		if config.Broker {
+			conn, err := net.ListenPacket("udp", config.Listen)
+			checkError(err)
+			log.Println("rendezvous on:", conn.LocalAddr())
+			checkError(generic.ServeRendezvous(conn))
+			return nil
+		}
+		if err := bandwidth.Set(config.UpLimit, config.DownLimit, config.StreamLimit); err != nil {
+			log.Fatal(err)
+		}
+		generic.SetCopyBuffer(config.CopyBuf)
+		if err := generic.SetCPUs(config.CPUs, config.GOMAXPROCS); err != nil {
+			log.Fatal(err)
+		}
+		quota, err := parseSize(config.Quota)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clientLimits, err = newClients(config.QuotaFile)
+		if err != nil {
+			log.Fatalf("%+v", err)
+		}
+		if err := clientLimits.set(config.ClientLimit, quota); err != nil {
+			log.Fatal(err)
+		}
+		go clientLimits.saver()
+		streamAccepts.set(config.StreamRate)
+		sourceACL, err = generic.NewACL(config.ACL)
+		if err != nil {
+			log.Fatalf("%+v", err)
+		}
+		streamACL, err = generic.NewACL(config.StreamACL)
+		if err != nil {
+			log.Fatalf("%+v", err)
+		}
+		if err := allowedTargets.set(config.Targets); err != nil {
+			log.Fatal(err)
+		}
+		targetPools.set(configTargets(&config), config.Balance, config.HealthCheck)
+
+		if config.KeyFile != "" {
+			key, err := generic.ReadKeyFile(config.KeyFile)
+			checkError(err)
+			config.Key = key
 		}
 
 		log.Println("initiating key derivation")
-		pass := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
+		pass, err := deriveKey(&config, config.Key)
+		checkError(err)
+		block := newBlockCrypt(&config, pass)
+
+		// the keys of a multi-user server, whose tokens are under any user's key
+		var users []User
+		var userBlocks []kcp.BlockCrypt
+		userPasses := make(map[string][]byte)
+		tokenKeys := [][]byte{pass}
+		if config.Users != "" {
+			tokenKeys = nil
+			users, err = loadUsers(config.Users)
+			checkError(err)
+			for _, u := range users {
+				pass, err := deriveKey(&config, u.Key)
+				checkError(err)
+				userBlocks = append(userBlocks, newBlockCrypt(&config, pass))
+				userPasses[u.Name] = pass
+				tokenKeys = append(tokenKeys, pass)
+			}
+			log.Println("users:", len(users))
+		}
 		log.Println("key derivation done")
-		var block kcp.BlockCrypt
-		switch config.Crypt {
-		case "null":
-			block = nil
-		case "sm4":
-			block, _ = kcp.NewSM4BlockCrypt(pass[:16])
-		case "tea":
-			block, _ = kcp.NewTEABlockCrypt(pass[:16])
-		case "xor":
-			block, _ = kcp.NewSimpleXORBlockCrypt(pass)
-		case "none":
-			block, _ = kcp.NewNoneBlockCrypt(pass)
-		case "aes-128":
-			block, _ = kcp.NewAESBlockCrypt(pass[:16])
-		case "aes-192":
-			block, _ = kcp.NewAESBlockCrypt(pass[:24])
-		case "blowfish":
-			block, _ = kcp.NewBlowfishBlockCrypt(pass)
-		case "twofish":
-			block, _ = kcp.NewTwofishBlockCrypt(pass)
-		case "cast5":
-			block, _ = kcp.NewCast5BlockCrypt(pass[:16])
-		case "3des":
-			block, _ = kcp.NewTripleDESBlockCrypt(pass[:24])
-		case "xtea":
-			block, _ = kcp.NewXTEABlockCrypt(pass[:16])
-		case "salsa20":
-			block, _ = kcp.NewSalsa20BlockCrypt(pass)
-		default:
-			config.Crypt = "aes"
-			block, _ = kcp.NewAESBlockCrypt(pass)
-		}
-
-		go generic.SnmpLogger(config.SnmpLog, config.SnmpPeriod)
+
+		go generic.SnmpLogger(config.SnmpLog, config.SnmpPeriod, config.SnmpFormat, config.SnmpReset)
 		if config.Pprof {
 			go http.ListenAndServe(":6060", nil)
 		}
 
+		tun := newTuner(&config)
+		if config.Cert != "" || config.CertKey != "" || config.CA != "" {
+			tun.certs, err = generic.LoadCertAuth(config.Cert, config.CertKey, config.CA)
+			checkError(err)
+		}
+		if config.AutoFEC {
+			go generic.AutoFEC(tun, config.MinParity, config.MaxParity)
+		}
+		go generic.AutoMode(tun)
+		if config.Wnd == "auto" {
+			go generic.AutoWindow(tun, config.MaxWnd)
+		}
+		go generic.ControlServer(config.ControlAddr, config.ControlToken, tun)
+		go generic.ControlSocket(config.ControlSock, tun)
+		go generic.MetricsServer(config.MetricsAddr, tun)
+
+		// reload json config on SIGHUP
+		// without a json config, only the acl files are reloaded
+		go func() {
+			for range reloadSignal {
+				if c.String("c") != "" {
+					tun.reload(base, c.String("c"), precedence, shell)
+					continue
+				}
+				if config.ACL != "" {
+					if err := sourceACL.Load(config.ACL); err != nil {
+						log.Println("reload:", err)
+					} else {
+						log.Println("reload: acl reloaded from", config.ACL)
+					}
+				}
+				if config.StreamACL != "" {
+					if err := streamACL.Load(config.StreamACL); err != nil {
+						log.Println("reload:", err)
+					} else {
+						log.Println("reload: streamacl reloaded from", config.StreamACL)
+					}
+				}
+			}
+		}()
+
+		// serve a multiplexer on conn until it closes, kcpconn is nil on the plain tcp
+		// transport. Dialed sessions must speak first for the client's listener to
+		// accept them. A target other than empty replaces the configured one.
+		serveMux := func(conn net.Conn, kcpconn *kcp.UDPSession, dialed bool, user, target string) {
+			if user != "" {
+				log.Println("remote address:", conn.RemoteAddr(), "user:", user)
+			} else {
+				log.Println("remote address:", conn.RemoteAddr())
+			}
+			cfg := tun.snapshot()
+			if target != "" {
+				cfg.Target = target
+			}
+			// a packet key of the kcp session's own with connkey
+			if kcpconn != nil && cfg.ConnKey {
+				if err := generic.ConnKeyExchange(kcpconn, pass, func(key []byte) kcp.BlockCrypt {
+					return replayGuard(&cfg, newBlockCrypt(&cfg, key))
+				}, dialed); err != nil {
+					log.Println(err, conn.RemoteAddr())
+					conn.Close()
+					return
+				}
+			}
+			meter := generic.NewMeter(conn)
+			// tls with cert, and a key of the session's own with keyexchange authenticated
+			// by the user's key
+			var wire net.Conn = meter
+			if tun.certs != nil {
+				var err error
+				if wire, err = generic.CertAuth(wire, tun.certs, dialed); err != nil {
+					log.Println(err, conn.RemoteAddr())
+					conn.Close()
+					return
+				}
+			}
+			if cfg.KeyExchange {
+				psk := pass
+				if user != "" {
+					psk = userPasses[user]
+				}
+				exchange := generic.KeyExchange
+				if cfg.PQKeyExchange {
+					exchange = generic.HybridKeyExchange
+				}
+				var err error
+				if wire, err = exchange(wire, psk, dialed); err != nil {
+					log.Println(err, conn.RemoteAddr())
+					conn.Close()
+					return
+				}
+			}
+			var stream net.Conn
+			var err error
+			if dialed {
+				codec, _ := generic.ParseComp(cfg.Comp)
+				stream, err = generic.DialComp(wire, codec, cfg.CompLevel, cfg.CompThreshold, cfg.CompAdaptive, cfg.Mux)
+			} else {
+				stream, err = generic.AcceptComp(wire, cfg.CompLevel, cfg.CompThreshold, cfg.CompAdaptive, cfg.Mux)
+			}
+			if err != nil {
+				log.Println(err)
+				conn.Close()
+				return
+			}
+			if dialed {
+				if _, err := stream.Write(generic.MuxNop(cfg.Mux, cfg.SmuxVer)); err != nil {
+					log.Println(err)
+					conn.Close()
+					return
+				}
+			}
+			mux, err := newMux(stream, &cfg)
+			if err != nil {
+				log.Println(err)
+				conn.Close()
+				return
+			}
+
+			s := &generic.Session{KCP: kcpconn, Mux: mux, Meter: meter, User: user}
+			if !tun.addConn(s) {
+				log.Println("maxsessions reached, rejecting:", conn.RemoteAddr())
+				mux.Close()
+				conn.Close()
+				return
+			}
+			closeSource, streams := clientSources.open(sourceOf(conn))
+			defer closeSource(meter)
+			defer tun.removeConn(s)
+
+			// clients are told apart by user, or else by source ip
+			name := user
+			if name == "" {
+				name, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+			}
+			act := newActivity()
+			if cfg.IdleTimeout > 0 {
+				go reapIdle(mux, act, time.Duration(cfg.IdleTimeout)*time.Second)
+			}
+			handleMux(mux, &cfg, name, act, streams)
+		}
+
+		// serve a kcp session
+		serve := func(conn *kcp.UDPSession, dialed bool, user, target string) {
+			conn.SetStreamMode(true)
+			conn.SetWriteDelay(false)
+			conn.SetACKNoDelay(tun.snapshot().AckNodelay)
+			serveMux(conn, conn, dialed, user, target)
+		}
+
 		// main loop
 		var wg sync.WaitGroup
-		loop := func(lis *kcp.Listener) {
+		loop := func(lis *kcp.Listener, user, target string) {
 			defer wg.Done()
 			if err := lis.SetDSCP(config.DSCP); err != nil {
 				log.Println("SetDSCP:", err)
@@ -424,80 +1499,229 @@ func main() {
 
 			for {
 				if conn, err := lis.AcceptKCP(); err == nil {
-					log.Println("remote address:", conn.RemoteAddr())
-					conn.SetStreamMode(true)
-					conn.SetWriteDelay(false)
-					conn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-					conn.SetMtu(config.MTU)
-					conn.SetWindowSize(config.SndWnd, config.RcvWnd)
-					conn.SetACKNoDelay(config.AckNodelay)
-
-					if config.NoComp {
-						go handleMux(conn, &config)
-					} else {
-						go handleMux(generic.NewCompStream(conn), &config)
-					}
+					go serve(conn, false, user, target)
 				} else {
 					log.Printf("%+v", err)
 				}
 			}
 		}
 
-		if config.TCP { // tcp dual stack
-			if conn, err := tcpraw.Listen("tcp", config.Listen); err == nil {
-				lis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, conn)
+		// the tun device clients with -tun carry their packets to
+		if config.TUN != "" {
+			dev, err := generic.OpenTUN(config.TUN, config.TUNAddr)
+			checkError(err)
+			tunDevice = newTUNSwitch(dev)
+		}
+
+		// reverse mode, keep dialing out to the client
+		if config.Reverse != "" {
+			guarded := replayGuard(&config, block)
+			for i := 0; i < config.Conn; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						conn, err := dial(config.Reverse, &config, guarded, pass)
+						if err != nil {
+							log.Println("re-connecting:", err)
+							time.Sleep(time.Second)
+							continue
+						}
+						serve(conn.UDPSession, true, "", "")
+						conn.Close()
+						time.Sleep(time.Second)
+					}
+				}()
+			}
+		} else {
+			// a server behind nat registers its udp sockets at the rendezvous
+			var rendezvous net.Addr
+			if config.P2P != "" {
+				rendezvous, err = net.ResolveUDPAddr("udp", config.P2P)
 				checkError(err)
+			}
+
+			// sockets are marked for policy routing
+			mark := func(conn net.PacketConn) {
+				if config.FwMark != 0 {
+					checkError(generic.SetMark(conn, config.FwMark))
+				}
+			}
+
+			// with multiple users, a kcp listener per user shares the packet conn,
+			// clients of a udp conn may migrate, and their streams go to target if not empty
+			listen := func(conn net.PacketConn, udp bool, target string) {
+				if udp && rendezvous != nil {
+					conn = generic.NewP2PConn(conn, rendezvous, generic.P2PID(pass))
+				}
+				conn = generic.NewACLPacketConn(conn, sourceACL)
+				if udp && config.Migrate {
+					conn = generic.NewMigrateConn(conn)
+				}
+				if config.Token > 0 {
+					conn = generic.NewTokenConn(conn, tokenKeys, time.Duration(config.Token)*time.Second, nil)
+				}
+				if config.Padding {
+					conn = generic.NewPaddingConn(conn)
+				}
+				if len(users) == 0 {
+					guarded := replayGuard(&config, block)
+					lis, err := kcp.ServeConn(guarded, config.DataShard, config.ParityShard, conn)
+					checkError(err)
+					if config.ConnKey {
+						lis.SetSessionBlockCrypt(func() kcp.BlockCrypt { return generic.NewConnKeyBlockCrypt(guarded) })
+					}
+					wg.Add(1)
+					go loop(lis, "", target)
+					return
+				}
+				conns := newUserConns(conn, users, userBlocks)
+				for _, uc := range conns {
+					lis, err := kcp.ServeConn(replayGuard(&config, uc.block), config.DataShard, config.ParityShard, uc)
+					checkError(err)
+					wg.Add(1)
+					go loop(lis, uc.name, target)
+				}
+				go demuxUsers(conn, conns)
+			}
+
+			// tcp listeners of the stream and ws transports
+			listenTCP := func(addr string) net.Listener {
+				if generic.IsSystemd(addr) {
+					lis, err := generic.SystemdListener(addr)
+					checkError(err)
+					return generic.NewACLListener(lis, sourceACL)
+				}
+				lis, err := net.Listen("tcp", addr)
+				checkError(err)
+				return generic.NewACLListener(lis, sourceACL)
+			}
+
+			// packets carried on tcp streams, for clients behind an http proxy
+			if config.Stream != "" {
+				listen(generic.ListenStream(listenTCP(config.Stream)), false, "")
+			}
+
+			// packets carried on websockets, for clients whose udp is blocked
+			if config.WS != "" {
+				lis := listenTCP(config.WS)
+				if config.WSCert != "" {
+					cert, err := tls.LoadX509KeyPair(config.WSCert, config.WSKey)
+					checkError(err)
+					lis = tls.NewListener(lis, &tls.Config{Certificates: []tls.Certificate{cert}})
+				}
+				listen(generic.ListenStream(generic.ListenWebSocket(lis)), false, "")
+			}
+
+			// a port range is listened on as a whole for clients hopping between its ports
+			var host string
+			var lo, hi int
+			if !generic.IsSystemd(config.Listen) {
+				host, lo, hi, err = generic.ParsePortRange(config.Listen)
+				checkError(err)
+			}
+			first := net.JoinHostPort(host, strconv.Itoa(lo))
+
+			if config.TCP { // tcp dual stack
+				if conn, err := tcpraw.Listen("tcp", first); err == nil {
+					listen(conn, false, "")
+				} else {
+					log.Println(err)
+				}
+			}
+
+			if config.ICMP { // icmp dual stack
+				if conn, err := generic.ListenICMP(first); err == nil {
+					mark(conn)
+					listen(conn, false, "")
+				} else {
+					log.Println(err)
+				}
+			}
+
+			// smux on encrypted tcp connections, for networks dropping all udp
+			if config.Transport != "kcp" {
+				lis, err := net.Listen("tcp", first)
+				checkError(err)
+				lis = generic.NewACLListener(lis, sourceACL)
+				var streamPass []byte
+				if config.Crypt != "null" {
+					streamPass = pass
+				}
 				wg.Add(1)
-				go loop(lis)
-			} else {
-				log.Println(err)
+				go func() {
+					defer wg.Done()
+					for {
+						conn, err := lis.Accept()
+						if err != nil {
+							log.Printf("%+v", err)
+							continue
+						}
+						tcpconn := conn.(*net.TCPConn)
+						tcpconn.SetNoDelay(true)
+						tcpconn.SetReadBuffer(config.SockBuf)
+						tcpconn.SetWriteBuffer(config.SockBuf)
+						if streamPass != nil {
+							conn = generic.NewCryptConn(conn, streamPass)
+						}
+						if config.Stealth {
+							conn = generic.NewStealthConn(conn, tcpconn)
+						}
+						go serveMux(conn, nil, false, "", "")
+					}
+				}()
+			}
+
+			// udp stack
+			if config.Transport != "tcp" {
+				var conns []net.PacketConn
+				switch {
+				case generic.IsSystemd(config.Listen):
+					conn, err := generic.SystemdPacketConn(config.Listen)
+					checkError(err)
+					conns = append(conns, conn)
+				case hi > lo:
+					conn, err := generic.ListenPortRange(host, lo, hi)
+					checkError(err)
+					conns = append(conns, conn)
+				default:
+					conns, err = generic.ListenReusePort(first, config.ReusePort)
+					checkError(err)
+				}
+				// a listener and a read loop for each socket
+				for _, conn := range conns {
+					mark(conn)
+					if !config.NoOffload {
+						conn = generic.NewOffloadConn(conn)
+					}
+					listen(conn, true, "")
+				}
+
+				// additional ports from the json config, each with a target of its own
+				for _, l := range config.Listeners {
+					conns, err := generic.ListenReusePort(l.Listen, config.ReusePort)
+					checkError(err)
+					for _, conn := range conns {
+						mark(conn)
+						if !config.NoOffload {
+							conn = generic.NewOffloadConn(conn)
+						}
+						listen(conn, true, l.Target)
+					}
+				}
 			}
 		}
 
-		// udp stack
-		lis, err := kcp.ListenWithOptions(config.Listen, block, config.DataShard, config.ParityShard)
-		checkError(err)
-		wg.Add(1)
-		go loop(lis)
+		if err := generic.SdNotify("READY=1"); err != nil {
+			log.Println("sd_notify:", err)
+		}
+		go generic.SdWatchdog(func() bool { return true })
 
         if config.Fifo != "" {
             wg.Add(1)
             go func() {
                 defer wg.Done()
-                os.Remove(config.Fifo)
-                syscall.Mkfifo(config.Fifo, 0666)
-                log.Println("Open named pipe file for read:", config.Fifo)
-                file, err := os.OpenFile(config.Fifo, os.O_CREATE, os.ModeNamedPipe)
-                if err != nil {
-                    log.Fatal("Open named pipe file error:", err)
-                }
-
-                reader := bufio.NewReader(file)
-
-                for {
-                    //line, err := reader.ReadBytes('\n')
-                    line, _, err := reader.ReadLine()
-                    if err == nil {
-                        //fmt.Print("load string:" + string(line))
-                        message := strings.Split(string(line), " ")
-                        if strings.Contains(message[0], "fec") {
-                            ds, _ := strconv.Atoi(message[1])
-                            ps, _ := strconv.Atoi(message[2])
-                            if ds != config.DataShard || ps != config.ParityShard {
-                                config.DataShard = ds
-                                config.ParityShard = ps
-                                log.Println("ds:", ds, "ps:", ps)
-                                //lis.SetFEC(config.DataShard, config.ParityShard)
-                                if err := lis.SetFEC(config.DataShard, config.ParityShard); err != nil {
-                                    log.Println("SetFEC:", err)
-                                }
-                            }
-                        } else {
-                            log.Println("Unknown call")
-                        }
-                    }
-                    time.Sleep(time.Second)
-                }
+				generic.FifoControl(config.Fifo, tun)
             } ()
         }
 
@@ -507,4 +1731,3 @@ func main() {
 
 	myApp.Run(os.Args)
 }
-
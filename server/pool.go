@@ -0,0 +1,201 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// balance policies of a backend pool
+	balanceRoundRobin = "roundrobin"
+	balanceLeastConn  = "leastconn"
+
+	// the time a backend has to accept a health check or a stream
+	backendTimeout = 5 * time.Second
+)
+
+// isTargetPool reports whether target is a comma separated list of backends
+func isTargetPool(target string) bool {
+	return strings.Contains(target, ",")
+}
+
+// backend is an address of a pool, with its streams in use
+type backend struct {
+	addr  string
+	conns int
+	down  bool
+}
+
+// backendPool spreads the streams to a target over its backends, skipping the ones
+// down until a health check or a stream finds them up again
+type backendPool struct {
+	mu        sync.Mutex
+	backends  []*backend
+	next      int
+	leastConn bool
+}
+
+// pick returns the backend for a stream and counts it in, the next one round robin or
+// the one with the fewest streams. With all of them down it tries them anyway.
+func (p *backendPool) pick(skip map[*backend]bool) *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best := -1
+	for _, anyDown := range []bool{false, true} {
+		for i := range p.backends {
+			j := (p.next + i) % len(p.backends)
+			b := p.backends[j]
+			if skip[b] || (b.down && !anyDown) {
+				continue
+			}
+			if best < 0 || (p.leastConn && b.conns < p.backends[best].conns) {
+				best = j
+			}
+			if !p.leastConn {
+				break
+			}
+		}
+		if best >= 0 {
+			break
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	p.next = (best + 1) % len(p.backends)
+	p.backends[best].conns++
+	return p.backends[best]
+}
+
+// release counts a stream of b out
+func (p *backendPool) release(b *backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.conns--
+}
+
+// mark records whether b is down, logging the changes
+func (p *backendPool) mark(b *backend, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if down := err != nil; down != b.down {
+		b.down = down
+		if down {
+			log.Println("backend down:", b.addr, err)
+		} else {
+			log.Println("backend up:", b.addr)
+		}
+	}
+}
+
+// dial connects a stream to a backend, trying the next ones while they fail. The
+// backend returned must be released once the stream is done with it.
+func (p *backendPool) dial() (net.Conn, *backend, error) {
+	tried := make(map[*backend]bool)
+	var err error
+	for len(tried) < len(p.backends) {
+		b := p.pick(tried)
+		conn, e := net.DialTimeout("tcp", b.addr, backendTimeout)
+		p.mark(b, e)
+		if e == nil {
+			return conn, b, nil
+		}
+		p.release(b)
+		tried[b] = true
+		err = e
+	}
+	return nil, nil, errors.WithStack(err)
+}
+
+// check dials every backend each interval until die is closed
+func (p *backendPool) check(interval time.Duration, die chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-die:
+			return
+		}
+		var wg sync.WaitGroup
+		for _, b := range p.backends {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				conn, err := net.DialTimeout("tcp", b.addr, backendTimeout)
+				if err == nil {
+					conn.Close()
+				}
+				p.mark(b, err)
+			}(b)
+		}
+		wg.Wait()
+	}
+}
+
+// backendPools are the pools of the targets configured as lists of backends
+type backendPools struct {
+	mu    sync.Mutex
+	pools map[string]*backendPool
+	die   chan struct{}
+}
+
+// set replaces the pools with the ones of targets, balanced by policy and health
+// checked every healthcheck seconds, 0 to only find backends down by their streams
+func (ps *backendPools) set(targets []string, policy string, healthcheck int) {
+	pools := make(map[string]*backendPool)
+	die := make(chan struct{})
+	for _, target := range targets {
+		if !isTargetPool(target) || pools[target] != nil {
+			continue
+		}
+		p := &backendPool{leastConn: policy == balanceLeastConn}
+		for _, addr := range strings.Split(target, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				p.backends = append(p.backends, &backend{addr: addr})
+			}
+		}
+		pools[target] = p
+		if healthcheck > 0 {
+			go p.check(time.Duration(healthcheck)*time.Second, die)
+		}
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.die != nil {
+		close(ps.die)
+	}
+	ps.pools, ps.die = pools, die
+}
+
+// get returns the pool of target, nil if it isn't one
+func (ps *backendPools) get(target string) *backendPool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.pools[target]
+}
+
+// configTargets are the target of config and the ones of its listeners
+func configTargets(config *Config) []string {
+	targets := []string{config.Target}
+	for _, l := range config.Listeners {
+		targets = append(targets, l.Target)
+	}
+	return targets
+}
+
+// parseTargetPool checks the backends of a target list
+func parseTargetPool(target string) error {
+	for _, addr := range strings.Split(target, ",") {
+		if _, _, err := net.SplitHostPort(strings.TrimSpace(addr)); err != nil {
+			return errors.Errorf("invalid backend: %v", addr)
+		}
+	}
+	return nil
+}
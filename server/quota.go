@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+)
+
+const (
+	// period of saving the traffic of clients
+	quotaSaveInterval = time.Minute
+	// layout of the month traffic is counted in
+	quotaMonth = "2006-01"
+)
+
+var errQuotaExceeded = errors.New("monthly quota exceeded")
+
+// size units, decimal multiples of bytes
+var sizeUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"tb", 1e12}, {"b", 1},
+}
+
+// parseSize parses a size like 500mb or 100gb into bytes, an empty size is 0
+func parseSize(s string) (int64, error) {
+	num := strings.ToLower(strings.TrimSpace(s))
+	if num == "" {
+		return 0, nil
+	}
+	scale := 1.0
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, scale = strings.TrimSuffix(num, u.suffix), u.scale
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, errors.Errorf("invalid size: %v", s)
+	}
+	return int64(v * scale), nil
+}
+
+// client is the bandwidth and traffic of one client
+type client struct {
+	name      string
+	bandwidth *generic.Bandwidth
+	used      int64 // bytes in either direction this month
+	exceeded  int32 // set once the exceeding is logged
+}
+
+// clients limits the bandwidth and the monthly traffic of each client, a user of a
+// multi-user server or else a source ip. The traffic is saved to a file, if given, to
+// survive restarts.
+type clients struct {
+	mu      sync.Mutex
+	rate    string // of each client and direction
+	quota   int64  // bytes per month, 0 is unlimited
+	path    string
+	month   string
+	clients map[string]*client
+}
+
+// quotaFile is the saved traffic of clients
+type quotaFile struct {
+	Month string           `json:"month"`
+	Used  map[string]int64 `json:"used"`
+}
+
+// newClients creates the clients, with the traffic of this month saved at path
+func newClients(path string) (*clients, error) {
+	c := &clients{path: path, month: time.Now().Format(quotaMonth), clients: make(map[string]*client)}
+	if path == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var saved quotaFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	if saved.Month == c.month {
+		for name, used := range saved.Used {
+			c.get(name).used = used
+		}
+	}
+	return c, nil
+}
+
+// enabled reports whether clients are limited at all
+func (c *clients) enabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rate != "" || c.quota > 0
+}
+
+// set changes the rate of each client, in a format generic.ParseRate understands, and
+// the monthly quota to quota bytes
+func (c *clients) set(rate string, quota int64) error {
+	if _, err := generic.ParseRate(rate); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rate, c.quota = rate, quota
+	for _, cl := range c.clients {
+		cl.bandwidth.Set(rate, rate, "")
+		atomic.StoreInt32(&cl.exceeded, 0)
+	}
+	return nil
+}
+
+// get returns the client of name, tracking it from now on
+func (c *clients) get(name string) *client {
+	cl, ok := c.clients[name]
+	if !ok {
+		cl = &client{name: name, bandwidth: generic.NewBandwidth()}
+		cl.bandwidth.Set(c.rate, c.rate, "")
+		c.clients[name] = cl
+	}
+	return cl
+}
+
+// client returns the client of name
+func (c *clients) client(name string) *client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rollover()
+	return c.get(name)
+}
+
+// rollover starts counting over in a new month
+func (c *clients) rollover() {
+	month := time.Now().Format(quotaMonth)
+	if month == c.month {
+		return
+	}
+	c.month = month
+	for _, cl := range c.clients {
+		atomic.StoreInt64(&cl.used, 0)
+		atomic.StoreInt32(&cl.exceeded, 0)
+	}
+}
+
+// allowed reports whether cl has traffic left this month, it logs the first time not
+func (c *clients) allowed(cl *client) bool {
+	c.mu.Lock()
+	c.rollover()
+	quota := c.quota
+	c.mu.Unlock()
+	if quota <= 0 || atomic.LoadInt64(&cl.used) < quota {
+		return true
+	}
+	if atomic.CompareAndSwapInt32(&cl.exceeded, 0, 1) {
+		log.Println("quota:", cl.name, "exceeded", quota, "bytes this month")
+	}
+	return false
+}
+
+// limit wraps the writers of a stream of cl in its quota
+func (c *clients) limit(cl *client, up, down io.Writer) (io.Writer, io.Writer) {
+	return &quotaWriter{up, c, cl}, &quotaWriter{down, c, cl}
+}
+
+// save writes the traffic of this month to the file
+func (c *clients) save() error {
+	c.mu.Lock()
+	c.rollover()
+	saved := quotaFile{Month: c.month, Used: make(map[string]int64)}
+	for name, cl := range c.clients {
+		if used := atomic.LoadInt64(&cl.used); used > 0 {
+			saved.Used[name] = used
+		}
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, c.path))
+}
+
+// saver saves the traffic to the file periodically, and before exiting on SIGINT or SIGTERM
+func (c *clients) saver() {
+	if c.path == "" {
+		return
+	}
+	exit := make(chan os.Signal, 1)
+	signal.Notify(exit, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(quotaSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.save(); err != nil {
+				log.Println("quota:", err)
+			}
+		case sig := <-exit:
+			if err := c.save(); err != nil {
+				log.Println("quota:", err)
+			}
+			log.Println("exiting on", sig)
+			os.Exit(0)
+		}
+	}
+}
+
+// quotaWriter counts the traffic of a client and stops writing once its quota is used up
+type quotaWriter struct {
+	w       io.Writer
+	clients *clients
+	client  *client
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	if !w.clients.allowed(w.client) {
+		return 0, errQuotaExceeded
+	}
+	n, err := w.w.Write(p)
+	atomic.AddInt64(&w.client.used, int64(n))
+	return n, err
+}
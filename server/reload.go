@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"reflect"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// reloadSignal is notified by the signal handler to reload the json config
+var reloadSignal = make(chan struct{}, 1)
+
+// reload re-reads the json config at path on top of the command line config base, the
+// settings of the shell winning with precedence flags, and applies the changes which
+// are safe at runtime. Changes to the target and smux settings take effect on
+// sessions accepted afterwards.
+func (t *tuner) reload(base Config, path, precedence string, shell generic.ConfigSources) {
+	config := base
+	if _, err := generic.LoadConfig(&config, path, precedence, shell); err != nil {
+		log.Println("reload:", err)
+		return
+	}
+	if nodelay, interval, resend, nc, ok := generic.ModeProfile(config.Mode); ok {
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = nodelay, interval, resend, nc
+	}
+	if config.NoComp {
+		config.Comp = "none"
+	}
+	// the checks done at start, a reload failing any of them is dropped
+	problems := checkConfig(&config, false)
+	for _, w := range problems.Warnings() {
+		log.Println("reload: warning:", w.Error)
+	}
+	if err := problems.Err(); err != nil {
+		log.Println("reload:", err)
+		return
+	}
+	quota, _ := parseSize(config.Quota)
+
+	if config.KeyFile != "" {
+		key, err := generic.ReadKeyFile(config.KeyFile)
+		if err != nil {
+			log.Println("reload:", err)
+			return
+		}
+		config.Key = key
+	}
+
+	old := t.snapshot()
+	if config.Listen != old.Listen || !reflect.DeepEqual(config.Listeners, old.Listeners) || config.Key != old.Key || config.Crypt != old.Crypt ||
+		config.Rekey != old.Rekey || config.AntiReplay != old.AntiReplay || config.ConnKey != old.ConnKey || config.Token != old.Token || config.Migrate != old.Migrate || config.P2P != old.P2P || config.ICMP != old.ICMP || config.TUN != old.TUN || config.TUNAddr != old.TUNAddr || config.FwMark != old.FwMark || config.Broker != old.Broker || config.KDF != old.KDF || config.Salt != old.Salt || config.KDFIter != old.KDFIter ||
+		config.KDFMem != old.KDFMem || config.Users != old.Users || config.TCP != old.TCP || config.Padding != old.Padding || config.Stream != old.Stream || config.Transport != old.Transport || config.WS != old.WS || config.WSCert != old.WSCert || config.WSKey != old.WSKey || config.Cert != old.Cert || config.CertKey != old.CertKey || config.CA != old.CA || config.Stealth != old.Stealth || config.Comp != old.Comp || config.SmuxVer != old.SmuxVer || config.Mux != old.Mux ||
+		config.DSCP != old.DSCP || config.SockBuf != old.SockBuf || config.Fifo != old.Fifo ||
+		config.ControlAddr != old.ControlAddr || config.ControlToken != old.ControlToken || config.ControlSock != old.ControlSock ||
+		config.MetricsAddr != old.MetricsAddr || config.OTLP != old.OTLP || config.QuotaFile != old.QuotaFile || config.SnmpLog != old.SnmpLog ||
+		config.SnmpPeriod != old.SnmpPeriod || config.SnmpFormat != old.SnmpFormat || config.SnmpReset != old.SnmpReset || config.Pprof != old.Pprof || config.Reverse != old.Reverse ||
+		config.Conn != old.Conn || config.LogFormat != old.LogFormat || config.AutoFEC != old.AutoFEC || config.MinParity != old.MinParity || config.MaxParity != old.MaxParity ||
+		config.Wnd != old.Wnd || config.MaxWnd != old.MaxWnd || config.NoOffload != old.NoOffload ||
+		config.ReusePort != old.ReusePort || config.GOMAXPROCS != old.GOMAXPROCS || config.CPUs != old.CPUs {
+		log.Println("reload: changes to listen, listeners, key, crypt, rekey, antireplay, connkey, token, migrate, p2p, broker, icmp, fwmark, tun, tunaddr, kdf, salt, kdfiter, kdfmem, users, tcp, padding, stream, transport, ws, wscert, wskey, cert, certkey, ca, stealth, comp, smuxver, mux, dscp, sockbuf, fifo, controladdr, controltoken, controlsock, metricsaddr, otlp, quotafile, snmplog, snmpperiod, snmpformat, snmpreset, pprof, reverse, conn, logformat, autofec, minparity, maxparity, wnd, maxwnd, nooffload, reuseport, gomaxprocs and cpus require a restart")
+	}
+
+	if config.Log != old.Log {
+		if err := generic.SetLogOutput(config.Log); err != nil {
+			log.Println("reload:", err)
+		}
+	}
+
+	if err := t.Apply(paramsOf(&config)); err != nil {
+		log.Println("reload:", err)
+		return
+	}
+
+	if err := sourceACL.Load(config.ACL); err != nil {
+		log.Println("reload:", err)
+		return
+	}
+	if err := streamACL.Load(config.StreamACL); err != nil {
+		log.Println("reload:", err)
+		return
+	}
+
+	t.mu.Lock()
+	if config.Target != old.Target || !reflect.DeepEqual(config.Listeners, old.Listeners) || config.Balance != old.Balance || config.HealthCheck != old.HealthCheck {
+		targetPools.set(configTargets(&config), config.Balance, config.HealthCheck)
+	}
+	t.config.Target = config.Target
+	t.config.Balance = config.Balance
+	t.config.HealthCheck = config.HealthCheck
+	t.config.UDP = config.UDP
+	t.config.Dynamic = config.Dynamic
+	t.config.ProxyProtocol = config.ProxyProtocol
+	t.config.UDPTimeout = config.UDPTimeout
+	t.config.CompLevel = config.CompLevel
+	t.config.CompThreshold = config.CompThreshold
+	t.config.CompAdaptive = config.CompAdaptive
+	t.config.KeyExchange = config.KeyExchange
+	t.config.PQKeyExchange = config.PQKeyExchange
+	t.config.SmuxBuf = config.SmuxBuf
+	t.config.StreamBuf = config.StreamBuf
+	if config.CopyBuf != old.CopyBuf {
+		generic.SetCopyBuffer(config.CopyBuf)
+	}
+	t.config.CopyBuf = config.CopyBuf
+	t.config.KeepAlive = config.KeepAlive
+	t.config.KeepAliveTimeout = config.KeepAliveTimeout
+	t.config.AckNodelay = config.AckNodelay
+	t.config.Quiet = config.Quiet
+	t.config.Log = config.Log
+	t.config.UpLimit = config.UpLimit
+	t.config.DownLimit = config.DownLimit
+	t.config.StreamLimit = config.StreamLimit
+	bandwidth.Set(config.UpLimit, config.DownLimit, config.StreamLimit)
+	t.config.ClientLimit = config.ClientLimit
+	t.config.Quota = config.Quota
+	clientLimits.set(config.ClientLimit, quota)
+	t.config.MaxSessions = config.MaxSessions
+	t.config.IdleTimeout = config.IdleTimeout
+	t.config.MaxStreams = config.MaxStreams
+	t.config.StreamRate = config.StreamRate
+	streamAccepts.set(config.StreamRate)
+	t.config.ACL = config.ACL
+	t.config.StreamACL = config.StreamACL
+	t.config.Targets = config.Targets
+	allowedTargets.set(config.Targets)
+	t.mu.Unlock()
+	log.Println("reload: config reloaded from", path)
+}
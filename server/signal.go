@@ -17,13 +17,18 @@ func init() {
 
 func sigHandler() {
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGUSR1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGHUP)
 	signal.Ignore(syscall.SIGPIPE)
 
 	for {
 		switch <-ch {
 		case syscall.SIGUSR1:
 			log.Printf("KCP SNMP:%+v", kcp.DefaultSnmp.Copy())
+		case syscall.SIGHUP:
+			select {
+			case reloadSignal <- struct{}{}:
+			default:
+			}
 		}
 	}
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+const (
+	// a source without sessions for this long is forgotten
+	sourceTTL = 24 * time.Hour
+	// sources accounted for before the ones without sessions are purged
+	maxSources = 1 << 16
+)
+
+// sourceAccount is what a client address has used, its open sessions aside which
+// are read from the tuner
+type sourceAccount struct {
+	sessions  int // open
+	sessionsT uint64
+	streamsT  uint64 // counted by the streams themselves
+	bytesIn   uint64 // of the closed sessions
+	bytesOut  uint64
+	uptime    time.Duration // with sessions open, until upSince
+	upSince   time.Time
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// sourceTable accounts for the clients by address
+type sourceTable struct {
+	mu      sync.Mutex
+	sources map[string]*sourceAccount
+}
+
+// clientSources accounts for the clients of the server
+var clientSources = &sourceTable{sources: make(map[string]*sourceAccount)}
+
+// sourceOf is the client address of conn
+func sourceOf(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// open accounts for a session of source, and returns the function to close it with
+// its meter, and the counter of its streams
+func (t *sourceTable) open(source string) (close func(meter *generic.Meter), streams *uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	a, ok := t.sources[source]
+	if !ok {
+		if len(t.sources) >= maxSources {
+			t.purge(now, 0)
+		}
+		a = &sourceAccount{firstSeen: now}
+		t.sources[source] = a
+	}
+	if a.sessions == 0 {
+		a.upSince = now
+	}
+	a.sessions++
+	a.sessionsT++
+	a.lastSeen = now
+	return func(meter *generic.Meter) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		now := time.Now()
+		a.sessions--
+		if a.sessions == 0 {
+			a.uptime += now.Sub(a.upSince)
+		}
+		a.bytesIn += meter.BytesIn()
+		a.bytesOut += meter.BytesOut()
+		a.lastSeen = now
+		t.purge(now, sourceTTL)
+	}, &a.streamsT
+}
+
+// purge forgets the sources without sessions for ttl
+func (t *sourceTable) purge(now time.Time, ttl time.Duration) {
+	for k, a := range t.sources {
+		if a.sessions == 0 && now.Sub(a.lastSeen) >= ttl {
+			delete(t.sources, k)
+		}
+	}
+}
+
+// Sources reports the accounting of the clients with their open sessions, by address
+func (t *tuner) Sources() []generic.SourceStats {
+	open := make(map[string][]*generic.Session)
+	for _, s := range t.Sessions() {
+		source := sourceOf(s.Meter)
+		open[source] = append(open[source], s)
+	}
+
+	clientSources.mu.Lock()
+	defer clientSources.mu.Unlock()
+	now := time.Now()
+	stats := make([]generic.SourceStats, 0, len(clientSources.sources))
+	for source, a := range clientSources.sources {
+		st := generic.SourceStats{
+			Source:        source,
+			Sessions:      a.sessions,
+			SessionsTotal: a.sessionsT,
+			StreamsTotal:  atomic.LoadUint64(&a.streamsT),
+			BytesIn:       a.bytesIn,
+			BytesOut:      a.bytesOut,
+			FirstSeen:     a.firstSeen.Unix(),
+			LastSeen:      a.lastSeen.Unix(),
+		}
+		uptime := a.uptime
+		if a.sessions > 0 {
+			uptime += now.Sub(a.upSince)
+			st.LastSeen = now.Unix()
+		}
+		st.Uptime = int64(uptime / time.Second)
+		for _, s := range open[source] {
+			st.Streams += s.Mux.NumStreams()
+			st.BytesIn += s.Meter.BytesIn()
+			st.BytesOut += s.Meter.BytesOut()
+		}
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].BytesIn+stats[i].BytesOut > stats[j].BytesIn+stats[j].BytesOut })
+	return stats
+}
+
+// WriteMetrics exports the accounting of the clients by address
+func (t *tuner) WriteMetrics(w io.Writer) {
+	stats := t.Sources()
+	metrics := []struct {
+		name, typ, help string
+		value           func(s *generic.SourceStats) interface{}
+	}{
+		{"kcptun_source_sessions", "gauge", "open sessions of a client address", func(s *generic.SourceStats) interface{} { return s.Sessions }},
+		{"kcptun_source_sessions_total", "counter", "sessions opened by a client address", func(s *generic.SourceStats) interface{} { return s.SessionsTotal }},
+		{"kcptun_source_streams", "gauge", "open streams of a client address", func(s *generic.SourceStats) interface{} { return s.Streams }},
+		{"kcptun_source_streams_total", "counter", "streams opened by a client address", func(s *generic.SourceStats) interface{} { return s.StreamsTotal }},
+		{"kcptun_source_bytes_in", "counter", "bytes received from a client address", func(s *generic.SourceStats) interface{} { return s.BytesIn }},
+		{"kcptun_source_bytes_out", "counter", "bytes sent to a client address", func(s *generic.SourceStats) interface{} { return s.BytesOut }},
+		{"kcptun_source_uptime_seconds", "counter", "time a client address had sessions open", func(s *generic.SourceStats) interface{} { return s.Uptime }},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", m.name, m.help, m.name, m.typ)
+		for i := range stats {
+			fmt.Fprintf(w, "%v{source=%q} %v\n", m.name, stats[i].Source, m.value(&stats[i]))
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// targetRule allows the ports lo to hi of a hostname, or of the addresses of a network
+type targetRule struct {
+	host   string
+	ipnet  *net.IPNet
+	lo, hi int
+}
+
+// targetList restricts the destinations clients in dynamic mode may ask for, to the
+// ones matching a rule or named by an alias. An empty list allows all.
+type targetList struct {
+	mu      sync.Mutex
+	rules   []targetRule
+	aliases map[string]string
+}
+
+// set replaces the list with s, comma separated entries of host:port, where host may
+// be a cidr and port * or a range like 8000-8100, or of name=host:port aliases
+func (l *targetList) set(s string) error {
+	var rules []targetRule
+	aliases := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			name, addr := strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+			if _, _, err := net.SplitHostPort(addr); name == "" || err != nil {
+				return errors.Errorf("invalid target alias: %v", entry)
+			}
+			aliases[name] = addr
+			continue
+		}
+		rule, err := parseTargetRule(entry)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rules, l.aliases = rules, aliases
+	return nil
+}
+
+func parseTargetRule(entry string) (targetRule, error) {
+	var rule targetRule
+	i := strings.LastIndexByte(entry, ':')
+	if i < 0 {
+		return rule, errors.Errorf("invalid target: %v", entry)
+	}
+	host, port := strings.Trim(entry[:i], "[]"), entry[i+1:]
+
+	if port == "*" {
+		rule.lo, rule.hi = 1, 65535
+	} else {
+		lo, hi := port, port
+		if j := strings.IndexByte(port, '-'); j >= 0 {
+			lo, hi = port[:j], port[j+1:]
+		}
+		var err1, err2 error
+		rule.lo, err1 = strconv.Atoi(lo)
+		rule.hi, err2 = strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || rule.lo < 1 || rule.hi > 65535 || rule.lo > rule.hi {
+			return rule, errors.Errorf("invalid target port: %v", entry)
+		}
+	}
+
+	if strings.Contains(host, "/") {
+		_, ipnet, err := net.ParseCIDR(host)
+		if err != nil {
+			return rule, errors.Errorf("invalid target cidr: %v", entry)
+		}
+		rule.ipnet = ipnet
+	} else if ip := net.ParseIP(host); ip != nil {
+		rule.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+	} else if host != "" {
+		rule.host = strings.ToLower(host)
+	} else {
+		return rule, errors.Errorf("invalid target: %v", entry)
+	}
+	return rule, nil
+}
+
+// resolve returns the address to dial for the destination addr asked for by a client,
+// an alias is replaced by its address. Hostnames only match rules of the same name,
+// networks only match addresses given as ips, so a hostname can't sneak in.
+func (l *targetList) resolve(addr string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.rules) == 0 && len(l.aliases) == 0 {
+		return addr, nil
+	}
+	if alias, ok := l.aliases[addr]; ok {
+		return alias, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", errors.Errorf("target not allowed: %v", addr)
+	}
+	portnum, err := strconv.Atoi(port)
+	if err != nil {
+		return "", errors.Errorf("target not allowed: %v", addr)
+	}
+	ip := net.ParseIP(host)
+	for _, r := range l.rules {
+		if portnum < r.lo || portnum > r.hi {
+			continue
+		}
+		if (ip != nil && r.ipnet != nil && r.ipnet.Contains(ip)) || (ip == nil && r.host == strings.ToLower(host)) {
+			return addr, nil
+		}
+	}
+	return "", errors.Errorf("target not allowed: %v", addr)
+}
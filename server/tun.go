@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// tunDevice is the tun device of the server, nil without -tun
+var tunDevice *tunSwitch
+
+// tunSwitch relays the packets of the tun device to the streams of the clients, each
+// packet to the stream its destination address was last seen as a source on, like a
+// learning switch
+type tunSwitch struct {
+	dev io.ReadWriteCloser
+
+	mu     sync.Mutex
+	routes map[string]generic.Stream
+}
+
+func newTUNSwitch(dev io.ReadWriteCloser) *tunSwitch {
+	s := &tunSwitch{dev: dev, routes: make(map[string]generic.Stream)}
+	go s.loop()
+	return s
+}
+
+// packetAddrs returns the source and destination address of an IP packet, nil if it is
+// none
+func packetAddrs(p []byte) (src, dst net.IP) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	switch p[0] >> 4 {
+	case 4:
+		if len(p) >= 20 {
+			return net.IP(p[12:16]), net.IP(p[16:20])
+		}
+	case 6:
+		if len(p) >= 40 {
+			return net.IP(p[8:24]), net.IP(p[24:40])
+		}
+	}
+	return nil, nil
+}
+
+// loop writes the packets read from the device on the streams, a stream failing a
+// write is closed, for its client to open another one
+func (s *tunSwitch) loop() {
+	buf := make([]byte, generic.MaxDatagramSize)
+	for {
+		n, err := s.dev.Read(buf)
+		if err != nil {
+			log.Println("tun:", err)
+			return
+		}
+		_, dst := packetAddrs(buf[:n])
+		if dst == nil {
+			continue
+		}
+		s.mu.Lock()
+		stream := s.routes[string(dst)]
+		s.mu.Unlock()
+		if stream != nil {
+			if err := generic.WriteDatagram(stream, buf[:n]); err != nil {
+				stream.Close()
+			}
+		}
+	}
+}
+
+// serve writes the packets of a client read from p1 to the device, learning their
+// source addresses as routes to p1
+func (s *tunSwitch) serve(p1 generic.Stream, quiet bool) {
+	if !quiet {
+		generic.LogEvent("tun stream opened", "in", p1.RemoteAddr(), "stream", p1.ID())
+		defer generic.LogEvent("tun stream closed", "in", p1.RemoteAddr(), "stream", p1.ID())
+	}
+	var learned []string
+	defer func() {
+		p1.Close()
+		s.mu.Lock()
+		for _, ip := range learned {
+			if s.routes[ip] == p1 {
+				delete(s.routes, ip)
+			}
+		}
+		s.mu.Unlock()
+	}()
+
+	buf := make([]byte, generic.MaxDatagramSize)
+	for {
+		n, err := generic.ReadDatagram(p1, buf)
+		if err != nil {
+			return
+		}
+		src, _ := packetAddrs(buf[:n])
+		if src == nil {
+			continue
+		}
+		s.mu.Lock()
+		if s.routes[string(src)] != p1 {
+			if !quiet {
+				log.Println("tun:", src, "via", p1.RemoteAddr(), "stream", p1.ID())
+			}
+			s.routes[string(src)] = p1
+			learned = append(learned, string(src))
+		}
+		s.mu.Unlock()
+		if _, err := s.dev.Write(buf[:n]); err != nil {
+			log.Println("tun:", err)
+		}
+	}
+}
+
+// handleTUN serves a client with -tun on p1, which fails without a device
+func handleTUN(p1 generic.Stream, config *Config) {
+	status := generic.StatusOK
+	if tunDevice == nil {
+		status = generic.StatusFailed
+	}
+	if _, err := p1.Write([]byte{status}); err != nil || status != generic.StatusOK {
+		p1.Close()
+		return
+	}
+	tunDevice.serve(p1, config.Quiet)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"sync"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// tuner tracks the accepted kcp sessions and applies runtime parameter changes to them
+type tuner struct {
+	mu       sync.Mutex
+	config   *Config
+	certs    *tls.Config // authenticates each session with cert, nil for none
+	sessions map[*generic.Session]struct{}
+}
+
+func newTuner(config *Config) *tuner {
+	t := new(tuner)
+	t.config = config
+	t.sessions = make(map[*generic.Session]struct{})
+	return t
+}
+
+// addConn starts tracking an accepted session and brings it up to date, it fails if
+// maxsessions are tracked already
+func (t *tuner) addConn(s *generic.Session) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.config.MaxSessions > 0 && len(t.sessions) >= t.config.MaxSessions {
+		return false
+	}
+	t.sessions[s] = struct{}{}
+	p := t.params()
+	p.ApplyTo(s.KCP)
+	return true
+}
+
+func (t *tuner) removeConn(s *generic.Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, s)
+}
+
+// snapshot returns a copy of the current config for new sessions
+func (t *tuner) snapshot() Config {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return *t.config
+}
+
+// Params returns the effective runtime parameters
+func (t *tuner) Params() generic.Params {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.params()
+}
+
+func (t *tuner) params() generic.Params {
+	return paramsOf(t.config)
+}
+
+// paramsOf extracts the runtime parameters from a config
+func paramsOf(config *Config) generic.Params {
+	return generic.Params{
+		Mode:         config.Mode,
+		NoDelay:      config.NoDelay,
+		Interval:     config.Interval,
+		Resend:       config.Resend,
+		NoCongestion: config.NoCongestion,
+		SndWnd:       config.SndWnd,
+		RcvWnd:       config.RcvWnd,
+		DataShard:    config.DataShard,
+		ParityShard:  config.ParityShard,
+		MTU:          config.MTU,
+	}
+}
+
+// Apply changes the parameters of all live sessions and the ones accepted later
+func (t *tuner) Apply(p generic.Params) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.config.Mode = p.Mode
+	t.config.NoDelay, t.config.Interval, t.config.Resend, t.config.NoCongestion = p.NoDelay, p.Interval, p.Resend, p.NoCongestion
+	t.config.SndWnd, t.config.RcvWnd = p.SndWnd, p.RcvWnd
+	t.config.DataShard, t.config.ParityShard = p.DataShard, p.ParityShard
+	t.config.MTU = p.MTU
+	for s := range t.sessions {
+		p.ApplyTo(s.KCP)
+	}
+	return nil
+}
+
+// Sessions returns the accepted sessions
+func (t *tuner) Sessions() []*generic.Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sessions := make([]*generic.Session, 0, len(t.sessions))
+	for s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// kcp-go prepends a 16 bytes nonce and a 4 bytes crc32 to encrypted packets
+	cryptHeaderSize = 20
+	// packets queued for a user's listener before dropping
+	userBacklog = 1024
+	// peers remembered before the cache is reset
+	maxPeers = 65536
+)
+
+// User is a named pre-shared key of a multi-user server
+type User struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// loadUsers reads the user table, a json array of {"name", "key"} objects or csv lines of name,key
+func loadUsers(path string) ([]User, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var users []User
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &users); err != nil {
+			return nil, errors.Wrap(err, path)
+		}
+	} else {
+		r := csv.NewReader(bytes.NewReader(data))
+		r.FieldsPerRecord = 2
+		r.Comment = '#'
+		r.TrimLeadingSpace = true
+		records, err := r.ReadAll()
+		if err != nil {
+			return nil, errors.Wrap(err, path)
+		}
+		for _, rec := range records {
+			users = append(users, User{Name: strings.TrimSpace(rec[0]), Key: strings.TrimSpace(rec[1])})
+		}
+	}
+
+	if len(users) == 0 {
+		return nil, errors.Errorf("no users in %v", path)
+	}
+	names := make(map[string]bool)
+	for _, u := range users {
+		if u.Name == "" || u.Key == "" {
+			return nil, errors.Errorf("user without name or key in %v", path)
+		}
+		if names[u.Name] {
+			return nil, errors.Errorf("duplicated user %v in %v", u.Name, path)
+		}
+		names[u.Name] = true
+	}
+	return users, nil
+}
+
+type userPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// userConn is the view of the shared packet conn for the kcp listener of one user
+type userConn struct {
+	net.PacketConn
+	name  string
+	block kcp.BlockCrypt
+	ch    chan userPacket
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func (c *userConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.ch:
+		return copy(b, pkt.data), pkt.addr, nil
+	case <-c.die:
+		return 0, nil, errors.New("use of closed user connection")
+	}
+}
+
+// Close only detaches the user, the shared conn is closed by its owner
+func (c *userConn) Close() error {
+	c.dieOnce.Do(func() { close(c.die) })
+	return nil
+}
+
+func (c *userConn) SetDeadline(t time.Time) error     { return nil }
+func (c *userConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (c *userConn) SetReadBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errors.New("SetReadBuffer: not supported")
+}
+
+func (c *userConn) SetWriteBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errors.New("SetWriteBuffer: not supported")
+}
+
+func (c *userConn) SetDSCP(dscp int) error {
+	if nc, ok := c.PacketConn.(interface{ SetDSCP(int) error }); ok {
+		return nc.SetDSCP(dscp)
+	}
+	if nc, ok := c.PacketConn.(net.Conn); ok {
+		err4 := ipv4.NewConn(nc).SetTOS(dscp << 2)
+		err6 := ipv6.NewConn(nc).SetTrafficClass(dscp)
+		if err4 == nil || err6 == nil {
+			return nil
+		}
+	}
+	return errors.New("SetDSCP: not supported")
+}
+
+// opens reports whether the packet decrypts to a valid checksum with the user's key
+func (c *userConn) opens(data, scratch []byte) bool {
+	if len(data) < cryptHeaderSize {
+		return false
+	}
+	scratch = scratch[:len(data)]
+	c.block.Decrypt(scratch, data)
+	return crc32.ChecksumIEEE(scratch[cryptHeaderSize:]) == binary.LittleEndian.Uint32(scratch[cryptHeaderSize-4:])
+}
+
+// demuxUsers reads the shared packet conn and hands each packet to the listener of the
+// user whose key opens it, the user of a peer address is remembered and tried first.
+func demuxUsers(conn net.PacketConn, users []*userConn) {
+	peers := make(map[string]*userConn)
+	buf := make([]byte, 1500)
+	scratch := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Println("users:", err)
+			for _, u := range users {
+				u.Close()
+			}
+			return
+		}
+		data := buf[:n]
+
+		key := addr.String()
+		u := peers[key]
+		if u == nil || !u.opens(data, scratch) {
+			u = nil
+			for _, candidate := range users {
+				if candidate.opens(data, scratch) {
+					u = candidate
+					break
+				}
+			}
+			if u == nil {
+				continue
+			}
+			if len(peers) >= maxPeers {
+				peers = make(map[string]*userConn)
+			}
+			peers[key] = u
+		}
+
+		select {
+		case u.ch <- userPacket{append([]byte(nil), data...), addr}:
+		default:
+		}
+	}
+}
+
+// newUserConns creates the views of conn for users, blocks are the ciphers of their keys
+func newUserConns(conn net.PacketConn, users []User, blocks []kcp.BlockCrypt) []*userConn {
+	conns := make([]*userConn, len(users))
+	for i, u := range users {
+		conns[i] = &userConn{
+			PacketConn: conn,
+			name:       u.Name,
+			block:      blocks[i],
+			ch:         make(chan userPacket, userBacklog),
+			die:        make(chan struct{}),
+		}
+	}
+	return conns
+}